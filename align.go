@@ -0,0 +1,297 @@
+package mf
+
+// Encodings of a run of + - > < chosen by emitAligned.
+const (
+	runPlain      = iota // plain nibbles
+	runCompressed        // special codes
+	runHead              // a nibble, then special codes
+	runTail              // special codes, then a nibble
+	runEncodings
+)
+
+// alignToken is a plain nibble or a special code written by emitAligned.
+type alignToken struct {
+	special bool
+	nibble  byte
+	in      Instruction // of a special code
+}
+
+// emitAligned emits ins like emit, but so that the fewest nibbles are
+// written. A special code written at a byte boundary needs a no-op
+// nibble to align its operand, which a nibble of a run written apart,
+// or a run written plain, can take instead. The encodings of all runs
+// are chosen together, then addat codes are moved across the commands
+// around them, which the no-ops depend on as well.
+func (r *FromBF) emitAligned(ins []Instruction) {
+	width := r.finalWidth()
+	// special returns the nibbles of k special codes,
+	// the first written with half a byte written if half is 1.
+	special := func(k uint64, half int) int {
+		return int(k)*(2+2*width) - half
+	}
+	specials := func(n uint64) uint64 {
+		return (n-1)/r.maxOperand() + 1
+	}
+	// cost returns the nibbles of writing in with the encoding enc,
+	// and the half bytes written after, or false if enc does not apply.
+	cost := func(in Instruction, enc, half int) (int, int, bool) {
+		switch in.Op {
+		case OpAdd, OpSub, OpRight, OpLeft:
+		case OpOut, OpIn:
+			if enc != runPlain {
+				return 0, 0, false
+			}
+			if !r.CompressIO || in.Arg <= 9 {
+				return int(in.Arg), (half + int(in.Arg&1)) & 1, true
+			}
+			return special((in.Arg-1)/0xffffff+1, half), 0, true
+		case OpNop:
+			return 0, half, enc == runPlain
+		default:
+			return special(1, half), 0, enc == runPlain
+		}
+		n := in.Arg
+		switch enc {
+		case runPlain:
+			// longer runs are always shorter compressed
+			if n > uint64(4+4*width) {
+				return 0, 0, false
+			}
+			return int(n), (half + int(n&1)) & 1, true
+		case runCompressed:
+			return special(specials(n), half), 0, true
+		case runHead:
+			if n < 2 {
+				return 0, 0, false
+			}
+			return 1 + special(specials(n-1), 1-half), 0, true
+		default:
+			if n < 2 {
+				return 0, 0, false
+			}
+			return special(specials(n-1), half) + 1, 1, true
+		}
+	}
+
+	// best[i][h] is the fewest nibbles writing ins[i:] and the final
+	// alignment no-op, with h half bytes written before
+	best := make([][2]int, len(ins)+1)
+	choice := make([][2]int, len(ins))
+	best[len(ins)] = [2]int{0, 1}
+	for i := len(ins) - 1; i >= 0; i-- {
+		for h := 0; h < 2; h++ {
+			best[i][h] = -1
+			for enc := 0; enc < runEncodings; enc++ {
+				c, next, ok := cost(ins[i], enc, h)
+				if !ok {
+					continue
+				}
+				if c += best[i+1][next]; best[i][h] < 0 || c < best[i][h] {
+					best[i][h], choice[i][h] = c, enc
+				}
+			}
+		}
+	}
+
+	var toks []alignToken
+	h := 0
+	if r.half {
+		h = 1
+	}
+	plain := func(op Op, n uint64) {
+		for j := uint64(0); j < n; j++ {
+			toks = append(toks, alignToken{nibble: byte(op)})
+		}
+		h = (h + int(n&1)) & 1
+	}
+	compressed := func(in Instruction) {
+		toks = append(toks, alignToken{special: true, in: in})
+		h = 0
+	}
+	for i, in := range ins {
+		switch op := in.Op; {
+		case op == OpNop:
+		case op >= OpAdd && op <= OpLeft:
+			switch choice[i][h] {
+			case runPlain:
+				plain(op, in.Arg)
+			case runCompressed:
+				compressed(in)
+			case runHead:
+				plain(op, 1)
+				compressed(Instruction{Op: op, Arg: in.Arg - 1})
+			case runTail:
+				compressed(Instruction{Op: op, Arg: in.Arg - 1})
+				plain(op, 1)
+			}
+		case (op == OpOut || op == OpIn) && (!r.CompressIO || in.Arg <= 9):
+			plain(op, in.Arg)
+		default:
+			compressed(in)
+		}
+	}
+
+	toks = alignAddAt(toks, r.half)
+	for _, t := range toks {
+		switch {
+		case !t.special:
+			r.writeNibble(t.nibble)
+		case t.in.Op >= OpAdd && t.in.Op <= OpLeft:
+			r.emitRun(t.in.Op, t.in.Arg)
+		default:
+			r.emit(t.in)
+		}
+	}
+}
+
+// maxAddAtShift is the most commands alignAddAt moves an addat code
+// across.
+const maxAddAtShift = 4
+
+// alignAddAt moves the addat codes in toks across the plain nibbles
+// around them where that saves no-ops, and returns toks. A no-op is
+// needed before a special code after an even number of plain nibbles,
+// and at the end after an odd number. half tells if the first token
+// follows half a byte.
+func alignAddAt(toks []alignToken, half bool) []alignToken {
+	h := 0
+	if half {
+		h = 1
+	}
+	for start := 0; start < len(toks); {
+		// the segment up to the next special code other than addat
+		end := start
+		var nibbles []alignToken
+		var adds []Instruction
+		var pos []int // plain nibbles before each addat code
+		for ; end < len(toks); end++ {
+			t := toks[end]
+			if !t.special {
+				nibbles = append(nibbles, t)
+			} else if t.in.Op == OpAddAt {
+				adds, pos = append(adds, t.in), append(pos, len(nibbles))
+			} else {
+				break
+			}
+		}
+		atEnd := end == len(toks)
+		if len(adds) > 0 {
+			// cross returns in moved from position p to q, or false
+			cross := func(in Instruction, p, q int) (Instruction, bool) {
+				for ; p > q; p-- {
+					if !crossAddAt(&in, nibbles[p-1].nibble, true) {
+						return in, false
+					}
+				}
+				for ; p < q; p++ {
+					if !crossAddAt(&in, nibbles[p].nibble, false) {
+						return in, false
+					}
+				}
+				return in, true
+			}
+			lo, hi := make([]int, len(adds)), make([]int, len(adds))
+			for j, in := range adds {
+				lo[j], hi[j] = pos[j], pos[j]
+				for lo[j] > max(pos[j]-maxAddAtShift, 0) {
+					if _, ok := cross(in, pos[j], lo[j]-1); !ok {
+						break
+					}
+					lo[j]--
+				}
+				for hi[j] < min(pos[j]+maxAddAtShift, len(nibbles)) {
+					if _, ok := cross(in, pos[j], hi[j]+1); !ok {
+						break
+					}
+					hi[j]++
+				}
+			}
+			// waste[j][p-lo[j]] is the fewest no-ops up to addat code j
+			// at position p, from[j][p-lo[j]] the position of code j-1
+			waste := make([][]int, len(adds))
+			from := make([][]int, len(adds))
+			for j := range adds {
+				waste[j] = make([]int, hi[j]-lo[j]+1)
+				from[j] = make([]int, hi[j]-lo[j]+1)
+				for p := lo[j]; p <= hi[j]; p++ {
+					best, prev := -1, -1
+					if j == 0 {
+						best = (p + h + 1) & 1
+					}
+					for q := lo[max(j-1, 0)]; j > 0 && q <= min(hi[j-1], p); q++ {
+						if w := waste[j-1][q-lo[j-1]] + (p-q+1)&1; best < 0 || w < best {
+							best, prev = w, q
+						}
+					}
+					if best < 0 {
+						best = len(adds) + 2 // more than any placement
+					}
+					waste[j][p-lo[j]], from[j][p-lo[j]] = best, prev
+				}
+			}
+			last := len(adds) - 1
+			best, p := -1, 0
+			for q := lo[last]; q <= hi[last]; q++ {
+				w := waste[last][q-lo[last]] + (len(nibbles)-q+1)&1
+				if atEnd {
+					w = waste[last][q-lo[last]] + (len(nibbles)-q)&1
+				}
+				if best < 0 || w < best {
+					best, p = w, q
+				}
+			}
+			for j := last; j >= 0; j-- {
+				adds[j], _ = cross(adds[j], pos[j], p)
+				pos[j], p = p, from[j][p-lo[j]]
+			}
+			// write the segment back
+			i, j := start, 0
+			for n := 0; n <= len(nibbles); n++ {
+				for ; j < len(adds) && pos[j] == n; j++ {
+					toks[i] = alignToken{special: true, in: adds[j]}
+					i++
+				}
+				if n < len(nibbles) {
+					toks[i] = nibbles[n]
+					i++
+				}
+			}
+		}
+		start, h = end+1, 0
+	}
+	return toks
+}
+
+// crossAddAt moves the command op across the addat instruction in, from
+// before it to after it if before is set, and the other way otherwise,
+// adjusting the offset of in for pointer moves. It reports false if the
+// two do not commute.
+func crossAddAt(in *Instruction, op byte, before bool) bool {
+	off, n := in.AddAt()
+	d := 0
+	switch Op(op) {
+	case OpRight:
+		d = 1
+	case OpLeft:
+		d = -1
+	default:
+		return off != 0 // + - . , use the cell under the pointer
+	}
+	if !before {
+		d = -d
+	}
+	if off+d < -1<<15 || off+d >= 1<<15 {
+		return false
+	}
+	in.Arg = AddAtArg(int16(off+d), n)
+	return true
+}
+
+// emitRun writes a run of n commands op as special codes.
+func (r *FromBF) emitRun(op Op, n uint64) {
+	for n > 0 {
+		k := min(n, r.maxOperand())
+		r.writeSpecial(byte(op), k)
+		n -= k
+	}
+}
@@ -0,0 +1,105 @@
+package mf
+
+import (
+	"fmt"
+	"math"
+)
+
+// PointerRange is the range of cells a BF program may visit,
+// relative to the starting cell.
+//
+// Min is math.MinInt and Max is math.MaxInt if the pointer movement
+// is unbounded in that direction, e.g. because of a [>] loop.
+type PointerRange struct {
+	Min, Max int
+
+	// Exact is true if no loop moves the pointer,
+	// so every cell in the range is actually visited.
+	Exact bool
+}
+
+// AnalyzePointerRange computes conservative bounds on pointer movement
+// of BF code. Loops with zero net pointer movement are bounded by their
+// body, and other loops make the range unbounded in their direction.
+func AnalyzePointerRange(p []byte) (PointerRange, error) {
+	if err := ValidateBF(p); err != nil {
+		return PointerRange{}, err
+	}
+	_, reach, exact := walkPointer(p, matchBrackets(p), 0, len(p))
+	return PointerRange{Min: reach.lo, Max: reach.hi, Exact: exact}, nil
+}
+
+// Check reports whether the range fits in a tape of memsize cells
+// with the pointer starting at cell 0.
+func (r PointerRange) Check(memsize uint64) error {
+	switch {
+	case r.Min == math.MinInt:
+		return fmt.Errorf("pointer may move left of cell 0 without bound")
+	case r.Min < 0:
+		return fmt.Errorf("pointer may move left of cell 0, to cell %d", r.Min)
+	case r.Max == math.MaxInt:
+		return fmt.Errorf("pointer may move right without bound, beyond memsize %d", memsize)
+	case uint64(r.Max) >= memsize:
+		return fmt.Errorf("pointer may reach cell %d, beyond memsize %d", r.Max, memsize)
+	}
+	return nil
+}
+
+type span struct {
+	lo, hi int
+}
+
+// walkPointer walks p[from:to] and returns the net pointer movement
+// and the range of visited cells relative to the position at from.
+func walkPointer(p []byte, match map[int]int, from, to int) (net, reach span, exact bool) {
+	exact = true
+	for i := from; i < to; i++ {
+		switch p[i] {
+		case '>':
+			net = span{addSat(net.lo, 1), addSat(net.hi, 1)}
+			reach.hi = max(reach.hi, net.hi)
+		case '<':
+			net = span{addSat(net.lo, -1), addSat(net.hi, -1)}
+			reach.lo = min(reach.lo, net.lo)
+		case '[':
+			end := match[i]
+			bnet, breach, _ := walkPointer(p, match, i+1, end)
+			if breach != (span{}) {
+				exact = false
+			}
+			reach.lo = min(reach.lo, addSat(net.lo, breach.lo))
+			reach.hi = max(reach.hi, addSat(net.hi, breach.hi))
+			if bnet.hi > 0 {
+				net.hi, reach.hi = math.MaxInt, math.MaxInt
+			}
+			if bnet.lo < 0 {
+				net.lo, reach.lo = math.MinInt, math.MinInt
+			}
+			i = end
+		}
+	}
+	return net, reach, exact
+}
+
+// addSat adds a and b, keeping math.MinInt and math.MaxInt as infinities.
+func addSat(a, b int) int {
+	switch {
+	case a == math.MinInt || b == math.MinInt:
+		return math.MinInt
+	case a == math.MaxInt || b == math.MaxInt:
+		return math.MaxInt
+	}
+	return a + b
+}
+
+// SuggestMemSize returns a memory size that BF code can never exceed,
+// and whether the size is exact, i.e. the last cell is actually visited.
+// It returns 0, false if the pointer movement is not bounded
+// or may move left of the starting cell.
+func SuggestMemSize(bf []byte) (uint32, bool) {
+	r, err := AnalyzePointerRange(bf)
+	if err != nil || r.Min < 0 || r.Max == math.MaxInt || uint64(r.Max) >= math.MaxUint32 {
+		return 0, false
+	}
+	return uint32(r.Max) + 1, r.Exact
+}
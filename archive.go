@@ -0,0 +1,123 @@
+package mf
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+// ArchiveMagic is a magic bytes for MF archive file (.mfa).
+//
+// An archive has ArchiveMagic, a 32-bit big-endian manifest size,
+// the manifest in JSON, and the programs it lists one after another.
+const ArchiveMagic = "\xff\x6d\x61\xfd"
+
+// ArchiveEntry is a named MF binary of an archive.
+type ArchiveEntry struct {
+	Name string
+	Prog []byte
+}
+
+// archiveManifest lists the programs of an archive.
+type archiveManifest struct {
+	Programs []archiveProgram `json:"programs"`
+}
+
+type archiveProgram struct {
+	Name   string `json:"name"`
+	Size   int    `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// checkArchiveName reports whether name can name an archived program,
+// which is extracted to a file of that name.
+func checkArchiveName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\\x00") {
+		return fmt.Errorf("invalid program name %q", name)
+	}
+	return nil
+}
+
+// WriteArchive writes an archive of the MF binaries of entries to w.
+// Names must be unique file names without directories.
+func WriteArchive(w io.Writer, entries []ArchiveEntry) error {
+	var m archiveManifest
+	names := make(map[string]bool)
+	for _, e := range entries {
+		if err := checkArchiveName(e.Name); err != nil {
+			return err
+		}
+		if names[e.Name] {
+			return fmt.Errorf("duplicate program name %q", e.Name)
+		}
+		names[e.Name] = true
+		if _, err := parseLayout(e.Prog); err != nil {
+			return fmt.Errorf("%s: %v", e.Name, err)
+		}
+		sum := sha256.Sum256(e.Prog)
+		m.Programs = append(m.Programs, archiveProgram{e.Name, len(e.Prog), hex.EncodeToString(sum[:])})
+	}
+	manifest, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if len(manifest) > math.MaxUint32 {
+		return fmt.Errorf("manifest of %d bytes too large", len(manifest))
+	}
+	buf := append([]byte(ArchiveMagic), uint32bytes(uint32(len(manifest)))...)
+	if _, err := w.Write(append(buf, manifest...)); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if _, err := w.Write(e.Prog); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadArchive reads an archive written by WriteArchive, checking the
+// sizes and hashes of its programs.
+func ReadArchive(r io.Reader) ([]ArchiveEntry, error) {
+	var head [8]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, fmt.Errorf("invalid MF archive: %v", err)
+	}
+	if string(head[:4]) != ArchiveMagic {
+		return nil, fmt.Errorf("invalid MF archive: magic mismatch 0x%x", head[:4])
+	}
+	// read in steps, so that a bad size does not allocate at once
+	var manifest bytes.Buffer
+	if _, err := io.CopyN(&manifest, r, int64(bytesUint32(head[4:]))); err != nil {
+		return nil, fmt.Errorf("invalid MF archive: manifest: %v", err)
+	}
+	var m archiveManifest
+	if err := json.Unmarshal(manifest.Bytes(), &m); err != nil {
+		return nil, fmt.Errorf("invalid MF archive: manifest: %v", err)
+	}
+	var entries []ArchiveEntry
+	names := make(map[string]bool)
+	for _, p := range m.Programs {
+		if err := checkArchiveName(p.Name); err != nil || names[p.Name] || p.Size < 0 {
+			return nil, fmt.Errorf("invalid MF archive: bad manifest entry %q", p.Name)
+		}
+		names[p.Name] = true
+		var prog bytes.Buffer
+		if n, err := io.CopyN(&prog, r, int64(p.Size)); err != nil {
+			return nil, fmt.Errorf("invalid MF archive: %s: %d of %d bytes: %v", p.Name, n, p.Size, err)
+		}
+		if sum := sha256.Sum256(prog.Bytes()); hex.EncodeToString(sum[:]) != p.SHA256 {
+			return nil, fmt.Errorf("invalid MF archive: %s: SHA-256 mismatch", p.Name)
+		}
+		entries = append(entries, ArchiveEntry{p.Name, prog.Bytes()})
+	}
+	if n, _ := io.Copy(io.Discard, r); n > 0 {
+		return nil, fmt.Errorf("invalid MF archive: %d bytes after the last program", n)
+	}
+	return entries, nil
+}
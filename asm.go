@@ -0,0 +1,396 @@
+package mf
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MF assembly is a text form of MF binaries, one instruction per line:
+//
+//	; comments start with a semicolon
+//	.memsize 30000      ; memory size, 4096 if omitted
+//	        + 10
+//	loop:   [ end       ; jump to the label end if the cell is zero
+//	        > 2
+//	        ]           ; without a label, brackets jump past their match
+//	end:    . 3
+//
+// The instructions are the ones printed by Instruction.String: + - > < . ,
+// with an optional repeat count, [ and ] with an optional label or offset,
+// set, clear, move, scan, shift, tape, syscall, dict, macro, ext with their
+// argument, addat with an offset and a value, call with a label or
+// offset, dbg with the cells to show on each side of the pointer, 4 if
+// omitted, assert with the value the current cell must have, nop and ret. A call runs the code
+// at its label until a ret returns after the call.
+// Brackets must be balanced even if they jump to labels. Labels are at byte
+// boundaries, and the code is assembled as a version 1 BF-converted binary.
+
+// AsmError is an error at a position of MF assembly.
+// Lines and columns start at 1; columns count bytes.
+type AsmError struct {
+	Line     int
+	Col, End int // columns of the erroneous text
+	Msg      string
+}
+
+func (e *AsmError) Error() string {
+	return fmt.Sprintf("%d:%d: %s", e.Line, e.Col, e.Msg)
+}
+
+// AsmLabel is a label definition of MF assembly.
+type AsmLabel struct {
+	Name     string
+	Line     int
+	Col, End int
+	Offset   int // byte offset of the label in the binary
+}
+
+// AsmStmt is an instruction of MF assembly.
+type AsmStmt struct {
+	In       Instruction // Offset is the byte offset of the code
+	Low      bool        // whether the code is in the low nibble
+	Line     int
+	Col, End int    // columns of the instruction
+	Target   string // label operand of [, ] or call
+	TargetAt int    // column of Target
+	Bytes    []byte // the encoded code byte and operand
+}
+
+// AsmFile is parsed and assembled MF assembly. If Errors is not empty,
+// Code may be incomplete.
+type AsmFile struct {
+	Stmts   []AsmStmt
+	Labels  map[string]*AsmLabel
+	Errors  []*AsmError
+	Memsize uint32
+	Code    []byte
+}
+
+// Assemble assembles MF assembly into an MF binary.
+func Assemble(src []byte) ([]byte, error) {
+	f := ParseAsm(src)
+	if len(f.Errors) > 0 {
+		errs := make([]error, len(f.Errors))
+		for i, e := range f.Errors {
+			errs[i] = e
+		}
+		return nil, errors.Join(errs...)
+	}
+	return f.Code, nil
+}
+
+// ParseAsm parses and assembles MF assembly, collecting every error.
+func ParseAsm(src []byte) *AsmFile {
+	f := &AsmFile{Labels: make(map[string]*AsmLabel), Memsize: 4096}
+	var labels []*AsmLabel // in order, for their offsets
+	var at []int           // statement index following each label
+	for i, line := range strings.Split(string(src), "\n") {
+		if c := strings.IndexByte(line, ';'); c >= 0 {
+			line = line[:c]
+		}
+		toks := asmFields(strings.TrimRight(line, "\r"))
+		errAt := func(t asmToken, format string, args ...any) {
+			f.Errors = append(f.Errors, &AsmError{i + 1, t.col, t.col + len(t.s), fmt.Sprintf(format, args...)})
+		}
+		if len(toks) > 0 && strings.HasSuffix(toks[0].s, ":") {
+			t := toks[0]
+			name := strings.TrimSuffix(t.s, ":")
+			switch {
+			case !asmIdent(name):
+				errAt(t, "invalid label name %q", name)
+			case f.Labels[name] != nil:
+				errAt(t, "label %s already defined at line %d", name, f.Labels[name].Line)
+			default:
+				l := &AsmLabel{Name: name, Line: i + 1, Col: t.col, End: t.col + len(name)}
+				f.Labels[name] = l
+				labels = append(labels, l)
+				at = append(at, len(f.Stmts))
+			}
+			toks = toks[1:]
+		}
+		if len(toks) == 0 {
+			continue
+		}
+		op, args := toks[0], toks[1:]
+		if op.s == ".memsize" {
+			if len(args) != 1 {
+				errAt(op, ".memsize needs 1 argument")
+				continue
+			}
+			n, err := strconv.ParseUint(args[0].s, 0, 32)
+			if err != nil || n == 0 {
+				errAt(args[0], "invalid memory size %q", args[0].s)
+				continue
+			}
+			f.Memsize = uint32(n)
+			continue
+		}
+		st := AsmStmt{Line: i + 1, Col: op.col, End: op.col + len(op.s)}
+		if len(args) > 0 {
+			st.End = args[len(args)-1].col + len(args[len(args)-1].s)
+		}
+		maxArgs := 1
+		if op.s == "addat" {
+			maxArgs = 2
+		}
+		if len(args) > maxArgs {
+			errAt(args[maxArgs], "unexpected %q", args[maxArgs].s)
+			continue
+		}
+		var arg *asmToken
+		if len(args) == 1 {
+			arg = &args[0]
+		}
+		// num parses the argument in [lo, hi], or def if there is none.
+		num := func(lo, hi int64, def *int64) (int64, bool) {
+			if arg == nil {
+				if def == nil {
+					errAt(op, "%s needs an argument", op.s)
+					return 0, false
+				}
+				return *def, true
+			}
+			n, err := strconv.ParseInt(arg.s, 0, 64)
+			if err != nil || n < lo || n > hi {
+				errAt(*arg, "invalid argument %q, must be in %d..%d", arg.s, lo, hi)
+				return 0, false
+			}
+			return n, true
+		}
+		one := int64(1)
+		var n int64
+		ok := true
+		switch op.s {
+		case "+", "-", ">", "<":
+			st.In.Op = Op(strings.Index(bf, op.s))
+			n, ok = num(1, math.MaxUint32, &one)
+		case ".", ",":
+			st.In.Op = Op(strings.Index(bf, op.s))
+			n, ok = num(1, 1<<24-1, &one)
+		case "[", "]":
+			st.In.Op = Op(strings.Index(bf, op.s))
+			if arg != nil && asmIdent(arg.s) {
+				st.Target, st.TargetAt = arg.s, arg.col
+			} else if arg != nil {
+				n, ok = num(0, math.MaxUint32, nil)
+			}
+		case "set", "assert":
+			st.In.Op = map[string]Op{"set": OpSet, "assert": OpAssert}[op.s]
+			n, ok = num(0, 255, nil)
+		case "clear", "tape", "syscall", "dict", "macro":
+			st.In.Op = map[string]Op{"clear": OpClear, "tape": OpTape, "syscall": OpSyscall, "dict": OpDict, "macro": OpMacro}[op.s]
+			n, ok = num(0, 1<<24-1, nil)
+		case "move", "scan", "shift":
+			st.In.Op = map[string]Op{"move": OpMove, "scan": OpScan, "shift": OpShift}[op.s]
+			n, ok = num(-1<<23, 1<<23-1, nil)
+			n = int64(uint32(int32(n)))
+		case "call":
+			st.In.Op = OpCall
+			if arg != nil && asmIdent(arg.s) {
+				st.Target, st.TargetAt = arg.s, arg.col
+			} else {
+				n, ok = num(0, 1<<24-1, nil)
+			}
+		case "addat":
+			st.In.Op = OpAddAt
+			if len(args) < 2 {
+				errAt(op, "addat needs an offset and a value")
+				ok = false
+				break
+			}
+			var off int64
+			arg = &args[0]
+			if off, ok = num(-1<<15, 1<<15-1, nil); ok {
+				arg = &args[1]
+				n, ok = num(0, 255, nil)
+				n = int64(AddAtArg(int16(off), byte(n)))
+			}
+		case "dbg":
+			st.In.Op = OpDebug
+			four := int64(4)
+			n, ok = num(0, 1<<24-1, &four)
+		case "ext":
+			st.In.Op = OpExt
+			n, ok = num(0, math.MaxUint32, nil)
+		case "nop", "ret":
+			st.In.Op = map[string]Op{"nop": OpNop, "ret": OpRet}[op.s]
+			if arg != nil {
+				errAt(*arg, "%s takes no argument", op.s)
+				ok = false
+			}
+		default:
+			errAt(op, "unknown instruction %q", op.s)
+			ok = false
+		}
+		if ok {
+			st.In.Arg = uint64(n)
+			f.Stmts = append(f.Stmts, st)
+		}
+	}
+	f.assemble(labels, at)
+	sort.SliceStable(f.Errors, func(i, j int) bool { return f.Errors[i].Line < f.Errors[j].Line })
+	return f
+}
+
+// assemble encodes the statements into Code, and resolves the labels,
+// which come before the statements at their index in at.
+func (f *AsmFile) assemble(labels []*AsmLabel, at []int) {
+	l := v1Layout
+	l.memsize = uint64(f.Memsize)
+	buf := l.header(BFMagic)
+	low := false // whether the low nibble of the last byte is free
+	align := func() {
+		if low {
+			buf[len(buf)-1] |= 8 | 6
+			low = false
+		}
+	}
+	operands := make([]int, len(f.Stmts)) // offsets of the operands
+	var open []int
+	var pairs [][2]int // matching brackets
+	for i := range f.Stmts {
+		for len(at) > 0 && at[0] == i {
+			align()
+			labels[0].Offset = len(buf)
+			labels, at = labels[1:], at[1:]
+		}
+		st := &f.Stmts[i]
+		in := st.In
+		code := byte(8 | 7) // special code, or plain if it has no operand
+		switch {
+		case in.Op == OpNop:
+			code = 8 | 6
+		case in.Op <= OpLeft && in.Arg == 1, (in.Op == OpOut || in.Op == OpIn) && in.Arg == 1:
+			code = byte(in.Op)
+		case in.Op <= OpClose:
+			code = 8 | byte(in.Op)
+		}
+		st.Low = low
+		if low {
+			buf[len(buf)-1] |= code
+			st.In.Offset = len(buf) - 1
+		} else {
+			buf = append(buf, code<<4)
+			st.In.Offset = len(buf) - 1
+		}
+		low = !low
+		if code&8 == 0 || code == 8|6 {
+			continue
+		}
+		align()
+		operands[i] = len(buf)
+		operand := uint32(in.Arg)
+		if code == 8|7 {
+			operand = extOperand(in)
+		}
+		buf = append(buf, uint32bytes(operand)...)
+		switch in.Op {
+		case OpOpen:
+			open = append(open, i)
+		case OpClose:
+			if len(open) == 0 {
+				f.Errors = append(f.Errors, &AsmError{st.Line, st.Col, st.Col + 1, "unmatched ]"})
+				continue
+			}
+			pairs = append(pairs, [2]int{open[len(open)-1], i})
+			open = open[:len(open)-1]
+		}
+	}
+	align()
+	for _, label := range labels {
+		label.Offset = len(buf)
+	}
+	if len(buf) > math.MaxUint32 {
+		st := f.Stmts[len(f.Stmts)-1]
+		f.Errors = append(f.Errors, &AsmError{st.Line, st.Col, st.Col + 1, fmt.Sprintf("code of %d bytes exceeds 32-bit jump offsets", len(buf))})
+	}
+	for _, p := range pairs {
+		o, c := p[0], p[1]
+		f.jump(buf, o, operands[o], operands[c]+4)
+		f.jump(buf, c, operands[c], operands[o]+4)
+	}
+	for i := range f.Stmts {
+		st := &f.Stmts[i]
+		if st.In.Op != OpCall || st.Target == "" || f.Labels[st.Target] == nil {
+			continue
+		}
+		if off := f.Labels[st.Target].Offset; off >= 1<<24 {
+			f.Errors = append(f.Errors, &AsmError{st.Line, st.TargetAt, st.TargetAt + len(st.Target), fmt.Sprintf("label %s at offset %d is too far for call", st.Target, off)})
+			continue
+		}
+		st.In.Arg = uint64(f.Labels[st.Target].Offset)
+		copy(buf[operands[i]:], uint32bytes(extOperand(st.In)))
+	}
+	for _, st := range f.Stmts {
+		if st.Target != "" && f.Labels[st.Target] == nil {
+			f.Errors = append(f.Errors, &AsmError{st.Line, st.TargetAt, st.TargetAt + len(st.Target), fmt.Sprintf("undefined label %s", st.Target)})
+		}
+	}
+	for _, o := range open {
+		st := f.Stmts[o]
+		f.Errors = append(f.Errors, &AsmError{st.Line, st.Col, st.Col + 1, "unmatched ["})
+	}
+	f.Code = buf
+	for i := range f.Stmts {
+		st := &f.Stmts[i]
+		end := st.In.Offset + 1
+		if operands[i] > 0 {
+			end = operands[i] + 4
+		}
+		st.Bytes = buf[st.In.Offset:end]
+	}
+}
+
+// jump sets the operand at off of bracket statement i, to its label or
+// offset operand if it has one, or to match.
+func (f *AsmFile) jump(buf []byte, i, off, match int) {
+	st := &f.Stmts[i]
+	switch {
+	case st.Target != "":
+		l := f.Labels[st.Target]
+		if l == nil {
+			return // reported by assemble
+		}
+		match = l.Offset
+	case st.In.Arg != 0:
+		return
+	}
+	st.In.Arg = uint64(match)
+	copy(buf[off:], uint32bytes(uint32(match)))
+}
+
+// asmToken is a field of a line of assembly at column col.
+type asmToken struct {
+	s   string
+	col int
+}
+
+func asmFields(line string) []asmToken {
+	var toks []asmToken
+	for i := 0; i < len(line); {
+		if line[i] == ' ' || line[i] == '\t' {
+			i++
+			continue
+		}
+		j := i
+		for j < len(line) && line[j] != ' ' && line[j] != '\t' {
+			j++
+		}
+		toks = append(toks, asmToken{line[i:j], i + 1})
+		i = j
+	}
+	return toks
+}
+
+func asmIdent(s string) bool {
+	for i, c := range s {
+		if !(c == '_' || c == '.' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || i > 0 && '0' <= c && c <= '9') {
+			return false
+		}
+	}
+	return s != ""
+}
@@ -0,0 +1,186 @@
+package mf
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"runtime"
+	"time"
+)
+
+// Bench benchmarks MF programs in the VM.
+type Bench struct {
+	// Runs is the number of runs. If Duration is also set, it is the
+	// minimum. If neither is set, programs run 10 times.
+	Runs int
+	// Duration, if set, keeps running a program until it is reached.
+	Duration time.Duration
+	// Input is read by every run of the program. Output is discarded.
+	Input []byte
+	// Preallocate runs programs in VMs set up with VM.Preallocate.
+	Preallocate bool
+}
+
+// BenchResult is the result of benchmarking a program.
+type BenchResult struct {
+	Times     []time.Duration // wall time of every run
+	Steps     int64           // instructions executed by a run
+	PeakCell  int             // highest pointer reached on any tape
+	TapeBytes int             // bytes of all tapes allocated
+	Allocs    uint64          // heap allocations of the last run
+}
+
+// Run benchmarks the MF binary prog. Runs ending with a nonzero exit
+// status count as finished; faults fail the benchmark.
+func (b *Bench) Run(prog []byte) (*BenchResult, error) {
+	runs := b.Runs
+	if runs <= 0 && b.Duration <= 0 {
+		runs = 10
+	}
+	res := new(BenchResult)
+	start := time.Now()
+	for i := 0; i < runs || time.Since(start) < b.Duration; i++ {
+		v, err := NewVM(prog)
+		if err != nil {
+			return nil, err
+		}
+		if err := v.RegisterStdSyscalls(); err != nil {
+			return nil, err
+		}
+		if b.Preallocate {
+			if err := v.Preallocate(); err != nil {
+				return nil, err
+			}
+		}
+		v.In, v.Out = bytes.NewReader(b.Input), io.Discard
+		var mem runtime.MemStats
+		runtime.ReadMemStats(&mem)
+		mallocs := mem.Mallocs
+		t := time.Now()
+		err = v.Run()
+		elapsed := time.Since(t)
+		runtime.ReadMemStats(&mem)
+		res.Allocs = mem.Mallocs - mallocs
+		var exit *ExitError
+		if err != nil && !errors.As(err, &exit) {
+			return nil, fmt.Errorf("run %d: %w", i+1, err)
+		}
+		res.Times = append(res.Times, elapsed)
+		res.Steps, res.PeakCell, res.TapeBytes = v.steps, v.peak, v.tapeBytes
+	}
+	return res, nil
+}
+
+// Mean returns the mean wall time of the runs.
+func (r *BenchResult) Mean() time.Duration {
+	m, _ := meanVar(r.Times)
+	return time.Duration(m)
+}
+
+// Stddev returns the sample standard deviation of the wall time.
+func (r *BenchResult) Stddev() time.Duration {
+	_, v := meanVar(r.Times)
+	return time.Duration(math.Sqrt(v))
+}
+
+// StepsPerSecond returns the instructions executed per second.
+func (r *BenchResult) StepsPerSecond() float64 {
+	return float64(r.Steps) / r.Mean().Seconds()
+}
+
+func (r *BenchResult) String() string {
+	return fmt.Sprintf("%d runs, %v ± %v, %d instructions, %.1fM instructions/s, peak cell %d, %d tape bytes, %d allocations",
+		len(r.Times), r.Mean(), r.Stddev(), r.Steps, r.StepsPerSecond()/1e6, r.PeakCell, r.TapeBytes, r.Allocs)
+}
+
+// CompareBench compares the wall times of two benchmarks with Welch's
+// t-test. It returns the relative change of the mean from a to b, and the
+// two-sided p-value of the difference, the probability of a difference
+// at least as large by chance. The p-value is 1 with less than two runs.
+func CompareBench(a, b *BenchResult) (change, p float64) {
+	ma, va := meanVar(a.Times)
+	mb, vb := meanVar(b.Times)
+	change = (mb - ma) / ma
+	na, nb := float64(len(a.Times)), float64(len(b.Times))
+	if na < 2 || nb < 2 {
+		return change, 1
+	}
+	se := va/na + vb/nb
+	if se == 0 {
+		if ma == mb {
+			return change, 1
+		}
+		return change, 0
+	}
+	t := (mb - ma) / math.Sqrt(se)
+	df := se * se / (va*va/(na*na*(na-1)) + vb*vb/(nb*nb*(nb-1)))
+	// P(|T| > |t|) for Student's t with df degrees of freedom
+	return change, incBeta(df/2, 0.5, df/(df+t*t))
+}
+
+// meanVar returns the mean and the sample variance of durations.
+func meanVar(ds []time.Duration) (mean, variance float64) {
+	if len(ds) == 0 {
+		return 0, 0
+	}
+	for _, d := range ds {
+		mean += float64(d)
+	}
+	mean /= float64(len(ds))
+	if len(ds) < 2 {
+		return mean, 0
+	}
+	for _, d := range ds {
+		variance += (float64(d) - mean) * (float64(d) - mean)
+	}
+	return mean, variance / float64(len(ds)-1)
+}
+
+// incBeta returns the regularized incomplete beta function I_x(a, b),
+// evaluated by its continued fraction as in Numerical Recipes.
+func incBeta(a, b, x float64) float64 {
+	if x <= 0 {
+		return 0
+	}
+	if x >= 1 {
+		return 1
+	}
+	if x > (a+1)/(a+b+2) {
+		return 1 - incBeta(b, a, 1-x)
+	}
+	la, _ := math.Lgamma(a)
+	lb, _ := math.Lgamma(b)
+	lab, _ := math.Lgamma(a + b)
+	front := math.Exp(lab - la - lb + a*math.Log(x) + b*math.Log(1-x))
+	const tiny = 1e-300
+	c, d := 1.0, 1-(a+b)*x/(a+1)
+	if math.Abs(d) < tiny {
+		d = tiny
+	}
+	d = 1 / d
+	f := d
+	for m := 1; m <= 200; m++ {
+		fm := float64(m)
+		for _, num := range []float64{
+			fm * (b - fm) * x / ((a + 2*fm - 1) * (a + 2*fm)),
+			-(a + fm) * (a + b + fm) * x / ((a + 2*fm) * (a + 2*fm + 1)),
+		} {
+			d = 1 + num*d
+			if math.Abs(d) < tiny {
+				d = tiny
+			}
+			c = 1 + num/c
+			if math.Abs(c) < tiny {
+				c = tiny
+			}
+			d = 1 / d
+			f *= c * d
+		}
+		if math.Abs(c*d-1) < 1e-12 {
+			break
+		}
+	}
+	return front * f / a
+}
@@ -0,0 +1,70 @@
+package mf
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// TestPreallocateNoAllocs checks that a VM set up with Preallocate runs
+// without allocating, once started.
+func TestPreallocateNoAllocs(t *testing.T) {
+	// loops forever moving and setting cells, switching tapes and writing
+	src := "+[>[-]+++[->+<]>[<+>-]<.<^1+^]"
+	var prog bytes.Buffer
+	r := NewBFReader(&prog, 16)
+	r.Optimize, r.MultiTape = true, true
+	r.Write([]byte(src))
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	v, err := NewVM(prog.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Preallocate(); err != nil {
+		t.Fatal(err)
+	}
+	v.Out = io.Discard
+	if err := v.run(DefaultQuantum); err != nil { // predecodes the code
+		t.Fatal(err)
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		if err := v.run(DefaultQuantum); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("%v allocations per %d instructions, want 0", allocs, DefaultQuantum)
+	}
+	if v.Done() || v.Tape(1) == nil {
+		t.Error("program did not run as expected")
+	}
+}
+
+func BenchmarkRunPreallocated(b *testing.B) {
+	var prog bytes.Buffer
+	r := NewBFReader(&prog, 16)
+	r.Write([]byte(benchSrc))
+	if err := r.Close(); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		v, err := NewVM(prog.Bytes())
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := v.Preallocate(); err != nil {
+			b.Fatal(err)
+		}
+		if err := v.predecode(); err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+		if err := v.Run(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package mf
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+)
+
+// CanonicalMF re-encodes the MF binary prog canonically, so that binaries
+// running the same instructions, once no-ops are dropped and runs of the
+// same command merged, get the same bytes, whatever options wrote them.
+// Their hashes can then be compared to verify builds. Adjacent + and -
+// are merged into their net change of the cell, and > < and shifts into
+// the net move of the pointer, so "+-" and "><" are dropped, even where
+// the pointer would move off the tape and back.
+//
+// Runs are compressed as NewBFReader does by default, jumps are resolved,
+// and the binary is version 1 unless its memsize or operands need version
+// 2. The magic and memsize of prog are kept. Calls are an error, since
+// their targets move.
+func CanonicalMF(prog []byte) ([]byte, error) {
+	prog, l, err := parseProg(prog)
+	if err != nil {
+		return nil, err
+	}
+	if l.memsize == 0 {
+		return nil, fmt.Errorf("MF binary has memsize 0")
+	}
+	decoded, err := DecodeMF(prog)
+	if err != nil {
+		return nil, err
+	}
+	var ins []Instruction
+	for _, in := range decoded {
+		switch in.Op {
+		case OpNop:
+			continue
+		case OpCall:
+			return nil, fmt.Errorf("MF binary at offset %d calls code, which moves when re-encoded", in.Offset)
+		}
+		ins = append(ins, in)
+	}
+
+	var buf bytes.Buffer
+	// Close narrows the binary to version 1 if it can
+	r := newBFReader(&buf, layout{version: Version2, code: 20, width: 8}, l.memsize)
+	for _, in := range foldNet(ins) {
+		r.emit(in)
+	}
+	if err := r.Close(); err != nil {
+		return nil, err
+	}
+	out := buf.Bytes()
+	copy(out, prog[:4]) // keep the magic
+	return out, nil
+}
+
+// foldNet is foldRuns, merging + and - into their net change of the
+// cell, as + up to 128 and - above it, and > < and shifts into the net
+// move of the pointer, as > or <. Those that change nothing are dropped,
+// so the instructions around them merge in turn.
+func foldNet(decoded []Instruction) []Instruction {
+	var ins []Instruction
+	for _, in := range decoded {
+		n := len(ins)
+		if d, ok := cellDelta(in); ok {
+			if p, ok := cellDelta(lastOf(ins)); ok {
+				d, ins = d+p, ins[:n-1]
+			}
+			switch d &= 0xff; {
+			case d > 128:
+				ins = append(ins, Instruction{Op: OpSub, Arg: 256 - d})
+			case d > 0:
+				ins = append(ins, Instruction{Op: OpAdd, Arg: d})
+			}
+			continue
+		}
+		if d, ok := moveDelta(in); ok {
+			if p, ok := moveDelta(lastOf(ins)); ok {
+				d, ins = d+p, ins[:n-1]
+			}
+			switch {
+			case d < 0:
+				ins = append(ins, Instruction{Op: OpLeft, Arg: uint64(-d)})
+			case d > 0:
+				ins = append(ins, Instruction{Op: OpRight, Arg: uint64(d)})
+			}
+			continue
+		}
+		switch {
+		case in.Op == OpOpen || in.Op == OpClose:
+			in.Arg = 0
+		case (in.Op == OpOut || in.Op == OpIn) && n > 0 && ins[n-1].Op == in.Op:
+			ins[n-1].Arg += in.Arg
+			continue
+		}
+		ins = append(ins, in)
+	}
+	return ins
+}
+
+// lastOf returns the last instruction of ins, a no-op if there is none.
+func lastOf(ins []Instruction) Instruction {
+	if len(ins) == 0 {
+		return Instruction{Op: OpNop}
+	}
+	return ins[len(ins)-1]
+}
+
+// cellDelta returns the change of the cell by a + or - run, modulo 2^64.
+func cellDelta(in Instruction) (uint64, bool) {
+	switch in.Op {
+	case OpAdd:
+		return in.Arg, true
+	case OpSub:
+		return -in.Arg, true
+	}
+	return 0, false
+}
+
+// moveDelta returns the move of the pointer by a > or < run of up to
+// math.MaxInt32 cells, or a shift.
+func moveDelta(in Instruction) (int64, bool) {
+	switch {
+	case in.Op == OpRight && in.Arg <= math.MaxInt32:
+		return int64(in.Arg), true
+	case in.Op == OpLeft && in.Arg <= math.MaxInt32:
+		return -int64(in.Arg), true
+	case in.Op == OpShift:
+		return int64(int32(in.Arg)), true
+	}
+	return 0, false
+}
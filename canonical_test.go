@@ -0,0 +1,54 @@
+package mf
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+)
+
+// TestCanonicalMF checks that BF code converted with any compression,
+// and with "+-" and "><" added, has the same canonical MF binary.
+func TestCanonicalMF(t *testing.T) {
+	type options struct {
+		compress  CompressStrategy
+		threshold int
+	}
+	opts := []options{
+		{CompressByLength, 0},
+		{CompressByLength, 1},
+		{CompressByLength, 3},
+		{CompressByLength, 40},
+		{CompressOptimal, 0},
+		{CompressAligned, 0},
+	}
+	for _, name := range []string{"hanoi", "long", "bench"} {
+		src, err := os.ReadFile("bf/" + name + ".bf")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want []byte
+		for _, prefix := range []string{"", "+-", "><", "-><+"} {
+			for _, o := range opts {
+				var prog bytes.Buffer
+				r := NewBFReader(&prog, 4096)
+				r.Compress, r.CompressThreshold = o.compress, o.threshold
+				r.Write([]byte(prefix))
+				r.Write(src)
+				if err := r.Close(); err != nil {
+					t.Fatal(err)
+				}
+				got, err := CanonicalMF(prog.Bytes())
+				if err != nil {
+					t.Fatal(err)
+				}
+				at := fmt.Sprintf("%s with %q, %+v", name, prefix, o)
+				if want == nil {
+					want = got
+				} else if !bytes.Equal(got, want) {
+					t.Errorf("%s: canonical MF differs", at)
+				}
+			}
+		}
+	}
+}
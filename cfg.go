@@ -0,0 +1,256 @@
+package mf
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// CFG is the control flow graph of a program, made of basic blocks.
+type CFG struct {
+	Ins    []Instruction
+	Blocks []*Block // in program order, Blocks[0] is the entry if any
+	Exit   *Block   // the empty block after the end of the program
+}
+
+// Block is a basic block, a run of instructions that is entered only at
+// the start and left only at the end.
+type Block struct {
+	Index int           // index in CFG.Blocks, len(CFG.Blocks) for the exit
+	Start int           // index of the first instruction in CFG.Ins
+	Ins   []Instruction // the instructions, ending with any bracket
+	Succs []Edge
+	Preds []*Block
+
+	// Idom is the immediate dominator, the closest block every path from
+	// the entry to this block goes through. It's nil for the entry and
+	// for unreachable blocks.
+	Idom *Block
+	rpo  int // reverse postorder number, -1 if unreachable
+}
+
+// EdgeKind is the condition under which control flows along an Edge.
+type EdgeKind int
+
+// Edge kinds.
+const (
+	EdgeFall    EdgeKind = iota // unconditional
+	EdgeZero                    // the current cell is zero
+	EdgeNonzero                 // the current cell is not zero
+)
+
+func (k EdgeKind) String() string {
+	switch k {
+	case EdgeFall:
+		return "fall"
+	case EdgeZero:
+		return "zero"
+	case EdgeNonzero:
+		return "nonzero"
+	}
+	return fmt.Sprintf("EdgeKind(%d)", int(k))
+}
+
+// Edge is a control flow edge.
+type Edge struct {
+	To   *Block
+	Kind EdgeKind
+	Loop bool // whether it is the back edge of a loop, from ] to its body
+}
+
+// NewCFG splits instructions into basic blocks, and computes their edges
+// and dominators. Jumps are resolved by matching brackets, so the jump
+// positions of the instructions may be unresolved.
+func NewCFG(ins []Instruction) (*CFG, error) {
+	match := make([]int, len(ins))
+	var open []int
+	leaders := map[int]bool{0: true}
+	for i, in := range ins {
+		switch in.Op {
+		case OpOpen:
+			open = append(open, i)
+		case OpClose:
+			if len(open) == 0 {
+				return nil, fmt.Errorf("unmatched ']' at offset %d", in.Offset)
+			}
+			o := open[len(open)-1]
+			open = open[:len(open)-1]
+			match[o], match[i] = i, o
+		default:
+			continue
+		}
+		leaders[i+1] = true
+	}
+	if len(open) > 0 {
+		return nil, fmt.Errorf("unmatched '[' at offset %d", ins[open[len(open)-1]].Offset)
+	}
+	starts := make([]int, 0, len(leaders))
+	for i := range leaders {
+		if i < len(ins) {
+			starts = append(starts, i)
+		}
+	}
+	sort.Ints(starts)
+
+	c := &CFG{Ins: ins, Blocks: make([]*Block, len(starts))}
+	c.Exit = &Block{Index: len(starts), Start: len(ins)}
+	at := map[int]*Block{len(ins): c.Exit} // blocks by start
+	for b, start := range starts {
+		end := len(ins)
+		if b+1 < len(starts) {
+			end = starts[b+1]
+		}
+		c.Blocks[b] = &Block{Index: b, Start: start, Ins: ins[start:end]}
+		at[start] = c.Blocks[b]
+	}
+	for _, b := range c.Blocks {
+		last := b.Start + len(b.Ins) - 1
+		switch ins[last].Op {
+		case OpOpen:
+			b.Succs = []Edge{{at[last+1], EdgeNonzero, false}, {at[match[last]+1], EdgeZero, false}}
+		case OpClose:
+			b.Succs = []Edge{{at[match[last]+1], EdgeNonzero, true}, {at[last+1], EdgeZero, false}}
+		default:
+			b.Succs = []Edge{{at[last+1], EdgeFall, false}}
+		}
+		for _, e := range b.Succs {
+			e.To.Preds = append(e.To.Preds, b)
+		}
+	}
+	c.dominators()
+	return c, nil
+}
+
+// entry returns the entry block, which is the exit for empty programs.
+func (c *CFG) entry() *Block {
+	if len(c.Blocks) == 0 {
+		return c.Exit
+	}
+	return c.Blocks[0]
+}
+
+// dominators computes the immediate dominators with the algorithm of
+// Cooper, Harvey and Kennedy, "A Simple, Fast Dominance Algorithm".
+func (c *CFG) dominators() {
+	var order []*Block // reverse postorder
+	seen := make(map[*Block]bool)
+	var visit func(b *Block)
+	visit = func(b *Block) {
+		seen[b] = true
+		for _, e := range b.Succs {
+			if !seen[e.To] {
+				visit(e.To)
+			}
+		}
+		order = append(order, b)
+	}
+	visit(c.entry())
+	for i, j := 0, len(order)-1; i < j; i, j = i+1, j-1 {
+		order[i], order[j] = order[j], order[i]
+	}
+	for _, b := range append(c.Blocks, c.Exit) {
+		b.rpo = -1
+	}
+	for i, b := range order {
+		b.rpo = i
+	}
+
+	entry := c.entry()
+	entry.Idom = entry // temporarily, to mark it processed
+	intersect := func(a, b *Block) *Block {
+		for a != b {
+			for a.rpo > b.rpo {
+				a = a.Idom
+			}
+			for b.rpo > a.rpo {
+				b = b.Idom
+			}
+		}
+		return a
+	}
+	for changed := true; changed; {
+		changed = false
+		for _, b := range order[1:] {
+			var idom *Block
+			for _, p := range b.Preds {
+				if p.Idom == nil {
+					continue
+				}
+				if idom == nil {
+					idom = p
+				} else {
+					idom = intersect(p, idom)
+				}
+			}
+			if b.Idom != idom {
+				b.Idom, changed = idom, true
+			}
+		}
+	}
+	entry.Idom = nil
+}
+
+// Dominates reports whether every path from the entry to b goes through a.
+// Every block dominates itself.
+func (a *Block) Dominates(b *Block) bool {
+	if a.rpo < 0 || b.rpo < 0 {
+		return false
+	}
+	for ; b != nil; b = b.Idom {
+		if b == a {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteCFG writes the control flow graph of an MF binary, or of BF code
+// if prog doesn't start with an MF magic, to w in Graphviz DOT format.
+// Nodes are basic blocks, and loop back edges are drawn bold.
+func WriteCFG(w io.Writer, prog []byte) error {
+	ins, err := decodeProgram(prog)
+	if err != nil {
+		return err
+	}
+	c, err := NewCFG(ins)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "digraph cfg {")
+	fmt.Fprintln(bw, "\tnode [shape=box fontname=monospace];")
+	fmt.Fprintln(bw, "\tstart [shape=oval];")
+	fmt.Fprintln(bw, "\tend [shape=oval];")
+	name := func(b *Block) string {
+		if b == c.Exit {
+			return "end"
+		}
+		return fmt.Sprintf("b%d", b.Index)
+	}
+	fmt.Fprintf(bw, "\tstart -> %s;\n", name(c.entry()))
+	for _, b := range c.Blocks {
+		var label strings.Builder
+		for _, in := range b.Ins {
+			fmt.Fprintf(&label, "%x: %v\\l", in.Offset, in)
+		}
+		fmt.Fprintf(bw, "\t%s [label=\"%s\"];\n", name(b), label.String())
+		for _, e := range b.Succs {
+			var attrs []string
+			if e.Kind != EdgeFall {
+				attrs = append(attrs, fmt.Sprintf("label=%q", e.Kind))
+			}
+			if e.Loop {
+				attrs = append(attrs, "style=bold", "color=blue")
+			}
+			fmt.Fprintf(bw, "\t%s -> %s", name(b), name(e.To))
+			if len(attrs) > 0 {
+				fmt.Fprintf(bw, " [%s]", strings.Join(attrs, " "))
+			}
+			fmt.Fprintln(bw, ";")
+		}
+	}
+	fmt.Fprintln(bw, "}")
+	return bw.Flush()
+}
@@ -0,0 +1,177 @@
+package mf
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// RunBF runs BF code in a plain reference interpreter, independent of
+// the MF converters and VM, with a tape of memsize cells. As in the VM,
+// cells wrap around, and input at EOF leaves the cell unchanged.
+// A timeout of zero means no limit.
+func RunBF(src []byte, memsize int, in io.Reader, out io.Writer, timeout time.Duration) error {
+	if err := ValidateBF(src); err != nil {
+		return err
+	}
+	var code []byte
+	for _, b := range src {
+		if strings.IndexByte(bf, b) >= 0 {
+			code = append(code, b)
+		}
+	}
+	match := make([]int, len(code))
+	var open []int
+	for i, b := range code {
+		switch b {
+		case '[':
+			open = append(open, i)
+		case ']':
+			o := open[len(open)-1]
+			open = open[:len(open)-1]
+			match[o], match[i] = i, o
+		}
+	}
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	tape := make([]byte, memsize)
+	ptr := 0
+	for pc, n := 0, 0; pc < len(code); pc, n = pc+1, n+1 {
+		if n%4096 == 0 && !deadline.IsZero() && time.Now().After(deadline) {
+			return fmt.Errorf("%w: time limit %v exceeded", ErrLimit, timeout)
+		}
+		switch code[pc] {
+		case '+':
+			tape[ptr]++
+		case '-':
+			tape[ptr]--
+		case '>', '<':
+			if code[pc] == '>' {
+				ptr++
+			} else {
+				ptr--
+			}
+			if ptr < 0 || ptr >= len(tape) {
+				return fmt.Errorf("pointer out of bounds: %d", ptr)
+			}
+		case '[':
+			if tape[ptr] == 0 {
+				pc = match[pc]
+			}
+		case ']':
+			if tape[ptr] != 0 {
+				pc = match[pc]
+			}
+		case '.':
+			if _, err := out.Write(tape[ptr : ptr+1]); err != nil {
+				return err
+			}
+		case ',':
+			if _, err := io.ReadFull(in, tape[ptr:ptr+1]); err != nil && err != io.EOF {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// CheckResult is the result of running BF code and its MF conversion
+// on the same input, see CrossCheck.
+type CheckResult struct {
+	BFOut, MFOut []byte
+	BFErr, MFErr error // why the runs failed, if they did
+}
+
+// OK reports whether both runs wrote the same output, and either both
+// ended normally or both failed. If a run hit the time limit, it only
+// reports whether the outputs agree as far as both got.
+func (r *CheckResult) OK() bool {
+	return runsAgree(r.BFOut, r.BFErr, r.MFOut, r.MFErr)
+}
+
+// TimedOut reports whether a run hit the time limit,
+// which makes the result inconclusive.
+func (r *CheckResult) TimedOut() bool {
+	return errors.Is(r.BFErr, ErrLimit) || errors.Is(r.MFErr, ErrLimit)
+}
+
+// String describes the differences of the runs.
+func (r *CheckResult) String() string {
+	return describeRuns("bf", r.BFOut, r.BFErr, "mf", r.MFOut, r.MFErr)
+}
+
+// runsAgree reports whether two runs agree, see CheckResult.OK.
+func runsAgree(aOut []byte, aErr error, bOut []byte, bErr error) bool {
+	if errors.Is(aErr, ErrLimit) || errors.Is(bErr, ErrLimit) {
+		n := min(len(aOut), len(bOut))
+		return bytes.Equal(aOut[:n], bOut[:n])
+	}
+	return bytes.Equal(aOut, bOut) && (aErr == nil) == (bErr == nil)
+}
+
+// describeRuns describes the differences of two runs named a and b.
+func describeRuns(a string, aOut []byte, aErr error, b string, bOut []byte, bErr error) string {
+	timedOut := errors.Is(aErr, ErrLimit) || errors.Is(bErr, ErrLimit)
+	if runsAgree(aOut, aErr, bOut, bErr) {
+		if timedOut {
+			return fmt.Sprintf("inconclusive, timed out, outputs agree on %d bytes", min(len(aOut), len(bOut)))
+		}
+		return fmt.Sprintf("ok, %d output bytes", len(aOut))
+	}
+	var s string
+	if !bytes.Equal(aOut, bOut) {
+		i := 0
+		for i < len(aOut) && i < len(bOut) && aOut[i] == bOut[i] {
+			i++
+		}
+		s = fmt.Sprintf("outputs differ at byte %d (%s %d bytes, %s %d bytes)", i, a, len(aOut), b, len(bOut))
+		if i < len(aOut) && i < len(bOut) {
+			s += fmt.Sprintf(": %s %q, %s %q", a, aOut[i], b, bOut[i])
+		}
+	}
+	if !timedOut && (aErr == nil) != (bErr == nil) {
+		if s != "" {
+			s += "; "
+		}
+		end := func(err error) string {
+			if err == nil {
+				return "ended normally"
+			}
+			return err.Error()
+		}
+		s += fmt.Sprintf("%s %s, %s %s", a, end(aErr), b, end(bErr))
+	}
+	return s
+}
+
+// CrossCheck runs BF code in RunBF and its MF conversion prog in the VM,
+// both with input, and compares their output and how they end. The BF
+// tape is as large as the memsize of prog. timeout limits each run.
+func CrossCheck(src, prog, input []byte, timeout time.Duration) (*CheckResult, error) {
+	prog, l, err := parseProg(prog)
+	if err != nil {
+		return nil, err
+	}
+	if string(prog[:4]) != BFMagic {
+		return nil, fmt.Errorf("MF binary is not converted from BF")
+	}
+	if l.memsize > 1<<31 {
+		return nil, fmt.Errorf("memory size %d too large", l.memsize)
+	}
+	r := new(CheckResult)
+	var bfOut, mfOut bytes.Buffer
+	r.BFErr = RunBF(src, int(l.memsize), bytes.NewReader(input), &bfOut, timeout)
+	v, err := NewSandboxVM(prog, Policy{Timeout: timeout})
+	if err != nil {
+		return nil, err
+	}
+	v.In, v.Out = bytes.NewReader(input), &mfOut
+	r.MFErr = v.Run()
+	r.BFOut, r.MFOut = bfOut.Bytes(), mfOut.Bytes()
+	return r, nil
+}
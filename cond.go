@@ -0,0 +1,222 @@
+package mf
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Cond is a breakpoint condition, parsed by ParseCond.
+type Cond struct {
+	src  string
+	eval func(v *VM) (int64, error)
+}
+
+// ParseCond parses a condition expression on the VM state, such as
+// "ptr == 42" or "cell > 100 && steps > 1000".
+//
+// Operands are integers and the variables ptr (or pointer), cell (the
+// current cell), cell[i] (cell i of the current tape), tape, pc and steps.
+// Operators are, from the lowest precedence, || && == != < <= > >= + -
+// and the unary ! and -. Comparisons are 1 if true and 0 if false.
+func ParseCond(s string) (*Cond, error) {
+	p := &condParser{src: s}
+	p.next()
+	eval, err := p.or()
+	if err == nil && p.tok != "" {
+		err = fmt.Errorf("unexpected %q", p.tok)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("condition %q: %w", s, err)
+	}
+	return &Cond{strings.TrimSpace(s), eval}, nil
+}
+
+func (c *Cond) String() string {
+	return c.src
+}
+
+// Eval reports whether the condition holds for v.
+func (c *Cond) Eval(v *VM) (bool, error) {
+	n, err := c.eval(v)
+	return n != 0, err
+}
+
+type condFunc = func(v *VM) (int64, error)
+
+// condParser is a recursive descent parser of conditions.
+type condParser struct {
+	src string
+	pos int
+	tok string // current token, empty at the end
+}
+
+// next advances to the next token.
+func (p *condParser) next() {
+	for p.pos < len(p.src) && p.src[p.pos] == ' ' {
+		p.pos++
+	}
+	start := p.pos
+	if p.pos >= len(p.src) {
+		p.tok = ""
+		return
+	}
+	isWord := func(c byte) bool { return c == '_' || unicode.IsLetter(rune(c)) || unicode.IsDigit(rune(c)) }
+	switch c := p.src[p.pos]; {
+	case isWord(c):
+		for p.pos < len(p.src) && isWord(p.src[p.pos]) {
+			p.pos++
+		}
+	case strings.HasPrefix(p.src[p.pos:], "&&"), strings.HasPrefix(p.src[p.pos:], "||"),
+		p.pos+1 < len(p.src) && p.src[p.pos+1] == '=' && strings.IndexByte("=!<>", c) >= 0:
+		p.pos += 2
+	default:
+		p.pos++
+	}
+	p.tok = p.src[start:p.pos]
+}
+
+// binary parses operands with operand, separated by the operators in ops.
+// If chain is false, only a single operator is allowed.
+func (p *condParser) binary(operand func() (condFunc, error), chain bool, ops map[string]func(a, b int64) int64) (condFunc, error) {
+	x, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := ops[p.tok]
+		if !ok {
+			return x, nil
+		}
+		p.next()
+		y, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		a := x
+		x = func(v *VM) (int64, error) {
+			m, err := a(v)
+			if err != nil {
+				return 0, err
+			}
+			n, err := y(v)
+			return op(m, n), err
+		}
+		if !chain {
+			return x, nil
+		}
+	}
+}
+
+func truth(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (p *condParser) or() (condFunc, error) {
+	return p.binary(p.and, true, map[string]func(a, b int64) int64{
+		"||": func(a, b int64) int64 { return truth(a != 0 || b != 0) },
+	})
+}
+
+func (p *condParser) and() (condFunc, error) {
+	return p.binary(p.cmp, true, map[string]func(a, b int64) int64{
+		"&&": func(a, b int64) int64 { return truth(a != 0 && b != 0) },
+	})
+}
+
+func (p *condParser) cmp() (condFunc, error) {
+	return p.binary(p.sum, false, map[string]func(a, b int64) int64{
+		"==": func(a, b int64) int64 { return truth(a == b) },
+		"!=": func(a, b int64) int64 { return truth(a != b) },
+		"<":  func(a, b int64) int64 { return truth(a < b) },
+		"<=": func(a, b int64) int64 { return truth(a <= b) },
+		">":  func(a, b int64) int64 { return truth(a > b) },
+		">=": func(a, b int64) int64 { return truth(a >= b) },
+	})
+}
+
+func (p *condParser) sum() (condFunc, error) {
+	return p.binary(p.unary, true, map[string]func(a, b int64) int64{
+		"+": func(a, b int64) int64 { return a + b },
+		"-": func(a, b int64) int64 { return a - b },
+	})
+}
+
+func (p *condParser) unary() (condFunc, error) {
+	switch p.tok {
+	case "!", "-":
+		op := p.tok
+		p.next()
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(v *VM) (int64, error) {
+			n, err := x(v)
+			if op == "!" {
+				return truth(n == 0), err
+			}
+			return -n, err
+		}, nil
+	}
+	return p.primary()
+}
+
+func (p *condParser) primary() (condFunc, error) {
+	tok := p.tok
+	p.next()
+	switch tok {
+	case "":
+		return nil, fmt.Errorf("unexpected end")
+	case "(":
+		x, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.tok != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		p.next()
+		return x, nil
+	case "ptr", "pointer":
+		return func(v *VM) (int64, error) { return int64(v.ptr), nil }, nil
+	case "tape":
+		return func(v *VM) (int64, error) { return int64(v.cur), nil }, nil
+	case "pc":
+		return func(v *VM) (int64, error) { return int64(v.pc), nil }, nil
+	case "steps":
+		return func(v *VM) (int64, error) { return v.steps, nil }, nil
+	case "cell":
+		if p.tok != "[" {
+			return func(v *VM) (int64, error) { return int64(v.tape[v.ptr]), nil }, nil
+		}
+		p.next()
+		i, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.tok != "]" {
+			return nil, fmt.Errorf("missing ]")
+		}
+		p.next()
+		return func(v *VM) (int64, error) {
+			n, err := i(v)
+			if err != nil {
+				return 0, err
+			}
+			if n < 0 || n >= int64(len(v.tape)) {
+				return 0, fmt.Errorf("cell %d out of bounds", n)
+			}
+			return int64(v.tape[n]), nil
+		}, nil
+	}
+	n, err := strconv.ParseInt(tok, 0, 64)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected %q", tok)
+	}
+	return func(*VM) (int64, error) { return n, nil }, nil
+}
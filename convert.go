@@ -9,6 +9,12 @@
 //
 // MF 바이너리의 첫 4바이트는 Magic(\xff\x6d\x66\xfd),
 // 다음 32비트는 할당할 VM 메모리 크기입니다.
+// 메모리 크기와 모든 32비트 피연산자는 빅 엔디언(big-endian)으로 저장합니다.
+//
+// 메모리 크기가 0이면 확장 헤더가 이어집니다: 32비트 버전, 그리고 버전별 필드.
+// 버전 2는 64비트 메모리 크기를 가지며, 모든 피연산자가 64비트입니다.
+// (확장 연산의 피연산자는 32비트 범위 안이어야 합니다)
+// 값이 32비트에 들어가면 NewBFReader64도 버전 1로 출력합니다.
 // BF에서 MF로 강제 변환한 코드의 경우 Magic은 \xff\x6d\x68\xfd입니다.
 //
 // 각 BF 코드 1바이트는 MF 코드 1니블로 치환됩니다.
@@ -23,6 +29,7 @@
 //
 // 주의: [, ] 즉 4, 5 코드는 special code로 대체됩니다. non-special code에서의 4, 5 코드 구현은 표준에서도 정의하지 않습니다.
 // 레거시 호환성을 위해 구현할 수 있으나, special code의 4, 5 사용을 권장합니다.
+// ToBF는 기본적으로 non-special 4, 5 코드를 무시하며, LegacyBrackets 옵션으로 [, ]로 변환할 수 있습니다.
 //
 // 니블코드의 첫 비트가 1(전체 니블이 8 이상)인 경우, 뒤 3비트는 special code로 취급되어 특수 목적으로 사용됩니다.
 //
@@ -44,14 +51,54 @@
 //
 // 주의: no-op 코드를 일반적 상황에서 직접 삽입할 이유는 없습니다. 예상하지 못한 효과를 일으킬 수 있습니다.
 //
-// 7은 예약된 special code입니다. (내부 조작, syscall 관련으로 사용될 예정)
+// special code가 7인 경우 확장 연산(extension operation)입니다.
+// 뒤 32비트 중 상위 8비트는 확장 연산 종류, 하위 24비트는 인자입니다.
+//  1: 현재 셀을 인자 값으로 설정 (set)
+//  2: 현재 셀부터 인자 개수만큼의 셀을 0으로 설정, 포인터는 유지 (memclear)
+//  3: 현재 셀 값을 인자(부호 있는 24비트)만큼 떨어진 셀에 더한 뒤 0으로 설정 (memmove)
+//     셀 값을 옮기는 연산이며, 포인터를 옮기지는 않습니다. 포인터 이동은 16입니다.
+//  4: 현재 셀이 0이 될 때까지 포인터를 인자(부호 있는 24비트)만큼씩 이동 (scan)
+//  5, 6: 인자 횟수만큼 ., , 반복 (출력/입력 압축)
+//  7: 인자 번호의 테이프로 전환 (multi-tape). 테이프마다 포인터를 따로 가지며,
+//     처음 사용할 때 0번 테이프와 같은 크기로 할당됩니다.
+//  8: 인자 번호의 syscall 호출. VM.RegisterSyscall로 등록된 것만 호출할 수 있습니다.
+//  9: 인자 개수만큼의 매크로를 담은 사전 (dict). 코드 맨 앞에만 올 수 있고,
+//     각 매크로는 11로 끝나며, 프로그램은 사전 뒤에서 시작합니다.
+//  10: 인자 번호의 매크로 실행 (macro). 매크로 안에서는 앞 번호의 매크로만 실행할 수 있습니다.
+//  11: 매크로나 호출의 끝 (ret). 매크로를 실행하거나 호출한 곳으로 돌아갑니다.
+//  12: 인자 오프셋의 코드 호출 (call). 호출 스택의 깊이는 VM.MaxCallDepth로 제한됩니다.
+//  13: 포인터에서 떨어진 칸에 값 더하기 (addat). 인자의 상위 16비트는 부호 있는 오프셋,
+//      하위 8비트는 더할 값입니다. 포인터는 움직이지 않습니다.
+//  14: 디버그 출력 (dbg). 포인터와 그 양쪽으로 인자 개수만큼의 셀을 VM.Debug에 출력하며,
+//      프로그램의 출력과 상태에는 영향이 없습니다. ToBF는 이를 버리거나,
+//      DebugHash가 설정되면 일부 BF 인터프리터의 디버그 명령인 #으로 출력합니다.
+//  15: 단언 (assert). 현재 셀이 인자 값이 아니면 VM은 ErrAssert로 실행을 멈춥니다.
+//      ToBF는 이를 버리거나, AssertLoops가 설정되면 셀이 인자 값이 아닐 때
+//      끝나지 않는 루프로 출력합니다.
+//  16: 포인터를 인자(부호 있는 24비트)만큼 이동 (shift). >, < 코드가 섞인 이동을 하나로 씁니다.
+// ToBF는 확장 연산을 일반 BF 코드로 풀어서 출력합니다. (테이프 전환과 호출은 변환할 수 없습니다)
+// 매크로는 실행하는 곳마다 펼쳐서 출력합니다.
+// 나머지 종류는 예약되어 있습니다.
+// VM.RegisterExt로 예약된 종류의 처리기를 등록해 실험적인 확장을 만들 수 있습니다.
+// ToBF는 syscall과 알 수 없는 확장 연산을 {ext 0123abcd} 형태의 토큰으로 출력하고,
+// FromBF는 이 토큰을 같은 확장 연산으로 되돌립니다.
+//
+// 서명된 MF 바이너리는 코드 뒤에 서명 섹션을 가집니다: 앞부분 전체의 Ed25519 서명 64바이트,
+// 그리고 SigMagic(\xff\x6d\x73\xfd). VM은 서명 섹션을 실행하지 않습니다. (SignMF, VerifyMF)
+//
+// 여러 MF 바이너리는 ArchiveMagic(\xff\x6d\x61\xfd)으로 시작하는 아카이브(.mfa) 하나로 묶을 수 있습니다.
+// (WriteArchive, ReadArchive)
 //
 package mf
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"math"
 	"strings"
 )
 
@@ -67,113 +114,318 @@ const BFMagic = "\xff\x6d\x68\xfd"
 
 const bf = "+-><[].,"
 
+// ErrBufferLimit is wrapped by errors of FromBF exceeding MaxBuffer.
+var ErrBufferLimit = errors.New("buffer limit exceeded")
+
+// extToken is how ToBF writes extension operations it cannot lower,
+// and FromBF reads them back. It contains no BF commands.
+const extToken = "{ext %08x}"
+
 // ToBF will accept MF code with Write function,
 // and write to wrapping Writer interface.
+// Close must be called after the last Write.
 type ToBF struct {
-	wr      io.Writer
-	bfmode  bool
-	rdSize  uint32
-	misc    [4]byte // magic, memsize storage
-	memSize uint32  // at least 32-bit
-	sbit    bool    // special bit flag
-	scode   byte    // special code
-	rdGoal  uint32  // bytes limit to read compressed length
+	wr        io.Writer
+	out       counter // wraps the Writer, wr is &out
+	scan      *Scanner
+	started   bool // whether the start of the BF code is written
+	commented int  // offset of the last code byte written by OffsetComments
+	discarded int  // offset of a low nibble after a no-op in the high one
+	memSize   uint64
+	dict      [][]byte      // BF code of the macros read so far
+	entry     *bytes.Buffer // BF code of the macro being read, wr while reading it
+	pending   uint64        // macros of the dictionary left to read
+
+	// Logger receives diagnostic messages. Nil means silent.
+	Logger *slog.Logger
+
+	// Mode selects how undefined encodings are converted.
+	Mode DecodeMode
+
+	// LegacyBrackets translates non-special 4 and 5 nibbles to [ and ],
+	// as legacy implementations may do, instead of ignoring them.
+	// It has no effect with DecodeStrict.
+	LegacyBrackets bool
+
+	// DebugHash writes dbg operations as #, which some BF interpreters
+	// run as a dump of the cells. Otherwise they are dropped.
+	DebugHash bool
+
+	// AssertLoops writes assert operations as BF code looping forever
+	// unless the cell has the asserted value, so that a failed assertion
+	// hangs the program instead of running on. Otherwise they are dropped.
+	AssertLoops bool
+
+	// OffsetComments writes the offset of each byte of MF code before
+	// the BF code converted from it, as "\n@offset ", which has no BF
+	// commands, so BF misbehaving in another interpreter can be traced
+	// back to the MF binary.
+	OffsetComments bool
+
+	// NoPreamble skips the BF code allocating the memsize of the MF
+	// binary, which only BetterBF needs, for interpreters that already
+	// have a large zeroed tape. MF converted from BF never has it.
+	NoPreamble bool
+
+	// NoBanner skips the "MinFuck compiled code" line starting the BF code.
+	NoBanner bool
+
+	// CellBits is the size in bits of the cells of the interpreter the
+	// BF code is for, zero if not known. With 8, runs of + and - are
+	// written modulo 256 and set values above 128 are counted down from
+	// zero, relying on cells wrapping around as in MF. With more, assert
+	// loops do not rely on it.
+	CellBits int
+
+	warner
+	progress
 }
 
 // NewBFWriter returns new mf.ToBF struct.
 func NewBFWriter(wr io.Writer) *ToBF {
-	return &ToBF{wr: wr}
+	r := new(ToBF)
+	r.Reset(wr)
+	return r
+}
+
+// Reset discards the conversion state and starts a new conversion
+// writing to wr, keeping the options, so a ToBF can be reused.
+func (r *ToBF) Reset(wr io.Writer) {
+	*r = ToBF{
+		out:            counter{w: wr},
+		Logger:         r.Logger,
+		Mode:           r.Mode,
+		LegacyBrackets: r.LegacyBrackets,
+		DebugHash:      r.DebugHash,
+		AssertLoops:    r.AssertLoops,
+		OffsetComments: r.OffsetComments,
+		NoPreamble:     r.NoPreamble,
+		NoBanner:       r.NoBanner,
+		CellBits:       r.CellBits,
+		scan:           &Scanner{mfOnly: true, nops: true},
+		commented:      -1,
+		discarded:      -1,
+		warner:         warner{Warn: r.Warn},
+		progress:       progress{Progress: r.Progress, ProgressInterval: r.ProgressInterval},
+	}
+	r.wr = &r.out
 }
 
 // Write implements io.Writer interface.
-// Write will write converted BF code from p to wr.
-func (r *ToBF) Write(p []byte) (n int, err error) {
-	for i := 0; i < len(p); i++ {
-		b := p[i]
-		switch {
-		case r.rdSize <= 4:
-			if r.rdSize != 4 {
-				r.misc[r.rdSize] = b
-			} else if string(r.misc[:4]) == BFMagic {
-				r.bfmode = true
-				r.misc[r.rdSize-4] = b
-			} else if string(r.misc[:4]) != Magic {
-				return i, fmt.Errorf("Invalid magic 0x%x", r.misc[:4])
-				r.misc[r.rdSize-4] = b
-			}
-		case r.rdSize <= 8:
-			if r.rdSize != 8 {
-				r.misc[r.rdSize-4] = b
-			} else {
-				r.wr.Write([]byte("MinFuck compiled code\n"))
-				if !r.bfmode {
-					fmt.Println("Memory alloc size:", r.miscData())
-					r.allocMem(r.miscData())
-				}
-				if err := r.processWrapper(b, &i); err != nil {
-					return i, err
-				}
-			}
-		case r.rdSize < r.rdGoal:
-			r.misc[(r.rdSize+4)-r.rdGoal] = b
-			if r.rdSize == r.rdGoal-1 {
-				for i := r.miscData(); i > 0; i-- {
-					r.wr.Write([]byte(bf[r.scode : r.scode+1]))
-				}
-			}
-		default:
-			if err := r.processWrapper(b, &i); err != nil {
-				return i, err
-			}
-		}
-		r.rdSize++
+// Write will write converted BF code from p to wr. The last bytes of
+// the code, which may be a signature section, are held back until more
+// are written or Close is called.
+func (r *ToBF) Write(p []byte) (int, error) {
+	base := r.base
+	r.base += len(p)
+	r.scan.Write(p)
+	if err := r.convert(); err != nil {
+		return min(max(r.at.Offset-base, 0), len(p)), err
 	}
 	return len(p), nil
 }
 
-func (r *ToBF) processWrapper(b byte, i *int) error {
-	if err := r.processByte(b); err != nil {
-		return err
-	}
-	if r.sbit { // special bit
-		switch {
-		case r.scode < 4: // compressed code
-			r.rdGoal = r.rdSize + 5
-		case r.scode == 4 || r.scode == 5:
-			r.wr.Write([]byte(bf[r.scode : r.scode+1]))
-			(*i) += 4
+// Close converts the bytes Write held back, unless they are the
+// signature section of a signed MF binary, which is dropped.
+func (r *ToBF) Close() error {
+	r.scan.Close()
+	return r.convert()
+}
+
+// convert converts the instructions scanned from the input so far.
+func (r *ToBF) convert() error {
+	r.scan.decode = r.Mode
+	for r.scan.Scan() {
+		r.begin()
+		tok := r.scan.Token()
+		r.at = tok.Pos
+		if err := r.token(tok); err != nil {
+			return err
 		}
-		r.sbit = false
+		r.tick(int64(r.scan.Pos().Offset), r.out.n)
 	}
-	return nil
+	r.begin()
+	return r.scan.Err()
 }
 
-func (r *ToBF) processByte(b byte) error {
-	if s := b >> 7; s == 0 {
-		r.processNibble(b >> 4)
-	} else {
-		r.sbit = true
-		r.scode = (b >> 4) & 7
+// begin writes the start of the BF code once the header is read.
+func (r *ToBF) begin() {
+	if r.started || !r.scan.IsMF() {
+		return
+	}
+	r.started = true
+	l := r.scan.l
+	r.memSize = l.memsize
+	if !r.NoBanner {
+		r.wr.Write([]byte("MinFuck compiled code\n"))
+	}
+	if !r.scan.fromBF && !r.NoPreamble {
+		logger(r.Logger).Debug("memory alloc", "size", l.memsize)
+		r.allocMem(l.memsize)
+	}
+}
+
+// token writes BF code for an instruction, or an alignment no-op or
+// undefined nibble, warning of encodings the spec discourages.
+func (r *ToBF) token(tok Token) error {
+	n := tok.Char >> 4
+	if tok.Pos.Low {
+		n = tok.Char & 0xf
+	}
+	special := n&8 != 0
+	if tok.Pos.Low && tok.Pos.Offset == r.discarded {
 		return nil
 	}
-	if s := (b >> 3) & 1; s == 0 {
-		r.processNibble(b & 0xf)
-	} else {
-		r.sbit = true
-		r.scode = b & 0x7
+	if special && !tok.Pos.Low {
+		switch {
+		case n == 8|6:
+			r.warn(WarnNopPlacement, "no-op code in high nibble discards the low nibble")
+			r.discarded = tok.Pos.Offset
+		case tok.Char&0xf != 8|6:
+			r.warn(WarnDiscardedNibble, "nibble %x after special code %d is discarded", tok.Char&0xf, n&7)
+		}
+	}
+	if r.OffsetComments && tok.Pos.Offset != r.commented {
+		fmt.Fprintf(r.wr, "\n@%d ", tok.Pos.Offset)
+		r.commented = tok.Pos.Offset
+	}
+	in := tok.In
+	switch {
+	case special && n&7 == 7:
+		return r.lowerExt(in)
+	case in.Op == OpNop && (n == 4 || n == 5):
+		if !r.LegacyBrackets {
+			r.warn(WarnUndefinedNibble, "undefined non-special nibble %d ignored", n)
+			return nil
+		}
+		r.warn(WarnLegacyBracket, "non-special nibble %d translated to '%c'", n, bf[n])
+		r.wr.Write([]byte{bf[n]})
+	case in.Op == OpNop:
+	case special && in.Op <= OpLeft:
+		r.checkRepeat(in.Op, in.Arg)
+		if in.Op < OpRight && r.CellBits == 8 {
+			in.Arg %= 256
+		}
+		run := bytes.Repeat([]byte{bf[in.Op]}, int(min(in.Arg, 4096)))
+		for k := in.Arg; k > 0; k -= uint64(len(run)) {
+			run = run[:min(k, uint64(len(run)))]
+			r.wr.Write(run)
+		}
+	default:
+		r.wr.Write([]byte{bf[in.Op]})
 	}
 	return nil
 }
 
-func (r *ToBF) processNibble(n byte) {
-	r.wr.Write([]byte{bf[n]})
+// lowerExt writes plain BF code for an extension operation.
+func (r *ToBF) lowerExt(in Instruction) (err error) {
+	var code string
+	switch in.Op {
+	case OpSet:
+		set := strings.Repeat("+", int(in.Arg))
+		if n := int(in.Arg % 256); r.CellBits == 8 {
+			set = strings.Repeat("+", n)
+			if n > 128 {
+				set = strings.Repeat("-", 256-n)
+			}
+		}
+		code = "[-]" + set
+	case OpClear:
+		if in.Arg > 0 {
+			code = "[-]" + strings.Repeat(">[-]", int(in.Arg-1)) + strings.Repeat("<", int(in.Arg-1))
+		}
+	case OpMove:
+		there, back := ">", "<"
+		off := int32(in.Arg)
+		if off < 0 {
+			there, back, off = "<", ">", -off
+		}
+		code = "[-" + strings.Repeat(there, int(off)) + "+" + strings.Repeat(back, int(off)) + "]"
+	case OpScan:
+		step, dir := int32(in.Arg), ">"
+		if step < 0 {
+			step, dir = -step, "<"
+		}
+		code = "[" + strings.Repeat(dir, int(step)) + "]"
+	case OpShift:
+		off, dir := int32(in.Arg), ">"
+		if off < 0 {
+			off, dir = -off, "<"
+		}
+		code = strings.Repeat(dir, int(off))
+	case OpAddAt:
+		off, n := in.AddAt()
+		there, back := ">", "<"
+		if off < 0 {
+			there, back, off = "<", ">", -off
+		}
+		add := strings.Repeat("+", int(n))
+		if n > 128 {
+			add = strings.Repeat("-", 256-int(n))
+		}
+		code = strings.Repeat(there, off) + add + strings.Repeat(back, off)
+	case OpOut:
+		code = strings.Repeat(".", int(in.Arg))
+	case OpIn:
+		code = strings.Repeat(",", int(in.Arg))
+	case OpTape:
+		return &PosError{r.at, fmt.Errorf("tape switch cannot be converted to BF")}
+	case OpSyscall, OpExt:
+		code = fmt.Sprintf(extToken, extOperand(in))
+	case OpDebug:
+		if r.DebugHash {
+			code = "#"
+		}
+	case OpAssert:
+		if r.AssertLoops {
+			sub, add := strings.Repeat("-", int(in.Arg)), strings.Repeat("+", int(in.Arg))
+			if in.Arg > 128 && r.CellBits <= 8 {
+				sub, add = strings.Repeat("+", 256-int(in.Arg)), strings.Repeat("-", 256-int(in.Arg))
+			}
+			code = sub + "[]" + add
+		}
+	case OpDict:
+		if r.dict != nil || r.entry != nil {
+			return &PosError{r.at, fmt.Errorf("second dictionary")}
+		}
+		r.dict = [][]byte{}
+		if in.Arg > 0 {
+			r.pending, r.entry = in.Arg, new(bytes.Buffer)
+			r.wr = r.entry
+		}
+	case OpCall:
+		return &PosError{r.at, fmt.Errorf("call cannot be converted to BF")}
+	case OpRet:
+		if r.pending == 0 {
+			return &PosError{r.at, fmt.Errorf("return cannot be converted to BF")}
+		}
+		r.dict = append(r.dict, bytes.Clone(r.entry.Bytes()))
+		r.entry.Reset()
+		if r.pending--; r.pending == 0 {
+			r.wr = &r.out
+		}
+	case OpMacro:
+		if in.Arg >= uint64(len(r.dict)) {
+			return &PosError{r.at, fmt.Errorf("undefined macro %d", in.Arg)}
+		}
+		_, err = r.wr.Write(r.dict[in.Arg])
+		return err
+	}
+	_, err = r.wr.Write([]byte(code))
+	return err
 }
 
-func (r *ToBF) miscData() uint32 {
-	return uint32(r.misc[0])<<24 | uint32(r.misc[1])<<12 | uint32(r.misc[2])<<8 | uint32(r.misc[3])
+// checkRepeat warns about a suspicious compressed run length.
+func (r *ToBF) checkRepeat(op Op, n uint64) {
+	switch {
+	case op < OpRight && n >= 256:
+		r.warn(WarnRepeatCount, "repeat count %d of '%c' wraps around, same as %d", n, bf[op], n%256)
+	case op >= OpRight && n >= r.memSize:
+		r.warn(WarnRepeatCount, "repeat count %d of '%c' exceeds memsize %d", n, bf[op], r.memSize)
+	}
 }
 
-func (r *ToBF) allocMem(size uint32) {
+func (r *ToBF) allocMem(size uint64) {
 	r.wr.Write([]byte(">>+>>+>>+>>+>"))
 	r.wr.Write([]byte(strings.Repeat("+", int(size))))
 	r.wr.Write([]byte("[[->>+<<]>+>-]<[<<]"))
@@ -181,98 +433,550 @@ func (r *ToBF) allocMem(size uint32) {
 
 // FromBF converts BF code to MF, and writes to the wrapping Writer.
 type FromBF struct {
-	wr   *bytes.Buffer
-	wrap io.Writer
+	wr    *bytes.Buffer
+	wrap  io.Writer
+	scan  *Scanner
+	l     layout
+	start layout // l as created, before Close narrows it
 	buf  byte
 	last byte
-	dup  uint32
+	dup  uint64
 	half bool
+
+	// PBrain enables the pbrain procedure extension.
+	// '(' and ')' define a procedure numbered by the current cell value,
+	// and ':' calls the procedure numbered by the current cell value.
+	//
+	// Procedures are inlined at the call site, so the cell value at each
+	// '(' and ':' must be statically known, e.g. "[-]+++:".
+	PBrain bool
+
+	// Calls makes PBrain convert each procedure once, into a dictionary
+	// at the start of the code, and ':' into a call operation of it,
+	// instead of inlining procedures, so that they may call themselves.
+	// A procedure calls the procedures defined when it is. The calls run
+	// as deep as VM.MaxCallDepth allows. Older MF readers and ToBF do
+	// not understand calls, and extension tokens of calls, returns and
+	// macros are errors with it, as the dictionary would not hold.
+	Calls bool
+
+	procs    map[byte][]byte
+	defs     [][]Instruction // procedures converted for Calls, in the dictionary
+	defOf    map[byte]int    // index in defs of each procedure
+	defSize  int             // instructions of defs
+	proc     []byte // body of the procedure being defined
+	procID   byte
+	defining bool
+	calls    []byte // inlined procedure stack, for recursion detection
+	known    bool   // whether the current cell value is statically known
+	val      byte
+
+	// Optimize rewrites common idioms into extension instructions.
+	// See the Optimize function.
+	Optimize bool
+
+	pending []Instruction // instructions kept for optimization
+
+	// Logger receives diagnostic messages. Nil means silent.
+	Logger *slog.Logger
+
+	// MaxBuffer limits the bytes buffered until Close writes the MF
+	// binary: the MF code, the instructions kept for Optimize, counted
+	// as pendingSize bytes each, and pbrain procedure bodies. Write
+	// fails with ErrBufferLimit beyond it. Zero means no limit.
+	MaxBuffer int
+	procSize  int // bytes of procs
+
+	// CompressIO compresses runs of . and , with extension operations.
+	// Older MF readers do not understand them.
+	CompressIO bool
+
+	// Compress selects which runs of + - > < are compressed into a
+	// special code with a repeat count.
+	Compress CompressStrategy
+
+	// CompressThreshold is the longest run CompressByLength writes as
+	// plain nibbles, 9 if zero.
+	CompressThreshold int
+
+	// MultiTape enables the tape switch extension.
+	// '^' followed by decimal digits switches to the numbered tape,
+	// and '^' alone switches back to tape 0.
+	MultiTape bool
+
+	// FixBrackets repairs unbalanced brackets instead of failing on
+	// them: a ] without a [ is dropped, and each [ left unmatched is
+	// closed at the end, with a warning for every fix.
+	FixBrackets bool
+
+	tape    uint64 // number of the tape switch being read
+	tapeSel bool   // whether a tape switch is being read
+	extTok  []byte // extension token being read
+	extAt   Pos    // of extTok
+	tapeAt  Pos    // of the tape switch being read
+	opens   []Pos  // of the [ not matched yet
+	defAt   Pos    // of the procedure being defined
+
+	warner
+	progress
+	ignored    Pos // start of ignored characters, offset -1 if none
+	defaultMem bool
 }
 
 // NewBFWriter returns new FromBF struct.
+// A zero memsize is replaced by DefaultMemSize.
 func NewBFReader(wr io.Writer, memsize uint32) *FromBF {
-	r := new(FromBF)
-	r.wr = new(bytes.Buffer)
-	r.wrap = wr
-	r.wr.Write([]byte(BFMagic))
-	r.wr.Write(uint32bytes(memsize))
+	return newBFReader(wr, v1Layout, uint64(memsize))
+}
+
+// NewBFReader64 returns new FromBF struct writing the version 2
+// container, with a 64-bit memsize and operands. If the memsize and
+// all operands fit in 32 bits, Close writes version 1 instead.
+// A zero memsize is replaced by DefaultMemSize.
+func NewBFReader64(wr io.Writer, memsize uint64) *FromBF {
+	return newBFReader(wr, layout{version: Version2, code: 20, width: 8}, memsize)
+}
+
+func newBFReader(wr io.Writer, l layout, memsize uint64) *FromBF {
+	r := &FromBF{wr: new(bytes.Buffer)}
+	if memsize == 0 {
+		memsize, r.defaultMem = uint64(DefaultMemSize), true
+	}
+	r.start = l
+	r.start.memsize = memsize
+	r.Reset(wr)
 	return r
 }
 
+// Reset discards the conversion state and starts a new conversion
+// writing to wr, keeping the memsize and options. It reuses the
+// buffers of the last conversion, so a FromBF can be pooled.
+func (r *FromBF) Reset(wr io.Writer) {
+	clear(r.procs)
+	clear(r.defOf)
+	scan := r.scan
+	if scan == nil {
+		scan = new(Scanner)
+	}
+	*scan = Scanner{bfOnly: true, win: scan.win[:0]}
+	*r = FromBF{
+		wr:                r.wr,
+		scan:              scan,
+		wrap:              wr,
+		l:                 r.start,
+		start:             r.start,
+		PBrain:            r.PBrain,
+		Calls:             r.Calls,
+		procs:             r.procs,
+		defs:              r.defs[:0],
+		defOf:             r.defOf,
+		calls:             r.calls[:0],
+		known:             true,
+		Optimize:          r.Optimize,
+		pending:           r.pending[:0],
+		opens:             r.opens[:0],
+		Logger:            r.Logger,
+		MaxBuffer:         r.MaxBuffer,
+		CompressIO:        r.CompressIO,
+		Compress:          r.Compress,
+		CompressThreshold: r.CompressThreshold,
+		MultiTape:         r.MultiTape,
+		FixBrackets:       r.FixBrackets,
+		warner:            warner{Warn: r.Warn, after: bfStart},
+		progress:          progress{Progress: r.Progress, ProgressInterval: r.ProgressInterval},
+		ignored:           Pos{Offset: -1},
+		defaultMem:        r.defaultMem,
+	}
+	r.wr.Reset()
+	h, _ := Header{BFMagic, r.l.version, r.l.memsize}.MarshalBinary()
+	r.wr.Write(h)
+}
+
 // Write implements io.Writer interface.
 func (r *FromBF) Write(p []byte) (n int, err error) {
-	for _, b := range p {
-		switch b {
-		case 43, 45, 62, 60:
-			var t byte
-			switch b {
-			case 43:
-				t = 0
-			case 45:
-				t = 1
-			case 62:
-				t = 2
-			case 60:
-				t = 3
-			}
-			if t != r.last {
-				r.clearDup()
-				switch b {
-				case 43:
-					r.last = 0
-				case 45:
-					r.last = 1
-				case 62:
-					r.last = 2
-				case 60:
-					r.last = 3
-				}
-				r.dup = 1
-			} else {
-				r.dup++
-			}
-		case 91, 93:
-			if r.dup > 0 {
-				r.clearDup()
-			}
-			if b == 91 {
-				r.writeNibble(8 | 4)
-			} else {
-				r.writeNibble(8 | 5)
+	base := r.base
+	r.base += len(p)
+	r.scan.Write(p)
+	for r.scan.Scan() {
+		tok := r.scan.Token()
+		r.at, r.after = tok.Pos, r.scan.Pos()
+		r.tick(int64(r.at.Offset), int64(r.wr.Len()))
+		if err := r.writeByte(tok.Char); err != nil {
+			return tok.Pos.Offset - base, err
+		}
+	}
+	return len(p), nil
+}
+
+// writeByte converts a byte of BF code, at r.at if it is not in the
+// body of a procedure being inlined.
+func (r *FromBF) writeByte(b byte) error {
+	if r.MaxBuffer > 0 && r.buffered() > r.MaxBuffer {
+		return r.errorf("%w: converting more than %d bytes", ErrBufferLimit, r.MaxBuffer)
+	}
+	if r.tapeSel {
+		if b >= '0' && b <= '9' {
+			if r.tape <= 0xffffff {
+				r.tape = r.tape*10 + uint64(b-'0')
 			}
-			if r.half {
-				r.writeNibble(8 | 6)
+			return nil
+		}
+		if err := r.switchTape(); err != nil {
+			return err
+		}
+	}
+	if !r.defining && (r.extTok != nil || b == '{') {
+		if ok, err := r.readExt(b); ok || err != nil {
+			return err
+		}
+	}
+	if len(r.calls) == 0 && r.ignored.Offset >= 0 && (isBF(b) || r.PBrain && isPBrain(b) || r.MultiTape && b == '^') {
+		r.flushIgnored()
+	}
+	if r.defining {
+		switch b {
+		case '(':
+			return r.errorf("pbrain: nested procedure definition")
+		case ')':
+			r.procSize += len(r.proc) - len(r.procs[r.procID])
+			r.procs[r.procID] = r.proc
+			r.defining = false
+			if r.Calls {
+				return r.define()
 			}
-			r.wr.Write(make([]byte, 4))
-		case 46, 44:
-			if r.dup > 0 {
-				r.clearDup()
+		default:
+			r.proc = append(r.proc, b)
+		}
+		return nil
+	}
+	r.track(b)
+	switch b {
+	case 43, 45, 62, 60, 46, 44:
+		t := byte(strings.IndexByte(bf, b))
+		if t != r.last {
+			r.clearDup()
+			r.last = t
+			r.dup = 1
+		} else {
+			r.dup++
+		}
+	case 91, 93:
+		if b == 93 && len(r.opens) == 0 && r.FixBrackets {
+			r.warn(WarnStrayBracket, "unmatched ']' dropped")
+			return nil
+		}
+		if r.dup > 0 {
+			r.clearDup()
+		}
+		if b == 91 {
+			r.opens = append(r.opens, r.at)
+			r.push(Instruction{Op: OpOpen})
+		} else {
+			if len(r.opens) == 0 {
+				return r.errorf("unmatched ']'")
 			}
-			if b == 46 {
-				r.writeNibble(6)
-			} else {
-				r.writeNibble(7)
+			r.opens = r.opens[:len(r.opens)-1]
+			r.push(Instruction{Op: OpClose})
+		}
+	case '^':
+		if !r.MultiTape {
+			r.ignore(b)
+			return nil
+		}
+		if r.dup > 0 {
+			r.clearDup()
+		}
+		r.tapeSel, r.tape, r.tapeAt = true, 0, r.at
+	case '(', ')', ':':
+		if !r.PBrain {
+			r.ignore(b)
+			return nil
+		}
+		if err := r.procedure(b); err != nil {
+			return err
+		}
+	default:
+		r.ignore(b)
+	}
+	return nil
+}
+
+// ignore records an ignored input character, except for whitespace.
+func (r *FromBF) ignore(b byte) {
+	switch b {
+	case ' ', '\t', '\n', '\r':
+		r.flushIgnored()
+	default:
+		if r.ignored.Offset < 0 && len(r.calls) == 0 {
+			r.ignored = r.at
+		}
+	}
+}
+
+// flushIgnored warns about the pending run of ignored characters.
+func (r *FromBF) flushIgnored() {
+	if r.ignored.Offset >= 0 {
+		at := r.at
+		r.at = r.ignored
+		r.warn(WarnIgnoredChar, "%d non-BF characters ignored", at.Offset-r.ignored.Offset)
+		r.at, r.ignored = at, Pos{Offset: -1}
+	}
+}
+
+// readExt reads an extension token written by ToBF,
+// and reports whether b is part of it.
+func (r *FromBF) readExt(b byte) (bool, error) {
+	if r.extTok == nil {
+		r.extAt = r.at
+	}
+	r.extTok = append(r.extTok, b)
+	n := len(r.extTok)
+	switch {
+	case n <= 5 && string(r.extTok) == "{ext "[:n]:
+		return true, nil
+	case n > 5 && n < 14 && strings.IndexByte("0123456789abcdef", b) >= 0:
+		return true, nil
+	case n == 14 && b == '}':
+		var operand uint32
+		fmt.Sscanf(string(r.extTok), extToken, &operand)
+		r.extTok = nil
+		r.known = false
+		r.clearDup()
+		in, _ := extInstruction(uint64(operand))
+		switch in.Op {
+		case OpDict, OpMacro, OpRet, OpCall:
+			if r.PBrain && r.Calls {
+				return true, &PosError{r.extAt, fmt.Errorf("pbrain: %v extension token with Calls", in.Op)}
 			}
 		}
+		r.push(in)
+		return true, nil
 	}
-	return len(p), nil
+	// not a token after all, but ordinary comment characters
+	r.extTok = nil
+	if n > 1 && r.ignored.Offset < 0 && len(r.calls) == 0 {
+		r.ignored = r.extAt
+	}
+	return false, nil
 }
 
-func (r *FromBF) clearDup() {
-	if r.dup > 9 {
-		r.writeNibble(8 | r.last)
-		if r.half {
-			r.writeNibble(14)
+func isPBrain(b byte) bool {
+	return b == '(' || b == ')' || b == ':'
+}
+
+// track updates the statically known value of the current cell.
+func (r *FromBF) track(b byte) {
+	switch b {
+	case '+':
+		r.val++
+	case '-':
+		r.val--
+	case '>', '<', ',', '[', '^':
+		r.known = false
+	case ']':
+		r.known, r.val = true, 0
+	}
+}
+
+// procedure handles pbrain '(', ')' and ':' outside of procedure definitions.
+func (r *FromBF) procedure(b byte) error {
+	if b == ')' {
+		return r.errorf("pbrain: unexpected ')' outside of procedure definition")
+	}
+	if !r.known {
+		return r.errorf("pbrain: procedure number at '%c' is not statically known", b)
+	}
+	if b == '(' {
+		if r.procs == nil {
+			r.procs = make(map[byte][]byte)
 		}
-		r.wr.Write(uint32bytes(r.dup))
-	} else {
-		for i := uint32(0); i < r.dup; i++ {
-			r.writeNibble(r.last)
+		r.defining, r.procID, r.proc, r.defAt = true, r.val, nil, r.at
+		return nil
+	}
+	body, ok := r.procs[r.val]
+	if !ok {
+		return r.errorf("pbrain: procedure %d is not defined", r.val)
+	}
+	if r.Calls {
+		r.clearDup()
+		r.push(Instruction{Op: OpCall, Arg: uint64(r.defOf[r.val])})
+		r.known = false
+		return nil
+	}
+	for _, id := range r.calls {
+		if id == r.val {
+			return r.errorf("pbrain: recursive call to procedure %d cannot be inlined", id)
 		}
 	}
+	r.calls = append(r.calls, r.val)
+	var err error
+	for i := 0; i < len(body) && err == nil; i++ {
+		err = r.writeByte(body[i])
+	}
+	r.calls = r.calls[:len(r.calls)-1]
+	return err
+}
+
+// define converts the procedure just defined for Calls, starting with
+// its number in the current cell, as it is when it is called.
+func (r *FromBF) define() error {
+	if len(r.defs) == 0xffffff {
+		return r.errorf("pbrain: more than %d procedure definitions", len(r.defs))
+	}
+	if r.defOf == nil {
+		r.defOf = make(map[byte]int)
+	}
+	r.defOf[r.procID] = len(r.defs)
+	pending, last, dup, opens, known, val := r.pending, r.last, r.dup, r.opens, r.known, r.val
+	r.pending, r.dup, r.opens, r.known, r.val = nil, 0, nil, true, r.procID
+	r.calls = append(r.calls, r.procID)
+	body := r.procs[r.procID]
+	var err error
+	for i := 0; i < len(body) && err == nil; i++ {
+		err = r.writeByte(body[i])
+	}
+	if err == nil && r.tapeSel {
+		err = r.switchTape()
+	}
+	if err == nil && len(r.opens) > 0 {
+		err = r.errorf("pbrain: unmatched '[' in procedure %d", r.procID)
+	}
+	r.clearDup()
+	r.extTok = nil
+	r.defs = append(r.defs, r.pending)
+	r.defSize += len(r.pending)
+	r.calls = r.calls[:len(r.calls)-1]
+	r.pending, r.last, r.dup, r.opens, r.known, r.val = pending, last, dup, opens, known, val
+	return err
+}
+
+// switchTape emits the tape switch being read.
+func (r *FromBF) switchTape() error {
+	r.tapeSel = false
+	if r.tape > 0xffffff {
+		return &PosError{r.tapeAt, fmt.Errorf("tape number exceeds 24 bits")}
+	}
+	r.push(Instruction{Op: OpTape, Arg: r.tape})
+	return nil
+}
+
+func (r *FromBF) clearDup() {
+	if r.dup > 0 {
+		r.push(Instruction{Op: Op(r.last), Arg: r.dup})
+	}
 	r.dup = 0
 }
 
+// pendingSize is about the memory of an instruction kept for Optimize.
+const pendingSize = 32
+
+// buffered returns the bytes buffered, as limited by MaxBuffer.
+func (r *FromBF) buffered() int {
+	return r.wr.Len() + (len(r.pending)+r.defSize)*pendingSize + len(r.proc) + r.procSize
+}
+
+// push emits the instruction, or keeps it until Close if optimizing,
+// aligning or calling procedures, which go before it.
+func (r *FromBF) push(in Instruction) {
+	if r.Optimize || r.Compress == CompressAligned || r.PBrain && r.Calls {
+		r.pending = append(r.pending, in)
+	} else {
+		r.emit(in)
+	}
+}
+
+func (r *FromBF) emit(in Instruction) {
+	switch in.Op {
+	case OpAdd, OpSub, OpRight, OpLeft:
+		if r.compress(in.Arg) {
+			r.emitRun(in.Op, in.Arg)
+			return
+		}
+		for i := uint64(0); i < in.Arg; i++ {
+			r.writeNibble(byte(in.Op))
+		}
+	case OpOpen, OpClose:
+		r.writeSpecial(byte(in.Op), 0)
+	case OpOut, OpIn:
+		if !r.CompressIO || in.Arg <= 9 {
+			for i := uint64(0); i < in.Arg; i++ {
+				r.writeNibble(byte(in.Op))
+			}
+			return
+		}
+		for n := in.Arg; n > 0; {
+			k := min(n, 0xffffff)
+			r.writeSpecial(7, uint64(extOperand(Instruction{Op: in.Op, Arg: k})))
+			n -= k
+		}
+	case OpSet, OpClear, OpMove, OpScan, OpTape, OpSyscall, OpExt, OpDict, OpMacro, OpRet, OpCall, OpAddAt, OpDebug, OpAssert, OpShift:
+		r.writeSpecial(7, uint64(extOperand(in)))
+	}
+}
+
+// CompressStrategy selects which runs FromBF compresses.
+type CompressStrategy int
+
+// Compression strategies.
+const (
+	// CompressByLength compresses runs longer than CompressThreshold.
+	CompressByLength CompressStrategy = iota
+	// CompressOptimal compresses a run if that takes fewer nibbles,
+	// counting the alignment no-op the special code needs where the
+	// run starts.
+	CompressOptimal
+	// CompressAligned keeps the instructions until Close, and chooses
+	// for all runs together whether to compress them, and whether to
+	// write a nibble of a compressed run apart, so that the fewest
+	// alignment no-ops are needed. It writes the fewest nibbles of the
+	// strategies.
+	CompressAligned
+)
+
+// compress reports whether a run of n commands is compressed.
+func (r *FromBF) compress(n uint64) bool {
+	if r.Compress == CompressOptimal {
+		special := 1 + 2*uint64(r.finalWidth())
+		if !r.half {
+			special++ // alignment no-op
+		}
+		return n > special
+	}
+	threshold := r.CompressThreshold
+	if threshold <= 0 {
+		threshold = 9
+	}
+	return n > uint64(threshold)
+}
+
+// finalWidth returns the operand width of the binary Close writes.
+func (r *FromBF) finalWidth() int {
+	if r.l.memsize <= math.MaxUint32 {
+		return 4 // Close narrows the container, unless operands are large
+	}
+	return r.l.width
+}
+
+// maxOperand returns the largest operand of the container being written.
+func (r *FromBF) maxOperand() uint64 {
+	if r.l.width == 4 {
+		return math.MaxUint32
+	}
+	return math.MaxUint64
+}
+
+// writeSpecial writes a special code with its operand,
+// aligning the operand with a no-op nibble if needed.
+func (r *FromBF) writeSpecial(code byte, operand uint64) {
+	r.writeNibble(8 | code)
+	if r.half {
+		r.writeNibble(8 | 6)
+	}
+	b := make([]byte, r.l.width)
+	r.l.putOperand(b, operand)
+	r.wr.Write(b)
+}
+
 func (r *FromBF) writeNibble(p byte) error {
 	if r.half {
 		r.half = false
@@ -287,60 +991,155 @@ func (r *FromBF) writeNibble(p byte) error {
 	}
 }
 
-// Close implements io.Closer interface.
+// Close implements io.Closer interface. A [ left unmatched is an error,
+// one PosError for each joined with errors.Join, as is a ] without a [
+// in Write, unless FixBrackets is set.
 func (r *FromBF) Close() error {
+	r.at = r.after
+	if r.defining {
+		return &PosError{r.defAt, fmt.Errorf("pbrain: unterminated procedure definition")}
+	}
+	if r.extTok != nil {
+		r.extTok = nil
+		if r.ignored.Offset < 0 {
+			r.ignored = r.extAt
+		}
+	}
+	r.flushIgnored()
+	if r.tapeSel {
+		if err := r.switchTape(); err != nil {
+			return err
+		}
+	}
+	if len(r.opens) > 0 && !r.FixBrackets {
+		errs := make([]error, len(r.opens))
+		for i, at := range r.opens {
+			errs[i] = &PosError{at, fmt.Errorf("unmatched '['")}
+		}
+		return errors.Join(errs...)
+	}
+	if r.defaultMem {
+		r.warn(WarnDefaultMemSize, "memsize is not set, using default %d", DefaultMemSize)
+	}
 	if r.dup > 0 {
 		r.clearDup()
 	}
+	for _, at := range r.opens {
+		r.warnAt(at, WarnUnclosedBracket, "unmatched '[' closed at the end")
+	}
+	for range r.opens {
+		r.push(Instruction{Op: OpClose})
+	}
+	r.opens = r.opens[:0]
+	ins := r.pending
+	if len(r.defs) > 0 {
+		dict := []Instruction{{Op: OpDict, Arg: uint64(len(r.defs))}}
+		for _, def := range r.defs {
+			dict = append(append(dict, def...), Instruction{Op: OpRet})
+		}
+		ins = append(dict, ins...)
+	}
+	if r.Optimize {
+		ins = Optimize(ins)
+	}
+	if r.Compress == CompressAligned {
+		r.emitAligned(ins)
+	} else {
+		for _, in := range ins {
+			r.emit(in)
+		}
+	}
 	if r.half {
 		r.writeNibble(8 | 6)
 	}
-	r.cacheJumpOff()
+	if r.l.version == Version2 {
+		if buf, ok := narrow(r.wr.Bytes()); ok {
+			r.wr = bytes.NewBuffer(buf)
+			r.l, _ = parseLayout(buf)
+		}
+	}
+	// jump operands are offsets, which must not wrap around
+	if n := uint64(r.wr.Len()); n > r.maxOperand() {
+		return r.errorf("MF code of %d bytes exceeds the 32-bit jump offsets of version 1, use NewBFReader64 for version 2", n)
+	}
+	if err := r.resolveCalls(); err != nil {
+		return err
+	}
+	if err := r.cacheJumpOff(); err != nil {
+		return err
+	}
+	if r.Progress != nil {
+		r.Progress(int64(r.base), int64(r.wr.Len()))
+	}
 	return nil
 }
 
-func (r *FromBF) cacheJumpOff() {
-	s := new(stack)
-	s.mem = make([]uint32, 1024)
+// resolveCalls writes the offsets of the procedures in the dictionary
+// as the operands of the calls of Calls, which hold their index in defs.
+func (r *FromBF) resolveCalls() error {
+	if len(r.defs) == 0 {
+		return nil
+	}
 	buf := r.wr.Bytes()
-	for i := 8; i < len(buf); i++ {
-		b := buf[i]
-		n1, n2 := b>>4, b&0xf
-		if n1 == 0xc || n2 == 0xc {
-			s.put(uint32(i))
-		} else if n1 == 0xd || n2 == 0xd {
-			jmp := s.get()
-			copy(buf[i+1:i+5], uint32bytes(jmp+5))
-			copy(buf[jmp+1:jmp+5], uint32bytes(uint32(i)+5))
+	var starts []uint64 // of the procedures, then of the code after them
+	var calls []int     // offsets of the calls
+	for pc, low := r.l.code, false; pc < len(buf); {
+		in, next, nextLow, err := decode(buf, r.l, pc, low, DecodeDefault)
+		if err != nil {
+			return err
 		}
-		if n1&8 == 8 || n2&8 == 8 {
-			i += 4
+		switch {
+		case in.Op == OpDict || in.Op == OpRet && len(starts) < len(r.defs):
+			starts = append(starts, uint64(next))
+		case in.Op == OpCall:
+			calls = append(calls, pc)
 		}
+		pc, low = next, nextLow
 	}
-	r.wrap.Write(buf)
-}
-
-type stack struct {
-	mem []uint32
-	off int
+	for _, pc := range calls {
+		operand := buf[pc+1 : pc+1+r.l.width]
+		at := starts[r.l.operand(operand)&0xffffff]
+		if at > 0xffffff {
+			return fmt.Errorf("pbrain: procedure at offset %d beyond the 24-bit operand of calls", at)
+		}
+		r.l.putOperand(operand, uint64(extOperand(Instruction{Op: OpCall, Arg: at})))
+	}
+	return nil
 }
 
-func (s *stack) put(n uint32) {
-	if len(s.mem) <= s.off {
-		s.mem = append(s.mem, make([]uint32, len(s.mem))...)
+// cacheJumpOff writes the jump operands of the brackets,
+// then the MF binary to the wrapped Writer.
+func (r *FromBF) cacheJumpOff() error {
+	buf := r.wr.Bytes()
+	w := r.l.width
+	loops := 0
+	for p, err := range JumpPairs(buf) {
+		if err != nil {
+			return err
+		}
+		open, close := p.Open.Offset, p.Close.Offset
+		r.l.putOperand(buf[close+1:close+1+w], uint64(open+1+w))
+		r.l.putOperand(buf[open+1:open+1+w], uint64(close+1+w))
+		logger(r.Logger).Debug("loop index pair", "open", open, "close", close)
+		loops++
 	}
-	s.mem[s.off] = n
-	s.off++
+	logger(r.Logger).Info("converted", "input", r.base, "size", len(buf), "version", r.l.version, "memsize", r.l.memsize, "loops", loops)
+	_, err := r.wrap.Write(buf)
+	return err
 }
 
-func (s *stack) get() uint32 {
-	s.off--
-	if s.off < 0 {
-		panic("invalid stack pointer: tried to get value from empty stack")
+var discard = slog.New(slog.DiscardHandler)
+
+// logger returns l, or a silent logger if l is nil.
+func logger(l *slog.Logger) *slog.Logger {
+	if l == nil {
+		return discard
 	}
-	return s.mem[s.off]
+	return l
 }
 
+// uint32bytes and bytesUint32 convert the memsize header field and
+// 32-bit operands of MF binaries, which are big-endian.
 func uint32bytes(n uint32) []byte {
 	return []byte{
 		byte(n >> 24),
@@ -349,3 +1148,7 @@ func uint32bytes(n uint32) []byte {
 		byte(n),
 	}
 }
+
+func bytesUint32(b []byte) uint32 {
+	return binary.BigEndian.Uint32(b)
+}
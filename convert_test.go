@@ -0,0 +1,101 @@
+package mf
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"os"
+	"slices"
+	"testing"
+)
+
+// TestToBFWrites checks that ToBF writes the same BF code however the
+// MF binary is split between Writes, and with or without a signature.
+func TestToBFWrites(t *testing.T) {
+	src, err := os.ReadFile("bf/hanoi.bf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prog := convertBF(t, string(src), 4096)
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := SignMF(prog, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	toBF := func(prog []byte, size int) []byte {
+		var bf bytes.Buffer
+		w := NewBFWriter(&bf)
+		for len(prog) > 0 {
+			n := min(size, len(prog))
+			if _, err := w.Write(prog[:n]); err != nil {
+				t.Fatal(err)
+			}
+			prog = prog[n:]
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return bf.Bytes()
+	}
+	want := toBF(prog, len(prog))
+	for _, size := range []int{1, 2, 3, 7, 100} {
+		if got := toBF(prog, size); !bytes.Equal(got, want) {
+			t.Errorf("Writes of %d bytes: BF differs from a single Write", size)
+		}
+		if got := toBF(signed, size); !bytes.Equal(got, want) {
+			t.Errorf("signed, Writes of %d bytes: BF differs from unsigned", size)
+		}
+	}
+}
+
+// TestPushScanner checks that a Scanner given its input with Write
+// scans the tokens it scans reading the input, however it is split.
+func TestPushScanner(t *testing.T) {
+	src, err := os.ReadFile("bf/hanoi.bf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := SignMF(convertBF(t, string(src), 4096), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, in := range [][]byte{src, signed} {
+		var want []Token
+		s := NewScanner(bytes.NewReader(in))
+		for s.Scan() {
+			want = append(want, s.Token())
+		}
+		if s.Err() != nil {
+			t.Fatal(s.Err())
+		}
+		for _, size := range []int{1, 3, 100} {
+			var got []Token
+			s := NewPushScanner()
+			for p := in; ; p = p[min(size, len(p)):] {
+				if len(p) == 0 {
+					s.Close()
+				} else {
+					s.Write(p[:min(size, len(p))])
+				}
+				for s.Scan() {
+					got = append(got, s.Token())
+				}
+				if s.Err() != nil {
+					t.Fatal(s.Err())
+				}
+				if len(p) == 0 {
+					break
+				}
+			}
+			if !slices.Equal(got, want) {
+				t.Errorf("Writes of %d bytes: %d tokens, want %d", size, len(got), len(want))
+			}
+		}
+	}
+}
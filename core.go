@@ -0,0 +1,92 @@
+package mf
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Core is a core dump: the state of a VM when it faulted,
+// for analyzing failures after the fact.
+type Core struct {
+	Reason string
+	PC     int  // offset of the faulting instruction
+	Low    bool // whether the fault is at the low nibble of PC
+	Steps  int64
+	Tape   uint64            // current tape number
+	Tapes  map[uint64][]byte // cells of every tape
+	Ptrs   map[uint64]int    // pointer of every tape
+	Calls  []int             // return offsets of the running macros and calls
+	Prog   []byte
+}
+
+// coreFormat identifies core dump files.
+const coreFormat = "mfcore/1"
+
+// Core returns a core dump of the VM, which faulted with err.
+func (v *VM) Core(err error) *Core {
+	c := &Core{
+		Reason: err.Error(),
+		PC:     v.pc,
+		Low:    v.low,
+		Steps:  v.steps,
+		Tape:   v.cur,
+		Tapes:  map[uint64][]byte{v.cur: bytes.Clone(v.tape)},
+		Ptrs:   map[uint64]int{v.cur: v.ptr},
+		Calls:  v.calls,
+		Prog:   v.prog,
+	}
+	for n, t := range v.tapes {
+		c.Tapes[n], c.Ptrs[n] = bytes.Clone(t.cells), t.ptr
+	}
+	return c
+}
+
+// Write writes the core dump to w.
+func (c *Core) Write(w io.Writer) error {
+	return json.NewEncoder(w).Encode(struct {
+		Format string
+		*Core
+	}{coreFormat, c})
+}
+
+// ReadCore reads a core dump written by Core.Write.
+func ReadCore(r io.Reader) (*Core, error) {
+	var f struct {
+		Format string
+		*Core
+	}
+	if err := json.NewDecoder(r).Decode(&f); err != nil {
+		return nil, fmt.Errorf("invalid core dump: %v", err)
+	}
+	if f.Format != coreFormat || f.Core == nil {
+		return nil, fmt.Errorf("invalid core dump: format %q", f.Format)
+	}
+	return f.Core, nil
+}
+
+// VM returns a VM with the state of the core dump, paused at the
+// faulting instruction, so it can be inspected or stepped again.
+func (c *Core) VM() (*VM, error) {
+	v, err := NewVM(c.Prog)
+	if err != nil {
+		return nil, err
+	}
+	cells, ok := c.Tapes[c.Tape]
+	if !ok || len(cells) != len(v.tape) {
+		return nil, fmt.Errorf("invalid core dump: bad tape %d", c.Tape)
+	}
+	v.pc, v.low, v.steps, v.cur = c.PC, c.Low, c.Steps, c.Tape
+	v.tape, v.ptr = bytes.Clone(cells), c.Ptrs[c.Tape]
+	v.calls = c.Calls
+	for n, cells := range c.Tapes {
+		if n != c.Tape {
+			if v.tapes == nil {
+				v.tapes = make(map[uint64]*tape)
+			}
+			v.tapes[n] = &tape{bytes.Clone(cells), c.Ptrs[n]}
+		}
+	}
+	return v, nil
+}
@@ -0,0 +1,237 @@
+package mf
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Event is why a Debugger paused.
+type Event int
+
+// Debugger events.
+const (
+	EventStep  Event = iota // the requested steps were executed
+	EventBreak              // a breakpoint was reached
+	EventEnd                // the program ended
+	EventWatch              // a watchpoint was hit, see Debugger.Hit
+)
+
+func (e Event) String() string {
+	switch e {
+	case EventStep:
+		return "step"
+	case EventBreak:
+		return "breakpoint"
+	case EventEnd:
+		return "end"
+	case EventWatch:
+		return "watchpoint"
+	}
+	return fmt.Sprintf("Event(%d)", int(e))
+}
+
+// Debugger runs a VM under control. It pauses at breakpoints, and lets
+// the state of the paused VM be inspected and changed.
+type Debugger struct {
+	VM *VM
+
+	breaks map[CodePos]*Cond // nil for unconditional breakpoints
+	hit    WatchHit
+}
+
+// NewDebugger returns a Debugger of v, paused before its next instruction.
+func NewDebugger(v *VM) *Debugger {
+	return &Debugger{VM: v, breaks: make(map[CodePos]*Cond)}
+}
+
+// Break sets a breakpoint at the instruction at at, which may be in
+// the low nibble of a byte, as the disassembly lists them. It is an
+// error if no instruction starts there, as the breakpoint would never
+// pause.
+func (d *Debugger) Break(at CodePos) error {
+	return d.BreakIf(at, nil)
+}
+
+// BreakIf sets a breakpoint at at which only pauses when c holds.
+// A nil c makes it unconditional.
+func (d *Debugger) BreakIf(at CodePos, c *Cond) error {
+	if !d.starts(at) {
+		return fmt.Errorf("no instruction at 0x%v", at)
+	}
+	d.breaks[at] = c
+	return nil
+}
+
+// starts reports whether an instruction of the code starts at at.
+func (d *Debugger) starts(at CodePos) bool {
+	v := d.VM
+	if at.Offset < v.l.code || at.Offset >= v.size {
+		return false
+	}
+	if v.index != nil {
+		return v.index[2*at.Offset+lowBit(at.Low)] >= 0
+	}
+	for pc, low := v.l.code, false; pc <= at.Offset; {
+		if pc == at.Offset && low == at.Low {
+			return true
+		}
+		_, next, nextLow, err := v.decodeAt(pc, low, v.Mode)
+		if err != nil {
+			return false
+		}
+		pc, low = next, nextLow
+	}
+	return false
+}
+
+// Condition returns the condition of the breakpoint at at,
+// or nil if it is unconditional.
+func (d *Debugger) Condition(at CodePos) *Cond {
+	return d.breaks[at]
+}
+
+// Delete deletes the breakpoint at at.
+func (d *Debugger) Delete(at CodePos) {
+	delete(d.breaks, at)
+}
+
+// Breakpoints returns the breakpoint positions in order.
+func (d *Debugger) Breakpoints() []CodePos {
+	pcs := make([]CodePos, 0, len(d.breaks))
+	for at := range d.breaks {
+		pcs = append(pcs, at)
+	}
+	sort.Slice(pcs, func(i, j int) bool {
+		if pcs[i].Offset != pcs[j].Offset {
+			return pcs[i].Offset < pcs[j].Offset
+		}
+		return !pcs[i].Low && pcs[j].Low
+	})
+	return pcs
+}
+
+// Step executes up to n instructions, stopping early
+// at breakpoints after the first one and at the end.
+func (d *Debugger) Step(n int) (Event, error) {
+	for i := 0; i < n; i++ {
+		if ev, err := d.step(i == 0); ev != EventStep || err != nil {
+			return ev, err
+		}
+	}
+	return EventStep, nil
+}
+
+// Continue executes until a breakpoint, the end or a fault.
+// A breakpoint at the paused instruction doesn't stop it.
+func (d *Debugger) Continue() (Event, error) {
+	for first := true; ; first = false {
+		if ev, err := d.step(first); ev != EventStep || err != nil {
+			return ev, err
+		}
+	}
+}
+
+// step executes an instruction, unless the VM is at a breakpoint
+// and first is false.
+func (d *Debugger) step(first bool) (Event, error) {
+	v := d.VM
+	if v.Done() {
+		return EventEnd, nil
+	}
+	if c, ok := d.breaks[CodePos{v.pc, v.low}]; ok && !first {
+		if c == nil {
+			return EventBreak, nil
+		}
+		hold, err := c.Eval(v)
+		if err != nil {
+			return EventBreak, fmt.Errorf("breakpoint at 0x%v: %w", CodePos{v.pc, v.low}, err)
+		}
+		if hold {
+			return EventBreak, nil
+		}
+	}
+	v.hit = nil
+	if err := v.Step(); err != nil {
+		return EventStep, err
+	}
+	if v.hit != nil {
+		d.hit = *v.hit
+		return EventWatch, nil
+	}
+	return EventStep, nil
+}
+
+// Watch sets a watchpoint on cells lo through hi of the current tape,
+// which pauses the debugger after an instruction accessing them.
+// Write watchpoints only break when a cell value changes.
+func (d *Debugger) Watch(lo, hi int, kind WatchKind) error {
+	v := d.VM
+	if lo < 0 || hi < lo || hi >= len(v.tape) {
+		return fmt.Errorf("cells %d-%d out of bounds", lo, hi)
+	}
+	if kind&WatchAccess == 0 {
+		return fmt.Errorf("invalid watchpoint kind %d", kind)
+	}
+	v.watches = append(v.watches, Watchpoint{lo, hi, v.cur, kind})
+	return nil
+}
+
+// Watchpoints returns the watchpoints, numbered by their index.
+func (d *Debugger) Watchpoints() []Watchpoint {
+	return d.VM.watches
+}
+
+// Unwatch deletes watchpoint i.
+func (d *Debugger) Unwatch(i int) error {
+	if i < 0 || i >= len(d.VM.watches) {
+		return fmt.Errorf("no watchpoint %d", i)
+	}
+	d.VM.watches = append(d.VM.watches[:i:i], d.VM.watches[i+1:]...)
+	return nil
+}
+
+// Hit returns the watchpoint hit of the last EventWatch.
+func (d *Debugger) Hit() WatchHit {
+	return d.hit
+}
+
+// Record makes the VM record up to n executed instructions, so that
+// Back can undo them. n <= 0 stops recording and discards the record.
+func (d *Debugger) Record(n int) {
+	d.VM.journal = nil
+	if n > 0 {
+		d.VM.journal = newJournal(n)
+	}
+}
+
+// Back undoes up to n recorded instructions, and returns the number
+// undone. Input read and output written are not undone, nor are effects
+// of syscalls other than on cells of the current tape.
+func (d *Debugger) Back(n int) (int, error) {
+	j := d.VM.journal
+	if j == nil {
+		return 0, fmt.Errorf("not recording")
+	}
+	for i := 0; i < n; i++ {
+		u, ok := j.pop()
+		if !ok {
+			return i, nil
+		}
+		d.VM.restore(u)
+	}
+	return n, nil
+}
+
+// SetCell sets cell i of the current tape.
+func (d *Debugger) SetCell(i int, val byte) error {
+	if i < 0 || i >= len(d.VM.tape) {
+		return fmt.Errorf("cell %d out of bounds", i)
+	}
+	d.VM.tape[i] = val
+	return nil
+}
+
+// SetPtr moves the pointer of the current tape.
+func (d *Debugger) SetPtr(ptr int) error {
+	return d.VM.SetPtr(ptr)
+}
@@ -0,0 +1,48 @@
+package mf
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+// TestBreakLowNibble checks that breakpoints pause at instructions in
+// low nibbles, and that those where no instruction starts are rejected.
+func TestBreakLowNibble(t *testing.T) {
+	// 8: + >, 9: + [ and its operand, e: - ] and its operand, 13: < .
+	prog := convertBF(t, "+>+[-]<.", 16)
+	v, err := NewVM(prog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.In, v.Out = strings.NewReader(""), io.Discard
+	d := NewDebugger(v)
+	for _, at := range []CodePos{{0xa, false}, {0xd, true}, {7, false}, {0x14, false}} {
+		if err := d.Break(at); err == nil {
+			t.Errorf("breakpoint at %v: no error", at)
+		}
+	}
+	cell := func() *Cond {
+		c, err := ParseCond("cell == 0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}()
+	if err := d.BreakIf(CodePos{0xe, true}, cell); err != nil {
+		t.Fatal(err)
+	}
+	for _, at := range []CodePos{{9, true}, {0x13, true}} {
+		if err := d.Break(at); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []CodePos{{9, true}, {0xe, true}, {0x13, true}} {
+		if ev, err := d.Continue(); ev != EventBreak || err != nil {
+			t.Fatalf("Continue = %v, %v; want a breakpoint at %v", ev, err, want)
+		}
+		if pc, low := v.PC(); (CodePos{pc, low}) != want {
+			t.Errorf("paused at %v, want %v", CodePos{pc, low}, want)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package mf
+
+import "sort"
+
+// Change is an instruction-level difference found by Diff.
+type Change struct {
+	// Del is true if Ins is only in the first program,
+	// and false if it is only in the second one.
+	Del bool
+	Ins Instruction
+
+	// Other is the byte offset of the change in the other program: of
+	// the instruction there that Ins comes before, or of the end of its
+	// code if none does.
+	Other int
+}
+
+// maxDiffCost bounds the edit distance Diff searches for. Beyond it,
+// the differing middle part is reported as a whole.
+const maxDiffCost = 4096
+
+// Diff decodes two MF binaries and returns the instruction-level
+// differences between them, in program order.
+//
+// Pure encoding differences are ignored: alignment no-ops are skipped,
+// adjacent runs of the same operation are merged, and jumps are
+// compared by the relative position of their target instruction.
+func Diff(a, b []byte) ([]Change, error) {
+	ia, err := DecodeMF(a)
+	if err != nil {
+		return nil, err
+	}
+	ib, err := DecodeMF(b)
+	if err != nil {
+		return nil, err
+	}
+	ia, ib = normalize(ia), normalize(ib)
+	ka, kb := diffKeys(ia), diffKeys(ib)
+
+	// offset returns the offset of instruction i of ins of prog,
+	// or of the end of its code.
+	offset := func(prog []byte, ins []Instruction, i int) int {
+		if i < len(ins) {
+			return ins[i].Offset
+		}
+		prog, _ = SplitSignature(prog)
+		return len(prog)
+	}
+	var changes []Change
+	dels, adds := 0, 0 // before the edit, which shift the other program
+	for _, e := range editScript(ka, kb) {
+		if e.del {
+			changes = append(changes, Change{Del: true, Ins: ia[e.i], Other: offset(b, ib, e.i-dels+adds)})
+			dels++
+		} else {
+			changes = append(changes, Change{Ins: ib[e.i], Other: offset(a, ia, e.i-adds+dels)})
+			adds++
+		}
+	}
+	return changes, nil
+}
+
+// normalize merges adjacent runs of the same operation.
+func normalize(ins []Instruction) []Instruction {
+	out := make([]Instruction, 0, len(ins))
+	for _, in := range ins {
+		if n := len(out); n > 0 && out[n-1].Op == in.Op && in.Op != OpOpen && in.Op != OpClose && in.Op <= OpIn {
+			out[n-1].Arg += in.Arg
+			continue
+		}
+		out = append(out, in)
+	}
+	return out
+}
+
+type diffKey struct {
+	op  Op
+	arg int64
+}
+
+// diffKeys returns comparison keys for instructions, with jump positions
+// replaced by the distance to the target instruction.
+func diffKeys(ins []Instruction) []diffKey {
+	keys := make([]diffKey, len(ins))
+	for i, in := range ins {
+		keys[i] = diffKey{in.Op, int64(in.Arg)}
+		if in.Op == OpOpen || in.Op == OpClose {
+			j := sort.Search(len(ins), func(j int) bool { return ins[j].Offset >= int(in.Arg) })
+			keys[i].arg = int64(j - i)
+		}
+	}
+	return keys
+}
+
+type edit struct {
+	del bool
+	i   int // index into the first sequence if del, else the second
+}
+
+// editScript returns a shortest edit script from a to b,
+// using Myers' algorithm on the part between common prefix and suffix.
+func editScript(a, b []diffKey) []edit {
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+	a, b = a[pre:len(a)-suf], b[pre:len(b)-suf]
+
+	n, m := len(a), len(b)
+	max := n + m
+	if max > maxDiffCost {
+		max = maxDiffCost
+	}
+	v := make([]int, 2*max+2)
+	var trace [][]int
+	found := false
+	for d := 0; d <= max && !found; d++ {
+		trace = append(trace, append([]int(nil), v...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || k != d && v[max+k-1] < v[max+k+1] {
+				x = v[max+k+1]
+			} else {
+				x = v[max+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x, y = x+1, y+1
+			}
+			v[max+k] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+	}
+
+	var edits []edit
+	if !found {
+		for i := range a {
+			edits = append(edits, edit{true, pre + i})
+		}
+		for i := range b {
+			edits = append(edits, edit{false, pre + i})
+		}
+		return edits
+	}
+	x, y := n, m
+	for d := len(trace) - 1; d > 0; d-- {
+		v := trace[d]
+		k := x - y
+		var pk int
+		if k == -d || k != d && v[max+k-1] < v[max+k+1] {
+			pk = k + 1
+		} else {
+			pk = k - 1
+		}
+		px := v[max+pk]
+		py := px - pk
+		for x > px && y > py {
+			x, y = x-1, y-1
+		}
+		if x == px {
+			edits = append(edits, edit{false, pre + py})
+		} else {
+			edits = append(edits, edit{true, pre + px})
+		}
+		x, y = px, py
+	}
+	for i, j := 0, len(edits)-1; i < j; i, j = i+1, j-1 {
+		edits[i], edits[j] = edits[j], edits[i]
+	}
+	return edits
+}
@@ -0,0 +1,26 @@
+package mf
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestDiffOther(t *testing.T) {
+	// a: 8: + >, 9: + [, e: - ], 13: < .
+	// b: 8: + >, 9: + +, a: [, f: - ], 14: < ,, 15: . >
+	a := convertBF(t, "+>+[-]<.", 16)
+	b := convertBF(t, "+>++[-]<,.>", 16)
+	changes, err := Diff(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Change{
+		{Del: true, Ins: Instruction{Op: OpAdd, Arg: 1, Offset: 9}, Other: 9},
+		{Ins: Instruction{Op: OpAdd, Arg: 2, Offset: 9}, Other: 9},
+		{Ins: Instruction{Op: OpIn, Arg: 1, Offset: 0x14}, Other: 0x13},
+		{Ins: Instruction{Op: OpRight, Arg: 1, Offset: 0x15}, Other: 0x14},
+	}
+	if !slices.Equal(changes, want) {
+		t.Errorf("Diff = %+v, want %+v", changes, want)
+	}
+}
@@ -0,0 +1,105 @@
+package mf
+
+import (
+	"fmt"
+	"io"
+)
+
+// Disassemble writes the instructions of an MF binary around the one
+// at byte offset pc, and its low nibble if low is true, with context
+// instructions before and after it. The instruction is marked with "=>".
+// Alignment no-ops are skipped.
+func Disassemble(w io.Writer, prog []byte, pc int, low bool, context int) error {
+	prog, l, err := parseProg(prog)
+	if err != nil {
+		return err
+	}
+	type line struct {
+		pc  int
+		low bool
+		in  Instruction
+	}
+	var lines []line
+	mark := -1
+	for at, atLow := l.code, false; at < len(prog); {
+		in, next, nextLow, err := decode(prog, l, at, atLow, DecodeDefault)
+		if err != nil {
+			return err
+		}
+		if at == pc && (atLow == low || in.Op == OpNop) && mark < 0 {
+			mark = len(lines)
+		}
+		if in.Op != OpNop {
+			lines = append(lines, line{at, atLow, in})
+		}
+		at, atLow = next, nextLow
+	}
+	if mark < 0 {
+		return fmt.Errorf("no instruction at offset %d", pc)
+	}
+	for i := max(mark-context, 0); i < min(mark+context+1, len(lines)); i++ {
+		prefix, nibble := "  ", ""
+		if i == mark {
+			prefix = "=>"
+		}
+		if lines[i].low {
+			nibble = ".5"
+		}
+		if _, err := fmt.Fprintf(w, "%s %08x%-2s  %v\n", prefix, lines[i].pc, nibble, lines[i].in); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HotShare is the share of steps from which DisassembleProfile
+// marks a loop as hot.
+const HotShare = 0.1
+
+// DisassembleProfile writes all instructions of an MF binary. If p is
+// not nil, each line starts with its execution count, and the [ of every
+// loop taking at least HotShare of the steps is marked with its rank and
+// share. Alignment no-ops are skipped.
+func DisassembleProfile(w io.Writer, prog []byte, p *Profile) error {
+	prog, l, err := parseProg(prog)
+	if err != nil {
+		return err
+	}
+	marks := make(map[int]string)
+	if p != nil {
+		loops, err := HotLoops(prog, p)
+		if err != nil {
+			return err
+		}
+		for i, h := range loops {
+			if h.Share < HotShare {
+				break
+			}
+			marks[h.Offset] = fmt.Sprintf("  ; hot loop #%d, %.1f%% of steps", i+1, 100*h.Share)
+		}
+	}
+	for at, atLow := l.code, false; at < len(prog); {
+		in, next, nextLow, err := decode(prog, l, at, atLow, DecodeDefault)
+		if err != nil {
+			return err
+		}
+		pos := CodePos{at, atLow}
+		at, atLow = next, nextLow
+		if in.Op == OpNop {
+			continue
+		}
+		nibble := ""
+		if pos.Low {
+			nibble = ".5"
+		}
+		if p != nil {
+			_, err = fmt.Fprintf(w, "%12d  %08x%-2s  %v%s\n", p.Counts[pos], pos.Offset, nibble, in, marks[pos.Offset])
+		} else {
+			_, err = fmt.Fprintf(w, "%08x%-2s  %v\n", pos.Offset, nibble, in)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
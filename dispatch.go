@@ -0,0 +1,250 @@
+package mf
+
+import (
+	"fmt"
+	"math"
+)
+
+// op is an instruction decoded at load, with what runOps needs to run it
+// without looking up offsets.
+type op struct {
+	in      Instruction
+	low     bool // whether in is at the low nibble of in.Offset
+	next    int  // offset of the next instruction
+	nextLow bool
+	skip    int32 // ops index of the next instruction other than a no-op
+	jump    int32 // ops index where a bracket jumps to, or -1
+	delta   byte  // added to the cell by + and -
+	move    int   // added to the pointer by > and <
+	super   superop
+	then    int32 // ops index after the superop
+}
+
+// superop is a pair of instructions run by runOps as one.
+type superop byte
+
+const (
+	superNone    superop = iota
+	superAddMove         // + or -, then > or <
+	superMoveAdd         // > or <, then + or -
+)
+
+// predecode decodes the code in the mode v.Mode, so that steps need not
+// decode instructions, and invalid code is found before it runs. Jumps
+// to the middle of an instruction are still decoded when taken.
+func (v *VM) predecode() error {
+	v.ops, v.index, v.opsMode = v.ops[:0], nil, v.Mode
+	if v.stream != nil || len(v.prog) > math.MaxInt32/2 {
+		return nil // streamed or too large to index, so decoded at each step
+	}
+	index := make([]int32, 2*len(v.prog))
+	for i := range index {
+		index[i] = -1
+	}
+	for pc, low := v.l.code, false; pc < len(v.prog); {
+		in, next, nextLow, err := decode(v.prog, v.l, pc, low, v.Mode)
+		if err != nil {
+			return err
+		}
+		in.Offset = pc
+		index[2*pc+lowBit(low)] = int32(len(v.ops))
+		v.ops = append(v.ops, op{in: in, low: low, next: next, nextLow: nextLow})
+		pc, low = next, nextLow
+	}
+	v.index = index
+
+	// real[i] is the first instruction other than a no-op from ops[i]
+	real := make([]int32, len(v.ops)+1)
+	real[len(v.ops)] = int32(len(v.ops))
+	for i := len(v.ops) - 1; i >= 0; i-- {
+		real[i] = int32(i)
+		if v.ops[i].in.Op == OpNop {
+			real[i] = real[i+1]
+		}
+	}
+	for i := range v.ops {
+		op := &v.ops[i]
+		op.skip, op.jump = real[i+1], -1
+		switch in := op.in; in.Op {
+		case OpAdd:
+			op.delta = byte(in.Arg)
+		case OpSub:
+			op.delta = -byte(in.Arg)
+		case OpRight:
+			op.move = int(min(in.Arg, math.MaxInt/2)) // out of bounds either way
+		case OpLeft:
+			op.move = -int(min(in.Arg, math.MaxInt/2))
+		case OpOpen, OpClose:
+			if in.Arg >= uint64(v.l.code) && in.Arg < uint64(len(v.prog)) {
+				if t := index[2*in.Arg]; t >= 0 {
+					op.jump = real[t]
+				}
+			}
+		}
+	}
+	for i := range v.ops {
+		op := &v.ops[i]
+		if int(op.skip) == len(v.ops) {
+			continue
+		}
+		second := &v.ops[op.skip]
+		isAdd := func(o Op) bool { return o == OpAdd || o == OpSub }
+		isMove := func(o Op) bool { return o == OpRight || o == OpLeft }
+		switch {
+		case isAdd(op.in.Op) && isMove(second.in.Op):
+			op.super, op.move = superAddMove, second.move
+		case isMove(op.in.Op) && isAdd(second.in.Op):
+			op.super, op.delta = superMoveAdd, second.delta
+		default:
+			continue
+		}
+		op.then = second.skip
+	}
+	return nil
+}
+
+// lowBit returns 1 for the low nibble of a byte, and 0 for the high one.
+func lowBit(low bool) int {
+	if low {
+		return 1
+	}
+	return 0
+}
+
+// opAt returns the ops index of the instruction at pc,
+// or -1 if the program has ended or pc is not at one.
+func (v *VM) opAt() int {
+	if v.Done() {
+		return -1
+	}
+	return int(v.index[2*v.pc+lowBit(v.low)])
+}
+
+// setOp moves pc to ops[i], or past the code if i is len(v.ops).
+func (v *VM) setOp(i int) {
+	if i == len(v.ops) {
+		last := &v.ops[i-1]
+		v.pc, v.low = last.next, last.nextLow
+		return
+	}
+	v.pc, v.low = v.ops[i].in.Offset, v.ops[i].low
+}
+
+// runOps executes up to n instructions, and returns how many it executed.
+// Without a Hook, a recording, a Profile or watchpoints, it runs the
+// predecoded code in a loop of its own, following the ops indexes of
+// the instructions rather than their offsets, skipping no-ops, and
+// running superops; otherwise it executes them with Step.
+//
+// The loop dispatches with a switch, which Go compiles to a jump table.
+// The benchmarks in dispatch_test.go compare it with a table of
+// functions, slower by a call per instruction, and a goto state
+// machine, about as fast but harder to follow.
+func (v *VM) runOps(n int) (int, error) {
+	if v.opsMode != v.Mode {
+		if err := v.predecode(); err != nil {
+			return 0, err
+		}
+	}
+	if v.Hook != nil || v.journal != nil || v.Profile != nil || len(v.watches) > 0 || v.index == nil {
+		k := 0
+		for ; k < n && !v.Done(); k++ {
+			if err := v.Step(); err != nil {
+				return k, err
+			}
+		}
+		return k, nil
+	}
+	limit := v.policy.MaxSteps
+	if limit <= 0 {
+		limit = math.MaxInt64
+	}
+	// the tape and pointer are kept in locals, and stored for the slow paths
+	tape, ptr, peak := v.tape, v.ptr, v.peak
+	defer func() { v.ptr, v.peak = ptr, max(v.peak, peak) }()
+	k, i := 0, v.opAt()
+	for k < n {
+		if i < 0 { // ended, or jumped into an instruction
+			if v.Done() {
+				return k, nil
+			}
+			v.ptr, v.peak = ptr, max(v.peak, peak)
+			err := v.Step()
+			tape, ptr = v.tape, v.ptr
+			if err != nil {
+				return k, err
+			}
+			k, i = k+1, v.opAt()
+			continue
+		}
+		if i == len(v.ops) {
+			v.setOp(i)
+			return k, nil
+		}
+		op := &v.ops[i]
+		if op.in.Op == OpNop {
+			i = int(op.skip)
+			continue
+		}
+		if v.steps >= limit {
+			v.setOp(i)
+			return k, fmt.Errorf("offset %d: %w: step limit %d exceeded", op.in.Offset, ErrLimit, limit)
+		}
+		if op.super != superNone && v.steps+1 < limit && k+1 < n {
+			if p := ptr + op.move; p >= 0 && p < len(tape) {
+				if op.super == superAddMove {
+					tape[ptr] += op.delta
+				} else {
+					tape[p] += op.delta
+				}
+				ptr, peak = p, max(peak, p)
+				v.steps, k, i = v.steps+2, k+2, int(op.then)
+				continue
+			}
+		}
+		v.steps++
+		k++
+		switch op.in.Op {
+		case OpAdd, OpSub:
+			tape[ptr] += op.delta
+			i = int(op.skip)
+			continue
+		case OpRight, OpLeft:
+			if p := ptr + op.move; p >= 0 && p < len(tape) {
+				ptr, peak = p, max(peak, p)
+				i = int(op.skip)
+				continue
+			}
+		case OpOpen:
+			if tape[ptr] != 0 {
+				i = int(op.skip)
+				continue
+			} else if op.jump >= 0 {
+				i = int(op.jump)
+				continue
+			}
+		case OpClose:
+			if tape[ptr] == 0 {
+				i = int(op.skip)
+				continue
+			} else if op.jump >= 0 {
+				i = int(op.jump)
+				continue
+			}
+		}
+		// everything else, and faults, as Step does
+		v.pc, v.low = op.next, op.nextLow
+		v.ptr, v.peak = ptr, max(v.peak, peak)
+		err := v.exec(op.in)
+		tape, ptr = v.tape, v.ptr
+		if err != nil {
+			v.pc, v.low = op.in.Offset, op.low // stay at the faulting instruction
+			return k, fmt.Errorf("offset %d: %w", op.in.Offset, err)
+		}
+		i = v.opAt()
+	}
+	if i >= 0 {
+		v.setOp(i) // pc is only kept up to date by the slow paths
+	}
+	return k, nil
+}
@@ -0,0 +1,264 @@
+package mf
+
+import (
+	"bytes"
+	"testing"
+)
+
+// The benchmarks compare ways of dispatching the predecoded code: the
+// switch of runOps, Step decoding every instruction, a table of
+// functions, and a goto state machine. The last two are kept here only
+// for the comparison; they run + - > < [ ] and superops as runOps does,
+// and leave anything else to exec.
+//
+//	go test -run '^$' -bench 'BenchmarkRun(Switch|Step|FuncTable|Goto)$'
+
+// benchSrc is BF code of nested counting loops, running about 300000
+// instructions of + - > < [ ].
+const benchSrc = "++++++++[>++++++++[>++++++++[>++++++++[>++++[-]<-]<-]<-]<-]"
+
+func benchDispatch(b *testing.B, run func(v *VM) error) {
+	var prog bytes.Buffer
+	r := NewBFReader(&prog, 16)
+	if _, err := r.Write([]byte(benchSrc)); err != nil {
+		b.Fatal(err)
+	}
+	if err := r.Close(); err != nil {
+		b.Fatal(err)
+	}
+	var steps int64
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		v, err := NewVM(prog.Bytes())
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := v.predecode(); err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+		if err := run(v); err != nil {
+			b.Fatal(err)
+		}
+		if !v.Done() {
+			b.Fatal("program did not end")
+		}
+		steps += v.steps
+	}
+	b.ReportMetric(float64(steps)/b.Elapsed().Seconds(), "instructions/s")
+}
+
+// TestDispatchAgree checks that the dispatchers compared by the
+// benchmarks run benchSrc the same.
+func TestDispatchAgree(t *testing.T) {
+	runs := map[string]func(v *VM) error{
+		"switch":     (*VM).Run,
+		"func table": runFuncTable,
+		"goto":       runGoto,
+	}
+	var prog bytes.Buffer
+	r := NewBFReader(&prog, 16)
+	r.Write([]byte(benchSrc))
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var want *VM
+	for _, name := range []string{"switch", "func table", "goto"} {
+		v, err := NewVM(prog.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := v.predecode(); err != nil {
+			t.Fatal(err)
+		}
+		if err := runs[name](v); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if want == nil {
+			want = v
+			continue
+		}
+		if v.steps != want.steps || v.ptr != want.ptr || !bytes.Equal(v.tape, want.tape) {
+			t.Errorf("%s: %d steps, pointer %d, tape % x; switch: %d steps, pointer %d, tape % x",
+				name, v.steps, v.ptr, v.tape, want.steps, want.ptr, want.tape)
+		}
+	}
+}
+
+func BenchmarkRunSwitch(b *testing.B) {
+	benchDispatch(b, (*VM).Run)
+}
+
+func BenchmarkRunStep(b *testing.B) {
+	benchDispatch(b, func(v *VM) error {
+		for !v.Done() {
+			if err := v.Step(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func BenchmarkRunFuncTable(b *testing.B) {
+	benchDispatch(b, runFuncTable)
+}
+
+func BenchmarkRunGoto(b *testing.B) {
+	benchDispatch(b, runGoto)
+}
+
+// tableState is the state of runFuncTable passed to the op functions.
+type tableState struct {
+	tape []byte
+	ptr  int
+	i    int // ops index of the next instruction
+}
+
+// opFuncs run an op, returning false to leave it to exec.
+var opFuncs [OpAssert + 1]func(s *tableState, op *op) bool
+
+func init() {
+	add := func(s *tableState, op *op) bool {
+		s.tape[s.ptr] += op.delta
+		s.i = int(op.skip)
+		return true
+	}
+	move := func(s *tableState, op *op) bool {
+		p := s.ptr + op.move
+		if p < 0 || p >= len(s.tape) {
+			return false
+		}
+		s.ptr, s.i = p, int(op.skip)
+		return true
+	}
+	jump := func(s *tableState, op *op) bool {
+		switch {
+		case (s.tape[s.ptr] != 0) == (op.in.Op == OpOpen):
+			s.i = int(op.skip)
+		case op.jump >= 0:
+			s.i = int(op.jump)
+		default:
+			return false
+		}
+		return true
+	}
+	opFuncs[OpAdd], opFuncs[OpSub] = add, add
+	opFuncs[OpRight], opFuncs[OpLeft] = move, move
+	opFuncs[OpOpen], opFuncs[OpClose] = jump, jump
+}
+
+// runFuncTable runs v to the end dispatching through opFuncs.
+func runFuncTable(v *VM) error {
+	s := &tableState{tape: v.tape, ptr: v.ptr, i: v.opAt()}
+	for s.i >= 0 && s.i < len(v.ops) {
+		op := &v.ops[s.i]
+		if op.in.Op == OpNop {
+			s.i = int(op.skip)
+			continue
+		}
+		if superStep(v, op, s.tape, &s.ptr, &s.i) {
+			continue
+		}
+		v.steps++
+		if f := opFuncs[op.in.Op]; f != nil && f(s, op) {
+			continue
+		}
+		v.ptr = s.ptr
+		if err := v.exec(op.in); err != nil {
+			return err
+		}
+		v.pc, v.low = op.next, op.nextLow
+		s.tape, s.ptr, s.i = v.tape, v.ptr, v.opAt()
+	}
+	v.ptr = s.ptr
+	v.setOp(len(v.ops))
+	return nil
+}
+
+// runGoto runs v to the end as a state machine of goto labels.
+func runGoto(v *VM) error {
+	tape, ptr, i := v.tape, v.ptr, v.opAt()
+	var o *op
+next:
+	if i < 0 || i >= len(v.ops) {
+		v.ptr = ptr
+		v.setOp(len(v.ops))
+		return nil
+	}
+	o = &v.ops[i]
+	if o.in.Op == OpNop {
+		i = int(o.skip)
+		goto next
+	}
+	if superStep(v, o, tape, &ptr, &i) {
+		goto next
+	}
+	v.steps++
+	switch o.in.Op {
+	case OpAdd, OpSub:
+		goto add
+	case OpRight, OpLeft:
+		goto move
+	case OpOpen:
+		goto open
+	case OpClose:
+		goto close
+	}
+	goto slow
+add:
+	tape[ptr] += o.delta
+	i = int(o.skip)
+	goto next
+move:
+	if p := ptr + o.move; p >= 0 && p < len(tape) {
+		ptr, i = p, int(o.skip)
+		goto next
+	}
+	goto slow
+open:
+	if tape[ptr] != 0 {
+		i = int(o.skip)
+		goto next
+	} else if o.jump >= 0 {
+		i = int(o.jump)
+		goto next
+	}
+	goto slow
+close:
+	if tape[ptr] == 0 {
+		i = int(o.skip)
+		goto next
+	} else if o.jump >= 0 {
+		i = int(o.jump)
+		goto next
+	}
+slow:
+	v.ptr = ptr
+	if err := v.exec(o.in); err != nil {
+		return err
+	}
+	v.pc, v.low = o.next, o.nextLow
+	tape, ptr, i = v.tape, v.ptr, v.opAt()
+	goto next
+}
+
+// superStep runs the superop o as runOps does, if it is one and stays
+// on the tape.
+func superStep(v *VM, o *op, tape []byte, ptr, i *int) bool {
+	if o.super == superNone {
+		return false
+	}
+	p := *ptr + o.move
+	if p < 0 || p >= len(tape) {
+		return false
+	}
+	if o.super == superAddMove {
+		tape[*ptr] += o.delta
+	} else {
+		tape[p] += o.delta
+	}
+	*ptr, *i = p, int(o.then)
+	v.steps += 2
+	return true
+}
@@ -0,0 +1,120 @@
+package mf
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Dump writes an annotated hexdump of an MF binary to w.
+// Each line shows the offset, the raw bytes of one code byte and its
+// operand, and the meaning of every nibble and operand.
+func Dump(w io.Writer, prog []byte) error {
+	prog, l, err := parseProg(prog)
+	if err != nil {
+		l = v1Layout // dump the rest as version 1 anyway
+	}
+	col := 3*(1+l.width) - 1
+	line := func(off int, raw []byte, format string, args ...any) error {
+		hex := make([]string, len(raw))
+		for i, b := range raw {
+			hex[i] = fmt.Sprintf("%02x", b)
+		}
+		_, err := fmt.Fprintf(w, "%08x  %-*s  %s\n", off, col, strings.Join(hex, " "), fmt.Sprintf(format, args...))
+		return err
+	}
+	if len(prog) < 8 {
+		return line(0, prog, "truncated header")
+	}
+	kind := "unknown magic"
+	switch string(prog[:4]) {
+	case Magic:
+		kind = "magic"
+	case BFMagic:
+		kind = "magic (BF-converted)"
+	}
+	if err := line(0, prog[:4], "%s", kind); err != nil {
+		return err
+	}
+	if l.version == Version2 {
+		if err := line(4, prog[4:8], "extended header"); err != nil {
+			return err
+		}
+		if err := line(8, prog[8:12], "version %d", l.version); err != nil {
+			return err
+		}
+		if err := line(12, prog[12:20], "memsize %d", l.memsize); err != nil {
+			return err
+		}
+	} else if err := line(4, prog[4:8], "memsize %d", bytesUint32(prog[4:8])); err != nil {
+		return err
+	}
+	for pc := l.code; pc < len(prog); {
+		n1, n2 := prog[pc]>>4, prog[pc]&0xf
+		var s int // position of the special nibble, if any
+		switch {
+		case n1&8 != 0 && n1 != 8|6:
+			s = 1
+		case n2&8 != 0 && n2 != 8|6:
+			s = 2
+		}
+		if s == 0 {
+			if err := line(pc, prog[pc:pc+1], "%s | %s", nibbleName(n1), nibbleName(n2)); err != nil {
+				return err
+			}
+			pc++
+			continue
+		}
+		end := min(pc+1+l.width, len(prog))
+		var desc string
+		if end-pc < 1+l.width {
+			desc = fmt.Sprintf("special %d, truncated operand", (prog[pc]>>(4*(2-s)))&7)
+		} else {
+			desc = specialName((prog[pc]>>(4*(2-s)))&7, l.operand(prog[pc+1:end]))
+		}
+		var err error
+		switch {
+		case s == 1 && n2 == 8|6:
+			err = line(pc, prog[pc:end], "%s | nop", desc)
+		case s == 1:
+			err = line(pc, prog[pc:end], "%s | (discarded %x)", desc, n2)
+		default:
+			err = line(pc, prog[pc:end], "%s | %s", nibbleName(n1), desc)
+		}
+		if err != nil {
+			return err
+		}
+		pc = end
+	}
+	return nil
+}
+
+// nibbleName describes a nibble without an operand.
+func nibbleName(n byte) string {
+	switch {
+	case n == 4 || n == 5:
+		return fmt.Sprintf("%c (undefined)", bf[n])
+	case n < 8:
+		return bf[n : n+1]
+	case n == 8|6:
+		return "nop"
+	}
+	return fmt.Sprintf("special %d", n&7)
+}
+
+// specialName describes a special code with its operand.
+func specialName(code byte, operand uint64) string {
+	switch code {
+	case 0, 1, 2, 3:
+		return fmt.Sprintf("%c x %d", bf[code], operand)
+	case 4, 5:
+		return fmt.Sprintf("%c -> 0x%x", bf[code], operand)
+	case 7:
+		in, err := extInstruction(operand)
+		if err != nil {
+			return fmt.Sprintf("ext 0x%x (invalid)", operand)
+		}
+		return in.String()
+	}
+	return fmt.Sprintf("special %d 0x%08x", code, operand)
+}
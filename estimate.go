@@ -0,0 +1,153 @@
+package mf
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// EstimateMFSize returns the size of the MF binary that FromBF from
+// NewBFReader writes for the BF code src with default options, without
+// converting it. The size is exact unless src has unbalanced brackets.
+func EstimateMFSize(src []byte) int {
+	size, half := v1Layout.code, false
+	nibble := func() {
+		if half {
+			size++
+		}
+		half = !half
+	}
+	special := func() {
+		nibble()
+		if half {
+			nibble() // alignment no-op
+		}
+		size += v1Layout.width
+	}
+	var last byte // '+' until the first command, as in FromBF
+	var dup uint64
+	flush := func() {
+		switch {
+		case dup > 9 && last < 4: // + - > <
+			for n := dup; n > 0; n -= min(n, math.MaxUint32) {
+				special()
+			}
+		default:
+			for i := uint64(0); i < dup; i++ {
+				nibble()
+			}
+		}
+		dup = 0
+	}
+	tok := 0 // length of the extension token being read
+	for _, b := range src {
+		if tok > 0 || b == '{' {
+			tok++
+			switch {
+			case tok <= 5 && b == "{ext "[tok-1]:
+				continue
+			case tok > 5 && tok < 14 && strings.IndexByte("0123456789abcdef", b) >= 0:
+				continue
+			case tok == 14 && b == '}':
+				tok = 0
+				flush()
+				special()
+				continue
+			}
+			tok = 0
+		}
+		switch b {
+		case '+', '-', '>', '<', '.', ',':
+			if t := byte(strings.IndexByte(bf, b)); t != last {
+				flush()
+				last = t
+			}
+			dup++
+		case '[', ']':
+			flush()
+			special()
+		}
+	}
+	flush()
+	if half {
+		nibble()
+	}
+	return size
+}
+
+// EstimateBFSize returns the size of the BF code that ToBF writes for
+// the MF binary prog with default options, without converting it.
+// It fails where the conversion would.
+func EstimateBFSize(prog []byte) (uint64, error) {
+	prog, l, err := parseProg(prog)
+	if err != nil {
+		return 0, err
+	}
+	ins, err := DecodeMF(prog)
+	if err != nil {
+		return 0, err
+	}
+	size := uint64(len("MinFuck compiled code\n"))
+	if string(prog[:4]) == Magic {
+		size += uint64(len(">>+>>+>>+>>+>")) + l.memsize + uint64(len("[[->>+<<]>+>-]<[<<]"))
+	}
+	// macros are written at each use
+	var macros []uint64
+	var entry, pending uint64
+	to := &size
+	for _, in := range ins {
+		switch in.Op {
+		case OpAdd, OpSub, OpRight, OpLeft, OpOut, OpIn:
+			*to += in.Arg
+		case OpOpen, OpClose:
+			*to++
+		case OpSet:
+			*to += 3 + in.Arg // [-]+++
+		case OpClear:
+			if in.Arg > 0 {
+				*to += 3 + 5*(in.Arg-1) // [-] >[-] <
+			}
+		case OpMove:
+			*to += 4 + 2*uint64(abs32(int32(in.Arg))) // [- > + < ]
+		case OpScan:
+			*to += 2 + uint64(abs32(int32(in.Arg))) // [ > ]
+		case OpShift:
+			*to += uint64(abs32(int32(in.Arg))) // >
+		case OpAddAt:
+			off, n := in.AddAt()
+			*to += 2*uint64(abs32(int32(off))) + min(uint64(n), 256-uint64(n)) // > + <
+		case OpTape:
+			return 0, &PosError{Pos{Offset: in.Offset}, fmt.Errorf("tape switch cannot be converted to BF")}
+		case OpSyscall, OpExt:
+			*to += uint64(len("{ext 01234567}"))
+		case OpDict:
+			pending = in.Arg
+			if pending > 0 {
+				to = &entry
+			}
+		case OpCall:
+			return 0, &PosError{Pos{Offset: in.Offset}, fmt.Errorf("call cannot be converted to BF")}
+		case OpRet:
+			if pending == 0 {
+				return 0, &PosError{Pos{Offset: in.Offset}, fmt.Errorf("return cannot be converted to BF")}
+			}
+			macros, entry = append(macros, entry), 0
+			if pending--; pending == 0 {
+				to = &size
+			}
+		case OpMacro:
+			if in.Arg >= uint64(len(macros)) {
+				return 0, &PosError{Pos{Offset: in.Offset}, fmt.Errorf("undefined macro %d", in.Arg)}
+			}
+			*to += macros[in.Arg]
+		}
+	}
+	return size, nil
+}
+
+func abs32(n int32) int64 {
+	if n < 0 {
+		return -int64(n)
+	}
+	return int64(n)
+}
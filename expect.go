@@ -0,0 +1,225 @@
+package mf
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultExpectTimeout is how long an expect line of an Expect script
+// waits without a timeout line.
+const DefaultExpectTimeout = 10 * time.Second
+
+// ErrExpect is wrapped by errors of Expect scripts whose program does
+// not write what they expect.
+var ErrExpect = errors.New("unexpected output")
+
+// Expect is a script of a session with an interactive program. A script
+// has a command on each line, with strings quoted as in Go:
+//
+//	expect "> "      wait until the program writes "> "
+//	send "42\n"      write "42\n" to the input of the program
+//	close            end the input
+//	expect eof       wait until the program ends
+//	timeout 5s       wait up to 5s for each expect line after
+//
+// Blank lines and lines starting with # are skipped. An expect line
+// matches the output after what the expect line before matched.
+type Expect struct {
+	// Echo, if set, receives the output of the program as it is written.
+	Echo io.Writer
+
+	lines []expectLine
+}
+
+// expectLine is a command of an Expect script.
+type expectLine struct {
+	n       int // line number
+	cmd     string
+	arg     string
+	timeout time.Duration
+}
+
+// ParseExpect reads an Expect script from r.
+func ParseExpect(r io.Reader) (*Expect, error) {
+	e := &Expect{}
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		cmd, arg, _ := strings.Cut(line, " ")
+		l := expectLine{n: n, cmd: cmd}
+		arg = strings.TrimSpace(arg)
+		var err error
+		switch {
+		case cmd == "close" && arg == "", cmd == "expect" && arg == "eof":
+			l.arg = arg
+		case cmd == "expect" || cmd == "send":
+			l.arg, err = strconv.Unquote(arg)
+		case cmd == "timeout":
+			l.timeout, err = time.ParseDuration(arg)
+		default:
+			err = fmt.Errorf("unknown command")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid %q: %v", n, line, err)
+		}
+		if cmd == "expect" && arg == "eof" {
+			l.cmd = "eof"
+		}
+		e.lines = append(e.lines, l)
+	}
+	return e, s.Err()
+}
+
+// Run runs the program of v, giving it input and checking its output
+// as the script says, and stops it when the script ends. It returns an
+// error wrapping ErrExpect if the program does not write what the script
+// expects in time, or the error VM.Run would have returned if it ends
+// earlier, or on an expect eof line.
+func (e *Expect) Run(v *VM) error {
+	in := &expectInput{}
+	in.cond.L = &in.mu
+	out := &expectOutput{echo: e.Echo, changed: make(chan struct{})}
+	v.In, v.Out = in, out
+
+	var stop atomic.Bool
+	ended := make(chan struct{})
+	var result error // of the program, once ended is closed
+	v.deadline = time.Time{}
+	if v.policy.Timeout > 0 {
+		v.deadline = time.Now().Add(v.policy.Timeout)
+	}
+	go func() {
+		defer close(ended)
+		for !v.Done() && !stop.Load() {
+			if result = v.run(DefaultQuantum); result != nil {
+				return
+			}
+		}
+	}()
+	defer func() {
+		stop.Store(true)
+		in.close()
+		<-ended
+	}()
+
+	timeout, pos := DefaultExpectTimeout, 0
+	for _, l := range e.lines {
+		switch l.cmd {
+		case "send":
+			in.write([]byte(l.arg))
+		case "close":
+			in.close()
+		case "timeout":
+			timeout = l.timeout
+		case "eof":
+			select {
+			case <-ended:
+				return result
+			case <-time.After(timeout):
+				return fmt.Errorf("line %d: %w: program did not end within %v", l.n, ErrExpect, timeout)
+			}
+		case "expect":
+			timer := time.NewTimer(timeout)
+			for {
+				got, changed := out.since(pos)
+				if i := bytes.Index(got, []byte(l.arg)); i >= 0 {
+					pos += i + len(l.arg)
+					break
+				}
+				select {
+				case <-changed:
+				case <-ended:
+					if got, _ = out.since(pos); bytes.Contains(got, []byte(l.arg)) {
+						continue // written before the end
+					}
+					err := fmt.Errorf("line %d: %w: program ended waiting for %q, after %q", l.n, ErrExpect, l.arg, got)
+					if result != nil {
+						err = fmt.Errorf("%w: %v", err, result)
+					}
+					return err
+				case <-timer.C:
+					got, _ = out.since(pos)
+					return fmt.Errorf("line %d: %w: waited %v for %q, after %q", l.n, ErrExpect, timeout, l.arg, got)
+				}
+			}
+			timer.Stop()
+		}
+	}
+	return nil
+}
+
+// expectInput is the input of a program run by an Expect script.
+type expectInput struct {
+	mu     sync.Mutex
+	cond   sync.Cond
+	buf    []byte
+	closed bool
+}
+
+func (in *expectInput) write(p []byte) {
+	in.mu.Lock()
+	in.buf = append(in.buf, p...)
+	in.mu.Unlock()
+	in.cond.Broadcast()
+}
+
+func (in *expectInput) close() {
+	in.mu.Lock()
+	in.closed = true
+	in.mu.Unlock()
+	in.cond.Broadcast()
+}
+
+// Read waits until the script sends input or closes it.
+func (in *expectInput) Read(p []byte) (int, error) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	for len(in.buf) == 0 && !in.closed {
+		in.cond.Wait()
+	}
+	if len(in.buf) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, in.buf)
+	in.buf = in.buf[n:]
+	return n, nil
+}
+
+// expectOutput is the output of a program run by an Expect script.
+type expectOutput struct {
+	mu      sync.Mutex
+	buf     []byte
+	echo    io.Writer
+	changed chan struct{} // closed on the next write
+}
+
+func (out *expectOutput) Write(p []byte) (int, error) {
+	out.mu.Lock()
+	out.buf = append(out.buf, p...)
+	close(out.changed)
+	out.changed = make(chan struct{})
+	out.mu.Unlock()
+	if out.echo != nil {
+		return out.echo.Write(p)
+	}
+	return len(p), nil
+}
+
+// since returns the output from pos, and a channel closed on the next
+// write.
+func (out *expectOutput) since(pos int) ([]byte, <-chan struct{}) {
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	return bytes.Clone(out.buf[pos:]), out.changed
+}
@@ -0,0 +1,185 @@
+package mf
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+)
+
+// maxMacroLen is the longest instruction sequence FactorMF turns into
+// a macro.
+const maxMacroLen = 64
+
+// FactorMF moves instruction sequences repeated in the MF binary prog
+// into macros of a dictionary at the start of the code, and runs them
+// where the sequences were. Sequences become macros only if that makes
+// the binary smaller. Code generated by compilers targeting BF repeats
+// a lot, so it often shrinks well.
+//
+// Macros contain balanced brackets and no other macros. A program that
+// already has a dictionary is an error.
+func FactorMF(prog []byte) ([]byte, error) {
+	prog, l, err := parseProg(prog)
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := DecodeMF(prog)
+	if err != nil {
+		return nil, err
+	}
+	var ins []Instruction
+	for _, in := range foldRuns(decoded) {
+		switch in.Op {
+		case OpDict, OpMacro, OpRet:
+			return nil, fmt.Errorf("MF binary at offset %d already uses macros", in.Offset)
+		case OpCall:
+			return nil, fmt.Errorf("MF binary at offset %d calls code, which moves when factored", in.Offset)
+		case OpNop:
+			continue
+		}
+		in.Offset = 0 // equal sequences compare equal
+		ins = append(ins, in)
+	}
+
+	special := 2 + 2*l.width // nibbles of a special code, with alignment
+	maxOp := uint64(math.MaxUint32)
+	if l.width == 8 {
+		maxOp = math.MaxUint64
+	}
+	cost := func(in Instruction) int {
+		switch in.Op {
+		case OpAdd, OpSub, OpRight, OpLeft:
+			if in.Arg > 9 {
+				return special * int((in.Arg-1)/maxOp+1)
+			}
+			return int(in.Arg)
+		case OpOut, OpIn:
+			return int(in.Arg)
+		}
+		return special
+	}
+	costs := make([]int, len(ins))
+	for i, in := range ins {
+		costs[i] = cost(in)
+	}
+
+	// group the balanced windows worth a macro by content
+	type window struct {
+		n    int
+		hash uint64
+	}
+	groups := make(map[window][]int)
+	for i := range ins {
+		var h uint64
+		depth, size := 0, 0
+		for n := 1; n <= maxMacroLen && i+n <= len(ins); n++ {
+			in := ins[i+n-1]
+			h = (h*1000003+uint64(in.Op))*1000003 + in.Arg
+			size += costs[i+n-1]
+			switch in.Op {
+			case OpOpen:
+				depth++
+			case OpClose:
+				depth--
+			}
+			if depth < 0 {
+				break
+			}
+			if depth == 0 && n > 1 && size > special {
+				groups[window{n, h}] = append(groups[window{n, h}], i)
+			}
+		}
+	}
+	type candidate struct {
+		n, size int
+		starts  []int
+	}
+	// profit returns the nibbles saved by a macro of the given size
+	// used count times.
+	profit := func(size, count int) int {
+		return count*size - count*special - size - special
+	}
+	var cands []candidate
+	for w, starts := range groups {
+		if len(starts) < 2 {
+			continue
+		}
+		first := ins[starts[0] : starts[0]+w.n]
+		var same []int
+		for _, s := range starts {
+			if slices.Equal(ins[s:s+w.n], first) {
+				same = append(same, s)
+			}
+		}
+		size := 0
+		for _, c := range costs[starts[0] : starts[0]+w.n] {
+			size += c
+		}
+		if profit(size, len(same)) > 0 {
+			cands = append(cands, candidate{w.n, size, same})
+		}
+	}
+	sort.Slice(cands, func(i, j int) bool {
+		a, b := cands[i], cands[j]
+		if pa, pb := profit(a.size, len(a.starts)), profit(b.size, len(b.starts)); pa != pb {
+			return pa > pb
+		}
+		return a.starts[0] < b.starts[0]
+	})
+
+	// take the most profitable macros first, on code not taken yet
+	taken := make([]bool, len(ins))
+	uses := make(map[int]int) // macro number at the start of a use
+	var macros [][]Instruction
+	for _, c := range cands {
+		if len(macros) == 1<<24-1 {
+			break
+		}
+		var free []int
+		end := 0
+		for _, s := range c.starts {
+			if s >= end && !slices.Contains(taken[s:s+c.n], true) {
+				free = append(free, s)
+				end = s + c.n
+			}
+		}
+		if profit(c.size, len(free)) <= 0 {
+			continue
+		}
+		for _, s := range free {
+			for i := s; i < s+c.n; i++ {
+				taken[i] = true
+			}
+			uses[s] = len(macros)
+		}
+		macros = append(macros, ins[c.starts[0]:c.starts[0]+c.n])
+	}
+
+	var buf bytes.Buffer
+	r := newBFReader(&buf, layout{version: l.version, code: l.code, width: l.width}, l.memsize)
+	if len(macros) > 0 {
+		r.emit(Instruction{Op: OpDict, Arg: uint64(len(macros))})
+		for _, m := range macros {
+			for _, in := range m {
+				r.emit(in)
+			}
+			r.emit(Instruction{Op: OpRet})
+		}
+	}
+	for i := 0; i < len(ins); i++ {
+		if m, ok := uses[i]; ok {
+			r.emit(Instruction{Op: OpMacro, Arg: uint64(m)})
+			i += len(macros[m]) - 1
+			continue
+		}
+		r.emit(ins[i])
+	}
+	if err := r.Close(); err != nil {
+		return nil, err
+	}
+	out := buf.Bytes()
+	copy(out, prog[:4]) // keep the magic
+	return out, nil
+}
@@ -0,0 +1,261 @@
+package mf
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// MF container format versions.
+//
+// A version 1 header is the magic and a nonzero 32-bit memsize.
+// A version 2 header is the magic, a zero 32-bit memsize which
+// marks an extended header, the 32-bit version, and a 64-bit memsize.
+// Version 2 operands are 64-bit; extension operands must fit in 32 bits.
+const (
+	Version1 = 1
+	Version2 = 2
+)
+
+// layout is the container layout of an MF binary.
+type layout struct {
+	version int
+	memsize uint64
+	code    int // offset of the first code byte
+	width   int // operand size in bytes
+}
+
+var v1Layout = layout{version: Version1, code: 8, width: 4}
+
+// Header is the header of an MF binary.
+type Header struct {
+	Magic   string // Magic, or BFMagic for code converted from BF
+	Version int    // Version1 or Version2
+	MemSize uint64
+}
+
+// Size returns the length of the header in bytes, where the code starts.
+func (h Header) Size() int {
+	return h.layout().code
+}
+
+// layout returns the container layout of the header.
+func (h Header) layout() layout {
+	if h.Version == Version1 {
+		l := v1Layout
+		l.memsize = h.MemSize
+		return l
+	}
+	return layout{version: Version2, memsize: h.MemSize, code: 20, width: 8}
+}
+
+// MarshalBinary returns the header bytes. It fails if the header cannot
+// be encoded, such as a version 1 header with a memsize of zero or over
+// 32 bits.
+func (h Header) MarshalBinary() ([]byte, error) {
+	switch {
+	case h.Magic != Magic && h.Magic != BFMagic:
+		return nil, fmt.Errorf("invalid MF header: magic mismatch 0x%x", h.Magic)
+	case h.Version != Version1 && h.Version != Version2:
+		return nil, fmt.Errorf("invalid MF header: unsupported version %d", h.Version)
+	case h.Version == Version1 && (h.MemSize == 0 || h.MemSize > math.MaxUint32):
+		return nil, fmt.Errorf("invalid MF header: memsize %d does not fit version 1", h.MemSize)
+	}
+	return h.layout().header(h.Magic), nil
+}
+
+// UnmarshalBinary reads the header at the start of data, which may be a
+// whole MF binary.
+func (h *Header) UnmarshalBinary(data []byte) error {
+	if len(data) < 8 {
+		return fmt.Errorf("invalid MF binary: file too small")
+	}
+	if m := string(data[:4]); m != Magic && m != BFMagic {
+		return fmt.Errorf("invalid MF binary: magic mismatch 0x%x", data[:4])
+	}
+	if n := bytesUint32(data[4:8]); n != 0 {
+		*h = Header{string(data[:4]), Version1, uint64(n)}
+		return nil
+	}
+	if len(data) < 20 {
+		return fmt.Errorf("invalid MF binary: truncated extended header")
+	}
+	if v := bytesUint32(data[8:12]); v != Version2 {
+		return fmt.Errorf("invalid MF binary: unsupported version %d", v)
+	}
+	*h = Header{string(data[:4]), Version2, binary.BigEndian.Uint64(data[12:20])}
+	return nil
+}
+
+// ReadHeader reads the header of an MF binary from r, and no more,
+// for identifying a file without reading its code.
+func ReadHeader(r io.Reader) (Header, error) {
+	var h Header
+	buf := make([]byte, 20)
+	if _, err := io.ReadFull(r, buf[:8]); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return h, fmt.Errorf("invalid MF binary: file too small")
+	} else if err != nil {
+		return h, err
+	}
+	if string(buf[:4]) != Magic && string(buf[:4]) != BFMagic || bytesUint32(buf[4:8]) != 0 {
+		return h, h.UnmarshalBinary(buf[:8])
+	}
+	if _, err := io.ReadFull(r, buf[8:]); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return h, fmt.Errorf("invalid MF binary: truncated extended header")
+	} else if err != nil {
+		return h, err
+	}
+	return h, h.UnmarshalBinary(buf)
+}
+
+// PatchHeader replaces the header of the MF binary ws with h in place,
+// without converting the code again. ws must be an io.Reader too, as
+// files are, for the header to be read first, and h must be as long as
+// it, so that the code stays where it is. Signed binaries are refused,
+// as their signature would no longer verify; sign them again instead.
+func PatchHeader(ws io.WriteSeeker, h Header) error {
+	return patchHeader(ws, func(old *Header) error {
+		*old = h
+		return nil
+	})
+}
+
+// PatchMemSize sets the memsize in the header of the MF binary ws in
+// place, as PatchHeader does.
+func PatchMemSize(ws io.WriteSeeker, newSize uint32) error {
+	return patchHeader(ws, func(h *Header) error {
+		if newSize == 0 {
+			return fmt.Errorf("patching the header: zero memsize")
+		}
+		h.MemSize = uint64(newSize)
+		return nil
+	})
+}
+
+// patchHeader reads the header of ws, changes it with patch,
+// and writes it back.
+func patchHeader(ws io.WriteSeeker, patch func(*Header) error) error {
+	r, ok := ws.(io.Reader)
+	if !ok {
+		return fmt.Errorf("patching the header: %T cannot be read", ws)
+	}
+	end, err := ws.Seek(-int64(len(SigMagic)), io.SeekEnd)
+	if err == nil && end >= 8 {
+		tail := make([]byte, len(SigMagic))
+		if _, err := io.ReadFull(r, tail); err != nil {
+			return err
+		}
+		if string(tail) == SigMagic {
+			return fmt.Errorf("patching the header: MF binary is signed")
+		}
+	}
+	if _, err := ws.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	old, err := ReadHeader(r)
+	if err != nil {
+		return err
+	}
+	h := old
+	if err := patch(&h); err != nil {
+		return err
+	}
+	b, err := h.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if len(b) != old.Size() {
+		return fmt.Errorf("patching the header: version %d header cannot replace version %d", h.Version, old.Version)
+	}
+	if _, err := ws.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = ws.Write(b)
+	return err
+}
+
+// parseLayout reads the header of an MF binary.
+func parseLayout(prog []byte) (layout, error) {
+	var h Header
+	if err := h.UnmarshalBinary(prog); err != nil {
+		return layout{}, err
+	}
+	return h.layout(), nil
+}
+
+// parseProg reads the header of an MF binary, and returns the binary
+// without its signature section, if it has one, for reading its code.
+func parseProg(prog []byte) ([]byte, layout, error) {
+	prog, _ = SplitSignature(prog)
+	l, err := parseLayout(prog)
+	return prog, l, err
+}
+
+// header returns the header bytes of the layout.
+func (l layout) header(magic string) []byte {
+	h := []byte(magic)
+	if l.version == Version1 {
+		return append(h, uint32bytes(uint32(l.memsize))...)
+	}
+	h = append(h, uint32bytes(0)...)
+	h = append(h, uint32bytes(Version2)...)
+	return binary.BigEndian.AppendUint64(h, l.memsize)
+}
+
+// operand reads an operand of the layout width.
+func (l layout) operand(b []byte) uint64 {
+	if l.width == 4 {
+		return uint64(bytesUint32(b))
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+// putOperand writes an operand of the layout width.
+func (l layout) putOperand(b []byte, n uint64) {
+	if l.width == 4 {
+		copy(b, uint32bytes(uint32(n)))
+	} else {
+		binary.BigEndian.PutUint64(b, n)
+	}
+}
+
+// narrow re-encodes a version 2 binary with unresolved jumps as version 1,
+// if its memsize and operands fit in 32 bits. Special codes keep their
+// nibble positions, so only the header and operand widths change.
+func narrow(prog []byte) ([]byte, bool) {
+	l, err := parseLayout(prog)
+	if err != nil || l.version != Version2 || l.memsize == 0 || l.memsize > math.MaxUint32 {
+		return nil, false
+	}
+	out := v1Layout
+	out.memsize = l.memsize
+	buf := out.header(string(prog[:4]))
+	for pc := l.code; pc < len(prog); pc++ {
+		b := prog[pc]
+		buf = append(buf, b)
+		if !hasOperand(b) {
+			continue
+		}
+		if pc+9 > len(prog) {
+			return nil, false
+		}
+		n := l.operand(prog[pc+1 : pc+9])
+		if n > math.MaxUint32 {
+			return nil, false
+		}
+		buf = append(buf, uint32bytes(uint32(n))...)
+		pc += 8
+	}
+	if len(buf) >= math.MaxUint32-5 {
+		return nil, false
+	}
+	return buf, true
+}
+
+// hasOperand reports whether a code byte holds a special code
+// followed by an operand, as FromBF writes them.
+func hasOperand(b byte) bool {
+	special := func(n byte) bool { return n&8 != 0 && n != 8|6 }
+	return special(b>>4) || special(b&0xf)
+}
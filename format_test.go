@@ -0,0 +1,94 @@
+package mf
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestOperandByteOrder(t *testing.T) {
+	v2 := Header{Version: Version2}.layout()
+	tests := []struct {
+		name string
+		l    layout
+		n    uint64
+		want []byte
+	}{
+		{"v1", v1Layout, 0x01020304, []byte{1, 2, 3, 4}},
+		{"v1 small", v1Layout, 0x1234, []byte{0, 0, 0x12, 0x34}},
+		{"v2", v2, 0x0102030405060708, []byte{1, 2, 3, 4, 5, 6, 7, 8}},
+		{"v2 small", v2, 0x1234, []byte{0, 0, 0, 0, 0, 0, 0x12, 0x34}},
+	}
+	for _, tt := range tests {
+		b := make([]byte, tt.l.width)
+		tt.l.putOperand(b, tt.n)
+		if !bytes.Equal(b, tt.want) {
+			t.Errorf("%s: putOperand(0x%x) = % x, want % x", tt.name, tt.n, b, tt.want)
+		}
+		if got := tt.l.operand(tt.want); got != tt.n {
+			t.Errorf("%s: operand(% x) = 0x%x, want 0x%x", tt.name, tt.want, got, tt.n)
+		}
+	}
+}
+
+func TestHeaderByteOrder(t *testing.T) {
+	tests := []struct {
+		h    Header
+		want []byte
+	}{
+		{Header{Magic, Version1, 0x01020304}, []byte(Magic + "\x01\x02\x03\x04")},
+		{Header{BFMagic, Version2, 0x0102030405060708}, []byte(BFMagic + "\x00\x00\x00\x00\x00\x00\x00\x02\x01\x02\x03\x04\x05\x06\x07\x08")},
+	}
+	for _, tt := range tests {
+		b, err := tt.h.MarshalBinary()
+		if err != nil || !bytes.Equal(b, tt.want) {
+			t.Errorf("%+v: MarshalBinary() = % x, %v, want % x", tt.h, b, err, tt.want)
+		}
+		var h Header
+		if err := h.UnmarshalBinary(tt.want); err != nil || h != tt.h {
+			t.Errorf("UnmarshalBinary(% x) = %+v, %v, want %+v", tt.want, h, err, tt.h)
+		}
+	}
+}
+
+// TestConvertedByteOrder checks the operand of a run written by FromBF
+// and read back by ToBF, in both versions.
+func TestConvertedByteOrder(t *testing.T) {
+	src := strings.Repeat("+", 300)
+	tests := []struct {
+		name    string
+		r       func(*bytes.Buffer) *FromBF
+		operand []byte
+	}{
+		{"v1", func(b *bytes.Buffer) *FromBF { return NewBFReader(b, 16) }, []byte{0, 0, 0x01, 0x2c}},
+		{"v2", func(b *bytes.Buffer) *FromBF { return NewBFReader64(b, 1<<33) }, []byte{0, 0, 0, 0, 0, 0, 0x01, 0x2c}},
+	}
+	for _, tt := range tests {
+		var prog bytes.Buffer
+		r := tt.r(&prog)
+		if _, err := r.Write([]byte(src)); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+		l, err := parseLayout(prog.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := prog.Bytes()[l.code+1:]; !bytes.Equal(got, tt.operand) {
+			t.Errorf("%s: run operand = % x, want % x", tt.name, got, tt.operand)
+		}
+		var bf bytes.Buffer
+		w := NewBFWriter(&bf)
+		if _, err := w.Write(prog.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if n := strings.Count(bf.String(), "+"); n != 300 {
+			t.Errorf("%s: converted back to %d +, want 300", tt.name, n)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package mf
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// Fuzzer generates random BF programs and checks that the converters
+// and the VM agree on them: the BF code run by RunBF, its MF conversion
+// run by the VM, and the BF code converted back from that MF binary run
+// by RunBF must write the same output and end the same way.
+//
+// FuzzRoundTrip runs Check as a go test fuzz target.
+type Fuzzer struct {
+	// Rand is the source of programs. Nil means a source seeded with 1.
+	Rand *rand.Rand
+	// MaxLen is the maximum number of commands of a program,
+	// 64 if zero.
+	MaxLen int
+	// MemSize is the tape size of the runs, 256 if zero.
+	MemSize uint64
+	// Timeout limits every run, 100ms if zero. Programs that time out
+	// count as passing if the outputs agree so far.
+	Timeout time.Duration
+}
+
+// FuzzFailure is a program on which the runs disagree.
+type FuzzFailure struct {
+	Src, Input []byte
+	Reason     string
+}
+
+func (f *FuzzFailure) Error() string {
+	return fmt.Sprintf("%s\nbf: %q\ninput: %q", f.Reason, f.Src, f.Input)
+}
+
+// Generate returns a random BF program, with some comment characters
+// and long runs of commands, and an input for it.
+func (f *Fuzzer) Generate() (src, input []byte) {
+	if f.Rand == nil {
+		f.Rand = rand.New(rand.NewSource(1))
+	}
+	r := f.Rand
+	maxLen := f.MaxLen
+	if maxLen <= 0 {
+		maxLen = 64
+	}
+	depth := 0
+	for n := r.Intn(maxLen) + 1; n > 0; n-- {
+		switch k := r.Intn(20); {
+		case k < 2 && depth < 4:
+			src = append(src, '[')
+			depth++
+		case k < 4 && depth > 0:
+			src = append(src, ']')
+			depth--
+		case k == 4:
+			src = append(src, " \nab#!"[r.Intn(6)])
+		default:
+			// pointer moves lean right to stay on the tape
+			c := "++--<>>>.,"[r.Intn(10)]
+			count := 1
+			switch r.Intn(8) {
+			case 0:
+				count = r.Intn(40) + 1
+			case 1:
+				count = r.Intn(300) + 1
+			}
+			src = append(src, bytes.Repeat([]byte{c}, count)...)
+		}
+	}
+	src = append(src, bytes.Repeat([]byte{']'}, depth)...)
+	input = make([]byte, r.Intn(17))
+	r.Read(input)
+	return src, input
+}
+
+// Check runs the BF code src, its MF conversion and the BF code
+// converted back from it on input, and returns a *FuzzFailure if they
+// disagree or a conversion fails.
+func (f *Fuzzer) Check(src, input []byte) error {
+	if err := ValidateBF(src); err != nil {
+		return err
+	}
+	memsize := f.MemSize
+	if memsize == 0 {
+		memsize = 256
+	}
+	timeout := f.Timeout
+	if timeout == 0 {
+		timeout = 100 * time.Millisecond
+	}
+	fail := func(format string, a ...any) error {
+		return &FuzzFailure{Src: src, Input: input, Reason: fmt.Sprintf(format, a...)}
+	}
+
+	var prog bytes.Buffer
+	w := NewBFReader64(&prog, memsize)
+	if _, err := w.Write(src); err != nil {
+		return fail("BF to MF: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return fail("BF to MF: %v", err)
+	}
+	var back bytes.Buffer
+	bw := NewBFWriter(&back)
+	if _, err := bw.Write(prog.Bytes()); err != nil {
+		return fail("MF to BF: %v", err)
+	}
+	if err := bw.Close(); err != nil {
+		return fail("MF to BF: %v", err)
+	}
+
+	r, err := CrossCheck(src, prog.Bytes(), input, timeout)
+	if err != nil {
+		return fail("%v", err)
+	}
+	if !r.OK() {
+		return fail("%s", r)
+	}
+	var backOut bytes.Buffer
+	backErr := RunBF(back.Bytes(), int(memsize), bytes.NewReader(input), &backOut, timeout)
+	if !runsAgree(r.BFOut, r.BFErr, backOut.Bytes(), backErr) {
+		return fail("%s", describeRuns("bf", r.BFOut, r.BFErr, "converted back", backOut.Bytes(), backErr))
+	}
+	return nil
+}
+
+// Run checks n generated programs. On the first failure, it shrinks the
+// program and its input and returns the *FuzzFailure.
+func (f *Fuzzer) Run(n int) error {
+	for i := 0; i < n; i++ {
+		src, input := f.Generate()
+		err := f.Check(src, input)
+		if err == nil {
+			continue
+		}
+		src, input = Shrink(src, input, func(src, input []byte) bool {
+			return f.Check(src, input) != nil
+		})
+		return f.Check(src, input)
+	}
+	return nil
+}
+
+// Shrink returns the smallest BF code and input it finds, by removing
+// parts of src and input and unwrapping loops, for which fails still
+// reports true. fails is only called with balanced BF code.
+func Shrink(src, input []byte, fails func(src, input []byte) bool) ([]byte, []byte) {
+	for changed := true; changed; {
+		changed = false
+		for n := len(src); n > 0; n /= 2 {
+			for i := 0; i+n <= len(src); {
+				c := append(src[:i:i], src[i+n:]...)
+				if ValidateBF(c) == nil && fails(c, input) {
+					src, changed = c, true
+				} else {
+					i += n
+				}
+			}
+		}
+		for i := 0; i < len(src); i++ {
+			if src[i] != '[' {
+				continue
+			}
+			depth, j := 0, i
+			for ; j < len(src); j++ {
+				if src[j] == '[' {
+					depth++
+				} else if src[j] == ']' {
+					if depth--; depth == 0 {
+						break
+					}
+				}
+			}
+			c := append(append(src[:i:i], src[i+1:j]...), src[j+1:]...)
+			if fails(c, input) {
+				src, changed = c, true
+				i--
+			}
+		}
+		for n := len(input); n > 0; n /= 2 {
+			for i := 0; i+n <= len(input); {
+				c := append(input[:i:i], input[i+n:]...)
+				if fails(src, c) {
+					input, changed = c, true
+				} else {
+					i += n
+				}
+			}
+		}
+	}
+	return src, input
+}
@@ -0,0 +1,32 @@
+package mf
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// FuzzRoundTrip checks with Fuzzer.Check that BF code, its MF
+// conversion and the BF code converted back from it run the same.
+// The corpus is seeded with the programs in bf.
+func FuzzRoundTrip(f *testing.F) {
+	seeds, err := filepath.Glob("bf/*.bf")
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, name := range seeds {
+		src, err := os.ReadFile(name)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(src, []byte("input\n"))
+	}
+	f.Fuzz(func(t *testing.T, src, input []byte) {
+		if ValidateBF(src) != nil {
+			t.Skip("unbalanced brackets")
+		}
+		if err := (&Fuzzer{}).Check(src, input); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -0,0 +1,275 @@
+package mf
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// gdbTarget describes the registers to GDB: the byte offset of the
+// next instruction, the pointer, and the current tape. Memory is the
+// current tape.
+const gdbTarget = `<?xml version="1.0"?>
+<!DOCTYPE target SYSTEM "gdb-target.dtd">
+<target version="1.0">
+  <feature name="org.cr0sh.mf.core">
+    <reg name="pc" bitsize="64" type="code_ptr"/>
+    <reg name="ptr" bitsize="64" type="data_ptr"/>
+    <reg name="tape" bitsize="64" type="uint64"/>
+  </feature>
+</target>`
+
+// ServeGDB serves the GDB remote serial protocol on conn, so that GDB
+// and its front ends can debug the VM with "target remote".
+// It returns when GDB detaches or kills the program, or conn fails.
+//
+// Memory is the current tape, and the registers are pc (the byte
+// offset of the next instruction), ptr and tape, all 64-bit little
+// endian. Software breakpoints and write, read and access watchpoints
+// are supported. A running continue can't be interrupted.
+func (d *Debugger) ServeGDB(conn io.ReadWriter) error {
+	g := &gdbConn{r: bufio.NewReader(conn), w: conn}
+	for {
+		pkt, err := g.read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		reply, done := d.gdbCommand(pkt)
+		if err := g.write(reply); err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+// gdbConn reads and writes GDB remote protocol packets.
+type gdbConn struct {
+	r     *bufio.Reader
+	w     io.Writer
+	noAck bool
+}
+
+// read reads a packet, acknowledging it. Interrupts and acks are skipped.
+func (g *gdbConn) read() (string, error) {
+	for {
+		b, err := g.r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if b != '$' {
+			continue
+		}
+		data, err := g.r.ReadString('#')
+		if err != nil {
+			return "", err
+		}
+		data = data[:len(data)-1]
+		var sum [2]byte
+		if _, err := io.ReadFull(g.r, sum[:]); err != nil {
+			return "", err
+		}
+		if g.noAck {
+			return data, nil
+		}
+		if fmt.Sprintf("%02x", gdbChecksum(data)) != strings.ToLower(string(sum[:])) {
+			if _, err := io.WriteString(g.w, "-"); err != nil {
+				return "", err
+			}
+			continue
+		}
+		if _, err := io.WriteString(g.w, "+"); err != nil {
+			return "", err
+		}
+		if data == "QStartNoAckMode" {
+			g.noAck = true
+		}
+		return data, nil
+	}
+}
+
+// write writes a packet. Acks from GDB are read by the next read.
+func (g *gdbConn) write(data string) error {
+	_, err := fmt.Fprintf(g.w, "$%s#%02x", data, gdbChecksum(data))
+	return err
+}
+
+func gdbChecksum(data string) byte {
+	var sum byte
+	for i := 0; i < len(data); i++ {
+		sum += data[i]
+	}
+	return sum
+}
+
+// gdbCommand executes a packet, and returns the reply and
+// whether the session is over.
+func (d *Debugger) gdbCommand(pkt string) (string, bool) {
+	v := d.VM
+	if pkt == "" {
+		return "", false
+	}
+	switch args := pkt[1:]; pkt[0] {
+	case '?':
+		return "S05", false
+	case 'q':
+		switch {
+		case strings.HasPrefix(args, "Supported"):
+			return "PacketSize=4000;qXfer:features:read+;QStartNoAckMode+", false
+		case args == "Attached":
+			return "1", false
+		case args == "C":
+			return "QC1", false
+		case strings.HasPrefix(args, "Xfer:features:read:target.xml:"):
+			return gdbXfer(gdbTarget, strings.TrimPrefix(args, "Xfer:features:read:target.xml:")), false
+		}
+		return "", false
+	case 'Q':
+		if args == "StartNoAckMode" {
+			return "OK", false
+		}
+		return "", false
+	case 'H':
+		return "OK", false
+	case 'g':
+		return d.gdbRegs(), false
+	case 'p':
+		n, err := strconv.ParseUint(args, 16, 8)
+		if err != nil || n > 2 {
+			return "E01", false
+		}
+		return d.gdbRegs()[16*n : 16*n+16], false
+	case 'G':
+		b, err := hex.DecodeString(args)
+		if err != nil || len(b) != 24 {
+			return "E01", false
+		}
+		if err := d.SetPtr(int(binary.LittleEndian.Uint64(b[8:]))); err != nil {
+			return "E01", false
+		}
+		return "OK", false
+	case 'm':
+		addr, n, ok := gdbRange(args)
+		if !ok || addr+n > len(v.tape) {
+			return "E01", false
+		}
+		return hex.EncodeToString(v.tape[addr : addr+n]), false
+	case 'M':
+		rng, data, _ := strings.Cut(args, ":")
+		addr, n, ok := gdbRange(rng)
+		b, err := hex.DecodeString(data)
+		if !ok || err != nil || len(b) != n || addr+n > len(v.tape) {
+			return "E01", false
+		}
+		copy(v.tape[addr:], b)
+		return "OK", false
+	case 's':
+		ev, err := d.Step(1)
+		return d.gdbStop(ev, err), false
+	case 'c':
+		ev, err := d.Continue()
+		return d.gdbStop(ev, err), false
+	case 'Z', 'z':
+		kind, rng, _ := strings.Cut(args, ",")
+		addr, n, ok := gdbRange(rng)
+		if !ok {
+			return "E01", false
+		}
+		set := pkt[0] == 'Z'
+		if kind == "0" || kind == "1" {
+			switch {
+			case !set:
+				d.Delete(CodePos{Offset: addr})
+			case d.Break(CodePos{Offset: addr}) != nil:
+				return "E01", false
+			}
+			return "OK", false
+		}
+		wk, ok := map[string]WatchKind{"2": WatchWrite, "3": WatchRead, "4": WatchAccess}[kind]
+		if !ok {
+			return "", false
+		}
+		if set {
+			if n == 0 || d.Watch(addr, addr+n-1, wk) != nil {
+				return "E01", false
+			}
+			return "OK", false
+		}
+		for i, w := range d.Watchpoints() {
+			if w == (Watchpoint{addr, addr + n - 1, v.cur, wk}) {
+				d.Unwatch(i)
+				break
+			}
+		}
+		return "OK", false
+	case 'D':
+		return "OK", true
+	case 'k':
+		return "X09", true
+	}
+	return "", false
+}
+
+// gdbRegs returns the registers in hex.
+func (d *Debugger) gdbRegs() string {
+	v := d.VM
+	var b [24]byte
+	binary.LittleEndian.PutUint64(b[0:], uint64(v.pc))
+	binary.LittleEndian.PutUint64(b[8:], uint64(v.ptr))
+	binary.LittleEndian.PutUint64(b[16:], v.cur)
+	return hex.EncodeToString(b[:])
+}
+
+// gdbStop returns the stop reply for a debugger event.
+func (d *Debugger) gdbStop(ev Event, err error) string {
+	switch {
+	case errors.Is(err, ErrLimit):
+		return "S18" // SIGXCPU
+	case err != nil:
+		return "S0b" // SIGSEGV
+	case ev == EventEnd || d.VM.Done():
+		return fmt.Sprintf("W%02x", byte(d.VM.ExitStatus()))
+	case ev == EventWatch:
+		h := d.Hit()
+		kind := "awatch"
+		if h.Write {
+			kind = "watch"
+		} else if h.Kind == WatchRead {
+			kind = "rwatch"
+		}
+		return fmt.Sprintf("T05%s:%x;", kind, h.Cell)
+	}
+	return "S05"
+}
+
+// gdbRange parses "addr,length" in hex.
+func gdbRange(s string) (addr, n int, ok bool) {
+	a, l, found := strings.Cut(s, ",")
+	x, err1 := strconv.ParseUint(a, 16, 32)
+	y, err2 := strconv.ParseUint(l, 16, 32)
+	return int(x), int(y), found && err1 == nil && err2 == nil
+}
+
+// gdbXfer returns the part "offset,length" of an qXfer object.
+func gdbXfer(obj, rng string) string {
+	off, n, ok := gdbRange(rng)
+	if !ok {
+		return "E01"
+	}
+	if off >= len(obj) {
+		return "l"
+	}
+	if off+n >= len(obj) {
+		return "l" + obj[off:]
+	}
+	return "m" + obj[off:off+n]
+}
@@ -0,0 +1,3 @@
+module github.com/cr0sh/mf
+
+go 1.24
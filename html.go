@@ -0,0 +1,125 @@
+package mf
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+)
+
+// htmlPage is the template of DisassembleHTML.
+var htmlPage = template.Must(template.New("disasm").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: monospace; background: #fdfdfd; color: #222; }
+table { border-collapse: collapse; }
+td { padding: 0 0.8em; white-space: pre; }
+tr:target { outline: 2px solid #f90; }
+.off { color: #888; }
+.count { color: #555; text-align: right; }
+.op-ptr { color: #06c; }
+.op-arith { color: #080; }
+.op-io { color: #c60; }
+.op-jump { color: #a0a; font-weight: bold; }
+.op-sys { color: #c00; }
+a { color: inherit; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>memsize {{.Memsize}}, version {{.Version}}{{if .Profiled}}, {{.Total}} instructions executed{{end}}</p>
+<table>
+{{- range .Lines}}
+<tr id="{{.ID}}"{{if .Heat}} style="background: rgba(255, 80, 0, {{.Heat}})"{{end}}>
+{{- if $.Profiled}}<td class="count">{{if .Count}}{{.Count}}{{end}}</td>{{end -}}
+<td class="off">{{.Pos}}</td><td class="{{.Class}}">{{.Op}}{{if .Target}} <a href="#{{.Target}}">{{.Arg}}</a>{{else if .Arg}} {{.Arg}}{{end}}</td></tr>
+{{- end}}
+</table>
+</body>
+</html>
+`))
+
+// DisassembleHTML writes a standalone HTML page of the disassembly of an
+// MF binary to w, with colored instructions and jump positions linking to
+// their targets. If p is not nil, every line shows its execution count,
+// and is shaded by it.
+func DisassembleHTML(w io.Writer, prog []byte, title string, p *Profile) error {
+	prog, l, err := parseProg(prog)
+	if err != nil {
+		return err
+	}
+	type line struct {
+		ID, Pos, Class, Op, Arg, Target string
+		Count                           int64
+		Heat                            string
+	}
+	var lines []line
+	var total, hottest int64
+	for at, atLow := l.code, false; at < len(prog); {
+		in, next, nextLow, err := decode(prog, l, at, atLow, DecodeDefault)
+		if err != nil {
+			return err
+		}
+		pos := CodePos{at, atLow}
+		at, atLow = next, nextLow
+		if in.Op == OpNop {
+			continue
+		}
+		ln := line{ID: htmlID(pos), Pos: fmt.Sprintf("%08x", pos.Offset), Op: in.Op.String(), Arg: fmt.Sprint(in.Arg)}
+		if pos.Low {
+			ln.Pos += ".5"
+		}
+		switch in.Op {
+		case OpRight, OpLeft, OpScan, OpShift, OpTape:
+			ln.Class = "op-ptr"
+		case OpAdd, OpSub, OpSet, OpClear, OpMove, OpAddAt:
+			ln.Class = "op-arith"
+		case OpOut, OpIn:
+			ln.Class = "op-io"
+		case OpOpen, OpClose, OpCall:
+			ln.Class = "op-jump"
+			ln.Arg = fmt.Sprintf("0x%x", in.Arg)
+			ln.Target = htmlID(CodePos{Offset: int(in.Arg)})
+		default:
+			ln.Class = "op-sys"
+		}
+		switch in.Op {
+		case OpMove, OpScan, OpShift:
+			ln.Arg = fmt.Sprint(int32(in.Arg))
+		case OpExt:
+			ln.Arg = fmt.Sprintf("0x%08x", in.Arg)
+		case OpAddAt:
+			off, n := in.AddAt()
+			ln.Arg = fmt.Sprintf("%d %d", off, n)
+		}
+		if p != nil {
+			ln.Count = p.Counts[pos]
+			total += ln.Count
+			hottest = max(hottest, ln.Count)
+		}
+		lines = append(lines, ln)
+	}
+	for i := range lines {
+		if c := lines[i].Count; c > 0 {
+			lines[i].Heat = fmt.Sprintf("%.2f", 0.05+0.45*float64(c)/float64(hottest))
+		}
+	}
+	return htmlPage.Execute(w, map[string]any{
+		"Title":    title,
+		"Memsize":  l.memsize,
+		"Version":  l.version,
+		"Profiled": p != nil,
+		"Total":    total,
+		"Lines":    lines,
+	})
+}
+
+// htmlID returns the element ID of the line of an instruction.
+func htmlID(pos CodePos) string {
+	if pos.Low {
+		return fmt.Sprintf("o%x-5", pos.Offset)
+	}
+	return fmt.Sprintf("o%x", pos.Offset)
+}
@@ -0,0 +1,116 @@
+package mf
+
+import (
+	"bytes"
+	"io"
+	"maps"
+	"slices"
+)
+
+// Incremental converts successive versions of BF code to MF as FromBF
+// does, reconverting only from the segment where a version first
+// differs from the last one. It keeps the state of FromBF at the start
+// of every segment, with the MF code buffered so far, so a version is
+// converted to the same MF binary as it is from scratch. Jump operands
+// are written at Close, so reused segments need no relocation.
+type Incremental struct {
+	// New returns the FromBF converting a version to w, with its
+	// options set. Its Warn is replaced by that of Incremental.
+	New func(w io.Writer) *FromBF
+
+	// Segment is the bytes of BF code between kept states, 64 KiB if
+	// zero.
+	Segment int
+
+	// Warn, if not nil, is called for every Warning of a version,
+	// including those of the reused segments.
+	Warn func(Warning)
+
+	src      []byte    // last version
+	code     []byte    // MF code buffered for it before Close
+	states   []savedBF // at the start of each segment of src
+	warnings []Warning // of src, in the order they were made
+}
+
+// savedBF is the state of FromBF at the start of a segment.
+type savedBF struct {
+	r        *FromBF // without its buffered code
+	code     int     // bytes of code buffered
+	warnings int     // made before the segment
+}
+
+// Convert converts src to MF, writing it to w, and returns the bytes
+// at the start of src whose conversion was reused from the last call.
+func (c *Incremental) Convert(w io.Writer, src []byte) (reused int, err error) {
+	seg := c.Segment
+	if seg <= 0 {
+		seg = 64 << 10
+	}
+	same := 0
+	for same < len(src) && same < len(c.src) && src[same] == c.src[same] {
+		same++
+	}
+	var r *FromBF
+	if k := min(same/seg, len(c.states)-1); k > 0 {
+		s := c.states[k]
+		r = s.r.clone()
+		r.wr = bytes.NewBuffer(slices.Clone(c.code[:s.code]))
+		r.wrap = w
+		c.states, c.warnings = c.states[:k+1], c.warnings[:s.warnings]
+		reused = k * seg
+		if c.Warn != nil {
+			for _, w := range c.warnings {
+				c.Warn(w)
+			}
+		}
+	} else {
+		r = c.New(w)
+		c.states, c.warnings = nil, nil
+	}
+	r.Warn = func(w Warning) {
+		c.warnings = append(c.warnings, w)
+		if c.Warn != nil {
+			c.Warn(w)
+		}
+	}
+	if len(c.states) == 0 {
+		c.states = append(c.states, c.save(r))
+	}
+	c.src = slices.Clone(src)
+	for at := reused; at < len(src) && err == nil; at += seg {
+		_, err = r.Write(src[at:min(at+seg, len(src))])
+		if err == nil && at+seg < len(src) {
+			c.states = append(c.states, c.save(r))
+		}
+	}
+	c.code = slices.Clone(r.wr.Bytes())
+	if err != nil {
+		return reused, err
+	}
+	return reused, r.Close()
+}
+
+// save returns the state of r, which is converting c.src.
+func (c *Incremental) save(r *FromBF) savedBF {
+	s := savedBF{r: r.clone(), code: r.wr.Len(), warnings: len(c.warnings)}
+	s.r.wr, s.r.wrap = nil, nil
+	return s
+}
+
+// clone returns a copy of r converting independently of it, sharing
+// its buffered code.
+func (r *FromBF) clone() *FromBF {
+	c := *r
+	scan := *r.scan
+	scan.win = slices.Clone(r.scan.win)
+	c.scan = &scan
+	c.procs = maps.Clone(r.procs)
+	c.defs = slices.Clone(r.defs)
+	c.defOf = maps.Clone(r.defOf)
+	c.proc = slices.Clone(r.proc)
+	c.calls = slices.Clone(r.calls)
+	c.pending = slices.Clone(r.pending)
+	c.extTok = slices.Clone(r.extTok)
+	c.opens = slices.Clone(r.opens)
+	return &c
+}
@@ -0,0 +1,61 @@
+package mf
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"slices"
+	"testing"
+)
+
+// TestIncremental checks that each version converted by Incremental is
+// the MF binary and the warnings of converting it from scratch.
+func TestIncremental(t *testing.T) {
+	hanoi, err := os.ReadFile("bf/hanoi.bf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newBF := func(w io.Writer) *FromBF {
+		r := NewBFReader64(w, 4096)
+		r.Optimize = true
+		return r
+	}
+	var warnings []Warning
+	c := &Incremental{New: newBF, Segment: 256, Warn: func(w Warning) { warnings = append(warnings, w) }}
+	mid := len(hanoi) / 2
+	versions := []struct {
+		src    []byte
+		reused bool
+	}{
+		{hanoi, false},
+		{hanoi, true},
+		{append(bytes.Clone(hanoi[:mid]), append([]byte("+-x"), hanoi[mid:]...)...), true},
+		{append(bytes.Clone(hanoi), "[+"...), true},
+		{append([]byte("x"), hanoi...), false},
+		{append([]byte("x"), hanoi[:mid]...), true}, // replays the warning
+	}
+	for i, v := range versions {
+		var want bytes.Buffer
+		var wantWarnings []Warning
+		r := newBF(&want)
+		r.Warn = func(w Warning) { wantWarnings = append(wantWarnings, w) }
+		r.Write(v.src)
+		wantErr := r.Close()
+
+		var got bytes.Buffer
+		warnings = nil
+		reused, err := c.Convert(&got, v.src)
+		if (err == nil) != (wantErr == nil) {
+			t.Fatalf("version %d: error %v, want %v", i, err, wantErr)
+		}
+		if err == nil && !bytes.Equal(got.Bytes(), want.Bytes()) {
+			t.Errorf("version %d: MF differs from the conversion from scratch", i)
+		}
+		if !slices.Equal(warnings, wantWarnings) {
+			t.Errorf("version %d: warnings %v, want %v", i, warnings, wantWarnings)
+		}
+		if (reused > 0) != v.reused {
+			t.Errorf("version %d: reused %d bytes", i, reused)
+		}
+	}
+}
@@ -0,0 +1,396 @@
+package mf
+
+import (
+	"fmt"
+	"io"
+	"iter"
+)
+
+// Op is an MF operation.
+// Op values 0 through 7 are the same as the MF nibble codes.
+type Op byte
+
+// MF operations.
+const (
+	OpAdd     Op = iota // +
+	OpSub               // -
+	OpRight             // >
+	OpLeft              // <
+	OpOpen              // [
+	OpClose             // ]
+	OpOut               // .
+	OpIn                // ,
+	OpSet               // set current cell to Arg
+	OpClear             // zero Arg cells starting at the pointer
+	OpMove              // add current cell to the cell int32(Arg) away, then zero it; the pointer stays
+	OpScan              // move the pointer by int32(Arg) until the current cell is zero
+	OpTape              // switch to tape Arg
+	OpSyscall           // call syscall number Arg
+	OpExt               // extension operation not built in; Arg is the operand
+	OpNop               // alignment no-op
+	OpDict              // dictionary of Arg macros at the start of the code
+	OpMacro             // run macro Arg of the dictionary
+	OpRet               // return from a macro or a call
+	OpCall              // call the code at offset Arg, pushing the return offset
+	OpAddAt             // add to the cell at an offset from the pointer, see AddAt
+	OpDebug             // dump the pointer and the Arg cells on each side of it
+	OpAssert            // fault unless the current cell is Arg
+	OpShift             // move the pointer by int32(Arg)
+)
+
+// Extension operation kinds, stored in the top 8 bits of
+// a special code 7 operand. The low 24 bits are the argument.
+const (
+	ExtSet     byte = 1  // argument: cell value
+	ExtClear   byte = 2  // argument: number of cells
+	ExtMove    byte = 3  // argument: signed 24-bit offset of the destination cell
+	ExtScan    byte = 4  // argument: signed 24-bit pointer step
+	ExtOut     byte = 5  // argument: repeat count
+	ExtIn      byte = 6  // argument: repeat count
+	ExtTape    byte = 7  // argument: tape number
+	ExtSyscall byte = 8  // argument: syscall number
+	ExtDict    byte = 9  // argument: number of macros
+	ExtMacro   byte = 10 // argument: macro number
+	ExtRet     byte = 11 // argument: 0
+	ExtCall    byte = 12 // argument: code offset
+	ExtAddAt   byte = 13 // argument: signed 16-bit pointer offset, then cell value
+	ExtDebug   byte = 14 // argument: cells shown on each side of the pointer
+	ExtAssert  byte = 15 // argument: cell value
+	ExtShift   byte = 16 // argument: signed 24-bit pointer offset
+)
+
+// Instruction is a single MF operation.
+//
+// Arg is the repeat count for + - > < . , and the jump position
+// for [ ]. A zero jump position means it is not resolved yet.
+//
+// Offset is the byte offset of the instruction in the code it was
+// decoded or parsed from. Both instructions of a byte share its offset.
+type Instruction struct {
+	Op     Op
+	Arg    uint64
+	Offset int
+}
+
+func (op Op) String() string {
+	switch op {
+	case OpAdd, OpSub, OpRight, OpLeft, OpOpen, OpClose, OpOut, OpIn:
+		return bf[op : op+1]
+	case OpSet:
+		return "set"
+	case OpClear:
+		return "clear"
+	case OpMove:
+		return "move"
+	case OpScan:
+		return "scan"
+	case OpTape:
+		return "tape"
+	case OpSyscall:
+		return "syscall"
+	case OpExt:
+		return "ext"
+	case OpNop:
+		return "nop"
+	case OpDict:
+		return "dict"
+	case OpMacro:
+		return "macro"
+	case OpRet:
+		return "ret"
+	case OpCall:
+		return "call"
+	case OpAddAt:
+		return "addat"
+	case OpDebug:
+		return "dbg"
+	case OpAssert:
+		return "assert"
+	case OpShift:
+		return "shift"
+	}
+	return fmt.Sprintf("Op(%d)", byte(op))
+}
+
+func (in Instruction) String() string {
+	switch in.Op {
+	case OpOpen, OpClose, OpCall:
+		return fmt.Sprintf("%v 0x%x", in.Op, in.Arg)
+	case OpMove, OpScan, OpShift:
+		return fmt.Sprintf("%v %d", in.Op, int32(in.Arg))
+	case OpExt:
+		return fmt.Sprintf("ext 0x%08x", in.Arg)
+	case OpNop, OpRet:
+		return in.Op.String()
+	case OpAddAt:
+		off, n := in.AddAt()
+		return fmt.Sprintf("%v %d %d", in.Op, off, n)
+	}
+	return fmt.Sprintf("%v %d", in.Op, in.Arg)
+}
+
+// AddAt returns the pointer offset and the value added of an OpAddAt
+// instruction.
+func (in Instruction) AddAt() (off int, n byte) {
+	return int(int16(in.Arg >> 8)), byte(in.Arg)
+}
+
+// AddAtArg returns the Arg of an OpAddAt instruction
+// adding n to the cell at offset off from the pointer.
+func AddAtArg(off int16, n byte) uint64 {
+	return uint64(uint16(off))<<8 | uint64(n)
+}
+
+// ParseBF parses BF code into instructions.
+// Runs of + - > < . , are folded into a single instruction,
+// and every non-BF byte is ignored.
+func ParseBF(p []byte) []Instruction {
+	var ins []Instruction
+	for i, b := range p {
+		var op Op
+		switch b {
+		case '+':
+			op = OpAdd
+		case '-':
+			op = OpSub
+		case '>':
+			op = OpRight
+		case '<':
+			op = OpLeft
+		case '[':
+			ins = append(ins, Instruction{Op: OpOpen, Offset: i})
+			continue
+		case ']':
+			ins = append(ins, Instruction{Op: OpClose, Offset: i})
+			continue
+		case '.':
+			op = OpOut
+		case ',':
+			op = OpIn
+		default:
+			continue
+		}
+		if n := len(ins); n > 0 && ins[n-1].Op == op {
+			ins[n-1].Arg++
+		} else {
+			ins = append(ins, Instruction{Op: op, Arg: 1, Offset: i})
+		}
+	}
+	return ins
+}
+
+// DecodeMF decodes an MF binary into instructions with DecodeDefault.
+// Alignment no-ops are skipped.
+func DecodeMF(prog []byte) ([]Instruction, error) {
+	return DecodeMFMode(prog, DecodeDefault)
+}
+
+// decodeProgram decodes an MF binary, or parses BF code
+// if prog doesn't start with an MF magic.
+func decodeProgram(prog []byte) ([]Instruction, error) {
+	if len(prog) >= 4 && (string(prog[:4]) == Magic || string(prog[:4]) == BFMagic) {
+		return DecodeMF(prog)
+	}
+	return ParseBF(prog), nil
+}
+
+// DecodeMFMode decodes an MF binary into instructions with the mode.
+// Alignment no-ops are skipped.
+func DecodeMFMode(prog []byte, mode DecodeMode) ([]Instruction, error) {
+	prog, l, err := parseProg(prog)
+	if err != nil {
+		return nil, err
+	}
+	var ins []Instruction
+	pc, low := l.code, false
+	for pc < len(prog) {
+		in, next, nextLow, err := decode(prog, l, pc, low, mode)
+		if err != nil {
+			return ins, err
+		}
+		if in.Op != OpNop {
+			in.Offset = pc
+			ins = append(ins, in)
+		}
+		pc, low = next, nextLow
+	}
+	return ins, nil
+}
+
+// Instructions returns the instructions of the MF binary read from r,
+// decoded with DecodeDefault as DecodeMF does, with their byte offsets.
+// The binary is read as the instructions are, so it need not fit in
+// memory. An error, of reading r or of invalid code, is yielded with an
+// instruction holding only its offset, and ends the sequence.
+func Instructions(r io.Reader) iter.Seq2[Instruction, error] {
+	return func(yield func(Instruction, error) bool) {
+		s := &Scanner{r: r, mfOnly: true}
+		for s.Scan() {
+			if !yield(s.Token().In, nil) {
+				return
+			}
+		}
+		if err := s.Err(); err != nil {
+			yield(Instruction{Offset: s.Pos().Offset}, err)
+		}
+	}
+}
+
+// extOperand returns the special code 7 operand for an extension instruction.
+func extOperand(in Instruction) uint32 {
+	arg := uint32(in.Arg) & 0xffffff
+	switch in.Op {
+	case OpSet:
+		return uint32(ExtSet)<<24 | arg&0xff
+	case OpClear:
+		return uint32(ExtClear)<<24 | arg
+	case OpMove:
+		return uint32(ExtMove)<<24 | arg
+	case OpScan:
+		return uint32(ExtScan)<<24 | arg
+	case OpOut:
+		return uint32(ExtOut)<<24 | arg
+	case OpIn:
+		return uint32(ExtIn)<<24 | arg
+	case OpTape:
+		return uint32(ExtTape)<<24 | arg
+	case OpSyscall:
+		return uint32(ExtSyscall)<<24 | arg
+	case OpDict:
+		return uint32(ExtDict)<<24 | arg
+	case OpMacro:
+		return uint32(ExtMacro)<<24 | arg
+	case OpRet:
+		return uint32(ExtRet) << 24
+	case OpCall:
+		return uint32(ExtCall)<<24 | arg
+	case OpAddAt:
+		return uint32(ExtAddAt)<<24 | arg
+	case OpDebug:
+		return uint32(ExtDebug)<<24 | arg
+	case OpAssert:
+		return uint32(ExtAssert)<<24 | arg&0xff
+	case OpShift:
+		return uint32(ExtShift)<<24 | arg
+	case OpExt:
+		return uint32(in.Arg)
+	}
+	panic("not an extension instruction")
+}
+
+// extInstruction decodes a special code 7 operand.
+func extInstruction(operand uint64) (Instruction, error) {
+	if operand>>32 != 0 {
+		return Instruction{}, fmt.Errorf("extension operand 0x%x overflows 32 bits", operand)
+	}
+	arg := operand & 0xffffff
+	switch byte(operand >> 24) {
+	case ExtSet:
+		return Instruction{Op: OpSet, Arg: arg & 0xff}, nil
+	case ExtClear:
+		return Instruction{Op: OpClear, Arg: arg}, nil
+	case ExtMove:
+		return Instruction{Op: OpMove, Arg: uint64(uint32(int32(arg<<8) >> 8))}, nil
+	case ExtScan:
+		return Instruction{Op: OpScan, Arg: uint64(uint32(int32(arg<<8) >> 8))}, nil
+	case ExtOut:
+		return Instruction{Op: OpOut, Arg: arg}, nil
+	case ExtIn:
+		return Instruction{Op: OpIn, Arg: arg}, nil
+	case ExtTape:
+		return Instruction{Op: OpTape, Arg: arg}, nil
+	case ExtSyscall:
+		return Instruction{Op: OpSyscall, Arg: arg}, nil
+	case ExtDict:
+		return Instruction{Op: OpDict, Arg: arg}, nil
+	case ExtMacro:
+		return Instruction{Op: OpMacro, Arg: arg}, nil
+	case ExtRet:
+		return Instruction{Op: OpRet}, nil
+	case ExtCall:
+		return Instruction{Op: OpCall, Arg: arg}, nil
+	case ExtAddAt:
+		return Instruction{Op: OpAddAt, Arg: arg}, nil
+	case ExtDebug:
+		return Instruction{Op: OpDebug, Arg: arg}, nil
+	case ExtAssert:
+		return Instruction{Op: OpAssert, Arg: arg & 0xff}, nil
+	case ExtShift:
+		return Instruction{Op: OpShift, Arg: uint64(uint32(int32(arg<<8) >> 8))}, nil
+	}
+	return Instruction{Op: OpExt, Arg: operand}, nil
+}
+
+// DecodeMode selects how MF encodings the spec leaves undefined
+// or discouraged are decoded.
+type DecodeMode int
+
+// Decode modes.
+const (
+	// DecodeDefault decodes non-special 4 and 5 nibbles as no-ops,
+	// and discards the nibble after a special code in a high nibble.
+	DecodeDefault DecodeMode = iota
+	// DecodeStrict rejects non-special 4 and 5 nibbles, no-op codes in
+	// high nibbles, and nibbles discarded after special codes.
+	DecodeStrict
+	// DecodeLegacy is DecodeDefault, except that a no-op code in a
+	// high nibble takes a 4-byte operand, as in interpreter/mf.py.
+	DecodeLegacy
+)
+
+// decode decodes the instruction at byte pc of an MF binary with layout l.
+// If low is true, decoding starts from the low nibble of the byte.
+// It returns the instruction and the position of the next one.
+func decode(prog []byte, l layout, pc int, low bool, mode DecodeMode) (in Instruction, next int, nextLow bool, err error) {
+	return decodeWindow(prog, 0, l, pc, low, mode)
+}
+
+// decodeWindow is decode of part of an MF binary: prog holds its bytes
+// from offset base, up to its end or at least past the instruction at pc.
+func decodeWindow(prog []byte, base int, l layout, pc int, low bool, mode DecodeMode) (in Instruction, next int, nextLow bool, err error) {
+	end := base + len(prog)
+	if pc < base || pc >= end {
+		return in, pc, false, fmt.Errorf("decode: offset %d out of range", pc)
+	}
+	c := prog[pc-base]
+	n := c >> 4
+	if low {
+		n = c & 0xf
+	}
+	switch {
+	case mode == DecodeStrict && (n == 4 || n == 5):
+		return in, pc, low, fmt.Errorf("decode: undefined non-special nibble %d at offset %d", n, pc)
+	case mode == DecodeStrict && n == 8|6 && !low:
+		return in, pc, low, fmt.Errorf("decode: no-op code in high nibble at offset %d", pc)
+	case mode == DecodeStrict && n&8 != 0 && !low && c&0xf != 8|6:
+		return in, pc, low, fmt.Errorf("decode: nibble after special code is discarded at offset %d", pc)
+	case mode == DecodeLegacy && n == 8|6 && !low:
+		if pc+1+l.width > end {
+			return in, pc, low, fmt.Errorf("decode: truncated operand at offset %d", pc)
+		}
+		return Instruction{Op: OpNop}, pc + 1 + l.width, false, nil
+	}
+	if n&8 == 0 || n == 8|6 {
+		if !low {
+			next, nextLow = pc, true
+		} else {
+			next = pc + 1
+		}
+		switch {
+		case n == 8|6 || n == 4 || n == 5:
+			return Instruction{Op: OpNop}, next, nextLow, nil
+		default:
+			return Instruction{Op: Op(n), Arg: 1}, next, nextLow, nil
+		}
+	}
+	next = pc + 1 + l.width
+	if next > end {
+		return in, pc, low, fmt.Errorf("decode: truncated operand at offset %d", pc)
+	}
+	operand := l.operand(prog[pc+1-base : next-base])
+	if n&7 == 7 {
+		in, err = extInstruction(operand)
+		return in, next, false, err
+	}
+	return Instruction{Op: Op(n & 7), Arg: operand}, next, false, nil
+}
@@ -0,0 +1,100 @@
+package mf
+
+// journal is a bounded ring of undo records of executed instructions,
+// so that a Debugger can step backwards.
+type journal struct {
+	buf   []undo
+	head  int // index of the oldest record
+	count int
+}
+
+// undo restores the state before an instruction.
+type undo struct {
+	pc     int
+	low    bool
+	ptr    int
+	cur    uint64
+	steps  int64
+	status int
+	exited bool
+	spans  []cellSpan // cells of tape cur written by the instruction
+	calls  []int      // running macros, if the instruction changes them
+}
+
+// cellSpan is a run of saved cells starting at cell lo.
+type cellSpan struct {
+	lo    int
+	cells []byte
+}
+
+func newJournal(n int) *journal {
+	return &journal{buf: make([]undo, n)}
+}
+
+// push records u, dropping the oldest record if the journal is full.
+func (j *journal) push(u undo) {
+	if j.count < len(j.buf) {
+		j.buf[(j.head+j.count)%len(j.buf)] = u
+		j.count++
+		return
+	}
+	j.buf[j.head] = u
+	j.head = (j.head + 1) % len(j.buf)
+}
+
+// pop removes and returns the newest record.
+func (j *journal) pop() (undo, bool) {
+	if j.count == 0 {
+		return undo{}, false
+	}
+	j.count--
+	i := (j.head + j.count) % len(j.buf)
+	u := j.buf[i]
+	j.buf[i] = undo{}
+	return u, true
+}
+
+// save returns the undo record of in, about to be executed by v.
+// Syscalls and extension operations may write any cell, so they
+// save the whole current tape.
+func (v *VM) save(in Instruction) undo {
+	u := undo{v.pc, v.low, v.ptr, v.cur, v.steps, v.status, v.exited, nil, nil}
+	keep := func(lo, n int) {
+		if lo >= 0 && n > 0 && lo+n <= len(v.tape) {
+			u.spans = append(u.spans, cellSpan{lo, append([]byte(nil), v.tape[lo:lo+n]...)})
+		}
+	}
+	switch in.Op {
+	case OpAdd, OpSub, OpIn, OpSet:
+		keep(v.ptr, 1)
+	case OpClear:
+		keep(v.ptr, int(min(in.Arg, uint64(len(v.tape)-v.ptr))))
+	case OpMove:
+		keep(v.ptr, 1)
+		keep(v.ptr+int(int32(in.Arg)), 1)
+	case OpAddAt:
+		off, _ := in.AddAt()
+		keep(v.ptr+off, 1)
+	case OpSyscall, OpExt:
+		keep(0, len(v.tape))
+	case OpMacro, OpRet, OpCall:
+		u.calls = append([]int{}, v.calls...)
+	}
+	return u
+}
+
+// restore undoes an instruction with its undo record. Input read and
+// output written are not undone, nor are other effects of syscalls.
+func (v *VM) restore(u undo) {
+	if u.cur != v.cur {
+		v.switchTape(u.cur) // the tape is saved, so this doesn't allocate
+	}
+	for _, s := range u.spans {
+		copy(v.tape[s.lo:], s.cells)
+	}
+	if u.calls != nil {
+		v.calls = u.calls
+	}
+	v.pc, v.low, v.ptr = u.pc, u.low, u.ptr
+	v.steps, v.status, v.exited = u.steps, u.status, u.exited
+}
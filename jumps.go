@@ -0,0 +1,58 @@
+package mf
+
+import (
+	"fmt"
+	"iter"
+)
+
+// JumpPair is a [ and the ] matching it in an MF binary.
+type JumpPair struct {
+	Open, Close CodePos
+}
+
+// JumpPairs returns the matched brackets of the MF binary code, decoded
+// with DecodeDefault, in the order their ] are found. An unmatched ]
+// yields an error and is skipped, and each [ left unmatched at the end
+// yields an error after the pairs; both are PosErrors at the bracket.
+// Invalid code yields an error and ends the sequence. Brackets are
+// matched by nesting, whatever their operands say.
+func JumpPairs(code []byte) iter.Seq2[JumpPair, error] {
+	return func(yield func(JumpPair, error) bool) {
+		code, l, err := parseProg(code)
+		if err != nil {
+			yield(JumpPair{}, err)
+			return
+		}
+		var open []CodePos
+		for pc, low := l.code, false; pc < len(code); {
+			in, next, nextLow, err := decode(code, l, pc, low, DecodeDefault)
+			if err != nil {
+				yield(JumpPair{}, err)
+				return
+			}
+			at := CodePos{pc, low}
+			pc, low = next, nextLow
+			switch in.Op {
+			case OpOpen:
+				open = append(open, at)
+			case OpClose:
+				if len(open) == 0 {
+					if !yield(JumpPair{Close: at}, &PosError{Pos{Offset: at.Offset, Low: at.Low}, fmt.Errorf("unmatched ']'")}) {
+						return
+					}
+					continue
+				}
+				p := JumpPair{open[len(open)-1], at}
+				open = open[:len(open)-1]
+				if !yield(p, nil) {
+					return
+				}
+			}
+		}
+		for _, at := range open {
+			if !yield(JumpPair{Open: at}, &PosError{Pos{Offset: at.Offset, Low: at.Low}, fmt.Errorf("unmatched '['")}) {
+				return
+			}
+		}
+	}
+}
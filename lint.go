@@ -0,0 +1,235 @@
+package mf
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Severity is the severity of a Diagnostic.
+type Severity int
+
+// Diagnostic severities.
+const (
+	SeverityInfo Severity = iota
+	SeverityWarning
+	SeverityError
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityInfo:
+		return "info"
+	case SeverityWarning:
+		return "warning"
+	case SeverityError:
+		return "error"
+	}
+	return fmt.Sprintf("Severity(%d)", int(s))
+}
+
+// Diagnostic is a finding about a program.
+type Diagnostic struct {
+	Pos      Position
+	Severity Severity
+	Code     string // one of the Diag constants
+	Message  string
+}
+
+// Diagnostic codes.
+const (
+	DiagUnbalanced   = "unbalanced-bracket" // unbalanced [ or ]
+	DiagInfiniteLoop = "infinite-loop"      // loop never terminates
+	DiagUnreachable  = "unreachable"        // code after an infinite loop
+	DiagCommentLoop  = "comment-loop"       // loop at program start never entered
+	DiagDeadLoop     = "dead-loop"          // loop never entered
+	DiagOverflow     = "overflow"           // cell value wraps around
+)
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%v: %v: %s", d.Pos, d.Severity, d.Message)
+}
+
+// LintBF reports obviously broken parts of BF code:
+// loops that are never entered, loops that never terminate,
+// and code after a loop that never terminates.
+//
+// The analysis follows the program from the start on a zero tape,
+// and only as far as cell values can be known without running it.
+func LintBF(p []byte) []Diagnostic {
+	if err := ValidateBF(p); err != nil {
+		var diags []Diagnostic
+		for _, err := range err.(interface{ Unwrap() []error }).Unwrap() {
+			var be *BracketError
+			if errors.As(err, &be) {
+				diags = append(diags, Diagnostic{be.Pos, SeverityError, DiagUnbalanced, be.Error()})
+			}
+		}
+		return diags
+	}
+	var diags []Diagnostic
+	for _, l := range deadLoops(p) {
+		pos := positionOf(p, l.open)
+		switch {
+		case l.infinite:
+			diags = append(diags, Diagnostic{pos, SeverityError, DiagInfiniteLoop, "loop never terminates"})
+			if next := nextCommand(p, l.close+1); next >= 0 {
+				diags = append(diags, Diagnostic{positionOf(p, next), SeverityWarning, DiagUnreachable, "unreachable code after infinite loop"})
+			}
+		case l.leading:
+			diags = append(diags, Diagnostic{pos, SeverityInfo, DiagCommentLoop, "loop at program start is never entered (comment loop?)"})
+		default:
+			diags = append(diags, Diagnostic{pos, SeverityWarning, DiagDeadLoop, "loop is never entered"})
+		}
+	}
+	return diags
+}
+
+// deadLoop is a loop found by deadLoops.
+type deadLoop struct {
+	open, close int
+	leading     bool // whether no BF command precedes the loop
+	infinite    bool // never terminates, rather than never entered
+}
+
+// deadLoops follows balanced BF code from the start on a zero tape,
+// and returns loops that are never entered and the first loop that
+// never terminates, if any, in source order.
+func deadLoops(p []byte) []deadLoop {
+	match := matchBrackets(p)
+	var loops []deadLoop
+	s := newTapeState()
+	leading := true
+	for i := 0; i < len(p); i++ {
+		switch p[i] {
+		case '+':
+			s.add(1)
+		case '-':
+			s.add(255)
+		case '>':
+			s.ptr++
+		case '<':
+			s.ptr--
+		case ',':
+			s.input()
+		case '[':
+			v, ok := s.get()
+			end := match[i]
+			switch {
+			case ok && v == 0:
+				loops = append(loops, deadLoop{open: i, close: end, leading: leading})
+				i = end
+				continue
+			case ok && loopNeverEnds(p[i+1:end]):
+				return append(loops, deadLoop{open: i, close: end, leading: leading, infinite: true})
+			}
+			i = end
+			s.reset()
+		}
+		if isBF(p[i]) {
+			leading = false
+		}
+	}
+	return loops
+}
+
+// loopNeverEnds reports whether a loop body, entered with a nonzero cell,
+// can be proven to keep the cell nonzero forever.
+func loopNeverEnds(body []byte) bool {
+	ptr, delta := 0, 0
+	for _, b := range body {
+		switch b {
+		case '+':
+			if ptr == 0 {
+				delta++
+			}
+		case '-':
+			if ptr == 0 {
+				delta--
+			}
+		case '>':
+			ptr++
+		case '<':
+			ptr--
+		case '[', ']', ',':
+			return false
+		}
+	}
+	return ptr == 0 && delta%256 == 0
+}
+
+// tapeState tracks statically known cell values,
+// relative to the pointer position at some point of the program.
+type tapeState struct {
+	known   map[int]byte
+	unknown map[int]bool // cells read from input, not zero even if zero is set
+	ptr     int
+	zero    bool // whether cells not in known or unknown are zero
+}
+
+func newTapeState() *tapeState {
+	return &tapeState{known: make(map[int]byte), unknown: make(map[int]bool), zero: true}
+}
+
+func (s *tapeState) get() (byte, bool) {
+	v, ok := s.known[s.ptr]
+	if !ok && s.zero && !s.unknown[s.ptr] {
+		return 0, true
+	}
+	return v, ok
+}
+
+// input forgets the current cell, as after ','.
+func (s *tapeState) input() {
+	delete(s.known, s.ptr)
+	s.unknown[s.ptr] = true
+}
+
+func (s *tapeState) add(n byte) {
+	if v, ok := s.get(); ok {
+		s.known[s.ptr] = v + n
+	}
+}
+
+// reset forgets everything but the current cell being zero,
+// as after a loop.
+func (s *tapeState) reset() {
+	clear(s.known)
+	clear(s.unknown)
+	s.ptr, s.zero = 0, false
+	s.known[0] = 0
+}
+
+// matchBrackets returns the matching bracket offset for each bracket.
+// The brackets must be balanced.
+func matchBrackets(p []byte) map[int]int {
+	match := make(map[int]int)
+	var open []int
+	for i, b := range p {
+		switch b {
+		case '[':
+			open = append(open, i)
+		case ']':
+			j := open[len(open)-1]
+			open = open[:len(open)-1]
+			match[i], match[j] = j, i
+		}
+	}
+	return match
+}
+
+func nextCommand(p []byte, from int) int {
+	for i := from; i < len(p); i++ {
+		if isBF(p[i]) {
+			return i
+		}
+	}
+	return -1
+}
+
+func isBF(b byte) bool {
+	switch b {
+	case '+', '-', '>', '<', '[', ']', '.', ',':
+		return true
+	}
+	return false
+}
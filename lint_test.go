@@ -0,0 +1,31 @@
+package mf
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestLintBF(t *testing.T) {
+	tests := []struct {
+		src   string
+		codes []string
+	}{
+		{",[.,]", nil},
+		{"+,[.,]", nil},
+		{">,<+[-]>[.,]", nil},
+		{",>[.]", []string{DiagDeadLoop}},
+		{"[comment]+[.]", []string{DiagCommentLoop, DiagInfiniteLoop}},
+		{"+[]+", []string{DiagInfiniteLoop, DiagUnreachable}},
+		{"+[-][.]", []string{DiagDeadLoop}},
+		{"+[-]+[-],[.,]", nil},
+	}
+	for _, tt := range tests {
+		var codes []string
+		for _, d := range LintBF([]byte(tt.src)) {
+			codes = append(codes, d.Code)
+		}
+		if !slices.Equal(codes, tt.codes) {
+			t.Errorf("LintBF(%q) = %v, want %v", tt.src, codes, tt.codes)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package mf
+
+import "fmt"
+
+// Loop describes a loop of a program, see AnalyzeLoops.
+type Loop struct {
+	Offset int // byte offset of the [
+	Close  int // byte offset of the ]
+	Depth  int // nesting depth, 1 for outermost loops
+	Body   int // number of instructions inside, nested loops included
+
+	// Balanced reports whether the pointer is back where it was at the
+	// end of every iteration. Loops with scans, tape switches or nested
+	// unbalanced loops are not balanced.
+	Balanced bool
+
+	// Idiom is the known idiom the loop matches, if any:
+	//
+	//	clear   [-] [+], which Optimize turns into set
+	//	scan    [>] [<<], which Optimize turns into scan
+	//	move    [->>+<<], which Optimize turns into move
+	//	linear  a balanced loop of only + - > < that decrements its
+	//	        cell by one, such as [->+>+++<<], which adds multiples
+	//	        of the cell to others
+	Idiom string
+}
+
+func (l Loop) String() string {
+	balanced := "unbalanced"
+	if l.Balanced {
+		balanced = "balanced"
+	}
+	s := fmt.Sprintf("loop at 0x%x: depth %d, %d instructions, %s", l.Offset, l.Depth, l.Body, balanced)
+	if l.Idiom != "" {
+		s += ", " + l.Idiom
+	}
+	return s
+}
+
+// AnalyzeLoops decodes an MF binary, or parses BF code if prog doesn't
+// start with an MF magic, and returns its loops in program order.
+func AnalyzeLoops(prog []byte) ([]Loop, error) {
+	ins, err := decodeProgram(prog)
+	if err != nil {
+		return nil, err
+	}
+	var loops []Loop
+	type frame struct {
+		loop     int   // index in loops
+		at       int   // index of the [
+		move     int64 // net pointer movement so far
+		balanced bool
+	}
+	var open []frame
+	for i, in := range ins {
+		if in.Op == OpOpen {
+			open = append(open, frame{len(loops), i, 0, true})
+			loops = append(loops, Loop{Offset: in.Offset, Depth: len(open)})
+			continue
+		}
+		if len(open) == 0 {
+			if in.Op == OpClose {
+				return nil, fmt.Errorf("unmatched ']' at offset %d", in.Offset)
+			}
+			continue
+		}
+		f := &open[len(open)-1]
+		switch in.Op {
+		case OpRight:
+			f.move += int64(in.Arg)
+		case OpLeft:
+			f.move -= int64(in.Arg)
+		case OpShift:
+			f.move += int64(int32(in.Arg))
+		case OpScan, OpTape, OpMacro, OpCall:
+			f.balanced = false
+		case OpClose:
+			l := &loops[f.loop]
+			l.Close = in.Offset
+			l.Body = i - f.at - 1
+			l.Balanced = f.balanced && f.move == 0
+			l.Idiom = loopIdiom(ins[f.at:i+1], l.Balanced)
+			open = open[:len(open)-1]
+			if len(open) > 0 && !l.Balanced {
+				open[len(open)-1].balanced = false
+			}
+		}
+	}
+	if len(open) > 0 {
+		return nil, fmt.Errorf("unmatched '[' at offset %d", ins[open[len(open)-1].at].Offset)
+	}
+	return loops, nil
+}
+
+// loopIdiom returns the idiom of the loop ins, from [ to ].
+func loopIdiom(ins []Instruction, balanced bool) string {
+	switch {
+	case len(ins) == 3 && clearLoop(ins):
+		return "clear"
+	case len(ins) == 3:
+		if _, ok := scanLoop(ins); ok {
+			return "scan"
+		}
+	case len(ins) == 6:
+		if _, ok := moveLoop(ins); ok {
+			return "move"
+		}
+	}
+	if !balanced {
+		return ""
+	}
+	var ptr int64
+	var delta byte // of the loop cell per iteration
+	for _, in := range ins[1 : len(ins)-1] {
+		switch in.Op {
+		case OpRight:
+			ptr += int64(in.Arg)
+		case OpLeft:
+			ptr -= int64(in.Arg)
+		case OpShift:
+			ptr += int64(int32(in.Arg))
+		case OpAdd:
+			if ptr == 0 {
+				delta += byte(in.Arg)
+			}
+		case OpSub:
+			if ptr == 0 {
+				delta -= byte(in.Arg)
+			}
+		default:
+			return ""
+		}
+	}
+	if delta == 0xff {
+		return "linear"
+	}
+	return ""
+}
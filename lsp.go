@@ -0,0 +1,259 @@
+package mf
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// ServeLSP serves the Language Server Protocol for MF assembly on r and w,
+// usually stdin and stdout of an editor's language server process.
+// It provides diagnostics, go-to-definition of labels, and hovers showing
+// the encoding of instructions and label offsets. It returns when the
+// client exits or r ends.
+//
+// Positions count bytes, which is only right for ASCII in UTF-16 clients.
+func ServeLSP(r io.Reader, w io.Writer) error {
+	s := &lspServer{r: textproto.NewReader(bufio.NewReader(r)), w: w, docs: make(map[string]*AsmFile)}
+	for {
+		msg, err := s.read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if msg.Method == "exit" {
+			return nil
+		}
+		result, err := s.handle(msg)
+		if msg.ID == nil {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		reply := map[string]any{"jsonrpc": "2.0", "id": msg.ID}
+		if rerr, ok := err.(*lspError); ok {
+			reply["error"] = rerr
+		} else if err != nil {
+			return err
+		} else {
+			reply["result"] = result
+		}
+		if err := s.write(reply); err != nil {
+			return err
+		}
+	}
+}
+
+type lspServer struct {
+	r    *textproto.Reader
+	w    io.Writer
+	docs map[string]*AsmFile // by URI
+}
+
+type lspMessage struct {
+	ID     *json.RawMessage `json:"id"`
+	Method string           `json:"method"`
+	Params json.RawMessage  `json:"params"`
+}
+
+// lspError is an error reply to a request.
+type lspError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *lspError) Error() string {
+	return e.Message
+}
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+// lspSpan returns the range of columns col to end of a line,
+// all numbered from 1.
+func lspSpan(line, col, end int) lspRange {
+	return lspRange{lspPosition{line - 1, col - 1}, lspPosition{line - 1, end - 1}}
+}
+
+type lspDocPosition struct {
+	TextDocument struct {
+		URI string `json:"uri"`
+	} `json:"textDocument"`
+	Position lspPosition `json:"position"`
+}
+
+// maxLSPMessage bounds the Content-Length of a message the server reads,
+// far above any MF assembly document, so a bad header cannot make it
+// allocate without bound.
+const maxLSPMessage = 64 << 20
+
+func (s *lspServer) read() (*lspMessage, error) {
+	h, err := s.r.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(h.Get("Content-Length"))
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("lsp: invalid Content-Length %q", h.Get("Content-Length"))
+	}
+	if n > maxLSPMessage {
+		return nil, fmt.Errorf("lsp: message of %d bytes exceeds %d", n, maxLSPMessage)
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(s.r.R, body); err != nil {
+		return nil, err
+	}
+	msg := new(lspMessage)
+	if err := json.Unmarshal(body, msg); err != nil {
+		return nil, fmt.Errorf("lsp: %w", err)
+	}
+	return msg, nil
+}
+
+func (s *lspServer) write(msg any) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(s.w, "Content-Length: %d\r\n\r\n%s", len(body), body)
+	return err
+}
+
+// handle handles a message, and returns the result for requests.
+func (s *lspServer) handle(msg *lspMessage) (any, error) {
+	switch msg.Method {
+	case "initialize":
+		return map[string]any{
+			"capabilities": map[string]any{
+				"textDocumentSync":   1, // full
+				"hoverProvider":      true,
+				"definitionProvider": true,
+			},
+			"serverInfo": map[string]string{"name": "mf"},
+		}, nil
+	case "shutdown":
+		return nil, nil
+	case "textDocument/didOpen", "textDocument/didChange":
+		var p struct {
+			TextDocument struct {
+				URI  string `json:"uri"`
+				Text string `json:"text"`
+			} `json:"textDocument"`
+			ContentChanges []struct {
+				Text string `json:"text"`
+			} `json:"contentChanges"`
+		}
+		if err := json.Unmarshal(msg.Params, &p); err != nil {
+			return nil, fmt.Errorf("lsp: %w", err)
+		}
+		text := p.TextDocument.Text
+		if n := len(p.ContentChanges); n > 0 {
+			text = p.ContentChanges[n-1].Text
+		}
+		f := ParseAsm([]byte(text))
+		s.docs[p.TextDocument.URI] = f
+		return nil, s.publish(p.TextDocument.URI, f.Errors)
+	case "textDocument/didClose":
+		var p lspDocPosition
+		if err := json.Unmarshal(msg.Params, &p); err != nil {
+			return nil, fmt.Errorf("lsp: %w", err)
+		}
+		delete(s.docs, p.TextDocument.URI)
+		return nil, s.publish(p.TextDocument.URI, nil)
+	case "textDocument/definition", "textDocument/hover":
+		var p lspDocPosition
+		if err := json.Unmarshal(msg.Params, &p); err != nil {
+			return nil, &lspError{-32602, err.Error()}
+		}
+		f := s.docs[p.TextDocument.URI]
+		if f == nil {
+			return nil, nil
+		}
+		line, col := p.Position.Line+1, p.Position.Character+1
+		if msg.Method == "textDocument/hover" {
+			return asmHover(f, line, col), nil
+		}
+		if l := asmLabelAt(f, line, col); l != nil {
+			return map[string]any{"uri": p.TextDocument.URI, "range": lspSpan(l.Line, l.Col, l.End)}, nil
+		}
+		return nil, nil
+	}
+	if msg.ID != nil {
+		return nil, &lspError{-32601, "method not found: " + msg.Method}
+	}
+	return nil, nil // notifications we don't care about
+}
+
+// publish publishes the diagnostics of a document.
+func (s *lspServer) publish(uri string, errs []*AsmError) error {
+	diags := []map[string]any{}
+	for _, e := range errs {
+		diags = append(diags, map[string]any{
+			"range":    lspSpan(e.Line, e.Col, e.End),
+			"severity": 1,
+			"source":   "mf",
+			"message":  e.Msg,
+		})
+	}
+	return s.write(map[string]any{
+		"jsonrpc": "2.0",
+		"method":  "textDocument/publishDiagnostics",
+		"params":  map[string]any{"uri": uri, "diagnostics": diags},
+	})
+}
+
+// asmLabelAt returns the label defined or referenced at a position.
+func asmLabelAt(f *AsmFile, line, col int) *AsmLabel {
+	for _, l := range f.Labels {
+		if l.Line == line && col >= l.Col && col <= l.End {
+			return l
+		}
+	}
+	for _, st := range f.Stmts {
+		if st.Line == line && st.Target != "" && col >= st.TargetAt && col <= st.TargetAt+len(st.Target) {
+			return f.Labels[st.Target]
+		}
+	}
+	return nil
+}
+
+// asmHover returns the hover of a position: the offset of a label,
+// or the offset and encoding of an instruction.
+func asmHover(f *AsmFile, line, col int) any {
+	hover := func(text string, r lspRange) any {
+		return map[string]any{"contents": map[string]string{"kind": "plaintext", "value": text}, "range": r}
+	}
+	if l := asmLabelAt(f, line, col); l != nil {
+		return hover(fmt.Sprintf("label %s at offset 0x%x", l.Name, l.Offset), lspSpan(l.Line, l.Col, l.End))
+	}
+	for _, st := range f.Stmts {
+		if st.Line != line || col < st.Col || col > st.End {
+			continue
+		}
+		nibble := "high"
+		if st.Low {
+			nibble = "low"
+		}
+		hex := make([]string, len(st.Bytes))
+		for i, b := range st.Bytes {
+			hex[i] = fmt.Sprintf("%02x", b)
+		}
+		text := fmt.Sprintf("%v\noffset 0x%x, %s nibble\nbytes: %s", st.In, st.In.Offset, nibble, strings.Join(hex, " "))
+		return hover(text, lspSpan(st.Line, st.Col, st.End))
+	}
+	return nil
+}
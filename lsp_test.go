@@ -0,0 +1,16 @@
+package mf
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestServeLSPContentLength(t *testing.T) {
+	for _, n := range []string{"-1", "x", "9223372036854775807"} {
+		in := "Content-Length: " + n + "\r\n\r\n{}"
+		if err := ServeLSP(strings.NewReader(in), io.Discard); err == nil {
+			t.Errorf("Content-Length %s: no error", n)
+		}
+	}
+}
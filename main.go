@@ -3,12 +3,32 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"math/rand"
+	"net"
 	"os"
+	"os/exec"
+	"os/signal"
 	"path"
+	"path/filepath"
 	"runtime"
+	"runtime/debug"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/cr0sh/mf"
 )
@@ -17,30 +37,226 @@ const help = `
 MF-tools v1.1
 
 Command usage:
-m2b <filename> : convert MF to BF
-b2m <filename> <memsize> : convert BF to MF
+[-q|-v|-vv] [--format json] [--no-cache] <command> ... :
+    -q hides warnings, -v logs conversion statistics and -vv also
+    logs details such as jump patching, to stderr; --format json
+    prints diagnostics of validate, lint and conversions as JSON
+    lines with severity, code, offset and message; --no-cache
+    converts even if the conversion cache has the output
+m2b <filename> [--legacy-brackets] [--report] [--progress] [--debug-hash]
+    [--assert-loops] [--offsets] [--no-preamble] [--target <name>] :
+    convert MF to BF; --debug-hash writes dbg operations as #, and
+    --assert-loops writes assert operations as code looping forever if
+    they fail, instead of dropping them
+    --offsets writes the offset of each MF code byte as @<offset> before
+    the BF code converted from it
+    --no-preamble skips the BetterBF code allocating the memsize, for
+    interpreters with a large zeroed tape
+    --target sets the options for a BF interpreter: betterbf, the
+    default, bff, beef or generic-8bit
+b2m <filename> <memsize> [--report] [--progress] [--eval|--eval-output]
+    [--compress-optimal|--compress-aligned] [--canonical] [--fix-brackets] :
+    convert BF to MF, 64-bit MF if memsize needs it
+    --fix-brackets drops ] without a [ and closes [ left open at the
+    end, warning of each, instead of failing on unbalanced brackets
+    --compress-optimal compresses runs only where that is shorter,
+    instead of runs longer than 9; --compress-aligned also splits runs
+    to save alignment nibbles, for the smallest MF
+    --canonical writes MF re-encoded as the canonical command does
+    --eval runs BF that reads no input, and writes MF only printing
+    its output; --eval-output writes the output to <filename>.out instead
+    --progress shows the bytes converted on stderr
+    --report writes a JSON report of the conversion next to the output,
+    with sizes, SHA-256 hashes and statistics of both files, options
+    and warnings
+watch <filename> [<memsize>] [--interval <duration>] : convert BF to MF
+    as b2m does whenever the file changes, until interrupted, reusing
+    the conversion of the code before the first change
+    --interval is how often the file is checked, 500ms by default
+run <filename> [--core] [--profile <file>] [--trust <key.pub>]... [--stream]
+    [--in <file>|--in-hex <hex>|--in-str <string>]... [--expect <script>]
+    [--record <file>|--replay <file>] [--raw] [--numeric] [--output utf8|hex] :
+    run MF, exiting with its exit status, write a core dump on fault,
+    and write a profile of instruction execution counts; with --trust,
+    only MF signed with one of the keys runs; --stream reads the code
+    from the file as it runs, for MF too large to load
+    --in, --in-hex and --in-str give the input instead of stdin: the
+    file, the bytes in hex, or the string with Go escapes such as \n,
+    one after another if given more than once
+    --expect <script> runs an interactive session of the script, with
+    lines such as expect "> ", send "42\n", close, expect eof and
+    timeout 5s, exiting with status 1 if the output does not match
+    --record <file> writes a session of the input, output, random bytes
+    and clock readings of the run, with their times, in JSON, which
+    --replay <file> runs again as recorded, exiting with status 1 if
+    the program does not write the same or end the same way
+    --raw reads the terminal a key at a time without echo while the
+    program runs, for games and editors, using stty
+    --numeric makes . write the cell as a decimal number on a line, and
+    , read a decimal number into the cell
+    --output utf8 shows the output as UTF-8, with U+FFFD for bytes that
+    are not, and --output hex shows it as a hexdump
+validate --bf <filename> : check BF bracket balance
+minify <filename> : minify BF
+dump <filename> : annotated hexdump of MF
+repair <filename> [--swap-bytes] : fix jump positions of old MF
+    --swap-bytes also swaps the memsize and run counts of MF written
+    little-endian by foreign writers, breaking valid MF with values of
+    1<<24 or more
+info <filename> : show statistics of MF or BF
+ratio <filename> [--threshold <n>] : show how BF compresses to MF, with
+    runs longer than n compressed, 9 by default, and the runs whose
+    other encoding would have been smaller
+diff <a.mf> <b.mf> : show instruction-level differences of MF
+lint [--overflow] <filename> : report obviously broken BF code,
+                               and cells that may wrap around
+core <filename> : show the fault, code and tape of an MF core dump
+debug <filename> : debug MF interactively, type help for commands
+loops <filename> : list the loops of MF or BF with their nesting,
+                   size, balance and idiom
+cfg <filename> [-o <file>] : write the control flow graph of MF or BF
+                             in Graphviz DOT format
+disasm <filename> [--profile <file>] : disassemble MF, with execution
+    counts and hot loops of the profile
+optimize <filename> [--profile <file>] : rewrite idioms of MF into
+    extension instructions, only in hot loops of the profile
+factor <filename> : move repeated code of MF into macros of a dictionary
+precompute <filename> : run the start of MF that reads no input, and
+    replace it with code setting the cells and writing the output
+set-memsize <filename> <memsize> [--check] : change the memsize in the
+    header of MF in place; --check first checks that the pointer of MF
+    converted from BF stays within it
+canonical <filename> : re-encode MF canonically, so that MF running the
+    same instructions gets the same bytes, e.g. to compare hashes
+pprof <filename> <profile> : convert a profile of MF to pprof format
+flame <filename> <profile> : write the loop stacks of a profile of MF
+                             as folded stacks for flame graphs
+bench <filename> [<other>] [-n <runs>] [-t <duration>] [--input <file>]
+    [--prealloc] : benchmark MF, comparing with the other MF if given;
+    --prealloc allocates the call stack and tapes before each run
+check <file.bf> [<file.mf>] [--input <file>]... [-t <timeout>] :
+    run BF and its MF conversion, converted now if not given,
+    on each input, and compare their outputs and how they end,
+    stopping runs after the timeout (default 1m)
+test [<path>...] : run the tests of MF programs, kept in a .mftest file
+    next to each program, and print a summary; a path is a program,
+    a test file or a directory, whose subdirectories are included if
+    it ends with /... (default ./...)
+fuzz <count> [-seed <n>] : check random BF programs on the converters
+    and the VM, printing a shrunk program if they disagree
+html <filename> [--profile <file>] : write an HTML page of the
+    disassembly, with execution counts of the profile
+asm <filename> : assemble MF assembly to MF
+lsp : serve the language server protocol for MF assembly on stdio
+cache clean : empty the conversion cache, which keeps the outputs of
+    m2b and b2m without --report by input, options and mf-tools build
+gdb <filename> [address] : debug MF with gdb, listening on the address
+                           for "target remote" (default localhost:1234)
+ar create <file.mfa> <filename>... : bundle MF files in an archive,
+    named by their file names
+ar list <file.mfa> : list the programs of an archive
+ar extract <file.mfa> [<name>]... : write the named programs of an
+    archive, or all of them, to files of their names
+build <filename> [-o <file>] [--target <os/arch>] [--mf-source <dir>] :
+    build a standalone executable running MF with the Go toolchain,
+    for the target platform if given; the mf package is fetched with
+    go get at the version of mf-tools, or taken from the source directory
+    if given
+keygen <name> : write an Ed25519 key pair to <name>.key and <name>.pub
+sign <filename> <key> : sign MF with the private key, replacing its
+    signature if it has one
+strip <filename> [-o <file>] : remove the optional sections of MF, of
+    which there is only the signature, in place or writing the file
+verify-sig <filename> <key.pub>... : check that MF is signed with one of
+    the public keys
+pipeline <filename>... : run MF or BF programs at once, each reading the
+    output of the one before, the first reading the input and the last
+    writing the output; BF is converted first, exiting with the exit
+    status of the last program
 `
 
 const defaultMemsize uint32 = 4096
 
+// precomputeSteps bounds the instructions run by precompute and b2m --eval.
+const precomputeSteps = 1 << 26
+
+var (
+	jsonFormat bool            // whether diagnostics are printed as JSON
+	quiet      bool            // whether warnings are hidden
+	logger     *slog.Logger    // of the converters, nil by default
+	noCache    bool            // whether the conversion cache is skipped
+	warned     []cachedWarning // warnings printed since the cache lookup
+)
+
 func main() {
-	if len(os.Args) < 3 {
+options:
+	for len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "-q":
+			quiet = true
+		case "--no-cache":
+			noCache = true
+		case "-v", "-vv":
+			level := slog.LevelInfo
+			if os.Args[1] == "-vv" {
+				level = slog.LevelDebug
+			}
+			logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+		case "--format":
+			if len(os.Args) < 3 || (os.Args[2] != "json" && os.Args[2] != "text") {
+				fmt.Println(help)
+				return
+			}
+			jsonFormat = os.Args[2] == "json"
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+		default:
+			break options
+		}
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+	if len(os.Args) < 3 && !(len(os.Args) == 2 && (os.Args[1] == "lsp" || os.Args[1] == "test")) {
 		fmt.Println(help)
 		return
 	}
-	go func() {
-		for {
-			var buf [4096]byte
-			fmt.Scanln()
-			runtime.Stack(buf[:], true)
-			fmt.Println(string(buf[:]))
-		}
-	}()
-
 	cmd := os.Args[1]
+	if cmd != "run" && cmd != "debug" && cmd != "gdb" && cmd != "lsp" && cmd != "pipeline" { // they read stdin for the program
+		go func() {
+			stdin := bufio.NewReader(os.Stdin)
+			for {
+				var buf [4096]byte
+				if _, err := stdin.ReadString('\n'); err != nil {
+					return
+				}
+				runtime.Stack(buf[:], true)
+				fmt.Println(string(buf[:]))
+			}
+		}()
+	}
+
 	switch cmd {
 	case "m2b":
-		fp, err := os.Create(os.Args[2][0:len(os.Args[2])-len(path.Ext(os.Args[2]))] + "_compile.bf")
+		report, progress := cutFlag("--report"), cutFlag("--progress")
+		debugHash, assertLoops := cutFlag("--debug-hash"), cutFlag("--assert-loops")
+		offsets, noPreamble := cutFlag("--offsets"), cutFlag("--no-preamble")
+		targetName, hasTarget := cutValue("--target")
+		var target mf.Target
+		if hasTarget {
+			var err error
+			if target, err = mf.LookupTarget(targetName); err != nil {
+				fmt.Println("error:", err)
+				return
+			}
+		}
+		legacy := len(os.Args) > 3 && os.Args[3] == "--legacy-brackets"
+		out := os.Args[2][0:len(os.Args[2])-len(path.Ext(os.Args[2]))] + "_compile.bf"
+		var key string
+		if !report {
+			var hit bool
+			if key, hit = cached("m2b", os.Args[2], out, legacy, debugHash, assertLoops, offsets, noPreamble, targetName); hit {
+				return
+			}
+		}
+		fp, err := os.Create(out)
 		if err != nil {
 			fmt.Println("error:", err)
 			return
@@ -50,40 +266,1959 @@ func main() {
 			fmt.Println("error:", err)
 			return
 		}
+		var warnings []record
+		warn := warningPrinter(os.Args[2])
 		r := mf.NewBFWriter(fp)
-		if _, err := io.Copy(r, fpp); err != nil {
-			fmt.Println("error:", err)
+		r.Logger = logger
+		r.Warn = func(w mf.Warning) {
+			warn(w)
+			warnings = append(warnings, warningRecord(os.Args[2], w))
+		}
+		if hasTarget {
+			target.Apply(r)
+		}
+		r.LegacyBrackets, r.AssertLoops, r.OffsetComments = legacy, assertLoops, offsets
+		r.DebugHash = r.DebugHash || debugHash
+		r.NoPreamble = r.NoPreamble || noPreamble
+		if fi, err := fpp.Stat(); err == nil && progress {
+			r.Progress = progressPrinter(fi.Size())
+		}
+		n, err := io.Copy(r, fpp)
+		if err == nil {
+			err = r.Close()
 		}
 		fpp.Close()
+		if fi, err := fp.Stat(); err == nil {
+			if logger != nil {
+				logger.Info("converted", "input", n, "size", fi.Size())
+			}
+			if r.Progress != nil {
+				r.Progress(n, fi.Size())
+				fmt.Fprintln(os.Stderr)
+			}
+		}
+		fp.Close()
+		if err != nil {
+			fmt.Println("error:", err)
+		} else if !report {
+			storeCache(key, out)
+		} else {
+			options := map[string]any{"legacy_brackets": r.LegacyBrackets, "debug_hash": r.DebugHash, "assert_loops": r.AssertLoops, "offset_comments": r.OffsetComments, "no_preamble": r.NoPreamble, "no_banner": r.NoBanner, "cell_bits": r.CellBits}
+			if hasTarget {
+				options["target"] = targetName
+			}
+			if err := writeReport(os.Args[2], out, options, warnings); err != nil {
+				fmt.Println("error:", err)
+			}
+		}
 
 	case "b2m":
-		var memsize uint32
+		report, progress := cutFlag("--report"), cutFlag("--progress")
+		eval, evalOutput := cutFlag("--eval"), cutFlag("--eval-output")
+		optimal := cutFlag("--compress-optimal")
+		aligned := cutFlag("--compress-aligned")
+		canonical := cutFlag("--canonical")
+		fix := cutFlag("--fix-brackets")
+		src, err := os.ReadFile(os.Args[2])
+		if err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		if err := mf.ValidateBF(src); err != nil && !fix {
+			if jsonFormat {
+				printBracketErrors(os.Args[2], err)
+			} else {
+				fmt.Println("error:", err)
+			}
+			return
+		}
+		var warnings []record
+		note := func(code, msg string) {
+			printNote(os.Args[2], code, msg)
+			warnings = append(warnings, record{os.Args[2], "warning", code, 0, 0, 0, msg})
+		}
+		var memsize uint64
+		source := "argument"
 		if len(os.Args) < 4 {
-			memsize = defaultMemsize
-			fmt.Println("warning: setting memsize to default", defaultMemsize)
+			if n, exact := mf.SuggestMemSize(src); n > 0 {
+				memsize = uint64(n)
+				if exact {
+					source = "suggested"
+					note("memsize", fmt.Sprint("setting memsize to suggested ", n))
+				} else {
+					source = "suggested upper bound"
+					note("memsize", fmt.Sprint("setting memsize to suggested upper bound ", n))
+				}
+			} else {
+				memsize = uint64(defaultMemsize)
+				source = "default"
+				note("memsize", fmt.Sprint("setting memsize to default ", defaultMemsize))
+			}
 		} else {
-			n, err := strconv.Atoi(os.Args[3])
-			if err != nil || n == 0 || uint64(n) >= (uint64(1)<<32) {
+			n, err := strconv.ParseUint(os.Args[3], 10, 64)
+			if err != nil || n == 0 {
 				fmt.Println("invalid memsize")
 				return
 			}
-			memsize = uint32(n)
+			memsize = n
+		}
+		if pr, err := mf.AnalyzePointerRange(src); err == nil {
+			if err := pr.Check(memsize); err != nil {
+				note("pointer-range", err.Error())
+			}
+		}
+		out := os.Args[2][0:len(os.Args[2])-len(path.Ext(os.Args[2]))] + ".mf"
+		if evalOutput {
+			out = os.Args[2][0:len(os.Args[2])-len(path.Ext(os.Args[2]))] + ".out"
+		}
+		var key string
+		if !report {
+			var hit bool
+			if key, hit = cached("b2m", os.Args[2], out, memsize, eval, evalOutput, optimal, aligned, canonical, fix); hit {
+				return
+			}
 		}
-		fp, err := os.Create(os.Args[2][0:len(os.Args[2])-len(path.Ext(os.Args[2]))] + ".mf")
+		fp, err := os.Create(out)
 		if err != nil {
 			fmt.Println("error:", err)
 			return
 		}
-		fpp, err := os.Open(os.Args[2])
+		var w io.Writer = fp
+		var conv bytes.Buffer // the conversion to evaluate or canonicalize
+		if eval || evalOutput || canonical {
+			w = &conv
+		}
+		warn := warningPrinter(os.Args[2])
+		r := mf.NewBFReader64(w, memsize)
+		r.Logger = logger
+		r.FixBrackets = fix
+		switch {
+		case aligned:
+			r.Compress = mf.CompressAligned
+		case optimal:
+			r.Compress = mf.CompressOptimal
+		}
+		r.Warn = func(w mf.Warning) {
+			warn(w)
+			warnings = append(warnings, warningRecord(os.Args[2], w))
+		}
+		if progress {
+			r.Progress = progressPrinter(int64(len(src)))
+		}
+		_, err = r.Write(src)
+		if err == nil {
+			err = r.Close()
+		}
+		if err == nil && canonical {
+			var prog []byte
+			if prog, err = mf.CanonicalMF(conv.Bytes()); err == nil {
+				conv.Reset()
+				conv.Write(prog)
+			}
+		}
+		if err == nil && (eval || evalOutput) {
+			prog, output, evalErr := mf.EvaluateMF(conv.Bytes(), precomputeSteps)
+			if evalOutput {
+				prog = output
+			}
+			if err = evalErr; err == nil {
+				_, err = fp.Write(prog)
+			}
+		} else if err == nil && canonical {
+			_, err = fp.Write(conv.Bytes())
+		}
+		fp.Close()
+		if progress {
+			fmt.Fprintln(os.Stderr)
+		}
 		if err != nil {
 			fmt.Println("error:", err)
 			return
 		}
-		r := mf.NewBFReader(fp, memsize)
-		io.Copy(r, fpp)
-		r.Close()
-		fpp.Close()
-	default:
-		fmt.Println(help)
+		storeCache(key, out)
+		if report {
+			options := map[string]any{"memsize": memsize, "memsize_source": source, "compress_optimal": optimal, "compress_aligned": aligned, "canonical": canonical, "fix_brackets": fix}
+			if eval || evalOutput {
+				options["eval"] = map[bool]string{false: "program", true: "output"}[evalOutput]
+			}
+			if err := writeReport(os.Args[2], out, options, warnings); err != nil {
+				fmt.Println("error:", err)
+			}
+		}
+	case "watch":
+		interval := 500 * time.Millisecond
+		if v, ok := cutValue("--interval"); ok {
+			var err error
+			if interval, err = time.ParseDuration(v); err != nil || interval <= 0 {
+				fmt.Println("invalid interval")
+				return
+			}
+		}
+		var memsize uint64
+		if len(os.Args) > 3 {
+			n, err := strconv.ParseUint(os.Args[3], 10, 64)
+			if err != nil || n == 0 {
+				fmt.Println("invalid memsize")
+				return
+			}
+			memsize = n
+		}
+		out := os.Args[2][0:len(os.Args[2])-len(path.Ext(os.Args[2]))] + ".mf"
+		var inc *mf.Incremental
+		var incMem uint64
+		var last os.FileInfo
+		for ; ; time.Sleep(interval) {
+			fi, err := os.Stat(os.Args[2])
+			if err != nil {
+				fmt.Println("error:", err)
+				return
+			}
+			if last != nil && fi.ModTime().Equal(last.ModTime()) && fi.Size() == last.Size() {
+				continue
+			}
+			last = fi
+			src, err := os.ReadFile(os.Args[2])
+			if err != nil {
+				fmt.Println("error:", err)
+				return
+			}
+			if err := mf.ValidateBF(src); err != nil {
+				fmt.Println("error:", err)
+				continue
+			}
+			n := memsize
+			if n == 0 {
+				if k, _ := mf.SuggestMemSize(src); k > 0 {
+					n = uint64(k)
+				} else {
+					n = uint64(defaultMemsize)
+				}
+			}
+			if inc == nil || n != incMem {
+				// the memsize is in the header, so nothing is reused
+				inc, incMem = &mf.Incremental{New: func(w io.Writer) *mf.FromBF { return mf.NewBFReader64(w, n) }}, n
+				inc.Warn = warningPrinter(os.Args[2])
+			}
+			var prog bytes.Buffer
+			start := time.Now()
+			reused, err := inc.Convert(&prog, src)
+			if err == nil {
+				err = os.WriteFile(out, prog.Bytes(), 0644)
+			}
+			if err != nil {
+				fmt.Println("error:", err)
+				continue
+			}
+			fmt.Printf("converted %s to %s in %v, reusing %d of %d bytes\n", os.Args[2], out, time.Since(start).Round(time.Microsecond), reused, len(src))
+		}
+	case "run":
+		var policy mf.Policy
+		for i := 3; i < len(os.Args)-1; i++ {
+			if os.Args[i] == "--trust" {
+				key, err := readPublicKey(os.Args[i+1])
+				if err != nil {
+					fmt.Println("error:", err)
+					return
+				}
+				policy.TrustedKeys = append(policy.TrustedKeys, key)
+			}
+		}
+		var vm *mf.VM
+		var err error
+		raw := cutFlag("--raw")
+		numeric := cutFlag("--numeric")
+		if cutFlag("--stream") {
+			var fp *os.File
+			var fi os.FileInfo
+			if fp, err = os.Open(os.Args[2]); err == nil {
+				defer fp.Close()
+				if fi, err = fp.Stat(); err == nil {
+					vm, err = mf.NewStreamVM(fp, fi.Size(), policy)
+				}
+			}
+		} else {
+			var prog []byte
+			if prog, err = os.ReadFile(os.Args[2]); err == nil {
+				vm, err = mf.NewSandboxVM(prog, policy)
+			}
+		}
+		if err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		vm.RegisterStdSyscalls()
+		vm.NumericIO = numeric
+		var core bytes.Buffer
+		var profile string
+		var input []byte
+		var script *mf.Expect
+		var session string
+		var replay bool
+		var output string
+		for i := 3; i < len(os.Args); i++ {
+			switch os.Args[i] {
+			case "--core":
+				vm.CoreDump = &core
+			case "--in", "--in-hex", "--in-str":
+				if i+1 == len(os.Args) {
+					fmt.Println(help)
+					return
+				}
+				b, err := readInput(os.Args[i], os.Args[i+1])
+				if err != nil {
+					fmt.Println("error:", err)
+					return
+				}
+				input = append(input, b...)
+				vm.In = bytes.NewReader(input)
+				i++
+			case "--expect":
+				if i+1 == len(os.Args) {
+					fmt.Println(help)
+					return
+				}
+				fp, err := os.Open(os.Args[i+1])
+				if err == nil {
+					script, err = mf.ParseExpect(fp)
+					fp.Close()
+				}
+				if err != nil {
+					fmt.Println("error:", err)
+					return
+				}
+				script.Echo = os.Stdout
+				i++
+			case "--output":
+				if i+1 == len(os.Args) || (os.Args[i+1] != "utf8" && os.Args[i+1] != "hex") {
+					fmt.Println(help)
+					return
+				}
+				output = os.Args[i+1]
+				i++
+			case "--record", "--replay":
+				if i+1 == len(os.Args) {
+					fmt.Println(help)
+					return
+				}
+				session = os.Args[i+1]
+				replay = os.Args[i] == "--replay"
+				i++
+			case "--profile":
+				if i+1 == len(os.Args) {
+					fmt.Println(help)
+					return
+				}
+				profile = os.Args[i+1]
+				vm.Profile = mf.NewProfile()
+				i++
+			case "--trust":
+				i++
+			}
+		}
+		var utf8Out *mf.UTF8Writer
+		var hexOut io.WriteCloser
+		switch output {
+		case "utf8":
+			utf8Out = &mf.UTF8Writer{W: os.Stdout}
+			vm.Out = utf8Out
+		case "hex":
+			hexOut = hex.Dumper(os.Stdout)
+			vm.Out = hexOut
+		}
+		if script != nil {
+			script.Echo = vm.Out
+		}
+		var recording mf.Session
+		switch {
+		case session != "" && script != nil:
+			fmt.Println("error: --expect cannot be used with --record or --replay")
+			return
+		case session != "" && replay:
+			fp, err := os.Open(session)
+			if err != nil {
+				fmt.Println("error:", err)
+				return
+			}
+			s, err := mf.ReadSession(fp)
+			fp.Close()
+			if err == nil {
+				err = vm.ReplaySession(s)
+			}
+			if err != nil {
+				fmt.Println("error:", err)
+				return
+			}
+		case session != "":
+			vm.RecordSession(&recording)
+		}
+		restore := func() {}
+		if raw {
+			if restore, err = rawTerminal(); err != nil {
+				fmt.Println("error:", err)
+				return
+			}
+		}
+		if script != nil {
+			err = script.Run(vm)
+		} else {
+			err = vm.Run()
+		}
+		restore()
+		if utf8Out != nil {
+			utf8Out.Flush()
+			if utf8Out.Invalid > 0 {
+				printNote(os.Args[2], "invalid-utf8", fmt.Sprintf("%d bytes of output are not UTF-8, shown as U+FFFD", utf8Out.Invalid))
+			}
+		}
+		if hexOut != nil {
+			hexOut.Close()
+		}
+		if session != "" && replay {
+			if err := vm.CheckReplay(err); err != nil {
+				fmt.Println("error:", err)
+				os.Exit(1)
+			}
+		} else if session != "" {
+			if err != nil {
+				recording.Result = err.Error()
+			}
+			fp, err := os.Create(session)
+			if err == nil {
+				err = recording.Write(fp)
+				fp.Close()
+			}
+			if err != nil {
+				fmt.Println("error:", err)
+			}
+		}
+		if vm.Profile != nil {
+			fp, err := os.Create(profile)
+			if err == nil {
+				err = vm.Profile.Write(fp)
+				fp.Close()
+			}
+			if err != nil {
+				fmt.Println("error:", err)
+			}
+		}
+		if err != nil {
+			var exit *mf.ExitError
+			if errors.As(err, &exit) {
+				os.Exit(exit.Status)
+			}
+			fmt.Println("error:", err)
+			if errors.Is(err, mf.ErrExpect) {
+				os.Exit(1)
+			}
+			if core.Len() > 0 {
+				name := os.Args[2][0:len(os.Args[2])-len(path.Ext(os.Args[2]))] + ".mfcore"
+				if err := os.WriteFile(name, core.Bytes(), 0644); err != nil {
+					fmt.Println("error:", err)
+				} else {
+					fmt.Println("core dumped to", name)
+				}
+			}
+		}
+	case "validate":
+		if os.Args[2] != "--bf" || len(os.Args) < 4 {
+			fmt.Println(help)
+			return
+		}
+		src, err := os.ReadFile(os.Args[3])
+		if err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		if err := mf.ValidateBF(src); err != nil {
+			if jsonFormat {
+				printBracketErrors(os.Args[3], err)
+			} else {
+				fmt.Println(err)
+			}
+			os.Exit(1)
+		}
+	case "minify":
+		src, err := os.ReadFile(os.Args[2])
+		if err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		min, err := mf.MinifyBF(src)
+		if err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		if err := os.WriteFile(os.Args[2][0:len(os.Args[2])-len(path.Ext(os.Args[2]))]+"_min.bf", min, 0644); err != nil {
+			fmt.Println("error:", err)
+		}
+	case "dump":
+		prog, err := os.ReadFile(os.Args[2])
+		if err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		if err := mf.Dump(os.Stdout, prog); err != nil {
+			fmt.Println("error:", err)
+		}
+	case "repair":
+		repair := mf.RepairMF
+		if cutFlag("--swap-bytes") {
+			repair = mf.RepairSwappedMF
+		}
+		prog, err := os.ReadFile(os.Args[2])
+		if err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		n, err := repair(prog)
+		if err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		fmt.Println(n, "fields repaired")
+		if err := os.WriteFile(os.Args[2][0:len(os.Args[2])-len(path.Ext(os.Args[2]))]+"_repaired.mf", prog, 0644); err != nil {
+			fmt.Println("error:", err)
+		}
+	case "info":
+		fp, err := os.Open(os.Args[2])
+		if err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		h, err := mf.ReadHeader(fp)
+		fp.Close()
+		if err == nil {
+			kind := "MF"
+			if h.Magic == mf.BFMagic {
+				kind = "MF converted from BF"
+			}
+			fmt.Printf("format: %s version %d, memsize %d\n", kind, h.Version, h.MemSize)
+		}
+		prog, err := os.ReadFile(os.Args[2])
+		if err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		s, err := mf.ProgramStats(prog)
+		if err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		fmt.Println("instructions:", s.Instructions)
+		for op := mf.OpAdd; op <= mf.OpAssert; op++ {
+			if n := s.Counts[op]; n > 0 {
+				fmt.Printf("  %-8v %d\n", op, n)
+			}
+		}
+		fmt.Println("loops:", s.Loops, "max depth:", s.MaxDepth)
+		fmt.Println("compressed runs:", s.CompressedRuns, "saving", s.CompressedSavings, "bytes")
+	case "ratio":
+		src, err := os.ReadFile(os.Args[2])
+		if err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		threshold := 0
+		if v, ok := cutValue("--threshold"); ok {
+			if threshold, err = strconv.Atoi(v); err != nil || threshold <= 0 {
+				fmt.Println("invalid threshold")
+				return
+			}
+		}
+		r, err := mf.ReportCompression(src, threshold)
+		if err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		fmt.Printf("BF %d bytes -> MF %d bytes (%.1f%%)\n", r.BFSize, r.MFSize, 100*float64(r.MFSize)/float64(max(r.BFSize, 1)))
+		fmt.Printf("  literal nibbles  %d\n", r.Literals)
+		fmt.Printf("  compressed runs  %d (%d nibbles)\n", r.Runs, r.RunNibbles)
+		fmt.Printf("  jumps            %d (%d nibbles)\n", r.Jumps, r.JumpNibbles)
+		fmt.Printf("  extensions       %d (%d nibbles)\n", r.Extensions, r.ExtNibbles)
+		fmt.Printf("  padding nibbles  %d\n", r.Padding)
+		fmt.Printf("  missed runs      %d (%d nibbles)\n", r.MissedRuns, r.MissedSaving)
+	case "diff":
+		if len(os.Args) < 4 {
+			fmt.Println(help)
+			return
+		}
+		a, err := os.ReadFile(os.Args[2])
+		if err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		b, err := os.ReadFile(os.Args[3])
+		if err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		changes, err := mf.Diff(a, b)
+		if err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		for _, c := range changes {
+			if c.Del {
+				fmt.Printf("- 0x%-8x 0x%-8x %v\n", c.Ins.Offset, c.Other, c.Ins)
+			} else {
+				fmt.Printf("+ 0x%-8x 0x%-8x %v\n", c.Other, c.Ins.Offset, c.Ins)
+			}
+		}
+		if len(changes) > 0 {
+			os.Exit(1)
+		}
+	case "lint":
+		name, overflow := os.Args[2], false
+		if name == "--overflow" && len(os.Args) > 3 {
+			name, overflow = os.Args[3], true
+		}
+		src, err := os.ReadFile(name)
+		if err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		diags := mf.LintBF(src)
+		if overflow {
+			diags = append(diags, mf.AnalyzeOverflow(src)...)
+		}
+		failed := false
+		for _, d := range diags {
+			if jsonFormat {
+				printRecord(record{name, d.Severity.String(), d.Code, d.Pos.Offset, d.Pos.Line, d.Pos.Col, d.Message})
+			} else {
+				fmt.Printf("%s:%d:%d: %v: %s\n", name, d.Pos.Line, d.Pos.Col, d.Severity, d.Message)
+			}
+			failed = failed || d.Severity == mf.SeverityError
+		}
+		if failed {
+			os.Exit(1)
+		}
+	case "debug":
+		prog, err := os.ReadFile(os.Args[2])
+		if err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		vm, err := mf.NewVM(prog)
+		if err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		vm.RegisterStdSyscalls()
+		stdin := bufio.NewReader(os.Stdin)
+		vm.In = stdin
+		d := mf.NewDebugger(vm)
+		d.Record(10000)
+		if err := d.REPL(stdin, os.Stdout); err != nil {
+			fmt.Println("error:", err)
+		}
+	case "loops":
+		prog, err := os.ReadFile(os.Args[2])
+		if err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		loops, err := mf.AnalyzeLoops(prog)
+		if err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		for _, l := range loops {
+			fmt.Println(l)
+		}
+	case "cfg":
+		prog, err := os.ReadFile(os.Args[2])
+		if err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		var w io.Writer = os.Stdout
+		if len(os.Args) > 4 && os.Args[3] == "-o" {
+			fp, err := os.Create(os.Args[4])
+			if err != nil {
+				fmt.Println("error:", err)
+				return
+			}
+			defer fp.Close()
+			w = fp
+		}
+		if err := mf.WriteCFG(w, prog); err != nil {
+			fmt.Println("error:", err)
+		}
+	case "disasm", "optimize":
+		prog, err := os.ReadFile(os.Args[2])
+		if err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		var profile *mf.Profile
+		if len(os.Args) > 4 && os.Args[3] == "--profile" {
+			fp, err := os.Open(os.Args[4])
+			if err != nil {
+				fmt.Println("error:", err)
+				return
+			}
+			profile, err = mf.ReadProfile(fp)
+			fp.Close()
+			if err != nil {
+				fmt.Println("error:", err)
+				return
+			}
+		}
+		if cmd == "disasm" {
+			if err := mf.DisassembleProfile(os.Stdout, prog, profile); err != nil {
+				fmt.Println("error:", err)
+			}
+			return
+		}
+		opt, err := mf.OptimizeMF(prog, profile, mf.HotShare)
+		if err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		if err := os.WriteFile(os.Args[2][0:len(os.Args[2])-len(path.Ext(os.Args[2]))]+"_opt.mf", opt, 0644); err != nil {
+			fmt.Println("error:", err)
+		}
+	case "set-memsize":
+		check := cutFlag("--check")
+		if len(os.Args) < 4 {
+			fmt.Println(help)
+			return
+		}
+		n, err := strconv.ParseUint(os.Args[3], 10, 32)
+		if err != nil || n == 0 {
+			fmt.Println("invalid memsize")
+			return
+		}
+		if check {
+			prog, err := os.ReadFile(os.Args[2])
+			if err != nil {
+				fmt.Println("error:", err)
+				return
+			}
+			if h, err := mf.ReadHeader(bytes.NewReader(prog)); err == nil && h.Magic != mf.BFMagic {
+				fmt.Println("error: --check needs MF converted from BF")
+				return
+			}
+			var src bytes.Buffer
+			w := mf.NewBFWriter(&src)
+			if _, err := w.Write(prog); err != nil {
+				fmt.Println("error:", err)
+				return
+			}
+			if err := w.Close(); err != nil {
+				fmt.Println("error:", err)
+				return
+			}
+			pr, err := mf.AnalyzePointerRange(src.Bytes())
+			if err == nil {
+				err = pr.Check(n)
+			}
+			if err != nil {
+				fmt.Println("error:", err)
+				os.Exit(1)
+			}
+		}
+		fp, err := os.OpenFile(os.Args[2], os.O_RDWR, 0)
+		if err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		err = mf.PatchMemSize(fp, uint32(n))
+		if cerr := fp.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			fmt.Println("error:", err)
+			os.Exit(1)
+		}
+	case "factor", "precompute", "canonical":
+		prog, err := os.ReadFile(os.Args[2])
+		if err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		var out []byte
+		suffix := "_factor.mf"
+		switch cmd {
+		case "precompute":
+			out, err = mf.PrecomputeMF(prog, precomputeSteps)
+			suffix = "_pre.mf"
+		case "canonical":
+			out, err = mf.CanonicalMF(prog)
+			suffix = "_canon.mf"
+		default:
+			out, err = mf.FactorMF(prog)
+		}
+		if err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		if err := os.WriteFile(os.Args[2][0:len(os.Args[2])-len(path.Ext(os.Args[2]))]+suffix, out, 0644); err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		fmt.Printf("%d bytes -> %d bytes\n", len(prog), len(out))
+	case "cache":
+		if os.Args[2] != "clean" {
+			fmt.Println(help)
+			return
+		}
+		dir, err := cacheDir()
+		if err == nil {
+			err = os.RemoveAll(dir)
+		}
+		if err != nil {
+			fmt.Println("error:", err)
+		}
+	case "pprof", "flame":
+		if len(os.Args) < 4 {
+			fmt.Println(help)
+			return
+		}
+		prog, err := os.ReadFile(os.Args[2])
+		if err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		fp, err := os.Open(os.Args[3])
+		if err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		profile, err := mf.ReadProfile(fp)
+		fp.Close()
+		if err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		if cmd == "flame" {
+			if err := profile.WriteFolded(os.Stdout, prog); err != nil {
+				fmt.Println("error:", err)
+			}
+			return
+		}
+		out, err := os.Create(os.Args[3][0:len(os.Args[3])-len(path.Ext(os.Args[3]))] + ".pb.gz")
+		if err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		defer out.Close()
+		if err := profile.WritePprof(out, prog, path.Base(os.Args[2])); err != nil {
+			fmt.Println("error:", err)
+		}
+	case "pipeline":
+		stages := make([]*mf.Stage, len(os.Args)-2)
+		ctxs := make([]context.Context, len(stages))
+		cancels := make([]context.CancelFunc, len(stages))
+		in := make(chan byte, 4096)
+		prev := in
+		for i, name := range os.Args[2:] {
+			prog, err := os.ReadFile(name)
+			if err == nil && path.Ext(name) == ".bf" {
+				prog, err = convertBF(name, prog)
+			}
+			var vm *mf.VM
+			if err == nil {
+				vm, err = mf.NewVM(prog)
+			}
+			if err != nil {
+				fmt.Println("error:", err)
+				return
+			}
+			vm.RegisterStdSyscalls()
+			out := make(chan byte, 4096)
+			stages[i] = &mf.Stage{VM: vm, In: prev, Out: out}
+			ctxs[i], cancels[i] = context.WithCancel(context.Background())
+			prev = out
+		}
+		go func() {
+			r := bufio.NewReader(os.Stdin)
+			defer close(in)
+			for {
+				b, err := r.ReadByte()
+				if err != nil {
+					return
+				}
+				select {
+				case in <- b:
+				case <-ctxs[0].Done():
+					return
+				}
+			}
+		}()
+		errs := make([]error, len(stages))
+		done := make(chan struct{})
+		for i, s := range stages {
+			go func() {
+				errs[i] = s.Run(ctxs[i])
+				if i > 0 {
+					cancels[i-1]() // nothing reads the output of the one before
+				}
+				done <- struct{}{}
+			}()
+		}
+		w := bufio.NewWriter(os.Stdout)
+		for b := range prev {
+			w.WriteByte(b)
+		}
+		w.Flush()
+		for range stages {
+			<-done
+		}
+		last := len(stages) - 1
+		for i, err := range errs {
+			var exit *mf.ExitError
+			switch {
+			case err == nil:
+			case i < last && (errors.As(err, &exit) || errors.Is(err, context.Canceled)):
+			case i == last && errors.As(err, &exit):
+				os.Exit(exit.Status)
+			default:
+				fmt.Println("error:", os.Args[2+i]+":", err)
+			}
+		}
+	case "bench":
+		var b mf.Bench
+		var files []string
+		for i := 2; i < len(os.Args); i++ {
+			arg := os.Args[i]
+			if arg[0] != '-' {
+				files = append(files, arg)
+				continue
+			}
+			if arg == "--prealloc" {
+				b.Preallocate = true
+				continue
+			}
+			if i+1 == len(os.Args) {
+				fmt.Println(help)
+				return
+			}
+			i++
+			var err error
+			switch arg {
+			case "-n":
+				b.Runs, err = strconv.Atoi(os.Args[i])
+			case "-t":
+				b.Duration, err = time.ParseDuration(os.Args[i])
+			case "--input":
+				b.Input, err = os.ReadFile(os.Args[i])
+			default:
+				err = fmt.Errorf("unknown flag %s", arg)
+			}
+			if err != nil {
+				fmt.Println("error:", err)
+				return
+			}
+		}
+		if len(files) == 0 || len(files) > 2 {
+			fmt.Println(help)
+			return
+		}
+		var results []*mf.BenchResult
+		for _, name := range files {
+			prog, err := os.ReadFile(name)
+			if err != nil {
+				fmt.Println("error:", err)
+				return
+			}
+			r, err := b.Run(prog)
+			if err != nil {
+				fmt.Println("error:", err)
+				return
+			}
+			fmt.Printf("%s: %v\n", name, r)
+			results = append(results, r)
+		}
+		if len(results) == 2 {
+			change, p := mf.CompareBench(results[0], results[1])
+			verdict := "not significant"
+			if p < 0.05 {
+				verdict = "significant"
+			}
+			fmt.Printf("%s vs %s: %+.1f%% time, p=%.3g, %s\n", files[1], files[0], 100*change, p, verdict)
+		}
+	case "fuzz":
+		n, err := strconv.Atoi(os.Args[2])
+		if err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		seed := time.Now().UnixNano()
+		if len(os.Args) > 4 && os.Args[3] == "-seed" {
+			if seed, err = strconv.ParseInt(os.Args[4], 10, 64); err != nil {
+				fmt.Println("error:", err)
+				return
+			}
+		}
+		fmt.Println("seed", seed)
+		f := &mf.Fuzzer{Rand: rand.New(rand.NewSource(seed))}
+		if err := f.Run(n); err != nil {
+			fmt.Println("error:", err)
+			os.Exit(1)
+		}
+		fmt.Println(n, "programs ok")
+
+	case "check":
+		var files, inputs []string
+		timeout := time.Minute
+		for i := 2; i < len(os.Args); i++ {
+			switch arg := os.Args[i]; {
+			case (arg == "--input" || arg == "-t") && i+1 < len(os.Args):
+				i++
+				if arg == "--input" {
+					inputs = append(inputs, os.Args[i])
+					continue
+				}
+				var err error
+				if timeout, err = time.ParseDuration(os.Args[i]); err != nil {
+					fmt.Println("error:", err)
+					return
+				}
+			default:
+				files = append(files, arg)
+			}
+		}
+		if len(files) == 0 || len(files) > 2 {
+			fmt.Println(help)
+			return
+		}
+		src, err := os.ReadFile(files[0])
+		if err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		var prog []byte
+		if len(files) == 2 {
+			if prog, err = os.ReadFile(files[1]); err != nil {
+				fmt.Println("error:", err)
+				return
+			}
+		} else if prog, err = convertBF(files[0], src); err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		if len(inputs) == 0 {
+			inputs = []string{""}
+		}
+		failed := false
+		for _, name := range inputs {
+			var input []byte
+			if name != "" {
+				if input, err = os.ReadFile(name); err != nil {
+					fmt.Println("error:", err)
+					return
+				}
+			} else {
+				name = "no input"
+			}
+			res, err := mf.CrossCheck(src, prog, input, timeout)
+			if err != nil {
+				fmt.Println("error:", err)
+				return
+			}
+			fmt.Printf("%s: %v\n", name, res)
+			failed = failed || !res.OK()
+		}
+		if failed {
+			os.Exit(1)
+		}
+	case "test":
+		paths := os.Args[2:]
+		if len(paths) == 0 {
+			paths = []string{"./..."}
+		}
+		var files []string
+		for _, p := range paths {
+			found, err := findTests(p)
+			if err != nil {
+				fmt.Println("error:", err)
+				return
+			}
+			files = append(files, found...)
+		}
+		total, failed := 0, 0
+		for _, file := range files {
+			name := strings.TrimSuffix(file, ".mftest") + ".mf"
+			start := time.Now()
+			n, fails, err := runTests(file, name)
+			total, failed = total+n, failed+len(fails)
+			if err != nil {
+				failed++
+				fmt.Printf("FAIL\t%s\t%v\n", name, err)
+				continue
+			}
+			for _, f := range fails {
+				fmt.Println("---", f)
+			}
+			if len(fails) > 0 {
+				fmt.Printf("FAIL\t%s\t%d of %d tests failed\n", name, len(fails), n)
+			} else {
+				fmt.Printf("ok\t%s\t%d tests\t%.3fs\n", name, n, time.Since(start).Seconds())
+			}
+		}
+		fmt.Printf("%d programs, %d tests, %d failed\n", len(files), total, failed)
+		if failed > 0 {
+			os.Exit(1)
+		}
+	case "html":
+		prog, err := os.ReadFile(os.Args[2])
+		if err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		var profile *mf.Profile
+		if len(os.Args) > 4 && os.Args[3] == "--profile" {
+			fp, err := os.Open(os.Args[4])
+			if err != nil {
+				fmt.Println("error:", err)
+				return
+			}
+			profile, err = mf.ReadProfile(fp)
+			fp.Close()
+			if err != nil {
+				fmt.Println("error:", err)
+				return
+			}
+		}
+		fp, err := os.Create(os.Args[2][0:len(os.Args[2])-len(path.Ext(os.Args[2]))] + ".html")
+		if err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		defer fp.Close()
+		if err := mf.DisassembleHTML(fp, prog, path.Base(os.Args[2]), profile); err != nil {
+			fmt.Println("error:", err)
+		}
+	case "asm":
+		src, err := os.ReadFile(os.Args[2])
+		if err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		prog, err := mf.Assemble(src)
+		if err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		if err := os.WriteFile(os.Args[2][0:len(os.Args[2])-len(path.Ext(os.Args[2]))]+".mf", prog, 0644); err != nil {
+			fmt.Println("error:", err)
+		}
+	case "lsp":
+		if err := mf.ServeLSP(os.Stdin, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			os.Exit(1)
+		}
+	case "gdb":
+		prog, err := os.ReadFile(os.Args[2])
+		if err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		vm, err := mf.NewVM(prog)
+		if err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		vm.RegisterStdSyscalls()
+		addr := "localhost:1234"
+		if len(os.Args) > 3 {
+			addr = os.Args[3]
+		}
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		fmt.Println("waiting for gdb on", ln.Addr())
+		conn, err := ln.Accept()
+		ln.Close()
+		if err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		defer conn.Close()
+		if err := mf.NewDebugger(vm).ServeGDB(conn); err != nil {
+			fmt.Println("error:", err)
+		}
+	case "core":
+		fp, err := os.Open(os.Args[2])
+		if err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		core, err := mf.ReadCore(fp)
+		fp.Close()
+		if err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		fmt.Println("fault:", core.Reason)
+		fmt.Println("steps:", core.Steps)
+		fmt.Println()
+		if err := mf.Disassemble(os.Stdout, core.Prog, core.PC, core.Low, 8); err != nil {
+			fmt.Println("error:", err)
+		}
+		fmt.Println()
+		fmt.Printf("tape %d, pointer %d\n", core.Tape, core.Ptrs[core.Tape])
+		if err := mf.ViewTape(os.Stdout, core.Tapes[core.Tape], core.Ptrs[core.Tape], 4); err != nil {
+			fmt.Println("error:", err)
+		}
+	case "ar":
+		if len(os.Args) < 4 {
+			fmt.Println(help)
+			return
+		}
+		if os.Args[2] == "create" {
+			var entries []mf.ArchiveEntry
+			for _, name := range os.Args[4:] {
+				prog, err := os.ReadFile(name)
+				if err != nil {
+					fmt.Println("error:", err)
+					return
+				}
+				entries = append(entries, mf.ArchiveEntry{Name: filepath.Base(name), Prog: prog})
+			}
+			var buf bytes.Buffer
+			err := mf.WriteArchive(&buf, entries)
+			if err == nil {
+				err = os.WriteFile(os.Args[3], buf.Bytes(), 0644)
+			}
+			if err != nil {
+				fmt.Println("error:", err)
+			}
+			return
+		}
+		fp, err := os.Open(os.Args[3])
+		if err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		entries, err := mf.ReadArchive(bufio.NewReader(fp))
+		fp.Close()
+		if err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		switch os.Args[2] {
+		case "list":
+			for _, e := range entries {
+				sum := sha256.Sum256(e.Prog)
+				fmt.Printf("%-24s %8d  %x\n", e.Name, len(e.Prog), sum)
+			}
+		case "extract":
+			names := os.Args[4:]
+			for _, e := range entries {
+				if len(names) > 0 && !slices.Contains(names, e.Name) {
+					continue
+				}
+				if err := os.WriteFile(e.Name, e.Prog, 0644); err != nil {
+					fmt.Println("error:", err)
+					return
+				}
+			}
+			for _, name := range names {
+				if !slices.ContainsFunc(entries, func(e mf.ArchiveEntry) bool { return e.Name == name }) {
+					fmt.Println("error: no program", name, "in", os.Args[3])
+				}
+			}
+		default:
+			fmt.Println(help)
+		}
+	case "build":
+		prog, err := os.ReadFile(os.Args[2])
+		if err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		if _, err := mf.NewVM(prog); err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		var out, target, source string
+		for i := 3; i < len(os.Args)-1; i++ {
+			switch os.Args[i] {
+			case "-o":
+				out = os.Args[i+1]
+			case "--target":
+				target = os.Args[i+1]
+			case "--mf-source":
+				source = os.Args[i+1]
+			default:
+				continue
+			}
+			i++
+		}
+		if out == "" {
+			out = filepath.Base(os.Args[2][0 : len(os.Args[2])-len(path.Ext(os.Args[2]))])
+			if strings.HasPrefix(target, "windows/") || target == "" && runtime.GOOS == "windows" {
+				out += ".exe"
+			}
+		}
+		if err := buildExecutable(prog, out, target, source); err != nil {
+			fmt.Println("error:", err)
+		}
+	case "keygen":
+		pub, key, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err == nil {
+			err = os.WriteFile(os.Args[2]+".key", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+		}
+		if err == nil {
+			der, err = x509.MarshalPKIXPublicKey(pub)
+		}
+		if err == nil {
+			err = os.WriteFile(os.Args[2]+".pub", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644)
+		}
+		if err != nil {
+			fmt.Println("error:", err)
+		}
+	case "sign":
+		if len(os.Args) < 4 {
+			fmt.Println(help)
+			return
+		}
+		prog, err := os.ReadFile(os.Args[2])
+		if err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		key, err := readPrivateKey(os.Args[3])
+		if err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		signed, err := mf.SignMF(prog, key)
+		if err == nil {
+			err = os.WriteFile(os.Args[2], signed, 0644)
+		}
+		if err != nil {
+			fmt.Println("error:", err)
+		}
+	case "strip":
+		out := os.Args[2]
+		if len(os.Args) > 4 && os.Args[3] == "-o" {
+			out = os.Args[4]
+		}
+		prog, err := os.ReadFile(os.Args[2])
+		if err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		if _, err := mf.ReadHeader(bytes.NewReader(prog)); err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		stripped, _ := mf.SplitSignature(prog)
+		if out == os.Args[2] && len(stripped) == len(prog) {
+			return // nothing to remove
+		}
+		if err := os.WriteFile(out, stripped, 0644); err != nil {
+			fmt.Println("error:", err)
+		}
+	case "verify-sig":
+		if len(os.Args) < 4 {
+			fmt.Println(help)
+			return
+		}
+		prog, err := os.ReadFile(os.Args[2])
+		if err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		var keys []ed25519.PublicKey
+		for _, name := range os.Args[3:] {
+			key, err := readPublicKey(name)
+			if err != nil {
+				fmt.Println("error:", err)
+				return
+			}
+			keys = append(keys, key)
+		}
+		if _, err := mf.VerifyMF(prog, keys...); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println("signature ok")
+	default:
+		fmt.Println(help)
+	}
+}
+
+// buildMain is the main package of executables written by build,
+// running the MF binary prog.mf embedded in them.
+const buildMain = `package main
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/cr0sh/mf"
+)
+
+//go:embed prog.mf
+var prog []byte
+
+func main() {
+	vm, err := mf.NewVM(prog)
+	if err == nil {
+		vm.RegisterStdSyscalls()
+		err = vm.Run()
+	}
+	if err != nil {
+		var exit *mf.ExitError
+		if errors.As(err, &exit) {
+			os.Exit(exit.Status)
+		}
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(2)
+	}
+}
+`
+
+// buildExecutable builds the executable out running prog with the go
+// command, for the target os/arch if not empty. The mf package is the
+// one in the source directory if not empty, or the version mf-tools is
+// built with.
+func buildExecutable(prog []byte, out, target, source string) error {
+	out, err := filepath.Abs(out)
+	if err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp("", "mf-build")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	mod := "module mfbuild\n\ngo 1.24\n"
+	if source != "" {
+		if source, err = filepath.Abs(source); err != nil {
+			return err
+		}
+		mod += fmt.Sprintf("\nrequire github.com/cr0sh/mf v0.0.0\n\nreplace github.com/cr0sh/mf => %s\n", source)
+	}
+	for name, data := range map[string][]byte{"go.mod": []byte(mod), "main.go": []byte(buildMain), "prog.mf": prog} {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			return err
+		}
+	}
+	env := append(os.Environ(), "CGO_ENABLED=0")
+	if target != "" {
+		goos, goarch, ok := strings.Cut(target, "/")
+		if !ok || goos == "" || goarch == "" {
+			return fmt.Errorf("invalid target %q, want os/arch", target)
+		}
+		env = append(env, "GOOS="+goos, "GOARCH="+goarch)
+	}
+	goCmd := func(args ...string) error {
+		cmd := exec.Command("go", args...)
+		cmd.Dir, cmd.Env = dir, env
+		cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("go %s: %v", args[0], err)
+		}
+		return nil
+	}
+	if source == "" {
+		version, err := mfVersion()
+		if err != nil {
+			return err
+		}
+		if err := goCmd("get", "github.com/cr0sh/mf@"+version); err != nil {
+			return err
+		}
+	}
+	return goCmd("build", "-trimpath", "-o", out, ".")
+}
+
+// mfVersion returns the version of the mf package mf-tools is built
+// with, as go get takes it: the module version, or the VCS revision of
+// a build in a checkout.
+func mfVersion() (string, error) {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "", fmt.Errorf("mf-tools has no build information, use --mf-source")
+	}
+	for _, m := range append([]*debug.Module{&bi.Main}, bi.Deps...) {
+		if m.Path == "github.com/cr0sh/mf" && m.Version != "" && m.Version != "(devel)" {
+			return m.Version, nil
+		}
+	}
+	for _, s := range bi.Settings {
+		if s.Key == "vcs.revision" {
+			return s.Value, nil
+		}
+	}
+	return "", fmt.Errorf("unknown version of the mf package mf-tools is built with, use --mf-source")
+}
+
+// readPEM returns the DER bytes of the PEM block in the file name.
+func readPEM(name, typ string) ([]byte, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != typ {
+		return nil, fmt.Errorf("%s: no PEM %s block", name, typ)
+	}
+	return block.Bytes, nil
+}
+
+// readPrivateKey reads an Ed25519 private key in PKCS #8 PEM format,
+// as written by keygen or openssl genpkey -algorithm ed25519.
+func readPrivateKey(name string) (ed25519.PrivateKey, error) {
+	der, err := readPEM(name, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	if key, ok := key.(ed25519.PrivateKey); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%s: not an Ed25519 private key", name)
+}
+
+// readPublicKey reads an Ed25519 public key in PKIX PEM format.
+func readPublicKey(name string) (ed25519.PublicKey, error) {
+	der, err := readPEM(name, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	if key, ok := key.(ed25519.PublicKey); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%s: not an Ed25519 public key", name)
+}
+
+// rawTerminal turns off line buffering and echo of the terminal of
+// stdin with stty, and returns a function turning them back on, which
+// an interrupt also does before exiting.
+func rawTerminal() (func(), error) {
+	stty := func(args ...string) (string, error) {
+		cmd := exec.Command("stty", args...)
+		cmd.Stdin = os.Stdin
+		out, err := cmd.Output()
+		return strings.TrimSpace(string(out)), err
+	}
+	saved, err := stty("-g")
+	if err != nil {
+		return nil, fmt.Errorf("--raw: stdin is not a terminal stty can set: %v", err)
+	}
+	if _, err := stty("-icanon", "-echo", "min", "1", "time", "0"); err != nil {
+		return nil, fmt.Errorf("--raw: %v", err)
+	}
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		if _, ok := <-interrupt; ok {
+			stty(saved)
+			os.Exit(130)
+		}
+	}()
+	return func() {
+		signal.Stop(interrupt)
+		close(interrupt)
+		stty(saved)
+	}, nil
+}
+
+// readInput returns the input given by the run flag --in, --in-hex or
+// --in-str with the argument arg.
+func readInput(flag, arg string) ([]byte, error) {
+	switch flag {
+	case "--in":
+		return os.ReadFile(arg)
+	case "--in-hex":
+		b, err := hex.DecodeString(strings.Join(strings.Fields(arg), ""))
+		if err != nil {
+			return nil, fmt.Errorf("--in-hex: %v", err)
+		}
+		return b, nil
+	}
+	str, err := strconv.Unquote(`"` + arg + `"`)
+	if err != nil {
+		return nil, fmt.Errorf("--in-str: invalid string %q", arg)
+	}
+	return []byte(str), nil
+}
+
+// convertBF converts the BF src of the file name to MF,
+// with the memsize SuggestMemSize suggests.
+func convertBF(name string, src []byte) ([]byte, error) {
+	memsize := uint64(defaultMemsize)
+	if n, _ := mf.SuggestMemSize(src); n > 0 {
+		memsize = uint64(n)
+	}
+	var buf bytes.Buffer
+	r := mf.NewBFReader64(&buf, memsize)
+	r.Logger = logger
+	r.Warn = warningPrinter(name)
+	if _, err := r.Write(src); err != nil {
+		return nil, err
+	}
+	if err := r.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// findTests returns the .mftest files of the path p, which is a program,
+// a test file, or a directory, searched recursively if p ends with /...
+func findTests(p string) ([]string, error) {
+	if dir, ok := strings.CutSuffix(p, "..."); ok {
+		if dir == "" {
+			dir = "."
+		}
+		var files []string
+		err := filepath.Walk(dir, func(name string, fi os.FileInfo, err error) error {
+			if err == nil && !fi.IsDir() && filepath.Ext(name) == ".mftest" {
+				files = append(files, name)
+			}
+			return err
+		})
+		return files, err
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return filepath.Glob(filepath.Join(p, "*.mftest"))
+	}
+	return []string{strings.TrimSuffix(p, filepath.Ext(p)) + ".mftest"}, nil
+}
+
+// runTests runs the tests of the file on the program name, and returns
+// how many there are and the failures, or an error if they cannot run.
+func runTests(file, name string) (int, []string, error) {
+	fp, err := os.Open(file)
+	if err != nil {
+		return 0, nil, err
+	}
+	tests, err := mf.ParseProgramTests(fp)
+	fp.Close()
+	if err != nil {
+		return 0, nil, fmt.Errorf("%s: %v", file, err)
+	}
+	prog, err := os.ReadFile(name)
+	if err != nil {
+		return len(tests), nil, err
+	}
+	var fails []string
+	for _, t := range tests {
+		if err := t.Run(prog); err != nil {
+			fails = append(fails, fmt.Sprintf("%s:%d: %s: %v", file, t.Line, t.Name, err))
+		}
+	}
+	return len(tests), fails, nil
+}
+
+// warningPrinter returns a function printing conversion warnings
+// of the file name.
+func warningPrinter(name string) func(mf.Warning) {
+	return func(w mf.Warning) {
+		printWarning(cachedWarning{warningRecord(name, w), w.String()})
+	}
+}
+
+func warningRecord(name string, w mf.Warning) record {
+	return record{name, "warning", w.Code, w.Offset, w.Line, w.Col, w.Message}
+}
+
+// printNote prints a warning of a command about the file name.
+func printNote(name, code, msg string) {
+	printWarning(cachedWarning{record{name, "warning", code, 0, 0, 0, msg}, msg})
+}
+
+// cachedWarning is a warning printed by a conversion, kept in the
+// conversion cache to be printed again when it is reused.
+type cachedWarning struct {
+	Record record
+	Text   string // printed without --format json, after "warning: "
+}
+
+// printWarning prints a warning, and adds it to warned.
+func printWarning(w cachedWarning) {
+	warned = append(warned, w)
+	switch {
+	case quiet:
+	case jsonFormat:
+		printRecord(w.Record)
+	default:
+		fmt.Println("warning:", w.Text)
+	}
+}
+
+// printBracketErrors prints the unbalanced brackets of BF code
+// in the file name, as returned by mf.ValidateBF.
+func printBracketErrors(name string, err error) {
+	for _, err := range err.(interface{ Unwrap() []error }).Unwrap() {
+		var be *mf.BracketError
+		if errors.As(err, &be) {
+			printRecord(record{name, "error", mf.DiagUnbalanced, be.Pos.Offset, be.Pos.Line, be.Pos.Col, be.Error()})
+		}
+	}
+}
+
+// record is a diagnostic printed with --format json.
+type record struct {
+	File     string `json:"file"`
+	Severity string `json:"severity"`
+	Code     string `json:"code"`
+	Offset   int    `json:"offset"`
+	Line     int    `json:"line,omitempty"` // BF code only
+	Col      int    `json:"col,omitempty"`
+	Message  string `json:"message"`
+}
+
+func printRecord(r record) {
+	b, _ := json.Marshal(r)
+	fmt.Println(string(b))
+}
+
+// progressPrinter returns a progress callback of the converters,
+// printing the bytes converted of total on stderr.
+func progressPrinter(total int64) func(in, out int64) {
+	return func(in, out int64) {
+		fmt.Fprintf(os.Stderr, "\r%d/%d bytes converted, %d bytes written", in, total, out)
+	}
+}
+
+// cutFlag removes the flag name from the arguments after the file name,
+// and reports whether it was given.
+func cutFlag(name string) bool {
+	for i := 3; i < len(os.Args); i++ {
+		if os.Args[i] == name {
+			os.Args = append(os.Args[:i], os.Args[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// cutValue removes the option name and its value from the arguments,
+// and returns the value, if there are.
+func cutValue(name string) (string, bool) {
+	for i := 3; i < len(os.Args)-1; i++ {
+		if os.Args[i] == name {
+			v := os.Args[i+1]
+			os.Args = append(os.Args[:i], os.Args[i+2:]...)
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// cacheDir returns the directory of the conversion cache.
+func cacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "mf-tools"), nil
+}
+
+// cacheFormat is the version of the conversion cache entries, changed
+// when they or the conversions change without a new mf-tools version.
+const cacheFormat = 2
+
+// cached looks up the conversion of the file in by cmd with options in the
+// conversion cache, and writes the output to out and prints the warnings
+// of the conversion if it is there. It returns the key of the conversion
+// for storeCache, empty if the cache is skipped. Keys include the version
+// of mf-tools, so that another build with changed conversions does not
+// reuse their old outputs; builds of modified sources, or without build
+// information, have the hash of the executable instead.
+func cached(cmd, in, out string, options ...any) (key string, hit bool) {
+	if noCache {
+		return "", false
+	}
+	dir, err := cacheDir()
+	if err != nil {
+		return "", false
+	}
+	src, err := os.ReadFile(in)
+	if err != nil {
+		return "", false
+	}
+	build, err := buildID()
+	if err != nil {
+		return "", false
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%d %s %s %v\n", cacheFormat, build, cmd, options)
+	h.Write(src)
+	key = hex.EncodeToString(h.Sum(nil))
+	warned = nil // those printed before the conversion are printed anyway
+	b, err := os.ReadFile(filepath.Join(dir, key))
+	if err != nil {
+		return key, false
+	}
+	var warnings []cachedWarning
+	if data, err := os.ReadFile(filepath.Join(dir, key+".warnings")); err != nil || json.Unmarshal(data, &warnings) != nil {
+		return key, false
+	}
+	if err := os.WriteFile(out, b, 0644); err != nil {
+		return key, false
+	}
+	if logger != nil {
+		logger.Info("cached conversion", "output", out, "size", len(b))
+	}
+	for _, w := range warnings {
+		printWarning(w)
+	}
+	return key, true
+}
+
+// buildID identifies the build of mf-tools: its version, or the hash
+// of the executable if the sources it is built from are unknown.
+func buildID() (string, error) {
+	if bi, ok := debug.ReadBuildInfo(); ok && !slices.Contains(bi.Settings, debug.BuildSetting{Key: "vcs.modified", Value: "true"}) {
+		if v, err := mfVersion(); err == nil {
+			return v, nil
+		}
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	exe, err := os.ReadFile(self)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(exe)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// storeCache stores the output file out of a conversion, and the warnings
+// printed by it, under key in the conversion cache. The cache is best
+// effort, so errors are only logged.
+func storeCache(key, out string) {
+	if key == "" {
+		return
+	}
+	err := func() error {
+		dir, err := cacheDir()
+		if err != nil {
+			return err
+		}
+		b, err := os.ReadFile(out)
+		if err != nil {
+			return err
+		}
+		warnings, err := json.Marshal(warned)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		// the warnings go first, as the output marks the entry complete
+		if err := writeCacheFile(dir, key+".warnings", warnings); err != nil {
+			return err
+		}
+		return writeCacheFile(dir, key, b)
+	}()
+	if err != nil && logger != nil {
+		logger.Debug("conversion cache", "error", err)
+	}
+}
+
+// writeCacheFile writes a file of the conversion cache in dir. It writes
+// and renames, so that concurrent builds never read a partial file.
+func writeCacheFile(dir, name string, b []byte) error {
+	fp, err := os.CreateTemp(dir, name+".*")
+	if err != nil {
+		return err
+	}
+	_, err = fp.Write(b)
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(fp.Name(), filepath.Join(dir, name))
+	}
+	if err != nil {
+		os.Remove(fp.Name())
+	}
+	return err
+}
+
+// fileReport describes a file in a conversion report.
+type fileReport struct {
+	Name   string      `json:"name"`
+	Size   int         `json:"size"`
+	SHA256 string      `json:"sha256"`
+	Stats  statsReport `json:"stats"`
+}
+
+// statsReport is mf.Stats with the operations named.
+type statsReport struct {
+	Instructions      int            `json:"instructions"`
+	Counts            map[string]int `json:"counts"`
+	Loops             int            `json:"loops"`
+	MaxDepth          int            `json:"max_depth"`
+	CompressedRuns    int            `json:"compressed_runs"`
+	CompressedSavings int            `json:"compressed_savings"`
+}
+
+// writeReport writes a JSON report of converting the file in to out,
+// next to out, for tracking the provenance of build outputs.
+func writeReport(in, out string, options map[string]any, warnings []record) error {
+	describe := func(name string) (fileReport, error) {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			return fileReport{}, err
+		}
+		s, err := mf.ProgramStats(b)
+		if err != nil {
+			return fileReport{}, err
+		}
+		counts := make(map[string]int)
+		for op, n := range s.Counts {
+			counts[op.String()] = n
+		}
+		sum := sha256.Sum256(b)
+		return fileReport{name, len(b), hex.EncodeToString(sum[:]), statsReport{
+			s.Instructions, counts, s.Loops, s.MaxDepth, s.CompressedRuns, s.CompressedSavings,
+		}}, nil
+	}
+	var rep struct {
+		Input    fileReport     `json:"input"`
+		Output   fileReport     `json:"output"`
+		Options  map[string]any `json:"options"`
+		Warnings []record       `json:"warnings"`
+	}
+	var err error
+	if rep.Input, err = describe(in); err != nil {
+		return err
+	}
+	if rep.Output, err = describe(out); err != nil {
+		return err
+	}
+	rep.Options, rep.Warnings = options, warnings
+	if rep.Warnings == nil {
+		rep.Warnings = []record{}
+	}
+	b, err := json.MarshalIndent(&rep, "", "\t")
+	if err != nil {
+		return err
 	}
+	return os.WriteFile(out[0:len(out)-len(path.Ext(out))]+".report.json", append(b, '\n'), 0644)
 }
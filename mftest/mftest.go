@@ -0,0 +1,103 @@
+// Package mftest provides test helpers for programs that generate BF
+// or MF code, asserting that conversions with package mf preserve it.
+package mftest
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/cr0sh/mf"
+)
+
+// Timeout limits every run of a program by the helpers.
+// Runs that time out pass if their outputs agree so far.
+var Timeout = 10 * time.Second
+
+// RequireRoundTrip converts the BF code src to MF and back to BF, and
+// fails t unless the MF binary and the converted BF code behave like src
+// on each input, or on empty input if none is given, and the MF binary
+// has a stable encoding, see RequireStableEncoding.
+//
+// The memsize of the conversion is suggested by mf.SuggestMemSize,
+// or mf.DefaultMemSize.
+func RequireRoundTrip(t testing.TB, src []byte, inputs ...[]byte) {
+	t.Helper()
+	memsize := uint64(mf.DefaultMemSize)
+	if n, _ := mf.SuggestMemSize(src); n > 0 {
+		memsize = uint64(n)
+	}
+	if len(inputs) == 0 {
+		inputs = [][]byte{nil}
+	}
+	f := &mf.Fuzzer{MemSize: memsize, Timeout: Timeout}
+	for _, input := range inputs {
+		if err := f.Check(src, input); err != nil {
+			t.Fatalf("round trip of BF code: %v", err)
+		}
+	}
+	prog, err := convert(src, memsize)
+	if err != nil {
+		t.Fatalf("converting BF code: %v", err)
+	}
+	RequireStableEncoding(t, prog)
+}
+
+// RequireStableEncoding converts the MF binary prog, converted from BF
+// code, to BF and back to MF with the same memsize, and fails t unless
+// that yields prog again.
+func RequireStableEncoding(t testing.TB, prog []byte) {
+	t.Helper()
+	if len(prog) < 4 || string(prog[:4]) != mf.BFMagic {
+		t.Fatalf("MF binary is not converted from BF")
+	}
+	// the tape of a VM for BF code is as large as the memsize
+	v, err := mf.NewVM(prog)
+	if err != nil {
+		t.Fatalf("loading MF binary: %v", err)
+	}
+	var src bytes.Buffer
+	w := mf.NewBFWriter(&src)
+	if _, err := w.Write(prog); err != nil {
+		t.Fatalf("converting MF binary to BF: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("converting MF binary to BF: %v", err)
+	}
+	again, err := convert(src.Bytes(), uint64(len(v.Cells())))
+	if err != nil {
+		t.Fatalf("converting BF code back to MF: %v", err)
+	}
+	if bytes.Equal(prog, again) {
+		return
+	}
+	changes, err := mf.Diff(prog, again)
+	if err != nil {
+		t.Fatalf("comparing MF binaries: %v", err)
+	}
+	if len(changes) == 0 {
+		i := 0
+		for i < len(prog) && i < len(again) && prog[i] == again[i] {
+			i++
+		}
+		t.Fatalf("MF encoding not stable: differs at byte %d (%d bytes, %d bytes again)", i, len(prog), len(again))
+	}
+	c := changes[0]
+	if c.Del {
+		t.Fatalf("MF encoding not stable: %v removed", c.Ins)
+	}
+	t.Fatalf("MF encoding not stable: %v added", c.Ins)
+}
+
+// convert converts BF code to MF.
+func convert(src []byte, memsize uint64) ([]byte, error) {
+	var buf bytes.Buffer
+	r := mf.NewBFReader64(&buf, memsize)
+	if _, err := r.Write(src); err != nil {
+		return nil, err
+	}
+	if err := r.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
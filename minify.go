@@ -0,0 +1,64 @@
+package mf
+
+// MinifyBF returns the smallest equivalent plain BF code it can find.
+// It strips every non-BF byte, removes loops that are never entered,
+// because their cell is provably zero, and code after a loop that never
+// terminates, and cancels adjacent +- and >< pairs. Cells read by , are
+// never assumed zero. The brackets must be balanced.
+func MinifyBF(p []byte) ([]byte, error) {
+	if err := ValidateBF(p); err != nil {
+		return nil, err
+	}
+	code := make([]byte, 0, len(p))
+	for _, b := range p {
+		if isBF(b) {
+			code = append(code, b)
+		}
+	}
+	for {
+		loops := deadLoops(code)
+		if len(loops) == 0 || len(loops) == 1 && loops[0].infinite && loops[0].close == len(code)-1 {
+			break
+		}
+		out := make([]byte, 0, len(code))
+		last := 0
+		for _, l := range loops {
+			if l.infinite {
+				out = append(out, code[last:l.close+1]...)
+				last = len(code)
+				break
+			}
+			out = append(out, code[last:l.open]...)
+			last = l.close + 1
+		}
+		code = cancelPairs(append(out, code[last:]...))
+	}
+	return cancelPairs(code), nil
+}
+
+// cancelPairs removes adjacent +- and >< pairs.
+func cancelPairs(code []byte) []byte {
+	out := code[:0]
+	for _, b := range code {
+		if n := len(out); n > 0 && inverse(out[n-1], b) {
+			out = out[:n-1]
+		} else {
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+func inverse(a, b byte) bool {
+	switch a {
+	case '+':
+		return b == '-'
+	case '-':
+		return b == '+'
+	case '>':
+		return b == '<'
+	case '<':
+		return b == '>'
+	}
+	return false
+}
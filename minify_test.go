@@ -0,0 +1,51 @@
+package mf
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestMinifyBF(t *testing.T) {
+	tests := []struct{ src, want string }{
+		{",[.,]", ",[.,]"},
+		{"cat: ,[.,]", ",[.,]"},
+		{"+,[.,]", "+,[.,]"},
+		{",>[.]<[.,]", ",[.,]"},
+		{",>,[.]<[.,]", ",>,[.]<[.,]"},
+		{"[comment]+[-]", "+[-]"},
+		{"+[-][.]", "+[-]"},
+		{"+-><,[-],[.,]", ",[-],[.,]"},
+		{"+[]+++", "+[]"},
+	}
+	for _, tt := range tests {
+		got, err := MinifyBF([]byte(tt.src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("MinifyBF(%q) = %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+// TestMinifyBFRuns checks that minified random programs run the same.
+func TestMinifyBFRuns(t *testing.T) {
+	f := &Fuzzer{Rand: rand.New(rand.NewSource(1))}
+	for range 1000 {
+		src, input := f.Generate()
+		min, err := MinifyBF(src)
+		if err != nil {
+			continue
+		}
+		var want, got bytes.Buffer
+		if RunBF(src, 64, bytes.NewReader(input), &want, 10*time.Millisecond) != nil {
+			continue
+		}
+		err = RunBF(min, 64, bytes.NewReader(input), &got, 10*time.Millisecond)
+		if err != nil || !bytes.Equal(got.Bytes(), want.Bytes()) {
+			t.Errorf("MinifyBF(%q) = %q, output %q, %v on input %q; want %q", src, min, got.Bytes(), err, input, want.Bytes())
+		}
+	}
+}
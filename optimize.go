@@ -0,0 +1,286 @@
+package mf
+
+import (
+	"bytes"
+	"math"
+)
+
+// Optimize rewrites common BF idioms into extension instructions.
+//
+//	[-] [+]           -> set 0
+//	set a, +b         -> set a+b
+//	[-] > [-] > [-]   -> clear 3, > 2
+//	[->>+<<]          -> move 2, which moves the cell, not the pointer
+//	[<]               -> scan -1
+//	>>> <             -> shift 2
+//	[->+>+<<]         -> [- addat 1 1, addat 2 1]
+//
+// Loops of + - > < . , with no net pointer movement add at offsets from
+// the pointer instead of moving it, except around . and ,.
+//
+// The input must not contain resolved jump positions.
+func Optimize(ins []Instruction) []Instruction {
+	return optimize(ins, nil)
+}
+
+// optimize is Optimize, rewriting only the loops whose [ hot accepts
+// if hot is not nil.
+func optimize(ins []Instruction, hot func(open Instruction) bool) []Instruction {
+	out := make([]Instruction, 0, len(ins))
+	for i := 0; i < len(ins); i++ {
+		if hot != nil && ins[i].Op == OpOpen && !hot(ins[i]) {
+			out = append(out, ins[i])
+			continue
+		}
+		if off, ok := moveLoop(ins[i:]); ok {
+			out = append(out, Instruction{Op: OpMove, Arg: uint64(uint32(off))})
+			i += 5
+			continue
+		}
+		if step, ok := scanLoop(ins[i:]); ok {
+			out = append(out, Instruction{Op: OpScan, Arg: uint64(uint32(step))})
+			i += 2
+			continue
+		}
+		if loop, n, ok := offsetLoop(ins[i:]); ok {
+			out = append(out, loop...)
+			i += n - 1
+			continue
+		}
+		in := ins[i]
+		if clearLoop(ins[i:]) {
+			in = Instruction{Op: OpSet}
+			i += 2
+		}
+		n := len(out)
+		if n > 0 && out[n-1].Op == OpSet {
+			switch in.Op {
+			case OpAdd:
+				out[n-1].Arg = (out[n-1].Arg + in.Arg) & 0xff
+				continue
+			case OpSub:
+				out[n-1].Arg = (out[n-1].Arg - in.Arg) & 0xff
+				continue
+			}
+		}
+		if in.Op == OpSet && in.Arg == 0 && n > 1 && out[n-1].Op == OpRight && out[n-1].Arg == 1 {
+			switch prev := out[n-2]; {
+			case prev.Op == OpSet && prev.Arg == 0:
+				out[n-2] = Instruction{Op: OpClear, Arg: 2}
+				out[n-1].Arg = 1
+				continue
+			case prev.Op == OpRight && n > 2 && out[n-3].Op == OpClear && prev.Arg == out[n-3].Arg-1 && out[n-3].Arg < 0xffffff:
+				out[n-3].Arg++
+				out[n-2].Arg++
+				out = out[:n-1]
+				continue
+			}
+		}
+		if d, ok := pointerDelta(in); ok && n > 0 && out[n-1].Op != in.Op {
+			if p, ok := pointerDelta(out[n-1]); ok && p+d > -1<<23 && p+d < 1<<23 {
+				if p+d == 0 {
+					out = out[:n-1]
+				} else {
+					out[n-1] = Instruction{Op: OpShift, Arg: uint64(uint32(p + d))}
+				}
+				continue
+			}
+		}
+		out = append(out, in)
+	}
+	return out
+}
+
+// pointerDelta returns the signed pointer movement of > < and shift
+// instructions small enough for a shift.
+func pointerDelta(in Instruction) (int32, bool) {
+	switch in.Op {
+	case OpRight:
+		return int32(in.Arg), in.Arg < 1<<23
+	case OpLeft:
+		return -int32(in.Arg), in.Arg < 1<<23
+	case OpShift:
+		return int32(in.Arg), true
+	}
+	return 0, false
+}
+
+// clearLoop reports whether ins starts with [-] or [+].
+func clearLoop(ins []Instruction) bool {
+	return len(ins) >= 3 && ins[0].Op == OpOpen && ins[2].Op == OpClose &&
+		(ins[1].Op == OpSub || ins[1].Op == OpAdd) && ins[1].Arg == 1
+}
+
+// scanLoop reports whether ins starts with [>] or a variant of it,
+// and returns the signed pointer step.
+func scanLoop(ins []Instruction) (int32, bool) {
+	if len(ins) < 3 || ins[0].Op != OpOpen || ins[2].Op != OpClose || ins[1].Arg >= 1<<23 {
+		return 0, false
+	}
+	switch ins[1].Op {
+	case OpRight:
+		return int32(ins[1].Arg), true
+	case OpLeft:
+		return -int32(ins[1].Arg), true
+	}
+	return 0, false
+}
+
+// moveLoop reports whether ins starts with [->>+<<] or a variant of it,
+// and returns the signed offset of the destination cell.
+func moveLoop(ins []Instruction) (int32, bool) {
+	if len(ins) < 6 || ins[0].Op != OpOpen || ins[5].Op != OpClose {
+		return 0, false
+	}
+	body := ins[1:5]
+	if body[0].Op == OpSub && body[0].Arg == 1 {
+		body = body[1:]
+	} else if body[3].Op == OpSub && body[3].Arg == 1 {
+		body = body[:3]
+	} else {
+		return 0, false
+	}
+	there, add, back := body[0], body[1], body[2]
+	if add.Op != OpAdd || add.Arg != 1 || there.Arg != back.Arg || there.Arg >= 1<<23 {
+		return 0, false
+	}
+	switch {
+	case there.Op == OpRight && back.Op == OpLeft:
+		return int32(there.Arg), true
+	case there.Op == OpLeft && back.Op == OpRight:
+		return -int32(there.Arg), true
+	}
+	return 0, false
+}
+
+// offsetLoop reports whether ins starts with a loop of + - > < . , with
+// no net pointer movement, and returns it rewritten with adds at offsets
+// and the number of instructions it replaces, if that is shorter.
+func offsetLoop(ins []Instruction) ([]Instruction, int, bool) {
+	if len(ins) == 0 || ins[0].Op != OpOpen {
+		return nil, 0, false
+	}
+	out := []Instruction{ins[0]}
+	var adds []Instruction // pending adds, Offset is the cell offset
+	ptr, at := 0, 0        // pointer offset, and where it is in out
+	flush := func() bool {
+		for _, a := range adds {
+			switch off := a.Offset - at; {
+			case byte(a.Arg) == 0:
+			case off < math.MinInt16 || off > math.MaxInt16:
+				return false
+			case off != 0:
+				out = append(out, Instruction{Op: OpAddAt, Arg: AddAtArg(int16(off), byte(a.Arg))})
+			case byte(a.Arg) > 128:
+				out = append(out, Instruction{Op: OpSub, Arg: uint64(-byte(a.Arg))})
+			default:
+				out = append(out, Instruction{Op: OpAdd, Arg: uint64(byte(a.Arg))})
+			}
+		}
+		adds = adds[:0]
+		switch {
+		case ptr > at:
+			out = append(out, Instruction{Op: OpRight, Arg: uint64(ptr - at)})
+		case ptr < at:
+			out = append(out, Instruction{Op: OpLeft, Arg: uint64(at - ptr)})
+		}
+		at = ptr
+		return true
+	}
+	add := func(n uint64) {
+		for i := range adds {
+			if adds[i].Offset == ptr {
+				adds[i].Arg += n
+				return
+			}
+		}
+		adds = append(adds, Instruction{Arg: n, Offset: ptr})
+	}
+	for i := 1; i < len(ins); i++ {
+		in := ins[i]
+		switch in.Op {
+		case OpAdd:
+			add(in.Arg)
+		case OpSub:
+			add(-in.Arg)
+		case OpRight, OpLeft:
+			if in.Arg > math.MaxInt16 {
+				return nil, 0, false
+			}
+			if in.Op == OpRight {
+				ptr += int(in.Arg)
+			} else {
+				ptr -= int(in.Arg)
+			}
+		case OpOut, OpIn:
+			if !flush() {
+				return nil, 0, false
+			}
+			out = append(out, in)
+		case OpClose:
+			if ptr != 0 || !flush() || len(out)+1 >= i+1 {
+				return nil, 0, false
+			}
+			return append(out, in), i + 1, true
+		default:
+			return nil, 0, false
+		}
+	}
+	return nil, 0, false
+}
+
+// OptimizeMF applies Optimize to an MF binary. If p is not nil, only the
+// loops taking at least minShare of the steps in the profile are
+// rewritten, as reported by HotLoops, leaving cold code as it is.
+func OptimizeMF(prog []byte, p *Profile, minShare float64) ([]byte, error) {
+	prog, l, err := parseProg(prog)
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := DecodeMF(prog)
+	if err != nil {
+		return nil, err
+	}
+	var hot func(Instruction) bool
+	if p != nil {
+		loops, err := HotLoops(prog, p)
+		if err != nil {
+			return nil, err
+		}
+		opens := make(map[int]bool)
+		for _, h := range loops {
+			if h.Share >= minShare {
+				opens[h.Offset] = true
+			}
+		}
+		hot = func(open Instruction) bool { return opens[open.Offset] }
+	}
+	var buf bytes.Buffer
+	r := newBFReader(&buf, layout{version: l.version, code: l.code, width: l.width}, l.memsize)
+	for _, in := range optimize(foldRuns(decoded), hot) {
+		r.emit(in)
+	}
+	if err := r.Close(); err != nil {
+		return nil, err
+	}
+	out := buf.Bytes()
+	copy(out, prog[:4]) // keep the magic
+	return out, nil
+}
+
+// foldRuns folds runs of nibbles of decoded MF code,
+// and unresolves the jumps for the encoder.
+func foldRuns(decoded []Instruction) []Instruction {
+	var ins []Instruction
+	for _, in := range decoded {
+		switch n := len(ins); {
+		case in.Op == OpOpen || in.Op == OpClose:
+			in.Arg = 0
+		case in.Op <= OpIn && n > 0 && ins[n-1].Op == in.Op:
+			ins[n-1].Arg += in.Arg
+			continue
+		}
+		ins = append(ins, in)
+	}
+	return ins
+}
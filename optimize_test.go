@@ -0,0 +1,63 @@
+package mf
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestOptimizeShift(t *testing.T) {
+	tests := []struct{ src, want string }{
+		{">>><", "[shift 2]"},
+		{"<<>", "[shift -1]"},
+		{"><", "[]"},
+		{">>>", "[> 3]"},
+		{">><<<+>", "[shift -1 + 1 > 1]"},
+		{"+[->+<]>><", "[+ 1 move 1 shift 1]"},
+	}
+	for _, tt := range tests {
+		if got := fmt.Sprint(Optimize(ParseBF([]byte(tt.src)))); got != tt.want {
+			t.Errorf("Optimize(%q) = %s, want %s", tt.src, got, tt.want)
+		}
+	}
+}
+
+// TestShiftRuns checks that shifts written by Optimize run in the VM,
+// and are lowered by ToBF, as the BF code they replace.
+func TestShiftRuns(t *testing.T) {
+	src := []byte("++++++[>++++++++>>+<<<-]>>>><.+<<>.>><<<<[>>><+.<<-]")
+	var prog bytes.Buffer
+	r := NewBFReader(&prog, 16)
+	r.Optimize = true
+	r.Write(src)
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	ins, err := DecodeMF(prog.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains([]byte(fmt.Sprint(ins)), []byte("shift")) {
+		t.Fatalf("no shift in %v", ins)
+	}
+	res, err := CrossCheck(src, prog.Bytes(), nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.OK() {
+		t.Errorf("VM: %v", res)
+	}
+	var back bytes.Buffer
+	w := NewBFWriter(&back)
+	w.NoBanner, w.NoPreamble = true, true
+	w.Write(prog.Bytes())
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var want, got bytes.Buffer
+	RunBF(src, 16, nil, &want, time.Second)
+	if err := RunBF(back.Bytes(), 16, nil, &got, time.Second); err != nil || !bytes.Equal(got.Bytes(), want.Bytes()) {
+		t.Errorf("ToBF: %q runs to %q, %v; want %q", back.Bytes(), got.Bytes(), err, want.Bytes())
+	}
+}
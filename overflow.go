@@ -0,0 +1,74 @@
+package mf
+
+// unknownCell is the value range of a cell that may hold any value.
+var unknownCell = span{0, 255}
+
+// AnalyzeOverflow reports + and - instructions of BF code that may wrap
+// an 8-bit cell around, so programs which need wider cells can be told
+// apart from ones that are fine with bytes.
+//
+// Cell value ranges are tracked through loop-free regions only.
+// A loop body starts with the current cell in 1..255 and every other
+// cell unknown, and the code after a loop starts with the current cell
+// at 0 and every other cell unknown. Unknown cells are never reported.
+func AnalyzeOverflow(p []byte) []Diagnostic {
+	var diags []Diagnostic
+	cells := map[int]span{}
+	ptr, zero := 0, true
+	for i, b := range p {
+		switch b {
+		case '+', '-':
+			r, ok := cells[ptr]
+			if !ok && !zero || r == unknownCell {
+				continue
+			}
+			var msg string
+			if b == '+' {
+				r.lo, r.hi = r.lo+1, r.hi+1
+				switch {
+				case r.lo > 255:
+					msg = "cell value wraps above 255"
+				case r.hi > 255:
+					msg = "cell value may wrap above 255"
+				}
+			} else {
+				r.lo, r.hi = r.lo-1, r.hi-1
+				switch {
+				case r.hi < 0:
+					msg = "cell value wraps below 0"
+				case r.lo < 0:
+					msg = "cell value may wrap below 0"
+				}
+			}
+			if msg == "" {
+				cells[ptr] = r
+				continue
+			}
+			sev := SeverityWarning
+			if r.lo != r.hi {
+				sev = SeverityInfo
+			}
+			diags = append(diags, Diagnostic{positionOf(p, i), sev, DiagOverflow, msg})
+			if r.lo == r.hi {
+				cells[ptr] = span{r.lo & 0xff, r.hi & 0xff}
+			} else {
+				cells[ptr] = unknownCell
+			}
+		case '>':
+			ptr++
+		case '<':
+			ptr--
+		case ',':
+			cells[ptr] = unknownCell
+		case '[', ']':
+			clear(cells)
+			ptr, zero = 0, false
+			if b == '[' {
+				cells[0] = span{1, 255}
+			} else {
+				cells[0] = span{0, 0}
+			}
+		}
+	}
+	return diags
+}
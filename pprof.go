@@ -0,0 +1,141 @@
+package mf
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// WritePprof writes the profile p of an MF binary to w in the gzipped
+// protobuf format of pprof, so it can be analyzed with "go tool pprof".
+// name is the file name of the binary shown by pprof.
+//
+// Loops are shown as functions named after the offset of their [, which
+// are called from their enclosing loop, or from main for outermost loops.
+// Every sample is an instruction with its loop stack, and line numbers
+// are byte offsets.
+func (p *Profile) WritePprof(w io.Writer, prog []byte, name string) error {
+	loops, err := AnalyzeLoops(prog)
+	if err != nil {
+		return err
+	}
+	var strs []string
+	index := make(map[string]int64)
+	str := func(s string) int64 {
+		i, ok := index[s]
+		if !ok {
+			i = int64(len(strs))
+			index[s] = i
+			strs = append(strs, s)
+		}
+		return i
+	}
+	str("")
+
+	var out protoBuf
+	valueType := func(typ, unit string) []byte {
+		var b protoBuf
+		b.int(1, str(typ))
+		b.int(2, str(unit))
+		return b
+	}
+	out.bytes(1, valueType("steps", "count"))
+
+	// function 1 is main, and function i+2 is loop i
+	funcs := []string{"main"}
+	for _, l := range loops {
+		funcs = append(funcs, fmt.Sprintf("loop@0x%x", l.Offset))
+	}
+	// locations are instructions, and the calls of loops at their [
+	type key struct {
+		at   CodePos
+		call bool
+	}
+	locs := make(map[key]uint64)
+	var locBufs []protoBuf
+	location := func(at CodePos, call bool, fn int) uint64 {
+		if id, ok := locs[key{at, call}]; ok {
+			return id
+		}
+		id := uint64(len(locBufs) + 1)
+		locs[key{at, call}] = id
+		var line, loc protoBuf
+		line.int(1, int64(fn))
+		line.int(2, int64(at.Offset))
+		loc.int(1, int64(id))
+		loc.int(3, int64(at.Offset))
+		loc.bytes(4, line)
+		locBufs = append(locBufs, loc)
+		return id
+	}
+	for _, at := range p.Positions() {
+		stack := loopStack(loops, at.Offset)
+		fn := 1
+		if len(stack) > 0 {
+			fn = stack[0] + 2
+		}
+		ids := []uint64{location(at, false, fn)}
+		for k, i := range stack {
+			caller := 1
+			if k+1 < len(stack) {
+				caller = stack[k+1] + 2
+			}
+			ids = append(ids, location(CodePos{Offset: loops[i].Offset}, true, caller))
+		}
+		var sample, idBuf protoBuf
+		for _, id := range ids {
+			idBuf.varint(id)
+		}
+		sample.bytes(1, idBuf)
+		var val protoBuf
+		val.varint(uint64(p.Counts[at]))
+		sample.bytes(2, val)
+		out.bytes(2, sample)
+	}
+	for _, loc := range locBufs {
+		out.bytes(4, loc)
+	}
+	for i, f := range funcs {
+		var b protoBuf
+		b.int(1, int64(i+1))
+		b.int(2, str(f))
+		b.int(3, str(f))
+		b.int(4, str(name))
+		out.bytes(5, b)
+	}
+	out.bytes(11, valueType("steps", "count"))
+	out.int(12, 1)
+	for _, s := range strs {
+		out.bytes(6, []byte(s))
+	}
+
+	zw := gzip.NewWriter(w)
+	if _, err := zw.Write(out); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// protoBuf is an encoded protocol buffer message.
+type protoBuf []byte
+
+func (b *protoBuf) varint(n uint64) {
+	for n >= 0x80 {
+		*b = append(*b, byte(n)|0x80)
+		n >>= 7
+	}
+	*b = append(*b, byte(n))
+}
+
+// int writes an integer field.
+func (b *protoBuf) int(field int, n int64) {
+	b.varint(uint64(field) << 3)
+	b.varint(uint64(n))
+}
+
+// bytes writes a length-delimited field.
+func (b *protoBuf) bytes(field int, p []byte) {
+	b.varint(uint64(field)<<3 | 2)
+	b.varint(uint64(len(p)))
+	*b = append(*b, p...)
+}
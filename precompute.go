@@ -0,0 +1,193 @@
+package mf
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// PrecomputeMF runs the start of the MF binary prog that reads no input,
+// and replaces it with code setting the cells it leaves and writing the
+// output it writes. Programs often spend thousands of instructions there
+// building constants.
+//
+// The start ends before the first instruction or loop at the top level
+// that reads input or uses extensions other than set, clear, move, scan,
+// shift and addat. If running it faults or executes more than maxSteps
+// instructions, or the binary does not get smaller, prog is returned as
+// it is. So are programs with calls, whose targets would move.
+func PrecomputeMF(prog []byte, maxSteps int64) ([]byte, error) {
+	prog, l, err := parseProg(prog)
+	if err != nil {
+		return nil, err
+	}
+	// find the start, and where the rest begins
+	var rest []Instruction
+	end, endLow := l.code, false
+	depth := 0
+walk:
+	for pc, low := l.code, false; pc < len(prog); {
+		in, next, nextLow, err := decode(prog, l, pc, low, DecodeDefault)
+		if err != nil {
+			return nil, err
+		}
+		pc, low = next, nextLow
+		switch in.Op {
+		case OpNop:
+			continue
+		case OpAdd, OpSub, OpRight, OpLeft, OpOut, OpSet, OpClear, OpMove, OpScan, OpShift, OpAddAt:
+		case OpOpen:
+			depth++
+		case OpClose:
+			depth--
+		default:
+			break walk
+		}
+		if depth == 0 {
+			end, endLow = pc, low
+		}
+	}
+	for pc, low := end, endLow; pc < len(prog); {
+		in, next, nextLow, err := decode(prog, l, pc, low, DecodeDefault)
+		if err != nil {
+			return nil, err
+		}
+		if in.Op == OpCall {
+			return prog, nil
+		}
+		if in.Op != OpNop {
+			in.Offset = pc
+			rest = append(rest, in)
+		}
+		pc, low = next, nextLow
+	}
+	if end == l.code {
+		return prog, nil
+	}
+
+	v, err := NewSandboxVM(prog, Policy{MaxSteps: maxSteps})
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	v.In, v.Out = bytes.NewReader(nil), &out
+	cells := bytes.Clone(v.Cells()) // as the replacement leaves them
+	for {
+		if pc, low := v.PC(); pc == end && low == endLow || v.Done() {
+			break
+		}
+		if err := v.Step(); err != nil {
+			return prog, nil
+		}
+	}
+
+	var code []Instruction
+	ptr := 0
+	seek := func(to int) {
+		switch {
+		case to > ptr:
+			code = append(code, Instruction{Op: OpRight, Arg: uint64(to - ptr)})
+		case to < ptr:
+			code = append(code, Instruction{Op: OpLeft, Arg: uint64(ptr - to)})
+		}
+		ptr = to
+	}
+	code, cells[0] = printCode(code, out.Bytes(), cells[0])
+	for i, c := range v.Cells() {
+		if c != cells[i] {
+			seek(i)
+			code = changeCell(code, cells[i], c)
+		}
+	}
+	seek(v.Ptr())
+
+	var buf bytes.Buffer
+	r := newBFReader(&buf, layout{version: l.version, code: l.code, width: l.width}, l.memsize)
+	for _, in := range code {
+		r.emit(in)
+	}
+	for _, in := range foldRuns(rest) {
+		r.emit(in)
+	}
+	if err := r.Close(); err != nil {
+		return nil, err
+	}
+	res := buf.Bytes()
+	if len(res) >= len(prog) {
+		return prog, nil
+	}
+	copy(res, prog[:4]) // keep the magic
+	return res, nil
+}
+
+// EvaluateMF runs the MF binary prog, which must not read input, and
+// returns its output and a binary that only writes it, with the memsize
+// of prog. Running prog must end normally within maxSteps instructions.
+func EvaluateMF(prog []byte, maxSteps int64) (evaluated, output []byte, err error) {
+	prog, l, err := parseProg(prog)
+	if err != nil {
+		return nil, nil, err
+	}
+	ins, err := DecodeMF(prog)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, in := range ins {
+		if in.Op == OpIn {
+			return nil, nil, fmt.Errorf("program reads input at offset %d", in.Offset)
+		}
+	}
+	v, err := NewSandboxVM(prog, Policy{MaxSteps: maxSteps})
+	if err != nil {
+		return nil, nil, err
+	}
+	var out bytes.Buffer
+	v.In, v.Out = bytes.NewReader(nil), &out
+	if err := v.Run(); err != nil {
+		return nil, nil, fmt.Errorf("evaluating: %w", err)
+	}
+	// the first cell starts as 0 in both tape layouts
+	code, _ := printCode(nil, out.Bytes(), 0)
+
+	var buf bytes.Buffer
+	r := newBFReader(&buf, layout{version: l.version, code: l.code, width: l.width}, l.memsize)
+	for _, in := range code {
+		r.emit(in)
+	}
+	if err := r.Close(); err != nil {
+		return nil, nil, err
+	}
+	evaluated = buf.Bytes()
+	copy(evaluated, prog[:4]) // keep the magic
+	return evaluated, out.Bytes(), nil
+}
+
+// printCode appends code writing output with the cell under the pointer,
+// which holds cell, and returns it with the value left in the cell.
+func printCode(code []Instruction, output []byte, cell byte) ([]Instruction, byte) {
+	for i := 0; i < len(output); {
+		j := i
+		for j < len(output) && output[j] == output[i] {
+			j++
+		}
+		code = changeCell(code, cell, output[i])
+		cell = output[i]
+		code = append(code, Instruction{Op: OpOut, Arg: uint64(j - i)})
+		i = j
+	}
+	return code, cell
+}
+
+// changeCell appends code changing a cell from a value to another,
+// adding small differences in nibbles rather than with set.
+func changeCell(code []Instruction, from, to byte) []Instruction {
+	switch d := to - from; {
+	case d == 0:
+	case d <= 9:
+		code = append(code, Instruction{Op: OpAdd, Arg: uint64(d)})
+	case -d <= 9:
+		code = append(code, Instruction{Op: OpSub, Arg: uint64(-d)})
+	default:
+		code = append(code, Instruction{Op: OpSet, Arg: uint64(to)})
+	}
+	return code
+}
@@ -0,0 +1,171 @@
+package mf
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// CodePos is the position of an instruction in an MF binary.
+type CodePos struct {
+	Offset int  // byte offset
+	Low    bool // whether it is in the low nibble
+}
+
+func (p CodePos) String() string {
+	if p.Low {
+		return fmt.Sprintf("%x.5", p.Offset)
+	}
+	return fmt.Sprintf("%x", p.Offset)
+}
+
+// Profile counts how many times each instruction of a program was
+// executed. Set VM.Profile to collect one.
+type Profile struct {
+	Counts map[CodePos]int64
+}
+
+// profileFormat identifies profile files.
+const profileFormat = "mfprof/1"
+
+// NewProfile returns an empty Profile.
+func NewProfile() *Profile {
+	return &Profile{Counts: make(map[CodePos]int64)}
+}
+
+// Positions returns the positions of executed instructions in order.
+func (p *Profile) Positions() []CodePos {
+	pos := make([]CodePos, 0, len(p.Counts))
+	for at := range p.Counts {
+		pos = append(pos, at)
+	}
+	sort.Slice(pos, func(i, j int) bool {
+		if pos[i].Offset != pos[j].Offset {
+			return pos[i].Offset < pos[j].Offset
+		}
+		return !pos[i].Low && pos[j].Low
+	})
+	return pos
+}
+
+// Write writes the profile to w as text, a line of the hex position
+// and the count of each executed instruction.
+func (p *Profile) Write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, profileFormat)
+	for _, at := range p.Positions() {
+		fmt.Fprintf(bw, "%v %d\n", at, p.Counts[at])
+	}
+	return bw.Flush()
+}
+
+// ReadProfile reads a profile written by Profile.Write.
+func ReadProfile(r io.Reader) (*Profile, error) {
+	s := bufio.NewScanner(r)
+	if !s.Scan() || s.Text() != profileFormat {
+		if err := s.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("invalid profile: missing %s header", profileFormat)
+	}
+	p := NewProfile()
+	for line := 2; s.Scan(); line++ {
+		f := strings.Fields(s.Text())
+		if len(f) == 0 {
+			continue
+		}
+		if len(f) != 2 {
+			return nil, fmt.Errorf("invalid profile: line %d: %q", line, s.Text())
+		}
+		var at CodePos
+		off, low := strings.CutSuffix(f[0], ".5")
+		o, err1 := strconv.ParseUint(off, 16, 63)
+		n, err2 := strconv.ParseInt(f[1], 10, 64)
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("invalid profile: line %d: %q", line, s.Text())
+		}
+		at.Offset, at.Low = int(o), low
+		p.Counts[at] += n
+	}
+	return p, s.Err()
+}
+
+// HotLoop is a loop with the steps executed inside it, see HotLoops.
+type HotLoop struct {
+	Loop
+	Steps int64   // instructions executed from its [ to its ]
+	Share float64 // Steps divided by all steps of the profile
+}
+
+// HotLoops returns the loops of an MF binary with their steps in the
+// profile p, from the hottest. The steps of nested loops count for
+// their outer loops too.
+func HotLoops(prog []byte, p *Profile) ([]HotLoop, error) {
+	loops, err := AnalyzeLoops(prog)
+	if err != nil {
+		return nil, err
+	}
+	var total int64
+	for _, n := range p.Counts {
+		total += n
+	}
+	hot := make([]HotLoop, len(loops))
+	for i, l := range loops {
+		hot[i].Loop = l
+		for at, n := range p.Counts {
+			if at.Offset >= l.Offset && at.Offset <= l.Close {
+				hot[i].Steps += n
+			}
+		}
+		if total > 0 {
+			hot[i].Share = float64(hot[i].Steps) / float64(total)
+		}
+	}
+	sort.SliceStable(hot, func(i, j int) bool { return hot[i].Steps > hot[j].Steps })
+	return hot, nil
+}
+
+// loopStack returns the indexes of the loops around byte offset off,
+// from the innermost.
+func loopStack(loops []Loop, off int) []int {
+	var stack []int
+	for i, l := range loops {
+		if l.Offset <= off && off <= l.Close {
+			stack = append([]int{i}, stack...)
+		}
+	}
+	return stack
+}
+
+// WriteFolded writes the profile p of an MF binary to w as folded stacks,
+// the input format of flamegraph.pl and compatible tools. Each line is a
+// loop stack from main, such as "main;loop@0x1c;loop@0x2a", and the steps
+// executed in it outside nested loops.
+func (p *Profile) WriteFolded(w io.Writer, prog []byte) error {
+	loops, err := AnalyzeLoops(prog)
+	if err != nil {
+		return err
+	}
+	steps := make(map[string]int64)
+	for at, n := range p.Counts {
+		frames := []string{"main"}
+		stack := loopStack(loops, at.Offset)
+		for i := len(stack) - 1; i >= 0; i-- {
+			frames = append(frames, fmt.Sprintf("loop@0x%x", loops[stack[i]].Offset))
+		}
+		steps[strings.Join(frames, ";")] += n
+	}
+	stacks := make([]string, 0, len(steps))
+	for s := range steps {
+		stacks = append(stacks, s)
+	}
+	sort.Strings(stacks)
+	bw := bufio.NewWriter(w)
+	for _, s := range stacks {
+		fmt.Fprintf(bw, "%s %d\n", s, steps[s])
+	}
+	return bw.Flush()
+}
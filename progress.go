@@ -0,0 +1,52 @@
+package mf
+
+import "io"
+
+// defaultProgressInterval is the input bytes between Progress calls
+// if ProgressInterval is zero.
+const defaultProgressInterval = 64 << 10
+
+// progress holds a progress callback and when to call it next.
+type progress struct {
+	// Progress, if not nil, is called with the input bytes consumed and
+	// the output bytes produced so far, every ProgressInterval input
+	// bytes. FromBF counts the MF code buffered until Close, and calls
+	// it once more at Close.
+	Progress func(in, out int64)
+	// ProgressInterval is the input bytes between Progress calls,
+	// 64 KiB if zero.
+	ProgressInterval int
+
+	next int64 // input bytes of the next call
+}
+
+// tick calls Progress if in input bytes are due.
+func (p *progress) tick(in, out int64) {
+	if p.Progress == nil {
+		return
+	}
+	interval := int64(p.ProgressInterval)
+	if interval <= 0 {
+		interval = defaultProgressInterval
+	}
+	if p.next == 0 {
+		p.next = interval
+	}
+	if in < p.next {
+		return
+	}
+	p.next = in + interval
+	p.Progress(in, out)
+}
+
+// counter is a Writer counting the bytes written to w.
+type counter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *counter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,120 @@
+package mf
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultTestTimeout limits the run of a ProgramTest without a timeout
+// line.
+const DefaultTestTimeout = 10 * time.Second
+
+// ProgramTest is a test of an MF program: the input it is run on, and
+// what it must write and how it must end. Tests of the program foo.mf
+// are kept in the file foo.mftest next to it, read by ParseProgramTests.
+type ProgramTest struct {
+	Name    string
+	Line    int    // of the test line in the file
+	Input   []byte // given to the program
+	Output  []byte // expected output, nil if not checked
+	Status  int    // expected exit status
+	Fault   string // expected in the error of a faulting run, "" if it must not fault
+	Timeout time.Duration
+}
+
+// ParseProgramTests reads the tests of a .mftest file from r. A file
+// has a command on each line, with strings quoted as in Go; a test line
+// starts a test, and the lines after it up to the next one set it up:
+//
+//	test "greets"    start the test named greets
+//	in "Ada\n"       run the program with the input "Ada\n"
+//	out "Hi, Ada\n"  expect the output to be "Hi, Ada\n"
+//	exit 3           expect the program to exit with status 3
+//	fault "bounds"   expect the program to fault with an error containing "bounds"
+//	timeout 5s       fail the test if it runs longer than 5s
+//
+// Blank lines and lines starting with # are skipped.
+func ParseProgramTests(r io.Reader) ([]ProgramTest, error) {
+	var tests []ProgramTest
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		cmd, arg, _ := strings.Cut(line, " ")
+		arg = strings.TrimSpace(arg)
+		if cmd != "test" && len(tests) == 0 {
+			return nil, fmt.Errorf("line %d: %q before the first test line", n, line)
+		}
+		var t *ProgramTest
+		if len(tests) > 0 {
+			t = &tests[len(tests)-1]
+		}
+		var err error
+		switch cmd {
+		case "test":
+			tests = append(tests, ProgramTest{Line: n, Timeout: DefaultTestTimeout})
+			tests[len(tests)-1].Name, err = strconv.Unquote(arg)
+		case "in":
+			var in string
+			in, err = strconv.Unquote(arg)
+			t.Input = []byte(in)
+		case "out":
+			var out string
+			out, err = strconv.Unquote(arg)
+			t.Output = []byte(out)
+		case "exit":
+			t.Status, err = strconv.Atoi(arg)
+		case "fault":
+			t.Fault, err = strconv.Unquote(arg)
+			if err == nil && t.Fault == "" {
+				err = fmt.Errorf("empty fault")
+			}
+		case "timeout":
+			t.Timeout, err = time.ParseDuration(arg)
+		default:
+			err = fmt.Errorf("unknown command")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid %q: %v", n, line, err)
+		}
+	}
+	return tests, s.Err()
+}
+
+// Run runs the MF binary prog on the input of the test, and returns an
+// error describing how it failed the test, if it did.
+func (t *ProgramTest) Run(prog []byte) error {
+	v, err := NewSandboxVM(prog, Policy{Timeout: t.Timeout})
+	if err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	v.In, v.Out, v.Debug = bytes.NewReader(t.Input), &out, nil
+	err = v.Run()
+	status := 0
+	var exit *ExitError
+	if errors.As(err, &exit) {
+		status, err = exit.Status, nil
+	}
+	switch {
+	case t.Fault != "" && err == nil:
+		return fmt.Errorf("ended without a fault, expected one with %q", t.Fault)
+	case t.Fault != "" && !strings.Contains(err.Error(), t.Fault):
+		return fmt.Errorf("faulted with %q, expected one with %q", err, t.Fault)
+	case t.Fault == "" && err != nil:
+		return fmt.Errorf("faulted: %v", err)
+	case t.Fault == "" && status != t.Status:
+		return fmt.Errorf("exit status %d, expected %d", status, t.Status)
+	case t.Output != nil && !bytes.Equal(out.Bytes(), t.Output):
+		return fmt.Errorf("output %q, expected %q", out.Bytes(), t.Output)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package mf
+
+import "bytes"
+
+// CompressionReport breaks down the size of the MF binary FromBF
+// produces for BF code. Sizes of code parts are in nibbles.
+type CompressionReport struct {
+	BFSize int // bytes
+	MFSize int // bytes, with the 8-byte header
+
+	Literals     int // plain command nibbles
+	Runs         int // compressed runs
+	RunNibbles   int // special code and operand nibbles of compressed runs
+	Jumps        int
+	JumpNibbles  int
+	Extensions   int
+	ExtNibbles   int
+	Padding      int // alignment no-op nibbles
+	MissedRuns   int // runs whose other encoding would have been smaller
+	MissedSaving int // nibbles the missed runs would have saved
+}
+
+// ReportCompression converts BF code with the CompressThreshold
+// threshold, 9 if zero, and reports how the MF size is made up.
+//
+// A compressed run costs 9 nibbles if its special code falls on a low
+// nibble and 10 otherwise, so runs around the compression threshold may
+// be smaller in the other encoding. Those are counted as missed runs:
+// runs compressed below a threshold of 9 which take fewer nibbles plain,
+// and runs above 9 left plain by a higher threshold which take fewer
+// compressed. With the threshold of 9, no run is missed.
+func ReportCompression(bf []byte, threshold int) (CompressionReport, error) {
+	var buf bytes.Buffer
+	r := NewBFReader(&buf, 0)
+	r.CompressThreshold = threshold
+	if _, err := r.Write(bf); err != nil {
+		return CompressionReport{}, err
+	}
+	if err := r.Close(); err != nil {
+		return CompressionReport{}, err
+	}
+	prog := buf.Bytes()
+	rep := CompressionReport{BFSize: len(bf), MFSize: len(prog)}
+
+	var run Instruction // pending run of plain nibbles
+	runLow := false     // whether the pending run starts on a low nibble
+	flush := func() {
+		if run.Arg == 0 {
+			return
+		}
+		alt := 10
+		if runLow {
+			alt = 9
+		}
+		if int(run.Arg) > alt {
+			rep.MissedRuns++
+			rep.MissedSaving += int(run.Arg) - alt
+		}
+		run.Arg = 0
+	}
+	pc, low := v1Layout.code, false
+	for pc < len(prog) {
+		in, next, nextLow, err := decode(prog, v1Layout, pc, low, DecodeDefault)
+		if err != nil {
+			return rep, err
+		}
+		size := (next-pc)*2 + b2i(nextLow) - b2i(low)
+		switch {
+		case in.Op == OpNop:
+			rep.Padding++
+		case size == 1:
+			rep.Literals++
+			if run.Arg == 0 || in.Op != run.Op || in.Op > OpLeft {
+				flush()
+				run.Op, runLow = in.Op, low
+			}
+			if in.Op <= OpLeft {
+				run.Arg++
+			}
+		default:
+			flush()
+			padded := !low && prog[pc]&0xf == 8|6
+			if padded {
+				rep.Padding++
+				size--
+			}
+			switch in.Op {
+			case OpAdd, OpSub, OpRight, OpLeft:
+				rep.Runs++
+				rep.RunNibbles += size
+				if int(in.Arg) < size+b2i(padded) {
+					rep.MissedRuns++
+					rep.MissedSaving += size + b2i(padded) - int(in.Arg)
+				}
+			case OpOpen, OpClose:
+				rep.Jumps++
+				rep.JumpNibbles += size
+			default:
+				rep.Extensions++
+				rep.ExtNibbles += size
+			}
+		}
+		pc, low = next, nextLow
+	}
+	flush()
+	return rep, nil
+}
+
+func b2i(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,30 @@
+package mf
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestReportCompression checks that runs are missed only when the
+// threshold moves away from 9, and then are those between it and 9.
+func TestReportCompression(t *testing.T) {
+	var src strings.Builder
+	for n := 2; n <= 20; n++ {
+		src.WriteString(strings.Repeat("+", n) + ".>")
+	}
+	tests := []struct{ threshold, missed int }{
+		{0, 0},
+		{9, 0},
+		{3, 6},   // runs of 4 to 9, compressed
+		{20, 10}, // runs of 11 to 20, left plain; 10 would start on a high nibble
+	}
+	for _, tt := range tests {
+		rep, err := ReportCompression([]byte(src.String()), tt.threshold)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rep.MissedRuns != tt.missed || (tt.missed > 0) != (rep.MissedSaving > 0) {
+			t.Errorf("threshold %d: %d missed runs saving %d nibbles, want %d", tt.threshold, rep.MissedRuns, rep.MissedSaving, tt.missed)
+		}
+	}
+}
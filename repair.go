@@ -0,0 +1,88 @@
+package mf
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+// RepairMF fixes, in place, MF binaries with broken jump positions, as
+// written by older versions shifting the second byte by 12 bits. Every
+// jump position is recomputed from the bracket structure. It returns
+// the number of fields changed. The signature section of a signed
+// binary is left as it is, so it no longer verifies if anything is
+// fixed.
+func RepairMF(prog []byte) (int, error) {
+	return repairMF(prog, false)
+}
+
+// RepairSwappedMF fixes MF binaries as RepairMF does, and also swaps the
+// memsize and run counts of version 1 binaries written little-endian by
+// foreign writers: those whose big-endian value is 1<<24 or more while
+// the swapped value is not. MF written by this package is always
+// big-endian, and valid binaries with such values are broken by it, so
+// it is only for binaries known to come from such a writer.
+func RepairSwappedMF(prog []byte) (int, error) {
+	return repairMF(prog, true)
+}
+
+func repairMF(prog []byte, swapped bool) (int, error) {
+	if len(prog) < 8 {
+		return 0, fmt.Errorf("invalid MF binary: file too small")
+	}
+	if m := string(prog[:4]); m != Magic && m != BFMagic {
+		return 0, fmt.Errorf("invalid MF binary: magic mismatch 0x%x", prog[:4])
+	}
+	fixed := 0
+	swap := func(field []byte) {
+		n := bytesUint32(field)
+		if swapped && n >= 1<<24 && bits.ReverseBytes32(n) < 1<<24 {
+			copy(field, uint32bytes(bits.ReverseBytes32(n)))
+			fixed++
+		}
+	}
+	swap(prog[4:8])
+	prog, l, err := parseProg(prog)
+	if err != nil {
+		return fixed, err
+	}
+	set := func(field []byte, n int) {
+		if l.operand(field) != uint64(n) {
+			l.putOperand(field, uint64(n))
+			fixed++
+		}
+	}
+
+	var open []int
+	pc, low := l.code, false
+	w := l.width
+	for pc < len(prog) {
+		in, next, nextLow, err := decode(prog, l, pc, low, DecodeDefault)
+		if err != nil {
+			return fixed, err
+		}
+		if next == pc+1+w {
+			operand := prog[pc+1 : next]
+			switch in.Op {
+			case OpAdd, OpSub, OpRight, OpLeft:
+				if swapped && w == 4 {
+					swap(operand)
+				}
+			case OpOpen:
+				open = append(open, pc)
+			case OpClose:
+				if len(open) == 0 {
+					return fixed, fmt.Errorf("unmatched ']' at offset %d", pc)
+				}
+				o := open[len(open)-1]
+				open = open[:len(open)-1]
+				set(prog[o+1:o+1+w], pc+1+w)
+				set(operand, o+1+w)
+			}
+		}
+		pc, low = next, nextLow
+	}
+	if len(open) > 0 {
+		return fixed, fmt.Errorf("unmatched '[' at offset %d", open[len(open)-1])
+	}
+	return fixed, nil
+}
@@ -0,0 +1,88 @@
+package mf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// convertBF converts BF code to a version 1 MF binary.
+func convertBF(t *testing.T, src string, memsize uint32) []byte {
+	t.Helper()
+	var prog bytes.Buffer
+	r := NewBFReader(&prog, memsize)
+	if _, err := r.Write([]byte(src)); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return prog.Bytes()
+}
+
+// TestRepairShiftedJumps repairs jump positions written as older
+// versions did, shifting the second byte by 12 bits instead of 16.
+func TestRepairShiftedJumps(t *testing.T) {
+	want := convertBF(t, "+["+strings.Repeat("+-", 5000)+"]", 16)
+	prog := bytes.Clone(want)
+	shifted := 0
+	for p, err := range JumpPairs(prog) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, off := range []int{p.Open.Offset, p.Close.Offset} {
+			field := prog[off+1 : off+5]
+			n := binary.BigEndian.Uint32(field)
+			copy(field, []byte{byte(n >> 24), byte(n >> 12), byte(n >> 8), byte(n)})
+			if !bytes.Equal(field, want[off+1:off+5]) {
+				shifted++
+			}
+		}
+	}
+	if shifted == 0 {
+		t.Fatal("no jump position changed by the shift")
+	}
+	fixed, err := RepairMF(prog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fixed != shifted {
+		t.Errorf("RepairMF fixed %d fields, want %d", fixed, shifted)
+	}
+	if !bytes.Equal(prog, want) {
+		t.Error("RepairMF did not restore the jump positions")
+	}
+}
+
+func TestRepairSwappedMemSize(t *testing.T) {
+	want := convertBF(t, "+[->+<]", 300)
+	prog := bytes.Clone(want)
+	binary.LittleEndian.PutUint32(prog[4:8], 300)
+	if fixed, err := RepairSwappedMF(prog); err != nil || fixed != 1 {
+		t.Errorf("RepairSwappedMF() = %d, %v, want 1 field fixed", fixed, err)
+	}
+	if !bytes.Equal(prog, want) {
+		t.Errorf("repaired header % x, want % x", prog[:8], want[:8])
+	}
+}
+
+// TestRepairKeepsLargeFields checks that RepairMF keeps a memsize and
+// runs of 1<<24 or more, which byte swapping would break.
+func TestRepairKeepsLargeFields(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		prog []byte
+	}{
+		{"memsize 1<<24", convertBF(t, "+[-]", 1<<24)},
+		{"run of 1<<24", convertBF(t, "+["+strings.Repeat(">", 1<<24)+"]", 16)},
+	} {
+		before := bytes.Clone(tt.prog)
+		if fixed, err := RepairMF(tt.prog); err != nil || fixed != 0 {
+			t.Errorf("%s: RepairMF() = %d, %v, want nothing fixed", tt.name, fixed, err)
+		}
+		if !bytes.Equal(tt.prog, before) {
+			t.Errorf("%s: RepairMF changed the binary", tt.name)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package mf
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const replHelp = `commands:
+  s, step [n]          execute n instructions (default 1)
+  c, continue          run until a breakpoint or the end
+  bs, back [n]         undo n recorded instructions (default 1)
+  record <n>           record the last n instructions for back, 0 to stop
+  b, break <offset> [if <cond>]
+                       set a breakpoint, paused only when cond holds,
+                       e.g. "b 0x1c if ptr == 42 && cell > 100"
+  d, delete <offset>   delete a breakpoint
+  watch <cell> [end]   break when cells change
+  rwatch <cell> [end]  break when cells are read
+  awatch <cell> [end]  break when cells are read or changed
+  unwatch <n>          delete watchpoint n
+  info                 list breakpoints and watchpoints
+  l, list [n]          disassemble n instructions around the PC
+  t, tape [rows]       show the tape around the pointer
+  set <cell> <value>   write a cell of the current tape
+  ptr <cell>           move the pointer
+  q, quit
+conditions use ptr, cell, cell[i], tape, pc, steps, numbers,
+  || && == != < <= > >= + - ! and parentheses
+numbers may be decimal, or hex with 0x
+offsets ending in .5 are of the low nibble, as list shows them`
+
+// REPL reads debugger commands from in, one per line, and writes the
+// results to out, until "quit" or the end of in. "help" lists commands.
+//
+// If the program reads the same input, VM.In should be a *bufio.Reader
+// passed as in, so that program input and commands are not mixed up.
+func (d *Debugger) REPL(in io.Reader, out io.Writer) error {
+	r := bufio.NewReader(in)
+	for {
+		fmt.Fprint(out, "(mf) ")
+		line, err := r.ReadString('\n')
+		if err != nil && line == "" {
+			if err == io.EOF {
+				fmt.Fprintln(out)
+				return nil
+			}
+			return err
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			continue
+		}
+		if args[0] == "q" || args[0] == "quit" {
+			return nil
+		}
+		if err := d.command(out, args); err != nil {
+			fmt.Fprintln(out, "error:", err)
+		}
+	}
+}
+
+// command executes a REPL command.
+func (d *Debugger) command(out io.Writer, args []string) error {
+	var cond *Cond
+	for i, a := range args {
+		if a == "if" && (args[0] == "b" || args[0] == "break") {
+			c, err := ParseCond(strings.Join(args[i+1:], " "))
+			if err != nil {
+				return err
+			}
+			cond, args = c, args[:i]
+			break
+		}
+	}
+	var at CodePos // of break and delete
+	if len(args) > 1 && (args[0] == "b" || args[0] == "break" || args[0] == "d" || args[0] == "delete") {
+		args[1], at.Low = strings.CutSuffix(args[1], ".5")
+	}
+	nums := make([]int, len(args)-1)
+	for i, a := range args[1:] {
+		n, err := strconv.ParseInt(a, 0, 0)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", a)
+		}
+		nums[i] = int(n)
+	}
+	arg := func(i, def int) int {
+		if i < len(nums) {
+			return nums[i]
+		}
+		return def
+	}
+	need := func(n int) error {
+		if len(nums) < n {
+			return fmt.Errorf("%s needs %d arguments", args[0], n)
+		}
+		return nil
+	}
+	switch args[0] {
+	case "s", "step":
+		ev, err := d.Step(arg(0, 1))
+		return d.report(out, ev, err)
+	case "c", "continue":
+		ev, err := d.Continue()
+		return d.report(out, ev, err)
+	case "bs", "back":
+		n, err := d.Back(arg(0, 1))
+		if err != nil {
+			return err
+		}
+		if n < arg(0, 1) {
+			fmt.Fprintf(out, "went back %d instructions, the start of the record\n", n)
+		}
+		pc, low := d.VM.PC()
+		return Disassemble(out, d.VM.prog, pc, low, 0)
+	case "record":
+		if err := need(1); err != nil {
+			return err
+		}
+		d.Record(nums[0])
+	case "b", "break":
+		if err := need(1); err != nil {
+			return err
+		}
+		at.Offset = nums[0]
+		return d.BreakIf(at, cond)
+	case "d", "delete":
+		if err := need(1); err != nil {
+			return err
+		}
+		at.Offset = nums[0]
+		d.Delete(at)
+	case "watch", "rwatch", "awatch":
+		if err := need(1); err != nil {
+			return err
+		}
+		kind := map[string]WatchKind{"watch": WatchWrite, "rwatch": WatchRead, "awatch": WatchAccess}[args[0]]
+		return d.Watch(nums[0], arg(1, nums[0]), kind)
+	case "unwatch":
+		if err := need(1); err != nil {
+			return err
+		}
+		return d.Unwatch(nums[0])
+	case "info":
+		for _, at := range d.Breakpoints() {
+			if c := d.Condition(at); c != nil {
+				fmt.Fprintf(out, "breakpoint at 0x%v if %v\n", at, c)
+			} else {
+				fmt.Fprintf(out, "breakpoint at 0x%v\n", at)
+			}
+		}
+		for i, w := range d.Watchpoints() {
+			fmt.Fprintf(out, "watchpoint %d: %v\n", i, w)
+		}
+	case "l", "list":
+		pc, low := d.VM.PC()
+		if d.VM.Done() {
+			return fmt.Errorf("program ended")
+		}
+		return Disassemble(out, d.VM.prog, pc, low, arg(0, 5))
+	case "t", "tape":
+		return ViewTape(out, d.VM.tape, d.VM.ptr, arg(0, 2))
+	case "set":
+		if err := need(2); err != nil {
+			return err
+		}
+		return d.SetCell(nums[0], byte(nums[1]))
+	case "ptr":
+		if err := need(1); err != nil {
+			return err
+		}
+		return d.SetPtr(nums[0])
+	case "help":
+		fmt.Fprintln(out, replHelp)
+	default:
+		return fmt.Errorf("unknown command %q, try help", args[0])
+	}
+	return nil
+}
+
+// report writes where the debugger paused.
+func (d *Debugger) report(out io.Writer, ev Event, err error) error {
+	if err != nil {
+		return err
+	}
+	if ev == EventEnd || d.VM.Done() {
+		fmt.Fprintln(out, "program ended")
+		return nil
+	}
+	switch ev {
+	case EventWatch:
+		fmt.Fprintf(out, "watchpoint: %v\n", d.Hit())
+	case EventBreak:
+		fmt.Fprintf(out, "%v\n", ev)
+	}
+	pc, low := d.VM.PC()
+	return Disassemble(out, d.VM.prog, pc, low, 0)
+}
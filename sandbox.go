@@ -0,0 +1,60 @@
+package mf
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// ErrLimit is wrapped by errors of programs stopped by a Policy.
+var ErrLimit = errors.New("sandbox limit")
+
+// Policy limits what a program run by a VM may do,
+// for running untrusted programs. Zero fields mean no limit.
+type Policy struct {
+	// Syscalls lists the syscalls a program may call, of those
+	// registered. Nil allows all of them, and empty allows none.
+	Syscalls []uint32
+
+	// MaxTape is the total size of all tapes in bytes.
+	MaxTape int
+
+	// MaxOutput is the number of bytes a program may write to Out.
+	MaxOutput int64
+
+	// Timeout is the wall-clock time limit of each VM.Run.
+	Timeout time.Duration
+
+	// MaxSteps is the number of instructions a program may execute,
+	// not counting alignment no-ops.
+	MaxSteps int64
+
+	// TrustedKeys lists the keys a program must be signed with, see
+	// VerifyMF. Nil loads unsigned programs too, and empty none.
+	TrustedKeys []ed25519.PublicKey
+}
+
+func (p Policy) allows(num uint32) bool {
+	return p.Syscalls == nil || slices.Contains(p.Syscalls, num)
+}
+
+// alloc accounts for a new tape of size bytes.
+func (v *VM) alloc(size int) error {
+	if p := v.policy.MaxTape; p > 0 && v.tapeBytes+size > p {
+		return fmt.Errorf("%w: tapes exceed %d bytes", ErrLimit, p)
+	}
+	v.tapeBytes += size
+	return nil
+}
+
+// write writes p to Out, within the output limit.
+func (v *VM) write(p []byte) error {
+	if limit := v.policy.MaxOutput; limit > 0 && v.outBytes+int64(len(p)) > limit {
+		return fmt.Errorf("%w: output exceeds %d bytes", ErrLimit, limit)
+	}
+	v.outBytes += int64(len(p))
+	_, err := v.Out.Write(p)
+	return err
+}
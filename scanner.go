@@ -0,0 +1,255 @@
+package mf
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+// Pos is a position in MF or BF input.
+type Pos struct {
+	Offset int  // byte offset
+	Low    bool // whether at the low nibble of the byte, in MF
+	Line   int  // line in BF, starting at 1; zero in MF
+	Col    int  // column in BF in bytes, starting at 1
+}
+
+func (p Pos) String() string {
+	switch {
+	case p.Line > 0:
+		return fmt.Sprintf("line %d, col %d", p.Line, p.Col)
+	case p.Low:
+		return fmt.Sprintf("offset %d.5", p.Offset)
+	}
+	return fmt.Sprintf("offset %d", p.Offset)
+}
+
+// PosError is an error at a position of the input of a converter.
+type PosError struct {
+	Pos Pos
+	Err error
+}
+
+func (e *PosError) Error() string {
+	return fmt.Sprintf("%v: %v", e.Pos, e.Err)
+}
+
+func (e *PosError) Unwrap() error {
+	return e.Err
+}
+
+// bfStart is the position of the start of BF input.
+var bfStart = Pos{Line: 1, Col: 1}
+
+// advance moves p past the byte b, counting lines if p is in BF.
+func (p *Pos) advance(b byte) {
+	p.Offset++
+	switch {
+	case p.Line == 0:
+	case b == '\n':
+		p.Line, p.Col = p.Line+1, 1
+	default:
+		p.Col++
+	}
+}
+
+// Token is what a Scanner scans at once: an instruction of MF, or a
+// character of BF.
+type Token struct {
+	Pos  Pos
+	In   Instruction // of MF, or the command of a BF character, OpNop if it is none
+	Char byte        // of BF, or the byte of MF code holding the instruction
+}
+
+// Scanner reads the instructions of an MF binary, or the characters of
+// BF code, with their positions, as bufio.Scanner reads lines. Input
+// starting with an MF magic is MF; anything else is BF. Alignment no-ops
+// of MF are skipped, as DecodeMF does.
+//
+// A Scanner made by NewPushScanner is given its input with Write
+// instead, as FromBF and ToBF are, which scan their input with one.
+type Scanner struct {
+	r      io.Reader // nil if the input is written
+	mfOnly bool      // whether input other than MF is an error
+	bfOnly bool      // whether input is BF even if it starts with an MF magic
+	decode DecodeMode
+	nops   bool // whether alignment no-ops and undefined nibbles are tokens
+	mode   scanMode
+	win    []byte // input read from offset base
+	base   int
+	eof    bool
+	l      layout
+	fromBF bool // whether MF starts with BFMagic
+	pos    Pos  // of the next token
+	tok    Token
+	err    error
+}
+
+type scanMode int
+
+const (
+	scanUnknown scanMode = iota
+	scanMF
+	scanBF
+)
+
+// NewScanner returns a Scanner reading from r.
+func NewScanner(r io.Reader) *Scanner {
+	return &Scanner{r: r}
+}
+
+// NewPushScanner returns a Scanner of the input given to it with Write,
+// ended by Close. Until Close, Scan returns false with Err nil where the
+// input written so far ends in a part of a token, or of the header or
+// signature section of MF, holding it back until more is written.
+func NewPushScanner() *Scanner {
+	return new(Scanner)
+}
+
+// Write adds p to the input of a Scanner made by NewPushScanner.
+func (s *Scanner) Write(p []byte) (int, error) {
+	if s.r != nil || s.eof {
+		return 0, fmt.Errorf("scanner: write to closed or reading Scanner")
+	}
+	s.win = append(s.win, p...)
+	return len(p), nil
+}
+
+// Close ends the input of a Scanner made by NewPushScanner, so that
+// Scan returns the tokens held back.
+func (s *Scanner) Close() error {
+	s.eof = true
+	return nil
+}
+
+// more reports whether the input is held back for the n bytes from
+// offset at, which have not all been written yet.
+func (s *Scanner) more(at, n int) bool {
+	return !s.eof && s.base+len(s.win) < at+n
+}
+
+// Scan reads the next token, which Token returns. It returns false at
+// the end of the input or on an error, which Err returns.
+func (s *Scanner) Scan() bool {
+	if s.err != nil {
+		return false
+	}
+	if s.mode == scanUnknown && !s.start() {
+		return false
+	}
+	if s.mode == scanBF {
+		return s.scanBF()
+	}
+	for {
+		if s.err = s.fill(s.pos.Offset, 1+s.l.width+sigSize); s.err != nil || s.more(s.pos.Offset, 1+s.l.width+sigSize) {
+			return false
+		}
+		win := s.code()
+		if s.pos.Offset >= s.base+len(win) {
+			return false
+		}
+		in, next, nextLow, err := decodeWindow(win, s.base, s.l, s.pos.Offset, s.pos.Low, s.decode)
+		if err != nil {
+			s.err = err
+			return false
+		}
+		at := s.pos
+		s.pos = Pos{Offset: next, Low: nextLow}
+		if in.Op != OpNop || s.nops {
+			in.Offset = at.Offset
+			s.tok = Token{Pos: at, In: in, Char: win[at.Offset-s.base]}
+			return true
+		}
+	}
+}
+
+// start reads the header of MF, or finds that the input is BF.
+func (s *Scanner) start() bool {
+	if s.bfOnly {
+		s.mode, s.pos = scanBF, bfStart
+		return true
+	}
+	if s.err = s.fill(0, 20); s.err != nil || s.more(0, 20) {
+		return false
+	}
+	if !s.mfOnly && (len(s.win) < 4 || string(s.win[:4]) != Magic && string(s.win[:4]) != BFMagic) {
+		s.mode, s.pos = scanBF, bfStart
+		return true
+	}
+	s.mode, s.fromBF = scanMF, len(s.win) >= 4 && string(s.win[:4]) == BFMagic
+	if s.l, s.err = parseLayout(s.win); s.err != nil {
+		return false
+	}
+	s.pos = Pos{Offset: s.l.code}
+	return true
+}
+
+func (s *Scanner) scanBF() bool {
+	if s.err = s.fill(s.pos.Offset, 1); s.err != nil {
+		return false
+	}
+	if s.pos.Offset >= s.base+len(s.win) {
+		return false
+	}
+	c := s.win[s.pos.Offset-s.base]
+	s.tok = Token{Pos: s.pos, In: Instruction{Op: OpNop, Offset: s.pos.Offset}, Char: c}
+	if i := strings.IndexByte(bf, c); i >= 0 {
+		s.tok.In.Op, s.tok.In.Arg = Op(i), 1
+		if c == '[' || c == ']' {
+			s.tok.In.Arg = 0 // not resolved
+		}
+	}
+	s.pos.advance(c)
+	return true
+}
+
+// code returns the window without the signature section of a signed
+// binary, which is read ahead with the code before it.
+func (s *Scanner) code() []byte {
+	win := s.win
+	if k := len(win) - sigSize; s.eof && k >= 0 && s.base+k >= 8 && string(win[len(win)-len(SigMagic):]) == SigMagic {
+		return win[:k]
+	}
+	return win
+}
+
+// fill reads until the window holds n bytes from offset at, or the
+// input ends, dropping the bytes before at once there are many.
+func (s *Scanner) fill(at, n int) error {
+	if k := at - s.base; k >= 4096 {
+		s.win, s.base = append(s.win[:0], s.win[k:]...), at
+	}
+	for s.r != nil && !s.eof && s.base+len(s.win) < at+n {
+		s.win = slices.Grow(s.win, 4096)
+		m, err := s.r.Read(s.win[len(s.win):cap(s.win)])
+		s.win = s.win[:len(s.win)+m]
+		if err == io.EOF {
+			s.eof = true
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Token returns the token read by the last call to Scan.
+func (s *Scanner) Token() Token {
+	return s.tok
+}
+
+// Pos returns the position after the last token read, which is where
+// the error Err returns is, if any.
+func (s *Scanner) Pos() Pos {
+	return s.pos
+}
+
+// Err returns the error that ended scanning, if any.
+func (s *Scanner) Err() error {
+	return s.err
+}
+
+// IsMF reports whether the input is MF, once Scan has been called.
+func (s *Scanner) IsMF() bool {
+	return s.mode == scanMF
+}
@@ -0,0 +1,108 @@
+package mf
+
+import (
+	"runtime"
+	"sync"
+	"time"
+)
+
+// DefaultQuantum is the instructions a VM runs per turn on a Scheduler
+// without Quantum.
+const DefaultQuantum = 10000
+
+// Scheduler runs many VMs on a pool of goroutines, giving each in turn
+// a budget of instructions, so that long programs do not hold up short
+// ones. Each VM keeps its own In, Out and policy, whose time limit
+// applies from when the VM is added.
+//
+// A VM blocked reading In or writing Out holds its goroutine until it
+// is done, so the I/O of VMs should not block for long.
+type Scheduler struct {
+	// Workers is the goroutines running VMs, GOMAXPROCS if zero.
+	Workers int
+	// Quantum is the instructions a VM runs per turn,
+	// DefaultQuantum if zero.
+	Quantum int
+
+	mu      sync.Mutex
+	queue   []*Task // of VMs waiting for a turn
+	workers int     // running
+	tasks   sync.WaitGroup
+}
+
+// Task is a VM added to a Scheduler.
+type Task struct {
+	VM   *VM
+	done chan struct{}
+	err  error
+}
+
+// Done returns a channel closed when the program has ended or faulted.
+func (t *Task) Done() <-chan struct{} {
+	return t.done
+}
+
+// Wait waits until the program has ended or faulted, and returns what
+// Run would have returned.
+func (t *Task) Wait() error {
+	<-t.done
+	return t.err
+}
+
+// Go adds v to the scheduler, which starts running it.
+// v must not be run otherwise until its task is done.
+func (s *Scheduler) Go(v *VM) *Task {
+	t := &Task{VM: v, done: make(chan struct{})}
+	v.deadline = time.Time{}
+	if v.policy.Timeout > 0 {
+		v.deadline = time.Now().Add(v.policy.Timeout)
+	}
+	s.tasks.Add(1)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queue = append(s.queue, t)
+	workers := s.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if s.workers < workers {
+		s.workers++
+		go s.work()
+	}
+	return t
+}
+
+// Wait waits until the tasks of all VMs added are done.
+func (s *Scheduler) Wait() {
+	s.tasks.Wait()
+}
+
+// work runs turns of the queued VMs until the queue is empty.
+func (s *Scheduler) work() {
+	quantum := s.Quantum
+	if quantum <= 0 {
+		quantum = DefaultQuantum
+	}
+	for {
+		s.mu.Lock()
+		if len(s.queue) == 0 {
+			s.workers--
+			s.mu.Unlock()
+			return
+		}
+		t := s.queue[0]
+		s.queue = s.queue[1:]
+		s.mu.Unlock()
+
+		err := t.VM.run(quantum)
+		if err == nil && !t.VM.Done() {
+			s.mu.Lock()
+			s.queue = append(s.queue, t)
+			s.mu.Unlock()
+			continue
+		}
+		t.err = err
+		close(t.done)
+		s.tasks.Done()
+	}
+}
@@ -0,0 +1,202 @@
+package mf
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Session is a recording of what a run of a program got from outside
+// and wrote: its input, output, random bytes and clock readings, with
+// when it got them. Replaying it runs the program again the same way,
+// for reproducing a bug report. Files of GrantFile are not recorded.
+type Session struct {
+	Program string         `json:"program,omitempty"` // SHA-256 of the MF binary in hex
+	Events  []SessionEvent `json:"events"`
+	Result  string         `json:"result,omitempty"` // error of the run, if any
+}
+
+// Session event kinds.
+const (
+	EventIn    = "in"    // bytes read from In
+	EventOut   = "out"   // bytes written to Out
+	EventRand  = "rand"  // bytes read from Rand
+	EventClock = "clock" // a reading of Clock
+)
+
+// SessionEvent is what a program got or wrote at once. Consecutive
+// reads or writes of the same kind are one event, at the time of the
+// first one.
+type SessionEvent struct {
+	Kind  string        `json:"kind"`
+	Time  time.Duration `json:"time"` // since the recording started
+	Step  int64         `json:"step"` // instructions executed before
+	Data  []byte        `json:"data,omitempty"`
+	Clock time.Duration `json:"clock,omitempty"`
+}
+
+// ReadSession reads a Session written by Session.Write.
+func ReadSession(r io.Reader) (*Session, error) {
+	var s Session
+	if err := json.NewDecoder(r).Decode(&s); err != nil {
+		return nil, fmt.Errorf("invalid session: %v", err)
+	}
+	return &s, nil
+}
+
+// Write writes the session to w in JSON.
+func (s *Session) Write(w io.Writer) error {
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	return e.Encode(s)
+}
+
+// programHash returns the SHA-256 of the code of v in hex,
+// or "" if v streams its code.
+func (v *VM) programHash() string {
+	if v.stream != nil {
+		return ""
+	}
+	sum := sha256.Sum256(v.prog)
+	return hex.EncodeToString(sum[:])
+}
+
+// RecordSession records what the program of v gets and writes from now
+// on in s, by wrapping In, Out, Rand and Clock, and setting Program.
+// s.Result is left for the caller to set when the run ends.
+func (v *VM) RecordSession(s *Session) {
+	s.Program, s.Events = v.programHash(), nil
+	start := time.Now()
+	add := func(kind string, data []byte, clock time.Duration) {
+		if n := len(s.Events); n > 0 && kind != EventClock && s.Events[n-1].Kind == kind {
+			s.Events[n-1].Data = append(s.Events[n-1].Data, data...)
+			return
+		}
+		s.Events = append(s.Events, SessionEvent{kind, time.Since(start), v.steps, bytes.Clone(data), clock})
+	}
+	in, out, rnd, clock := v.In, v.Out, v.Rand, v.Clock
+	if rnd == nil {
+		rnd = rand.Reader
+	}
+	if clock == nil {
+		clock = func() time.Duration { return time.Since(v.start) }
+	}
+	v.In = readerFunc(func(p []byte) (int, error) {
+		n, err := in.Read(p)
+		if n > 0 {
+			add(EventIn, p[:n], 0)
+		}
+		return n, err
+	})
+	v.Out = writerFunc(func(p []byte) (int, error) {
+		n, err := out.Write(p)
+		add(EventOut, p[:n], 0)
+		return n, err
+	})
+	v.Rand = readerFunc(func(p []byte) (int, error) {
+		n, err := rnd.Read(p)
+		if n > 0 {
+			add(EventRand, p[:n], 0)
+		}
+		return n, err
+	})
+	v.Clock = func() time.Duration {
+		d := clock()
+		add(EventClock, nil, d)
+		return d
+	}
+}
+
+// ReplaySession sets the VM to run as recorded in s: reads get the input
+// and random bytes of s and Clock its readings, and writing other output
+// than s has faults. Out still receives the output. Once the program
+// ends, CheckReplay reports whether it ended as recorded.
+func (v *VM) ReplaySession(s *Session) error {
+	if h := v.programHash(); s.Program != "" && h != "" && h != s.Program {
+		return fmt.Errorf("replay: session of another program, SHA-256 %s", s.Program)
+	}
+	var in, out, rnd []byte
+	var clocks []time.Duration
+	for _, e := range s.Events {
+		switch e.Kind {
+		case EventIn:
+			in = append(in, e.Data...)
+		case EventOut:
+			out = append(out, e.Data...)
+		case EventRand:
+			rnd = append(rnd, e.Data...)
+		case EventClock:
+			clocks = append(clocks, e.Clock)
+		default:
+			return fmt.Errorf("replay: unknown event kind %q", e.Kind)
+		}
+	}
+	w := v.Out
+	v.In = bytes.NewReader(in)
+	v.Rand = readerFunc(func(p []byte) (int, error) {
+		if len(rnd) < len(p) {
+			return 0, fmt.Errorf("replay: %d random bytes read, %d recorded", len(p), len(rnd))
+		}
+		n := copy(p, rnd)
+		rnd = rnd[n:]
+		return n, nil
+	})
+	v.Clock = func() time.Duration {
+		if len(clocks) == 0 {
+			return time.Since(v.start) // not recorded, so surely diverged
+		}
+		d := clocks[0]
+		clocks = clocks[1:]
+		return d
+	}
+	written := 0
+	v.Out = writerFunc(func(p []byte) (int, error) {
+		if rest := out[written:]; !bytes.HasPrefix(rest, p) {
+			return 0, fmt.Errorf("replay: output %q at byte %d, recorded %q", p, written, rest[:min(len(rest), len(p))])
+		}
+		written += len(p)
+		if w == nil {
+			return len(p), nil
+		}
+		return w.Write(p)
+	})
+	v.replayed = func(result error) error {
+		if written < len(out) {
+			return fmt.Errorf("replay: program ended after %d bytes of output, recorded %d", written, len(out))
+		}
+		got := ""
+		if result != nil {
+			got = result.Error()
+		}
+		if got != s.Result {
+			return fmt.Errorf("replay: program ended with %q, recorded %q", got, s.Result)
+		}
+		return nil
+	}
+	return nil
+}
+
+// CheckReplay reports, once the program of a VM set up with ReplaySession
+// has ended with result, the error Run returned, whether it ended as
+// recorded.
+func (v *VM) CheckReplay(result error) error {
+	if v.replayed == nil {
+		return fmt.Errorf("replay: VM is not replaying a session")
+	}
+	return v.replayed(result)
+}
+
+// readerFunc is an io.Reader calling a function.
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) { return f(p) }
+
+// writerFunc is an io.Writer calling a function.
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
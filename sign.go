@@ -0,0 +1,60 @@
+package mf
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+)
+
+// SigMagic ends the signature section of a signed MF binary, which
+// follows the code: an Ed25519 signature of the binary before it,
+// then SigMagic.
+const SigMagic = "\xff\x6d\x73\xfd"
+
+// sigSize is the size of a signature section.
+const sigSize = ed25519.SignatureSize + len(SigMagic)
+
+// ErrUntrusted is wrapped by errors of MF binaries not signed by
+// a trusted key.
+var ErrUntrusted = errors.New("untrusted MF binary")
+
+// SignMF returns the MF binary prog with a signature section signed with
+// key. A signature prog already has is replaced.
+func SignMF(prog []byte, key ed25519.PrivateKey) ([]byte, error) {
+	if len(key) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("invalid Ed25519 private key of %d bytes", len(key))
+	}
+	prog, _ = SplitSignature(prog)
+	if _, err := parseLayout(prog); err != nil {
+		return nil, err
+	}
+	signed := append(bytes.Clone(prog), ed25519.Sign(key, prog)...)
+	return append(signed, SigMagic...), nil
+}
+
+// SplitSignature returns the MF binary of the signed MF binary b and its
+// signature, or b and nil if b has no signature section. Code that ends
+// in SigMagic, which FromBF does not write, reads as signed.
+func SplitSignature(b []byte) (prog, sig []byte) {
+	n := len(b) - sigSize
+	if n < 8 || string(b[len(b)-len(SigMagic):]) != SigMagic {
+		return b, nil
+	}
+	return b[:n], b[n : n+ed25519.SignatureSize]
+}
+
+// VerifyMF checks that the MF binary signed is signed with one of keys,
+// and returns it without its signature section.
+func VerifyMF(signed []byte, keys ...ed25519.PublicKey) ([]byte, error) {
+	prog, sig := SplitSignature(signed)
+	if sig == nil {
+		return nil, fmt.Errorf("%w: not signed", ErrUntrusted)
+	}
+	for _, key := range keys {
+		if len(key) == ed25519.PublicKeySize && ed25519.Verify(key, prog, sig) {
+			return prog, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: signature does not match a trusted key", ErrUntrusted)
+}
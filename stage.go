@@ -0,0 +1,92 @@
+package mf
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Stage is a VM wired into a pipeline of goroutines: , receives a byte
+// from In, and . sends one to Out. A program's input ends when In is
+// closed, and Run closes Out when the program is done, so that stages
+// chain by sharing channels.
+type Stage struct {
+	VM  *VM
+	In  <-chan byte // nil for no input
+	Out chan<- byte // nil to discard the output
+}
+
+// Run runs the program of the stage until it ends, faults, or ctx is
+// done, and returns what VM.Run would have returned, or an error
+// wrapping the error of ctx. Out is closed when Run returns.
+func (s *Stage) Run(ctx context.Context) error {
+	v := s.VM
+	v.In, v.Out = &chanReader{ctx, s.In}, &chanWriter{ctx, s.Out}
+	if s.Out != nil {
+		defer close(s.Out)
+	}
+	v.deadline = time.Time{}
+	if v.policy.Timeout > 0 {
+		v.deadline = time.Now().Add(v.policy.Timeout)
+	}
+	for !v.Done() {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("offset %d: %w", v.pc, err)
+		}
+		if err := v.run(DefaultQuantum); err != nil {
+			return err
+		}
+	}
+	if v.status != 0 {
+		return &ExitError{v.status}
+	}
+	return nil
+}
+
+// chanReader reads bytes received from a channel.
+type chanReader struct {
+	ctx context.Context
+	ch  <-chan byte
+}
+
+// Read reads a single byte, so that no byte is received
+// that the program does not read.
+func (r *chanReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if r.ch == nil {
+		return 0, io.EOF
+	}
+	select {
+	case b, ok := <-r.ch:
+		if !ok {
+			return 0, io.EOF
+		}
+		p[0] = b
+		return 1, nil
+	case <-r.ctx.Done():
+		return 0, r.ctx.Err()
+	}
+}
+
+// chanWriter writes bytes by sending them to a channel.
+type chanWriter struct {
+	ctx context.Context
+	ch  chan<- byte
+}
+
+func (w *chanWriter) Write(p []byte) (int, error) {
+	if w.ch == nil {
+		return len(p), nil
+	}
+	for i, b := range p {
+		select {
+		case w.ch <- b:
+		case <-w.ctx.Done():
+			return i, w.ctx.Err()
+		}
+	}
+	return len(p), nil
+}
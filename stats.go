@@ -0,0 +1,62 @@
+package mf
+
+// Stats is a summary of a program, see ProgramStats.
+type Stats struct {
+	// Instructions is the number of decoded instructions,
+	// with runs of + - > < . , folded for BF code.
+	Instructions int
+	// Counts is the number of BF commands of each operation that
+	// the instructions stand for, e.g. 10 for a compressed run of 10.
+	Counts map[Op]int
+	// Loops is the number of loops, and MaxDepth their maximum nesting.
+	Loops    int
+	MaxDepth int
+	// CompressedRuns is the number of compressed runs in MF, or the
+	// number of runs FromBF compresses for BF, and CompressedSavings
+	// the bytes they save compared to plain nibbles.
+	CompressedRuns    int
+	CompressedSavings int
+}
+
+// ProgramStats decodes an MF binary, or parses BF code if prog
+// doesn't start with an MF magic, and returns its statistics.
+func ProgramStats(prog []byte) (Stats, error) {
+	var ins []Instruction
+	compressed := func(in Instruction) bool { return in.Arg > 1 }
+	if len(prog) >= 4 && (string(prog[:4]) == Magic || string(prog[:4]) == BFMagic) {
+		var err error
+		if ins, err = DecodeMF(prog); err != nil {
+			return Stats{}, err
+		}
+	} else {
+		ins = ParseBF(prog)
+		compressed = func(in Instruction) bool { return in.Arg > 9 }
+	}
+
+	s := Stats{Instructions: len(ins), Counts: make(map[Op]int)}
+	depth := 0
+	for _, in := range ins {
+		switch in.Op {
+		case OpAdd, OpSub, OpRight, OpLeft:
+			s.Counts[in.Op] += int(in.Arg)
+			if compressed(in) {
+				s.CompressedRuns++
+				// a run costs 5 bytes instead of Arg nibbles
+				s.CompressedSavings += (int(in.Arg)+1)/2 - 5
+			}
+		case OpOut, OpIn:
+			s.Counts[in.Op] += int(in.Arg)
+		case OpOpen:
+			s.Counts[in.Op]++
+			s.Loops++
+			depth++
+			s.MaxDepth = max(s.MaxDepth, depth)
+		case OpClose:
+			s.Counts[in.Op]++
+			depth--
+		default:
+			s.Counts[in.Op]++
+		}
+	}
+	return s, nil
+}
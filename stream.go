@@ -0,0 +1,150 @@
+package mf
+
+import (
+	"fmt"
+	"io"
+	"math"
+)
+
+// streamBlockSize is the code bytes of a block of streamed MF.
+const streamBlockSize = 4096
+
+// streamBlocks is the number of blocks a streaming VM keeps decoded.
+const streamBlocks = 32
+
+// streamCode is the code of MF streamed from an io.ReaderAt, read and
+// decoded a block at a time as it runs.
+type streamCode struct {
+	r      io.ReaderAt
+	l      layout
+	size   int                  // of the binary, without a signature section
+	blocks map[int]*streamBlock // by start
+	last   *streamBlock         // used last
+	tick   uint64               // blocks used
+}
+
+// streamBlock is a block of streamed code and its decoded instructions.
+type streamBlock struct {
+	start int
+	used  uint64 // tick of the last use
+	buf   []byte // bytes of the block, and of the operands after it
+	mode  DecodeMode
+	ops   []streamOp // by nibble of the block
+}
+
+// streamOp is an instruction of a streamBlock, if decoded.
+type streamOp struct {
+	in      Instruction
+	next    int
+	nextLow bool
+	ok      bool
+}
+
+// NewStreamVM returns a VM loaded with the MF binary of size bytes read
+// from r, which enforces the policy p. The binary is not read into
+// memory, but read and decoded by blocks as they run, keeping the last
+// few, so that MF larger than memory runs, slower than with NewSandboxVM.
+// r is typically an *os.File. It must not change while the VM runs.
+//
+// A signature section is not loaded, and cannot be verified: with
+// trusted keys in p, NewStreamVM fails. A core dump of the VM has no
+// code.
+func NewStreamVM(r io.ReaderAt, size int64, p Policy) (*VM, error) {
+	if p.TrustedKeys != nil {
+		return nil, fmt.Errorf("%w: signatures of streamed MF are not verified", ErrUntrusted)
+	}
+	if size > math.MaxInt/2 {
+		return nil, fmt.Errorf("invalid MF binary: size %d too large", size)
+	}
+	head := make([]byte, max(min(size, 20), 0))
+	if n, err := r.ReadAt(head, 0); n < len(head) {
+		return nil, fmt.Errorf("invalid MF binary: %v", err)
+	}
+	l, err := parseLayout(head)
+	if err != nil {
+		return nil, err
+	}
+	if size-int64(sigSize) >= 8 {
+		magic := make([]byte, len(SigMagic))
+		if n, err := r.ReadAt(magic, size-int64(len(SigMagic))); n < len(magic) {
+			return nil, fmt.Errorf("invalid MF binary: %v", err)
+		}
+		if string(magic) == SigMagic {
+			size -= int64(sigSize)
+		}
+	}
+	v, err := newVM(string(head[:4]), l, p)
+	if err != nil {
+		return nil, err
+	}
+	v.stream = &streamCode{r: r, l: l, size: int(size)}
+	v.size = int(size)
+	v.opsMode = v.Mode // nothing to predecode
+	if err := v.loadDict(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// decode decodes the instruction at byte pc, as decode does.
+func (s *streamCode) decode(pc int, low bool, mode DecodeMode) (in Instruction, next int, nextLow bool, err error) {
+	if pc < 0 || pc >= s.size {
+		return in, pc, false, fmt.Errorf("decode: offset %d out of range", pc)
+	}
+	b := s.last
+	if start := pc - pc%streamBlockSize; b == nil || b.start != start {
+		if b, err = s.block(start); err != nil {
+			return in, pc, low, err
+		}
+		s.last = b
+	}
+	if b.mode != mode {
+		clear(b.ops)
+		b.mode = mode
+	}
+	o := &b.ops[2*(pc-b.start)+lowBit(low)]
+	if !o.ok {
+		in, next, nextLow, err := decodeWindow(b.buf, b.start, s.l, pc, low, mode)
+		if err != nil {
+			return in, next, nextLow, err
+		}
+		*o = streamOp{in, next, nextLow, true}
+	}
+	return o.in, o.next, o.nextLow, nil
+}
+
+// block returns the block at start, reading it if it is not kept.
+func (s *streamCode) block(start int) (*streamBlock, error) {
+	s.tick++
+	if b, ok := s.blocks[start]; ok {
+		b.used = s.tick
+		return b, nil
+	}
+	var b *streamBlock
+	if len(s.blocks) < streamBlocks {
+		b = &streamBlock{ops: make([]streamOp, 2*streamBlockSize)}
+		if s.blocks == nil {
+			s.blocks = make(map[int]*streamBlock)
+		}
+	} else {
+		for _, c := range s.blocks {
+			if b == nil || c.used < b.used {
+				b = c // the least recently used
+			}
+		}
+		delete(s.blocks, b.start)
+		clear(b.ops)
+	}
+	b.start, b.used, b.mode = start, s.tick, DecodeDefault
+	n := min(streamBlockSize+s.l.width, s.size-start)
+	if cap(b.buf) < n {
+		b.buf = make([]byte, n)
+	}
+	b.buf = b.buf[:n]
+	if n, err := s.r.ReadAt(b.buf, int64(start)); n < len(b.buf) {
+		s.last = nil
+		return nil, fmt.Errorf("reading code at offset %d: %v", start, err)
+	}
+	s.blocks[start] = b
+	return b, nil
+}
@@ -0,0 +1,175 @@
+package mf
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Syscalls take their arguments from, and store their results to,
+// the cells from the pointer on. They don't move the pointer.
+// Multi-byte numbers are big-endian.
+
+// Standard syscall numbers. See RegisterStdSyscalls.
+const (
+	SysPutDec   uint32 = 1 // write the current cell in decimal to Out
+	SysGetDec   uint32 = 2 // read a decimal number from In into the current cell, modulo 256
+	SysTapeSize uint32 = 3 // store the current tape size in 4 cells
+	SysClock    uint32 = 4 // store milliseconds since the VM was created in 8 cells
+	SysRandom   uint32 = 5 // fill as many cells as the current cell value with random bytes
+	SysSleep    uint32 = 6 // sleep for the milliseconds in 4 cells
+	SysOpen     uint32 = 7 // see GrantFile
+	SysRead     uint32 = 8
+	SysWrite    uint32 = 9
+	SysClose    uint32 = 10
+	SysExit     uint32 = 11 // end the program with the current cell as exit status
+	SysGetenv   uint32 = 12 // replace the NUL-terminated name in cells by its value, see VM.AllowedEnv
+)
+
+var stdSyscalls = map[uint32]func(*VM) error{
+	SysPutDec:   sysPutDec,
+	SysGetDec:   sysGetDec,
+	SysTapeSize: sysTapeSize,
+	SysClock:    sysClock,
+	SysRandom:   sysRandom,
+	SysSleep:    sysSleep,
+	SysOpen:     sysOpen,
+	SysRead:     sysRead,
+	SysWrite:    sysWrite,
+	SysClose:    sysClose,
+	SysExit:     sysExit,
+	SysGetenv:   sysGetenv,
+}
+
+// RegisterSyscall registers fn as syscall num, replacing any previous one.
+// Syscall numbers are 24-bit; RegisterSyscall panics on larger ones.
+//
+// No syscall is registered by a new VM, so the host decides exactly
+// which capabilities a program gets.
+func (v *VM) RegisterSyscall(num uint32, fn func(*VM) error) {
+	if num > 0xffffff {
+		panic(fmt.Sprintf("mf: syscall number %d exceeds 24 bits", num))
+	}
+	if v.syscalls == nil {
+		v.syscalls = make(map[uint32]func(*VM) error)
+	}
+	v.syscalls[num] = fn
+}
+
+// RegisterStdSyscalls registers the standard syscalls nums,
+// or all of them if nums is empty.
+func (v *VM) RegisterStdSyscalls(nums ...uint32) error {
+	if len(nums) == 0 {
+		for num, fn := range stdSyscalls {
+			v.RegisterSyscall(num, fn)
+		}
+		return nil
+	}
+	for _, num := range nums {
+		fn, ok := stdSyscalls[num]
+		if !ok {
+			return fmt.Errorf("no standard syscall %d", num)
+		}
+		v.RegisterSyscall(num, fn)
+	}
+	return nil
+}
+
+// args returns n cells from the pointer on.
+func (v *VM) args(n int) ([]byte, error) {
+	if v.ptr+n > len(v.tape) {
+		return nil, fmt.Errorf("pointer out of bounds: syscall needs cells %d to %d", v.ptr, v.ptr+n-1)
+	}
+	return v.tape[v.ptr : v.ptr+n], nil
+}
+
+func sysPutDec(v *VM) error {
+	return v.write(strconv.AppendUint(nil, uint64(v.tape[v.ptr]), 10))
+}
+
+func sysGetDec(v *VM) error {
+	var n uint
+	if _, err := fmt.Fscan(v.In, &n); err != nil {
+		return fmt.Errorf("syscall %d: %v", SysGetDec, err)
+	}
+	v.tape[v.ptr] = byte(n)
+	return nil
+}
+
+func sysTapeSize(v *VM) error {
+	cells, err := v.args(4)
+	if err != nil {
+		return err
+	}
+	copy(cells, uint32bytes(uint32(min(len(v.tape), 0xffffffff))))
+	return nil
+}
+
+func sysClock(v *VM) error {
+	cells, err := v.args(8)
+	if err != nil {
+		return err
+	}
+	elapsed := time.Since(v.start)
+	if v.Clock != nil {
+		elapsed = v.Clock()
+	}
+	binary.BigEndian.PutUint64(cells, uint64(elapsed.Milliseconds()))
+	return nil
+}
+
+func sysRandom(v *VM) error {
+	cells, err := v.args(int(v.tape[v.ptr]))
+	if err != nil {
+		return err
+	}
+	r := v.Rand
+	if r == nil {
+		r = rand.Reader
+	}
+	_, err = io.ReadFull(r, cells)
+	return err
+}
+
+func sysSleep(v *VM) error {
+	cells, err := v.args(4)
+	if err != nil {
+		return err
+	}
+	d := time.Duration(bytesUint32(cells)) * time.Millisecond
+	if !v.deadline.IsZero() && time.Until(v.deadline) < d {
+		time.Sleep(time.Until(v.deadline))
+		return fmt.Errorf("%w: time limit %v exceeded", ErrLimit, v.policy.Timeout)
+	}
+	time.Sleep(d)
+	return nil
+}
+
+func sysExit(v *VM) error {
+	v.status, v.exited = int(v.tape[v.ptr]), true
+	return nil
+}
+
+func sysGetenv(v *VM) error {
+	i := bytes.IndexByte(v.tape[v.ptr:], 0)
+	if i < 0 {
+		return fmt.Errorf("syscall %d: variable name is not NUL-terminated", SysGetenv)
+	}
+	name := string(v.tape[v.ptr : v.ptr+i])
+	var val string
+	if slices.Contains(v.AllowedEnv, name) {
+		val = os.Getenv(name)
+	}
+	cells, err := v.args(len(val) + 1)
+	if err != nil {
+		return err
+	}
+	copy(cells, val+"\x00")
+	return nil
+}
@@ -0,0 +1,109 @@
+package mf
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// file is a file granted to a program.
+type file struct {
+	r io.Reader
+	w io.Writer
+}
+
+// GrantFile lets the program open the file name, which reads from r and
+// writes to w. Either may be nil to deny reading or writing.
+// The program never sees host paths, only granted names.
+//
+// File syscalls work on cells from the pointer, and report failures to
+// the program rather than faulting:
+//
+//	SysOpen:  cells hold the NUL-terminated name; the handle (1-255),
+//	          or 0 on failure, is stored in the current cell.
+//	SysRead:  cells hold the handle and a count; up to count bytes are
+//	          read into the cells after them, and the count cell is set
+//	          to the number of bytes read, or 0 at end of file.
+//	SysWrite: cells hold the handle, a count and the bytes to write;
+//	          the count cell is set to the number of bytes written.
+//	SysClose: the current cell holds the handle.
+//
+// On failure, SysRead and SysWrite set the handle cell to 0.
+func (v *VM) GrantFile(name string, r io.Reader, w io.Writer) {
+	if v.grants == nil {
+		v.grants = make(map[string]file)
+	}
+	v.grants[name] = file{r, w}
+}
+
+func sysOpen(v *VM) error {
+	i := bytes.IndexByte(v.tape[v.ptr:], 0)
+	if i < 0 {
+		return fmt.Errorf("syscall %d: file name is not NUL-terminated", SysOpen)
+	}
+	f, ok := v.grants[string(v.tape[v.ptr:v.ptr+i])]
+	v.tape[v.ptr] = 0
+	if !ok {
+		return nil
+	}
+	if v.files == nil {
+		v.files = make(map[byte]file)
+	}
+	for h := 1; h < 256; h++ {
+		if _, used := v.files[byte(h)]; !used {
+			v.files[byte(h)] = f
+			v.tape[v.ptr] = byte(h)
+			break
+		}
+	}
+	return nil
+}
+
+func sysRead(v *VM) error {
+	cells, err := v.args(2)
+	if err != nil {
+		return err
+	}
+	buf, err := v.args(2 + int(cells[1]))
+	if err != nil {
+		return err
+	}
+	f, ok := v.files[cells[0]]
+	if !ok || f.r == nil {
+		cells[0] = 0
+		return nil
+	}
+	n, err := f.r.Read(buf[2:])
+	cells[1] = byte(n)
+	if err != nil && err != io.EOF {
+		cells[0] = 0
+	}
+	return nil
+}
+
+func sysWrite(v *VM) error {
+	cells, err := v.args(2)
+	if err != nil {
+		return err
+	}
+	buf, err := v.args(2 + int(cells[1]))
+	if err != nil {
+		return err
+	}
+	f, ok := v.files[cells[0]]
+	if !ok || f.w == nil {
+		cells[0] = 0
+		return nil
+	}
+	n, err := f.w.Write(buf[2:])
+	cells[1] = byte(n)
+	if err != nil {
+		cells[0] = 0
+	}
+	return nil
+}
+
+func sysClose(v *VM) error {
+	delete(v.files, v.tape[v.ptr])
+	return nil
+}
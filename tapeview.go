@@ -0,0 +1,34 @@
+package mf
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ViewTape writes the cells of a tape around ptr in rows of 16,
+// with rows rows before and after the row of ptr. Each row shows
+// the index of its first cell, the cells in hex with the one at ptr
+// marked by '>', and the printable cells as text.
+func ViewTape(w io.Writer, cells []byte, ptr, rows int) error {
+	row := ptr / 16
+	for r := max(row-rows, 0); r <= row+rows && r*16 < len(cells); r++ {
+		var hex, text strings.Builder
+		for i := r * 16; i < min(r*16+16, len(cells)); i++ {
+			sep := ' '
+			if i == ptr {
+				sep = '>'
+			}
+			fmt.Fprintf(&hex, "%c%02x", sep, cells[i])
+			if c := cells[i]; c >= 0x20 && c < 0x7f {
+				text.WriteByte(c)
+			} else {
+				text.WriteByte('.')
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%8d %-48s  %s\n", r*16, hex.String(), text.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
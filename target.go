@@ -0,0 +1,40 @@
+package mf
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// Target is a set of ToBF options suiting a BF interpreter.
+type Target struct {
+	Preamble  bool // write the BetterBF memory allocation code, see ToBF.NoPreamble
+	Banner    bool // write the "MinFuck compiled code" line
+	CellBits  int  // see ToBF.CellBits
+	DebugHash bool // write dbg operations as #, which the interpreter runs
+}
+
+// Targets are the BF interpreters known to ToBF, by name.
+var Targets = map[string]Target{
+	"betterbf":     {Preamble: true, Banner: true},
+	"bff":          {Banner: true, CellBits: 8},
+	"beef":         {Banner: true, CellBits: 8, DebugHash: true},
+	"generic-8bit": {CellBits: 8},
+}
+
+// LookupTarget returns the target named name in Targets.
+func LookupTarget(name string) (Target, error) {
+	t, ok := Targets[name]
+	if !ok {
+		names := slices.Sorted(maps.Keys(Targets))
+		return Target{}, fmt.Errorf("unknown target %q, known are %s", name, strings.Join(names, ", "))
+	}
+	return t, nil
+}
+
+// Apply sets the options of r the target covers.
+func (t Target) Apply(r *ToBF) {
+	r.NoPreamble, r.NoBanner = !t.Preamble, !t.Banner
+	r.CellBits, r.DebugHash = t.CellBits, t.DebugHash
+}
@@ -0,0 +1,69 @@
+package mf
+
+import (
+	"io"
+	"unicode/utf8"
+)
+
+// UTF8Writer writes what is written to it to W as valid UTF-8, for
+// showing the output of programs writing text byte by byte. Bytes that
+// are not part of a valid encoding are written as U+FFFD, and counted
+// in Invalid. An encoding split across writes is held until it is
+// complete; Flush writes one held at the end.
+type UTF8Writer struct {
+	W       io.Writer
+	Invalid int // bytes replaced by U+FFFD
+
+	held []byte // start of an incomplete encoding
+}
+
+// Write writes p, returning len(p) unless W fails.
+func (u *UTF8Writer) Write(p []byte) (int, error) {
+	b := append(u.held, p...)
+	out := make([]byte, 0, len(b))
+	i := 0
+	for i < len(b) {
+		if b[i] < utf8.RuneSelf {
+			out = append(out, b[i])
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRune(b[i:])
+		switch {
+		case r != utf8.RuneError || size > 1:
+			out = append(out, b[i:i+size]...)
+		case !utf8.FullRune(b[i:]): // may complete with the next write
+			u.held = append(u.held[:0], b[i:]...)
+			return u.flush(out, len(p))
+		default:
+			out = utf8.AppendRune(out, utf8.RuneError)
+			u.Invalid++
+		}
+		i += size
+	}
+	u.held = u.held[:0]
+	return u.flush(out, len(p))
+}
+
+// flush writes out to W, and returns n if it succeeds.
+func (u *UTF8Writer) flush(out []byte, n int) (int, error) {
+	if len(out) == 0 {
+		return n, nil
+	}
+	if _, err := u.W.Write(out); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Flush writes an encoding held incomplete as U+FFFD for each byte.
+func (u *UTF8Writer) Flush() error {
+	var out []byte
+	for range u.held {
+		out = utf8.AppendRune(out, utf8.RuneError)
+		u.Invalid++
+	}
+	u.held = u.held[:0]
+	_, err := u.flush(out, 0)
+	return err
+}
@@ -0,0 +1,79 @@
+package mf
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// Position is a location in BF code.
+// Line and Col are 1-based, and Col counts UTF-8 characters.
+type Position struct {
+	Offset int
+	Line   int
+	Col    int
+}
+
+func (p Position) String() string {
+	return fmt.Sprintf("line %d, col %d", p.Line, p.Col)
+}
+
+// BracketError reports an unbalanced bracket in BF code.
+type BracketError struct {
+	Pos  Position
+	Char byte // '[' or ']'
+}
+
+func (e *BracketError) Error() string {
+	return fmt.Sprintf("unbalanced '%c' at %v", e.Char, e.Pos)
+}
+
+// ValidateBF checks that every [ and ] in BF code is balanced.
+// It returns nil, or every unbalanced bracket as *BracketError
+// joined with errors.Join, in source order.
+func ValidateBF(p []byte) error {
+	var open []Position
+	var errs []error
+	pos := Position{Line: 1}
+	for i, b := range p {
+		if b&0xc0 != 0x80 {
+			pos.Col++
+		}
+		pos.Offset = i
+		switch b {
+		case '[':
+			open = append(open, pos)
+		case ']':
+			if len(open) == 0 {
+				errs = append(errs, &BracketError{Pos: pos, Char: ']'})
+			} else {
+				open = open[:len(open)-1]
+			}
+		case '\n':
+			pos.Line++
+			pos.Col = 0
+		}
+	}
+	for _, p := range open {
+		errs = append(errs, &BracketError{Pos: p, Char: '['})
+	}
+	slices.SortStableFunc(errs, func(a, b error) int {
+		return a.(*BracketError).Pos.Offset - b.(*BracketError).Pos.Offset
+	})
+	return errors.Join(errs...)
+}
+
+// positionOf returns the position of byte offset off in BF code.
+func positionOf(p []byte, off int) Position {
+	pos := Position{Offset: off, Line: 1, Col: 1}
+	for _, b := range p[:off] {
+		switch {
+		case b == '\n':
+			pos.Line++
+			pos.Col = 1
+		case b&0xc0 != 0x80:
+			pos.Col++
+		}
+	}
+	return pos
+}
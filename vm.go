@@ -0,0 +1,673 @@
+package mf
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// VM executes MF binaries.
+//
+// The tape layout follows interpreter/mf.py: BF-converted binaries get
+// a zeroed tape of memsize cells, and native binaries get the BetterBF
+// layout of 2*memsize+8 cells with every even cell from 2 set to 1.
+// Tapes switched to with the tape extension are zeroed, and as large
+// as tape 0.
+type VM struct {
+	prog  []byte
+	l     layout
+	pc    int
+	low   bool // whether pc points to the low nibble
+	tape  []byte
+	ptr   int
+	cur   uint64           // current tape number
+	tapes map[uint64]*tape // tapes other than the current one
+
+	// Mode selects how undefined encodings are executed.
+	Mode DecodeMode
+
+	// In and Out are read by , and written by . instructions.
+	// NewVM sets them to os.Stdin and os.Stdout.
+	In  io.Reader
+	Out io.Writer
+
+	// Debug receives the dumps of dbg instructions, which do not affect
+	// the program. NewVM sets it to os.Stderr; nil discards them.
+	Debug io.Writer
+
+	// Hook, if not nil, is called before each instruction but alignment
+	// no-ops, with its offset, the pointer and the current cell value.
+	// A non-nil error stops the program and is returned by Step.
+	Hook func(pc int, in Instruction, ptr int, cell byte) error
+
+	// Rand is read by the SysRandom syscall.
+	// Nil means crypto/rand.Reader.
+	Rand io.Reader
+
+	// Clock, if not nil, is read by the SysClock syscall
+	// instead of the time since the VM was created.
+	Clock func() time.Duration
+
+	// NumericIO makes . write the cell in decimal and a newline, and ,
+	// read a decimal number, which may be negative, into the cell modulo
+	// 256, skipping the white space before it. At the end of In, the
+	// cell is unchanged.
+	NumericIO bool
+
+	// AllowedEnv lists the environment variables the SysGetenv syscall
+	// may read. Others read as empty.
+	AllowedEnv []string
+
+	// CoreDump, if not nil, receives a core dump when Run faults.
+	// See ReadCore.
+	CoreDump io.Writer
+
+	// Profile, if not nil, counts the executed instructions.
+	Profile *Profile
+
+	// MaxCallDepth bounds the calls and macros running at once,
+	// DefaultCallDepth if zero. Exceeding it is a fault.
+	MaxCallDepth int
+
+	exts     map[byte]ExtHandler
+	syscalls map[uint32]func(*VM) error
+	grants   map[string]file
+	files    map[byte]file // open files by handle
+
+	policy    Policy
+	tapeBytes int   // total size of all tapes
+	peak      int   // highest pointer reached on any tape
+	outBytes  int64 // bytes written to Out
+	start     time.Time
+	deadline  time.Time // of the running Run, if limited
+	status    int       // exit status
+	exited    bool      // whether the program called SysExit
+	steps     int64     // instructions executed
+	watches   []Watchpoint
+	hit       *WatchHit // watchpoint hit by the last step
+	journal   *journal  // of executed instructions, if recording
+	dict      []int     // code offsets of the macros
+	calls     []int     // return offsets of the running macros and calls
+
+	ops     []op    // the code, decoded at load in mode opsMode
+	index   []int32 // ops index of the instruction at each nibble, or -1
+	opsMode DecodeMode
+	stream  *streamCode // code of a VM of NewStreamVM, instead of prog
+	size    int         // of prog, or of the streamed binary
+
+	replayed func(result error) error // checks the end of a replay
+}
+
+// ErrAssert is wrapped by errors of programs stopped by a failed assert
+// instruction.
+var ErrAssert = errors.New("assertion failed")
+
+// DefaultCallDepth is the call stack size of a VM without MaxCallDepth.
+const DefaultCallDepth = 1024
+
+// ExitError is returned by Run when the program exits
+// with a nonzero status through SysExit.
+type ExitError struct {
+	Status int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Status)
+}
+
+// ExtHandler executes an extension operation of a registered kind.
+// arg is the low 24 bits of the operand.
+type ExtHandler func(v *VM, arg uint32) error
+
+// RegisterExt registers fn to execute extension operations of kind,
+// which must not be a built-in kind. Executing an extension operation
+// of a kind with no handler is a fault.
+func (v *VM) RegisterExt(kind byte, fn ExtHandler) error {
+	if kind >= ExtSet && kind <= ExtShift {
+		return fmt.Errorf("extension operation %d is built in", kind)
+	}
+	if v.exts == nil {
+		v.exts = make(map[byte]ExtHandler)
+	}
+	v.exts[kind] = fn
+	return nil
+}
+
+// NewVM returns a VM loaded with the MF binary prog.
+func NewVM(prog []byte) (*VM, error) {
+	return NewSandboxVM(prog, Policy{})
+}
+
+// NewSandboxVM returns a VM loaded with the MF binary prog,
+// which enforces the policy p. A signature section is not loaded.
+func NewSandboxVM(prog []byte, p Policy) (*VM, error) {
+	if p.TrustedKeys != nil {
+		var err error
+		if prog, err = VerifyMF(prog, p.TrustedKeys...); err != nil {
+			return nil, err
+		}
+	} else {
+		prog, _ = SplitSignature(prog)
+	}
+	l, err := parseLayout(prog)
+	if err != nil {
+		return nil, err
+	}
+	v, err := newVM(string(prog[:4]), l, p)
+	if err != nil {
+		return nil, err
+	}
+	v.prog, v.size = prog, len(prog)
+	if err := v.predecode(); err != nil {
+		return nil, fmt.Errorf("invalid MF binary: %v", err)
+	}
+	if err := v.loadDict(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// newVM returns a VM with no code, for MF of the magic and layout l.
+func newVM(magic string, l layout, p Policy) (*VM, error) {
+	if l.memsize > math.MaxInt/2-8 {
+		return nil, fmt.Errorf("invalid MF binary: memory size %d too large", l.memsize)
+	}
+	size := int(l.memsize)
+	if magic == Magic {
+		size = 2*size + 8
+	}
+	if size == 0 {
+		return nil, fmt.Errorf("invalid MF binary: zero memory size")
+	}
+	v := &VM{l: l, pc: l.code, In: os.Stdin, Out: os.Stdout, Debug: os.Stderr, policy: p, start: time.Now()}
+	if err := v.alloc(size); err != nil {
+		return nil, err
+	}
+	v.tape = make([]byte, size)
+	if magic == Magic {
+		for i := 2; i < len(v.tape); i += 2 {
+			v.tape[i] = 1
+		}
+	}
+	return v, nil
+}
+
+// fetch returns the instruction at pc, and the offset of the next one.
+func (v *VM) fetch() (in Instruction, next int, nextLow bool, err error) {
+	if v.opsMode != v.Mode {
+		if err := v.predecode(); err != nil {
+			return in, v.pc, v.low, err
+		}
+	}
+	if v.index != nil {
+		if i := v.index[2*v.pc+lowBit(v.low)]; i >= 0 {
+			op := &v.ops[i]
+			return op.in, op.next, op.nextLow, nil
+		}
+	}
+	return v.decodeAt(v.pc, v.low, v.Mode)
+}
+
+// decodeAt decodes the instruction at byte pc of the code, as decode does.
+func (v *VM) decodeAt(pc int, low bool, mode DecodeMode) (in Instruction, next int, nextLow bool, err error) {
+	if v.stream != nil {
+		in, next, nextLow, err = v.stream.decode(pc, low, mode)
+	} else {
+		in, next, nextLow, err = decode(v.prog, v.l, pc, low, mode)
+	}
+	in.Offset = pc
+	return in, next, nextLow, err
+}
+
+// loadDict finds the macros of the dictionary at the start of the
+// code, if there is one, and starts the program after it.
+func (v *VM) loadDict() error {
+	in, pc, low, err := v.decodeAt(v.pc, false, DecodeDefault)
+	if err != nil || in.Op != OpDict {
+		return nil
+	}
+	for n := 0; n < int(in.Arg); n++ {
+		v.dict = append(v.dict, pc)
+		for {
+			if pc >= v.size {
+				return fmt.Errorf("invalid MF binary: macro %d is not terminated", n)
+			}
+			in, next, nextLow, err := v.decodeAt(pc, low, DecodeDefault)
+			if err != nil {
+				return fmt.Errorf("invalid MF binary: macro %d: %v", n, err)
+			}
+			switch {
+			case in.Op == OpDict:
+				return fmt.Errorf("invalid MF binary: dictionary in macro %d", n)
+			case in.Op == OpMacro && in.Arg >= uint64(n):
+				return fmt.Errorf("invalid MF binary: macro %d runs macro %d, not an earlier one", n, in.Arg)
+			}
+			pc, low = next, nextLow
+			if in.Op == OpRet {
+				break
+			}
+		}
+	}
+	v.pc, v.low = pc, low
+	return nil
+}
+
+// push pushes the return offset of a call or macro.
+func (v *VM) push() error {
+	depth := v.MaxCallDepth
+	if depth <= 0 {
+		depth = DefaultCallDepth
+	}
+	if len(v.calls) >= depth {
+		return fmt.Errorf("call stack overflow, %d calls deep", len(v.calls))
+	}
+	v.calls = append(v.calls, v.pc)
+	return nil
+}
+
+// tape is a saved tape with its pointer.
+type tape struct {
+	cells []byte
+	ptr   int
+}
+
+// PC returns the byte offset of the next instruction,
+// and whether it is in the low nibble of the byte.
+func (v *VM) PC() (int, bool) {
+	return v.pc, v.low
+}
+
+// Cells returns the current tape.
+// Changes to it are seen by the program.
+func (v *VM) Cells() []byte {
+	return v.tape
+}
+
+// Ptr returns the pointer of the current tape.
+func (v *VM) Ptr() int {
+	return v.ptr
+}
+
+// SetPtr moves the pointer of the current tape.
+func (v *VM) SetPtr(ptr int) error {
+	return v.seek(ptr)
+}
+
+// Tape returns the cells of tape n,
+// or nil if the program has never switched to it.
+func (v *VM) Tape(n uint64) []byte {
+	if n == v.cur {
+		return v.tape
+	}
+	if t, ok := v.tapes[n]; ok {
+		return t.cells
+	}
+	return nil
+}
+
+// Run executes the program until it ends or faults.
+// The policy time limit applies to each call.
+func (v *VM) Run() error {
+	v.deadline = time.Time{}
+	if v.policy.Timeout > 0 {
+		v.deadline = time.Now().Add(v.policy.Timeout)
+	}
+	return v.run(-1)
+}
+
+// run executes up to n instructions, or all if n is negative, as Run does
+// without setting the deadline. It returns an ExitError only if the
+// program ends.
+func (v *VM) run(n int) error {
+	for k := 0; !v.Done() && (n < 0 || k < n); {
+		if k%4096 == 0 && !v.deadline.IsZero() && time.Now().After(v.deadline) {
+			return v.fault(fmt.Errorf("offset %d: %w: time limit %v exceeded", v.pc, ErrLimit, v.policy.Timeout))
+		}
+		m := 4096 - k%4096
+		if n >= 0 {
+			m = min(m, n-k)
+		}
+		d, err := v.runOps(m)
+		if k += d; err != nil {
+			return v.fault(err)
+		}
+	}
+	if v.Done() && v.status != 0 {
+		return &ExitError{v.status}
+	}
+	return nil
+}
+
+// fault writes a core dump of the fault err to CoreDump, if set,
+// and returns err.
+func (v *VM) fault(err error) error {
+	if v.CoreDump != nil {
+		if err := v.Core(err).Write(v.CoreDump); err != nil {
+			return fmt.Errorf("writing core dump: %v", err)
+		}
+	}
+	return err
+}
+
+// ExitStatus returns the exit status of the program,
+// which is 0 unless it exits through SysExit.
+func (v *VM) ExitStatus() int {
+	return v.status
+}
+
+// Done reports whether the program has ended.
+func (v *VM) Done() bool {
+	return v.exited || v.pc >= v.size
+}
+
+// Step executes a single instruction.
+func (v *VM) Step() error {
+	in, pc, low, err := v.fetch()
+	if err != nil {
+		return err
+	}
+	at, atLow := v.pc, v.low
+	if v.Hook != nil && in.Op != OpNop {
+		if err := v.Hook(at, in, v.ptr, v.tape[v.ptr]); err != nil {
+			return fmt.Errorf("offset %d: %w", at, err)
+		}
+	}
+	var u undo // of the instruction, if recording
+	if v.journal != nil {
+		u = v.save(in)
+	}
+	if in.Op != OpNop {
+		if limit := v.policy.MaxSteps; limit > 0 && v.steps >= limit {
+			return fmt.Errorf("offset %d: %w: step limit %d exceeded", at, ErrLimit, limit)
+		}
+		v.steps++
+		if v.Profile != nil {
+			v.Profile.Counts[CodePos{at, atLow}]++
+		}
+	}
+	var old []byte // watched cells before the instruction
+	ptr, cur := v.ptr, v.cur
+	if len(v.watches) > 0 {
+		old = v.watched()
+	}
+	v.pc, v.low = pc, low
+	if err := v.exec(in); err != nil {
+		v.pc, v.low = at, atLow // stay at the faulting instruction
+		return fmt.Errorf("offset %d: %w", at, err)
+	}
+	if v.journal != nil {
+		v.journal.push(u)
+	}
+	if len(v.watches) > 0 {
+		v.checkWatches(in, at, ptr, cur, old)
+	}
+	return nil
+}
+
+func (v *VM) exec(in Instruction) error {
+	switch in.Op {
+	case OpAdd:
+		v.tape[v.ptr] += byte(in.Arg)
+	case OpSub:
+		v.tape[v.ptr] -= byte(in.Arg)
+	case OpRight:
+		if in.Arg > uint64(len(v.tape)) {
+			return fmt.Errorf("pointer out of bounds: moving right by %d", in.Arg)
+		}
+		return v.seek(v.ptr + int(in.Arg))
+	case OpLeft:
+		if in.Arg > uint64(len(v.tape)) {
+			return fmt.Errorf("pointer out of bounds: moving left by %d", in.Arg)
+		}
+		return v.seek(v.ptr - int(in.Arg))
+	case OpOpen:
+		if v.tape[v.ptr] == 0 {
+			return v.jump(in.Arg)
+		}
+	case OpClose:
+		if v.tape[v.ptr] != 0 {
+			return v.jump(in.Arg)
+		}
+	case OpOut:
+		for i := uint64(0); i < in.Arg; i++ {
+			out := v.tape[v.ptr : v.ptr+1]
+			if v.NumericIO {
+				out = strconv.AppendUint(nil, uint64(v.tape[v.ptr]), 10)
+				out = append(out, '\n')
+			}
+			if err := v.write(out); err != nil {
+				return err
+			}
+		}
+	case OpIn:
+		for i := uint64(0); i < in.Arg; i++ {
+			if v.NumericIO {
+				if err := v.readNumber(); err != nil {
+					return err
+				}
+				continue
+			}
+			if _, err := io.ReadFull(v.In, v.tape[v.ptr:v.ptr+1]); err != nil && err != io.EOF {
+				return err
+			}
+		}
+	case OpSet:
+		v.tape[v.ptr] = byte(in.Arg)
+	case OpClear:
+		end := v.ptr + int(in.Arg)
+		if in.Arg > uint64(len(v.tape)) || end > len(v.tape) {
+			return fmt.Errorf("pointer out of bounds: %d", end-1)
+		}
+		clear(v.tape[v.ptr:end])
+	case OpMove:
+		dst := v.ptr + int(int32(in.Arg))
+		if dst < 0 || dst >= len(v.tape) {
+			return fmt.Errorf("pointer out of bounds: %d", dst)
+		}
+		v.tape[dst] += v.tape[v.ptr]
+		v.tape[v.ptr] = 0
+	case OpAddAt:
+		off, n := in.AddAt()
+		dst := v.ptr + off
+		if dst < 0 || dst >= len(v.tape) {
+			return fmt.Errorf("pointer out of bounds: %d", dst)
+		}
+		v.tape[dst] += n
+	case OpDebug:
+		v.debug(in)
+	case OpAssert:
+		if c := v.tape[v.ptr]; c != byte(in.Arg) {
+			return fmt.Errorf("%w: cell %d is %d, not %d", ErrAssert, v.ptr, c, byte(in.Arg))
+		}
+	case OpScan:
+		return v.scan(int(int32(in.Arg)))
+	case OpShift:
+		return v.seek(v.ptr + int(int32(in.Arg)))
+	case OpTape:
+		return v.switchTape(in.Arg)
+	case OpSyscall:
+		fn, ok := v.syscalls[uint32(in.Arg)]
+		if !ok {
+			return fmt.Errorf("syscall %d is not registered", in.Arg)
+		}
+		if !v.policy.allows(uint32(in.Arg)) {
+			return fmt.Errorf("%w: syscall %d is not allowed", ErrLimit, in.Arg)
+		}
+		return fn(v)
+	case OpExt:
+		fn, ok := v.exts[byte(in.Arg>>24)]
+		if !ok {
+			return fmt.Errorf("unknown extension operation 0x%x", in.Arg>>24)
+		}
+		return fn(v, uint32(in.Arg)&0xffffff)
+	case OpDict:
+		return fmt.Errorf("dictionary not at the start of the code")
+	case OpMacro:
+		if in.Arg >= uint64(len(v.dict)) {
+			return fmt.Errorf("macro %d is not in the dictionary", in.Arg)
+		}
+		if err := v.push(); err != nil {
+			return err
+		}
+		v.pc, v.low = v.dict[in.Arg], false
+	case OpCall:
+		if in.Arg < uint64(v.l.code) || in.Arg >= uint64(v.size) {
+			return fmt.Errorf("call to 0x%x outside of the code", in.Arg)
+		}
+		if err := v.push(); err != nil {
+			return err
+		}
+		v.pc, v.low = int(in.Arg), false
+	case OpRet:
+		if len(v.calls) == 0 {
+			return fmt.Errorf("return with an empty call stack")
+		}
+		v.pc, v.low = v.calls[len(v.calls)-1], false
+		v.calls = v.calls[:len(v.calls)-1]
+	}
+	return nil
+}
+
+// debug writes the dump of the dbg instruction in to Debug: its offset,
+// the tape and pointer, and the cells around the pointer in hex, with
+// the current one in brackets. Errors writing it are ignored.
+func (v *VM) debug(in Instruction) {
+	if v.Debug == nil {
+		return
+	}
+	n := int(in.Arg)
+	lo, hi := max(v.ptr-n, 0), min(v.ptr+n, len(v.tape)-1)
+	var b strings.Builder
+	fmt.Fprintf(&b, "dbg at offset %d: tape %d, pointer %d:", in.Offset, v.cur, v.ptr)
+	for i := lo; i <= hi; i++ {
+		if i == v.ptr {
+			fmt.Fprintf(&b, " [%02x]", v.tape[i])
+		} else {
+			fmt.Fprintf(&b, " %02x", v.tape[i])
+		}
+	}
+	b.WriteByte('\n')
+	io.WriteString(v.Debug, b.String())
+}
+
+// readNumber reads a decimal number from In into the current cell,
+// for NumericIO.
+func (v *VM) readNumber() error {
+	var n int64
+	if _, err := fmt.Fscan(v.In, &n); err == io.EOF {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("reading a number: %v", err)
+	}
+	v.tape[v.ptr] = byte(n)
+	return nil
+}
+
+// switchTape saves the current tape, and makes tape n current.
+// It allocates only tapes used for the first time.
+func (v *VM) switchTape(n uint64) error {
+	if n == v.cur {
+		return nil
+	}
+	t, ok := v.tapes[n]
+	if !ok {
+		var err error
+		if t, err = v.newTape(); err != nil {
+			return err
+		}
+	}
+	if v.tapes == nil {
+		v.tapes = make(map[uint64]*tape)
+	}
+	delete(v.tapes, n)
+	cells, ptr := t.cells, t.ptr
+	t.cells, t.ptr = v.tape, v.ptr // t now saves the current tape
+	v.tapes[v.cur] = t
+	v.tape, v.ptr, v.cur = cells, ptr, n
+	return nil
+}
+
+// newTape allocates a tape as large as the others.
+func (v *VM) newTape() (*tape, error) {
+	if err := v.alloc(len(v.tape)); err != nil {
+		return nil, err
+	}
+	return &tape{cells: make([]byte, len(v.tape))}, nil
+}
+
+// Preallocate allocates up front what running the program would
+// allocate as it goes: the call stack, as deep as MaxCallDepth, and the
+// tapes the program switches to. Steps then allocate nothing, unless they
+// fault, run syscalls or extension handlers, read In or write Out that
+// allocate, or the VM has a Hook, a Profile, watchpoints or a recording.
+func (v *VM) Preallocate() error {
+	for pc, low := v.l.code, false; pc < v.size; {
+		in, next, nextLow, err := v.decodeAt(pc, low, v.Mode)
+		if err != nil {
+			return err
+		}
+		if pc, low = next, nextLow; in.Op != OpTape || in.Arg == v.cur || v.tapes[in.Arg] != nil {
+			continue
+		}
+		t, err := v.newTape()
+		if err != nil {
+			return err
+		}
+		if v.tapes == nil {
+			v.tapes = make(map[uint64]*tape)
+		}
+		v.tapes[in.Arg] = t
+	}
+	depth := v.MaxCallDepth
+	if depth <= 0 {
+		depth = DefaultCallDepth
+	}
+	v.calls = slices.Grow(v.calls, max(depth-len(v.calls), 0))
+	return nil
+}
+
+// scan moves the pointer by step until it reaches a zero cell.
+func (v *VM) scan(step int) error {
+	var i int
+	switch step {
+	case 1:
+		if i = bytes.IndexByte(v.tape[v.ptr:], 0); i >= 0 {
+			i += v.ptr
+		}
+	case -1:
+		i = bytes.LastIndexByte(v.tape[:v.ptr+1], 0)
+	default:
+		for i = v.ptr; i >= 0 && i < len(v.tape) && v.tape[i] != 0; i += step {
+		}
+	}
+	if i < 0 || i >= len(v.tape) {
+		return fmt.Errorf("pointer out of bounds: scan from %d never reaches a zero cell", v.ptr)
+	}
+	v.ptr = i
+	v.peak = max(v.peak, i)
+	return nil
+}
+
+func (v *VM) seek(ptr int) error {
+	if ptr < 0 || ptr >= len(v.tape) {
+		return fmt.Errorf("pointer out of bounds: %d", ptr)
+	}
+	v.ptr = ptr
+	v.peak = max(v.peak, ptr)
+	return nil
+}
+
+func (v *VM) jump(pc uint64) error {
+	if pc < uint64(v.l.code) || pc > uint64(v.size) {
+		return fmt.Errorf("bad jump position: %d", pc)
+	}
+	v.pc, v.low = int(pc), false
+	return nil
+}
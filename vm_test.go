@@ -0,0 +1,86 @@
+package mf
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// countdown defines pbrain procedure 1, which writes the cell left of
+// the pointer, decrements it, and calls itself again unless it is zero,
+// then calls it with 5 in that cell.
+const countdown = "+(<.-[>[-]+:<]>)[-]+++++>[-]+:"
+
+// pbrainMF converts pbrain code to MF, calling its procedures. The
+// version 2 container Close narrows moves them.
+func pbrainMF(t *testing.T, src string, compress CompressStrategy, optimize bool) []byte {
+	t.Helper()
+	var prog bytes.Buffer
+	r := NewBFReader64(&prog, 16)
+	r.PBrain, r.Calls, r.Compress, r.Optimize = true, true, compress, optimize
+	r.Write([]byte(src))
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return prog.Bytes()
+}
+
+// runVM runs prog with no input, and returns its output.
+func runVM(prog []byte, depth int) (string, error) {
+	v, err := NewVM(prog)
+	if err != nil {
+		return "", err
+	}
+	var out bytes.Buffer
+	v.In, v.Out, v.MaxCallDepth = strings.NewReader(""), &out, depth
+	err = v.Run()
+	return out.String(), err
+}
+
+func TestVMCalls(t *testing.T) {
+	for _, compress := range []CompressStrategy{CompressByLength, CompressOptimal, CompressAligned} {
+		for _, optimize := range []bool{false, true} {
+			prog := pbrainMF(t, countdown, compress, optimize)
+			out, err := runVM(prog, 0)
+			if err != nil || out != "\x05\x04\x03\x02\x01" {
+				t.Errorf("compress %d, optimize %v: output %q, %v", compress, optimize, out, err)
+			}
+		}
+	}
+
+	// procedures that are not recursive run as they do inlined
+	src := "+++(>++++++++[<++++++++>-]<+.---)[-]++(>.<[-]+++:)[-]++:>+:"
+	var inlined bytes.Buffer
+	r := NewBFReader(&inlined, 16)
+	r.PBrain = true
+	r.Write([]byte(src))
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want, err := runVM(inlined.Bytes(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := runVM(pbrainMF(t, src, CompressByLength, false), 0); err != nil || got != want {
+		t.Errorf("output %q, %v; inlined %q", got, err, want)
+	}
+
+	r.Reset(new(bytes.Buffer))
+	if _, err := r.Write([]byte(countdown)); err == nil || !strings.Contains(err.Error(), "cannot be inlined") {
+		t.Errorf("inlining recursion: %v", err)
+	}
+}
+
+func TestVMCallDepth(t *testing.T) {
+	prog := pbrainMF(t, countdown, CompressByLength, false)
+	if _, err := runVM(prog, 5); err != nil {
+		t.Errorf("5 calls deep: %v", err)
+	}
+	out, err := runVM(prog, 3)
+	if err == nil || !strings.Contains(err.Error(), "call stack overflow") {
+		t.Errorf("4 calls deep with MaxCallDepth 3: %v", err)
+	}
+	if out != "\x05\x04\x03" {
+		t.Errorf("output before overflow %q", out)
+	}
+}
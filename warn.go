@@ -0,0 +1,59 @@
+package mf
+
+import "fmt"
+
+// Warning is a non-fatal problem found during conversion.
+type Warning struct {
+	Offset    int    // input byte offset
+	Line, Col int    // of BF input, starting at 1; zero for MF input
+	Code      string // one of the Warn constants
+	Message   string
+}
+
+// Pos returns the input position of the warning.
+func (w Warning) Pos() Pos {
+	return Pos{Offset: w.Offset, Line: w.Line, Col: w.Col}
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("%v: %s", w.Pos(), w.Message)
+}
+
+// Warning codes.
+const (
+	WarnIgnoredChar     = "ignored-char"     // non-BF characters in BF input
+	WarnDefaultMemSize  = "default-memsize"  // zero memsize replaced by DefaultMemSize
+	WarnNopPlacement    = "nop-placement"    // no-op code outside of operand alignment
+	WarnDiscardedNibble = "discarded-nibble" // nibble after a special code is not a no-op
+	WarnRepeatCount     = "repeat-count"     // repeat count wraps a cell or exceeds memsize
+	WarnUndefinedNibble = "undefined-nibble" // non-special 4 or 5 nibble ignored
+	WarnLegacyBracket   = "legacy-bracket"   // non-special 4 or 5 nibble translated to [ or ]
+	WarnStrayBracket    = "stray-bracket"    // ] without a [ dropped by FixBrackets
+	WarnUnclosedBracket = "unclosed-bracket" // [ left unmatched closed by FixBrackets
+)
+
+// warner holds a warning callback and the input position being processed.
+type warner struct {
+	// Warn, if not nil, is called for every Warning.
+	Warn func(Warning)
+
+	base  int // input offset of the current Write call
+	at    Pos // of the current byte
+	after Pos // of the byte after the current one, of converters tracking lines
+}
+
+// errorf returns an error at the position of the current byte.
+func (w *warner) errorf(format string, args ...any) error {
+	return &PosError{w.at, fmt.Errorf(format, args...)}
+}
+
+func (w *warner) warn(code, format string, args ...any) {
+	w.warnAt(w.at, code, format, args...)
+}
+
+// warnAt warns at the position at, rather than the current byte.
+func (w *warner) warnAt(at Pos, code, format string, args ...any) {
+	if w.Warn != nil {
+		w.Warn(Warning{Offset: at.Offset, Line: at.Line, Col: at.Col, Code: code, Message: fmt.Sprintf(format, args...)})
+	}
+}
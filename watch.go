@@ -0,0 +1,102 @@
+package mf
+
+import "fmt"
+
+// WatchKind selects the cell accesses a Watchpoint breaks on.
+type WatchKind int
+
+// Watchpoint kinds.
+const (
+	WatchWrite  WatchKind = 1 << iota // a cell value changes
+	WatchRead                         // a cell value is used
+	WatchAccess = WatchWrite | WatchRead
+)
+
+// Watchpoint breaks when cells Lo through Hi of a tape are accessed.
+type Watchpoint struct {
+	Lo, Hi int
+	Tape   uint64
+	Kind   WatchKind
+}
+
+func (w Watchpoint) String() string {
+	kind := map[WatchKind]string{WatchWrite: "write", WatchRead: "read", WatchAccess: "access"}[w.Kind]
+	if w.Lo == w.Hi {
+		return fmt.Sprintf("%s of tape %d cell %d", kind, w.Tape, w.Lo)
+	}
+	return fmt.Sprintf("%s of tape %d cells %d-%d", kind, w.Tape, w.Lo, w.Hi)
+}
+
+// WatchHit is an access that hit a Watchpoint.
+type WatchHit struct {
+	Watchpoint
+	PC       int // offset of the instruction
+	Cell     int
+	Write    bool
+	Old, New byte
+}
+
+func (h WatchHit) String() string {
+	if h.Write {
+		return fmt.Sprintf("cell %d written at offset %d: %d -> %d", h.Cell, h.PC, h.Old, h.New)
+	}
+	return fmt.Sprintf("cell %d read at offset %d: %d", h.Cell, h.PC, h.New)
+}
+
+// watched returns the values of the watched cells of the current tape.
+// Watchpoints are checked only while watches is not empty, so the
+// interpreter loop pays nothing for them otherwise.
+func (v *VM) watched() []byte {
+	var cells []byte
+	for _, w := range v.watches {
+		if w.Tape == v.cur && w.Kind&WatchWrite != 0 {
+			cells = append(cells, v.tape[w.Lo:w.Hi+1]...)
+		}
+	}
+	return cells
+}
+
+// checkWatches records the first watchpoint hit by in, the instruction
+// at offset at executed with pointer ptr on tape cur, given the watched
+// cells before it.
+func (v *VM) checkWatches(in Instruction, at, ptr int, cur uint64, old []byte) {
+	var reads [][2]int // ranges of cells read
+	switch in.Op {
+	case OpRight, OpLeft, OpShift, OpSet, OpClear, OpIn, OpTape, OpDict, OpMacro, OpRet, OpCall, OpDebug:
+	case OpScan:
+		reads = [][2]int{{min(ptr, v.ptr), max(ptr, v.ptr)}}
+	case OpMove:
+		dst := ptr + int(int32(in.Arg))
+		reads = [][2]int{{ptr, ptr}, {dst, dst}}
+	case OpAddAt:
+		off, _ := in.AddAt()
+		reads = [][2]int{{ptr + off, ptr + off}}
+	default:
+		reads = [][2]int{{ptr, ptr}}
+	}
+	for _, w := range v.watches {
+		if w.Tape != cur {
+			continue
+		}
+		if w.Kind&WatchWrite != 0 {
+			before := old[:w.Hi-w.Lo+1]
+			old = old[len(before):]
+			for i, b := range before {
+				if c := v.Tape(cur)[w.Lo+i]; c != b {
+					v.hit = &WatchHit{w, at, w.Lo + i, true, b, c}
+					return
+				}
+			}
+		}
+		if w.Kind&WatchRead == 0 {
+			continue
+		}
+		for _, r := range reads {
+			if r[0] <= w.Hi && r[1] >= w.Lo {
+				cell := max(r[0], w.Lo)
+				v.hit = &WatchHit{Watchpoint: w, PC: at, Cell: cell, New: v.Tape(cur)[cell]}
+				return
+			}
+		}
+	}
+}